@@ -15,16 +15,23 @@
 package main
 
 import (
-	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/couchbase/service-broker/pkg/accesslog"
 	"github.com/couchbase/service-broker/pkg/broker"
 	"github.com/couchbase/service-broker/pkg/client"
 	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/operation"
 	"github.com/couchbase/service-broker/pkg/version"
 
 	"github.com/golang/glog"
@@ -48,12 +55,15 @@ const (
 	// basic authentication alos does a string match, or username and password.
 	// Note Cloud Foundry expects basic auth.
 	basic authenticationType = "basic"
+
+	// mutualTLS authentication verifies client certificates against a CA bundle.
+	mutualTLS authenticationType = "mtls"
 )
 
 // Set sets the authentication type from CLI parameters.
 func (a *authenticationType) Set(s string) error {
 	switch t := authenticationType(s); t {
-	case bearerToken, basic:
+	case bearerToken, basic, mutualTLS:
 		*a = t
 	default:
 		return fmt.Errorf("%w: unexpected authentication type %s", ErrFatal, s)
@@ -72,6 +82,97 @@ func (a *authenticationType) String() string {
 	return string(*a)
 }
 
+// readPrincipalTokens reads bearer tokens from a directory, keyed by file name.  Hidden
+// files, e.g. those created when mounting a Kubernetes secret, are ignored.
+func readPrincipalTokens(path string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := map[string]string{}
+
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		token, err := ioutil.ReadFile(filepath.Join(path, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		tokens[file.Name()] = string(token)
+	}
+
+	return tokens, nil
+}
+
+// parseTrustedProxies parses a comma separated list of CIDRs, or IP addresses, that
+// identify trusted proxies.
+func parseTrustedProxies(proxies string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+
+	for _, proxy := range strings.Split(proxies, ",") {
+		if ip := net.ParseIP(proxy); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+
+			bits := 8 * len(ip)
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%w: trusted proxy %s is not an IP address or CIDR", ErrFatal, proxy)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// parseAccessLogSampling parses a comma separated list of route=rate pairs that
+// define the fraction of requests to each route that are logged.
+func parseAccessLogSampling(sampling string) (map[string]float64, error) {
+	rates := map[string]float64{}
+
+	for _, pair := range strings.Split(sampling, ",") {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: access log sampling %s is not a route=rate pair", ErrFatal, pair)
+		}
+
+		route := accesslog.Route(fields[0])
+
+		valid := false
+
+		for _, r := range accesslog.Routes {
+			if route == r {
+				valid = true
+			}
+		}
+
+		if !valid {
+			return nil, fmt.Errorf("%w: access log sampling route %s must be one of %v", ErrFatal, route, accesslog.Routes)
+		}
+
+		rate, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("%w: access log sampling rate %s must be between 0 and 1", ErrFatal, fields[1])
+		}
+
+		rates[string(route)] = rate
+	}
+
+	return rates, nil
+}
+
 func main() {
 	// authenticationType is the type of authentication to use.
 	authentication := basic
@@ -79,31 +180,166 @@ func main() {
 	// tokenPath is the location of the file containing the bearer token for authentication.
 	var tokenPath string
 
+	// tokenPrincipal is the principal authenticated by the bearer token.
+	var tokenPrincipal string
+
 	// usernamePath is the location of the file containing the username for authentication.
 	var usernamePath string
 
 	// passwordPath is the location of the file containing the password for authentication.
 	var passwordPath string
 
+	// clientCAPath is the location of the file containing the CA bundle for mutual TLS authentication.
+	var clientCAPath string
+
 	// tlsCertificatePath is the location of the file containing the TLS server certifcate.
 	var tlsCertificatePath string
 
 	// tlsPrivateKeyPath is the location of the file containing the TLS private key.
 	var tlsPrivateKeyPath string
 
-	flag.Var(&authentication, "authentication", "Authentication type to use, either 'basic' or 'token'")
+	// tlsCertificateExpiryWindow is how long before certificate expiry readiness fails.
+	var tlsCertificateExpiryWindow time.Duration
+
+	// insecureHTTP serves plain HTTP when set.
+	var insecureHTTP bool
+
+	// hostname is the default lock identity, in Kubernetes this is the pod name.
+	hostname, err := os.Hostname()
+	if err != nil {
+		glog.Fatal(err)
+		os.Exit(errorCode)
+	}
+
+	// principalTokensPath is a directory of additional bearer tokens, named after their principal.
+	var principalTokensPath string
+
+	// authorizationPolicyPath is the location of the file containing the authorization policy.
+	var authorizationPolicyPath string
+
+	// catalogOverlayPath is the location of the file containing the catalog overlay.
+	var catalogOverlayPath string
+
+	// registryBackup enables registry export and import endpoints when set.
+	var registryBackup bool
+
+	// versionEndpoint enables the version endpoint when set.
+	var versionEndpoint bool
+
+	// maxRequestBodySize is the maximum size of a request body in bytes.
+	var maxRequestBodySize int64
+
+	// responseCompressionThreshold is the response body size at which it is compressed, zero disables it.
+	var responseCompressionThreshold int
+
+	// reconcileInterval is how often service instances are reconciled, zero disables it.
+	var reconcileInterval time.Duration
+
+	// registrySelfTestInterval is how often the registry is checked, zero disables it.
+	var registrySelfTestInterval time.Duration
+
+	// sourceNamespaces is a comma separated list of namespaces templates may read from.
+	var sourceNamespaces string
+
+	// queryParameters is a comma separated list of query parameters templates may read.
+	var queryParameters string
+
+	// asyncOptional is a comma separated list of operations that do not require accepts_incomplete.
+	var asyncOptional string
+
+	// trustedProxies is a comma separated list of proxies whose forwarding headers are honored.
+	var trustedProxies string
+
+	// accessLogSampling is a comma separated list of route=rate pairs that control access logging.
+	var accessLogSampling string
+
+	// registerURL is the URL the service catalog contacts the broker at, if set the broker registers itself.
+	var registerURL string
+
+	// registerName is the name of the service catalog broker resource.
+	var registerName string
+
+	// registerCABundlePath is the location of the CA certificate the service catalog verifies the broker with.
+	var registerCABundlePath string
+
+	// registerSecret is the name of the secret the service catalog reads credentials from.
+	var registerSecret string
+
+	// registerNamespaced registers a namespaced service broker rather than a cluster service broker.
+	var registerNamespaced bool
+
+	// options are the service broker options, populated with defaults and then by flags.
+	options := config.NewOptions()
+
+	flag.Var(&authentication, "authentication", "Authentication type to use, either 'basic', 'token' or 'mtls'")
 	flag.StringVar(&tokenPath, "token", "/var/run/secrets/service-broker/token", "Bearer token for API authentication")
+	flag.StringVar(&tokenPrincipal, "token-principal", "token", "Principal authenticated by the bearer token, used for authorization and auditing")
+	flag.StringVar(&principalTokensPath, "principal-tokens", "", "Directory of additional bearer tokens for API authentication, each file is named after the principal it authenticates")
+	flag.StringVar(&authorizationPolicyPath, "authorization-policy", "", "Path to a policy that authorizes principals to perform API requests")
+	flag.StringVar(&catalogOverlayPath, "catalog-overlay", "", "Path to an overlay that patches service catalog metadata before it is served")
 	flag.StringVar(&usernamePath, "username", "/var/run/secrets/service-broker/username", "Username for basic authentication")
 	flag.StringVar(&passwordPath, "password", "/var/run/secrets/service-broker/password", "Password for basic authentication")
+	flag.StringVar(&clientCAPath, "client-ca", "/var/run/secrets/service-broker/client-ca", "PEM encoded CA bundle for mutual TLS authentication")
 	flag.StringVar(&tlsCertificatePath, "tls-certificate", "/var/run/secrets/service-broker/tls-certificate", "Path to the server TLS certificate")
 	flag.StringVar(&tlsPrivateKeyPath, "tls-private-key", "/var/run/secrets/service-broker/tls-private-key", "Path to the server TLS key")
-	flag.StringVar(&config.ConfigurationName, "config", config.ConfigurationNameDefault, "Configuration resource name")
+	flag.DurationVar(&tlsCertificateExpiryWindow, "tls-certificate-expiry-window", 0, "Report not ready when the TLS certificate expires within this duration")
+	flag.BoolVar(&insecureHTTP, "insecure-http", false, "Serve plain HTTP, only for use behind a trusted proxy that terminates TLS")
+	flag.BoolVar(&registryBackup, "registry-backup", false, "Enable endpoints to export and import the registry for backup and disaster recovery")
+	flag.BoolVar(&versionEndpoint, "version-endpoint", false, "Enable an endpoint that reports the service broker version and build information")
+	flag.IntVar(&responseCompressionThreshold, "response-compression-threshold", 0, "Size in bytes at or above which response bodies are gzip compressed for clients that accept it, zero disables compression")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", 0, "How often service instances are reconciled, recreating deleted resources, zero disables periodic reconciliation")
+	flag.DurationVar(&registrySelfTestInterval, "registry-self-test-interval", 0, "How often the registry is checked to be writable and readable, reporting not ready on failure, zero disables the check")
+	flag.StringVar(&asyncOptional, "async-optional", "", "Comma separated list of operations, 'provision', 'update' or 'deprovision', run synchronously, rather than rejected, if the client does not set accepts_incomplete")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Comma separated list of CIDRs of proxies whose Forwarded and X-Forwarded-For headers are honored")
+	flag.StringVar(&options.ConfigurationName, "config", config.ConfigurationNameDefault, "Configuration resource name")
+	flag.Int64Var(&maxRequestBodySize, "max-request-body-size", broker.DefaultMaxRequestBodySize, "Maximum size of a request body in bytes")
+	flag.BoolVar(&options.CreateNamespaces, "create-namespaces", false, "Create service instance namespaces supplied by the request context if they do not exist")
+	flag.StringVar(&sourceNamespaces, "source-namespaces", "", "Comma separated list of additional namespaces templates may read secrets and config maps from")
+	flag.StringVar(&queryParameters, "query-parameters", "", "Comma separated list of request query parameters templates may read")
+	flag.IntVar(&options.MaxConcurrentOperations, "max-concurrent-operations", 0, "Maximum number of asynchronous operations that may run at the same time, zero is unlimited")
+	flag.BoolVar(&options.RejectExcessOperations, "reject-excess-operations", false, "Reject asynchronous operations beyond the limit with a 429 status code, rather than queuing them")
+	flag.IntVar(&options.DeleteConcurrency, "delete-concurrency", config.DeleteConcurrencyDefault, "Maximum number of resources deleted at the same time when deleting a service instance or binding")
+	flag.StringVar(&options.ClusterDomain, "cluster-domain", config.ClusterDomainDefault, "Kubernetes cluster DNS domain, templates may read this to build service URLs")
+	flag.BoolVar(&options.Events, "events", false, "Raise Kubernetes events for service instance and binding lifecycle changes")
+	flag.StringVar(&options.CompletionWebhook, "completion-webhook", "", "URL to notify when an asynchronous operation completes")
+	flag.IntVar(&options.CompletionWebhookAttempts, "completion-webhook-attempts", config.CompletionWebhookAttemptsDefault, "Maximum number of completion webhook delivery attempts")
+	flag.DurationVar(&options.CompletionWebhookBackoff, "completion-webhook-backoff", config.CompletionWebhookBackoffDefault, "Delay before the first completion webhook retry, doubled for each subsequent retry")
+	flag.DurationVar(&options.AbandonedCreateTimeout, "abandoned-create-timeout", 0, "How long an asynchronous service instance create may go without being polled before it is reaped, 0 disables")
+	flag.BoolVar(&options.PrettyJSON, "pretty-json", false, "Indent JSON response bodies for readability")
+	flag.IntVar(&options.MaxIDLength, "max-id-length", config.MaxIDLengthDefault, "Maximum length of service instance and binding IDs")
+	flag.IntVar(&options.MaxIncludeDepth, "max-include-depth", config.MaxIncludeDepthDefault, "Maximum depth of nested template includes")
+	flag.IntVar(&options.RollbackAttempts, "rollback-attempts", config.RollbackAttemptsDefault, "Maximum number of attempts to delete each resource when rolling back a cancelled or failed operation")
+	flag.DurationVar(&options.RollbackBackoff, "rollback-backoff", config.RollbackBackoffDefault, "Delay before the first retry of a failed rollback deletion, doubled for each subsequent retry")
+	flag.DurationVar(&options.ApplyTimeout, "apply-timeout", config.ApplyTimeoutDefault, "How long a single resource create or update may take before the operation fails, zero disables the timeout")
+	flag.Var(&options.NameCollisionStrategy, "name-collision-strategy", "How resource names that are too long are shortened, either 'hash', 'reject' or 'truncate'")
+	flag.StringVar(&options.AuditLog, "audit-log", "", "File to append audit records of mutating operations to, or '-' for standard output")
+	flag.StringVar(&options.AccessLog, "access-log", "", "File to append access log records of API requests to, or '-' for standard output")
+	flag.StringVar(&accessLogSampling, "access-log-sampling", "", "Comma separated list of route=rate pairs, the fraction of 'poll', 'readiness' or 'read' requests that are logged")
+	flag.BoolVar(&options.AccessLogBodies, "access-log-bodies", false, "Record request bodies in the access log, with sensitive values redacted")
+	flag.DurationVar(&options.OperationRetention, "operation-retention", 0, "How long the result of a completed asynchronous operation can be polled for, zero disables retention")
+	flag.DurationVar(&options.SoftDeleteGracePeriod, "soft-delete-grace-period", 0, "How long deprovisioned service instances are retained, and may be undeleted, before being deleted, zero deletes them immediately")
+	flag.DurationVar(&options.LockLeaseDuration, "lock-lease-duration", 0, "How long a service instance lock is held for without renewal when running multiple replicas, zero disables locking")
+	flag.StringVar(&options.LockIdentity, "lock-identity", hostname, "Unique identity of this replica when holding service instance locks")
+	flag.StringVar(&registerURL, "register-url", "", "URL the Kubernetes Service Catalog contacts the broker at, if set the broker registers itself with the Service Catalog")
+	flag.StringVar(&registerName, "register-name", config.ConfigurationNameDefault, "Name of the Service Catalog broker resource to register")
+	flag.StringVar(&registerCABundlePath, "register-ca-bundle", "", "Path to the CA certificate the Service Catalog verifies the broker's TLS certificate with")
+	flag.StringVar(&registerSecret, "register-secret", config.ConfigurationNameDefault, "Name of the secret in the broker namespace the Service Catalog reads credentials from")
+	flag.BoolVar(&registerNamespaced, "register-namespaced", false, "Register a namespaced ServiceBroker, rather than a ClusterServiceBroker")
 	flag.Parse()
 
 	// Start the server.
 	glog.Infof("%s %s (git commit %s)", version.Application, version.Version, version.GitCommit)
 
-	c := broker.ServerConfiguration{}
+	c := broker.ServerConfiguration{
+		MaxRequestBodySize:           maxRequestBodySize,
+		CertificateExpiryWindow:      tlsCertificateExpiryWindow,
+		RegistryBackup:               registryBackup,
+		Version:                      versionEndpoint,
+		ResponseCompressionThreshold: responseCompressionThreshold,
+		ReconcileInterval:            reconcileInterval,
+		RegistrySelfTestInterval:     registrySelfTestInterval,
+		Options:                      options,
+	}
 
 	// Parse implicit configuration.
 	namespace, ok := os.LookupEnv("NAMESPACE")
@@ -114,6 +350,94 @@ func main() {
 
 	c.Namespace = namespace
 
+	options.BrokerNamespace = namespace
+
+	if podName, ok := os.LookupEnv("POD_NAME"); ok {
+		options.BrokerPodName = podName
+	}
+
+	if sourceNamespaces != "" {
+		options.SourceNamespaces = strings.Split(sourceNamespaces, ",")
+	}
+
+	if queryParameters != "" {
+		options.QueryParameters = strings.Split(queryParameters, ",")
+	}
+
+	if asyncOptional != "" {
+		c.AsyncOptional = map[operation.Type]bool{}
+
+		for _, op := range strings.Split(asyncOptional, ",") {
+			switch operation.Type(op) {
+			case operation.TypeProvision, operation.TypeUpdate, operation.TypeDeprovision:
+				c.AsyncOptional[operation.Type(op)] = true
+			default:
+				glog.Fatal(fmt.Errorf("%w: unknown operation %s", ErrFatal, op))
+				os.Exit(errorCode)
+			}
+		}
+	}
+
+	if trustedProxies != "" {
+		proxies, err := parseTrustedProxies(trustedProxies)
+		if err != nil {
+			glog.Fatal(err)
+			os.Exit(errorCode)
+		}
+
+		c.TrustedProxies = proxies
+	}
+
+	if accessLogSampling != "" {
+		rates, err := parseAccessLogSampling(accessLogSampling)
+		if err != nil {
+			glog.Fatal(err)
+			os.Exit(errorCode)
+		}
+
+		options.AccessLogSampleRates = rates
+	}
+
+	if options.MaxConcurrentOperations < 0 {
+		glog.Fatal(fmt.Errorf("%w: maximum concurrent operations must not be negative", ErrFatal))
+		os.Exit(errorCode)
+	}
+
+	if options.DeleteConcurrency < 1 {
+		glog.Fatal(fmt.Errorf("%w: delete concurrency must be positive", ErrFatal))
+		os.Exit(errorCode)
+	}
+
+	if options.CompletionWebhookAttempts < 1 || options.CompletionWebhookBackoff <= 0 {
+		glog.Fatal(fmt.Errorf("%w: completion webhook attempts and backoff must be positive", ErrFatal))
+		os.Exit(errorCode)
+	}
+
+	if options.AbandonedCreateTimeout < 0 {
+		glog.Fatal(fmt.Errorf("%w: abandoned create timeout must not be negative", ErrFatal))
+		os.Exit(errorCode)
+	}
+
+	if options.MaxIDLength < 1 {
+		glog.Fatal(fmt.Errorf("%w: maximum ID length must be positive", ErrFatal))
+		os.Exit(errorCode)
+	}
+
+	if options.MaxIncludeDepth < 1 {
+		glog.Fatal(fmt.Errorf("%w: maximum include depth must be positive", ErrFatal))
+		os.Exit(errorCode)
+	}
+
+	if options.RollbackAttempts < 1 || options.RollbackBackoff <= 0 {
+		glog.Fatal(fmt.Errorf("%w: rollback attempts and backoff must be positive", ErrFatal))
+		os.Exit(errorCode)
+	}
+
+	if options.ApplyTimeout < 0 {
+		glog.Fatal(fmt.Errorf("%w: apply timeout must not be negative", ErrFatal))
+		os.Exit(errorCode)
+	}
+
 	// Load up explicit configuration.
 	switch authentication {
 	case bearerToken:
@@ -125,6 +449,17 @@ func main() {
 
 		stringToken := string(token)
 		c.Token = &stringToken
+		c.TokenPrincipal = tokenPrincipal
+
+		if principalTokensPath != "" {
+			tokens, err := readPrincipalTokens(principalTokensPath)
+			if err != nil {
+				glog.Fatal(err)
+				os.Exit(errorCode)
+			}
+
+			c.Tokens = tokens
+		}
 
 	case basic:
 		username, err := ioutil.ReadFile(usernamePath)
@@ -146,15 +481,85 @@ func main() {
 			Username: stringUsername,
 			Password: stringPassword,
 		}
+
+	case mutualTLS:
+		if insecureHTTP {
+			glog.Fatal(fmt.Errorf("%w: mutual TLS authentication cannot be used with -insecure-http", ErrFatal))
+			os.Exit(errorCode)
+		}
+
+		caBundle, err := ioutil.ReadFile(clientCAPath)
+		if err != nil {
+			glog.Fatal(err)
+			os.Exit(errorCode)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			glog.Fatal(fmt.Errorf("%w: no certificates found in %s", ErrFatal, clientCAPath))
+			os.Exit(errorCode)
+		}
+
+		c.ClientCAs = pool
 	}
 
-	cert, err := tls.LoadX509KeyPair(tlsCertificatePath, tlsPrivateKeyPath)
-	if err != nil {
-		glog.Fatal(err)
-		os.Exit(errorCode)
+	if authorizationPolicyPath != "" {
+		policy, err := broker.LoadAuthorizationPolicy(authorizationPolicyPath)
+		if err != nil {
+			glog.Fatal(err)
+			os.Exit(errorCode)
+		}
+
+		c.Authorizer = policy
 	}
 
-	c.Certificate = cert
+	if catalogOverlayPath != "" {
+		overlay, err := broker.LoadCatalogOverlay(catalogOverlayPath)
+		if err != nil {
+			glog.Fatal(err)
+			os.Exit(errorCode)
+		}
+
+		c.CatalogOverlay = overlay
+	}
+
+	if insecureHTTP {
+		// TLS flags are meaningless, so catch any misconfiguration.
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "tls-certificate" || f.Name == "tls-private-key" {
+				glog.Fatal(fmt.Errorf("%w: -insecure-http cannot be used with -%s", ErrFatal, f.Name))
+				os.Exit(errorCode)
+			}
+		})
+
+		glog.Warning("*** WARNING: TLS is disabled, all API traffic including credentials is sent in plain text ***")
+		glog.Warning("*** WARNING: -insecure-http must only be used behind a trusted proxy that terminates TLS ***")
+
+		c.InsecureHTTP = true
+	} else {
+		// The certificate is reloaded when rotated.
+		c.CertificatePath = tlsCertificatePath
+		c.PrivateKeyPath = tlsPrivateKeyPath
+	}
+
+	if registerURL != "" {
+		c.Registration = &broker.Registration{
+			Name:       registerName,
+			URL:        registerURL,
+			SecretName: registerSecret,
+			Namespaced: registerNamespaced,
+		}
+
+		if registerCABundlePath != "" {
+			caBundle, err := ioutil.ReadFile(registerCABundlePath)
+			if err != nil {
+				glog.Fatal(err)
+				os.Exit(errorCode)
+			}
+
+			c.Registration.CABundle = caBundle
+		}
+	}
 
 	// Initialize the clients.
 	clients, err := client.New()
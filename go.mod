@@ -7,7 +7,7 @@ require (
 	github.com/dustinkirkland/golang-petname v0.0.0-20191129215211-8e5a1ed0cff0
 	github.com/evanphx/json-patch v4.12.0+incompatible
 	github.com/ghodss/yaml v1.0.0
-	github.com/go-openapi/errors v0.20.2 // indirect
+	github.com/go-openapi/errors v0.20.2
 	github.com/go-openapi/jsonpointer v0.19.5
 	github.com/go-openapi/spec v0.20.4
 	github.com/go-openapi/strfmt v0.21.2
@@ -0,0 +1,269 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/registry"
+
+	"github.com/golang/glog"
+)
+
+// Route classifies requests so they can be sampled at different rates.
+type Route string
+
+const (
+	// RouteMutating is any request that may modify state, these are always logged.
+	RouteMutating Route = "mutating"
+
+	// RoutePoll is a last operation poll.
+	RoutePoll Route = "poll"
+
+	// RouteReadiness is a readiness check.
+	RouteReadiness Route = "readiness"
+
+	// RouteRead is any other read only request.
+	RouteRead Route = "read"
+)
+
+// Routes are the routes whose sample rate may be configured.
+var Routes = []Route{
+	RoutePoll,
+	RouteReadiness,
+	RouteRead,
+}
+
+// stdout is the access log path that writes to standard output.
+const stdout = "-"
+
+// bodyLimit is the largest request body that is logged.
+const bodyLimit = 64 << 10
+
+// redacted replaces sensitive values in logged request bodies.
+const redacted = "<redacted>"
+
+// Record is a single access log record.
+type Record struct {
+	// Timestamp is when the request was received.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Route is the class of request, used for sampling.
+	Route Route `json:"route"`
+
+	// Method is the HTTP method.
+	Method string `json:"method"`
+
+	// URI is the request path and query.
+	URI string `json:"uri"`
+
+	// ClientIP is the address of the client, resolved through any trusted proxies.
+	ClientIP string `json:"clientIP,omitempty"`
+
+	// RequestIdentity correlates the request with platform logs.
+	RequestIdentity string `json:"requestIdentity,omitempty"`
+
+	// Body is the request body, with sensitive values redacted.  It is only
+	// recorded when enabled, and the body is JSON.
+	Body json.RawMessage `json:"body,omitempty"`
+
+	// Status is the HTTP status code returned to the client.
+	Status int `json:"status"`
+
+	// Duration is how long the request took to handle, in milliseconds.
+	Duration float64 `json:"duration"`
+}
+
+// lock serializes writes to the access log.
+var lock sync.Mutex
+
+// RouteOf returns the route a request belongs to.
+func RouteOf(r *http.Request) Route {
+	switch {
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		return RouteMutating
+	case strings.HasSuffix(r.URL.Path, "/last_operation"):
+		return RoutePoll
+	case r.URL.Path == "/readyz":
+		return RouteReadiness
+	default:
+		return RouteRead
+	}
+}
+
+// Sampled returns whether a request should be logged.  Mutating requests are always
+// logged, others are logged at the configured sample rate for the route, which
+// defaults to all requests.
+func Sampled(route Route) bool {
+	if route == RouteMutating {
+		return true
+	}
+
+	rate, ok := config.GetOptions().AccessLogSampleRates[string(route)]
+	if !ok || rate >= 1 {
+		return true
+	}
+
+	return rand.Float64() < rate
+}
+
+// NewRecord returns a new access log record for a sampled request.  If request bodies
+// are logged, the body is read and replaced so it can still be handled.
+func NewRecord(r *http.Request, route Route, clientIP, identity string) *Record {
+	record := &Record{
+		Timestamp:       time.Now(),
+		Route:           route,
+		Method:          r.Method,
+		URI:             r.URL.RequestURI(),
+		ClientIP:        clientIP,
+		RequestIdentity: identity,
+	}
+
+	options := config.GetOptions()
+
+	if options.AccessLog != "" && options.AccessLogBodies && r.Body != nil {
+		record.Body = readBody(r)
+	}
+
+	return record
+}
+
+// readBody reads the start of a request body, returning it with sensitive values
+// redacted if it is JSON.  The body is restored so that it can be read again.
+func readBody(r *http.Request) json.RawMessage {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, bodyLimit))
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(data), r.Body),
+		Closer: r.Body,
+	}
+
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+
+	var body interface{}
+
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil
+	}
+
+	data, err = encode(redact(body))
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// encode returns the JSON encoding of a value as a line of text, without escaping
+// HTML characters so that redacted values are readable.
+func encode(value interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// redact replaces the values of any object fields that look like they hold secrets.
+func redact(value interface{}) interface{} {
+	switch t := value.(type) {
+	case map[string]interface{}:
+		for k, v := range t {
+			if registry.IsKeySensitive(k) {
+				t[k] = redacted
+				continue
+			}
+
+			t[k] = redact(v)
+		}
+	case []interface{}:
+		for i, v := range t {
+			t[i] = redact(v)
+		}
+	}
+
+	return value
+}
+
+// Complete records the response status code and duration, and writes the record
+// to the access log.
+func (r *Record) Complete(status int) {
+	// Handlers that never write a header implicitly return OK.
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	r.Status = status
+	r.Duration = float64(time.Since(r.Timestamp)) / float64(time.Millisecond)
+
+	if err := write(r); err != nil {
+		glog.Errorf("failed to write access log record: %v", err)
+	}
+}
+
+// write appends a record to the access log as a line of JSON.
+func write(record *Record) error {
+	path := config.GetOptions().AccessLog
+	if path == "" {
+		return nil
+	}
+
+	data, err := encode(record)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if path == stdout {
+		_, err := os.Stdout.Write(data)
+
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
@@ -21,23 +21,25 @@ type ServiceCatalog struct {
 
 // ServiceOffering must be provided by a service catalog.
 type ServiceOffering struct {
-	Name            string           `json:"name"`
-	ID              string           `json:"id"`
-	Description     string           `json:"description"`
-	Tags            []string         `json:"tags,omitempty"`
-	Requires        []string         `json:"requires,omitempty"`
-	Bindable        bool             `json:"bindable"`
-	Metadata        interface{}      `json:"metadata,omitempty"`
-	DashboardClient *DashboardClient `json:"dashboard_client,omitempty"`
-	PlanUpdatable   bool             `json:"plan_updatable,omitempty"`
-	Plans           []ServicePlan    `json:"plans"`
+	Name                 string           `json:"name"`
+	ID                   string           `json:"id"`
+	Description          string           `json:"description"`
+	Tags                 []string         `json:"tags,omitempty"`
+	Requires             []string         `json:"requires,omitempty"`
+	Bindable             bool             `json:"bindable"`
+	Metadata             interface{}      `json:"metadata,omitempty"`
+	DashboardClient      *DashboardClient `json:"dashboard_client,omitempty"`
+	PlanUpdatable        bool             `json:"plan_updatable,omitempty"`
+	InstancesRetrievable *bool            `json:"instances_retrievable,omitempty"`
+	BindingsRetrievable  *bool            `json:"bindings_retrievable,omitempty"`
+	Plans                []ServicePlan    `json:"plans"`
 }
 
 // DashboardClient may be provided by a service offering.
 type DashboardClient struct {
-	ID            string `json:"id"`
-	Secret        string `json:"secret"`
-	RedirectedURI string `json:"redirected_uri,omitempty"`
+	ID          string `json:"id"`
+	Secret      string `json:"secret"`
+	RedirectURI string `json:"redirect_uri,omitempty"`
 }
 
 // ServicePlan must be provided by a service offering.
@@ -46,11 +48,18 @@ type ServicePlan struct {
 	Name        string      `json:"name"`
 	Description string      `json:"description"`
 	Metadata    interface{} `json:"metadata,omitempty"`
-	Free        bool        `json:"free,omitempty"`
+	Free        *bool       `json:"free,omitempty"`
 	Bindable    *bool       `json:"bindable,omitempty"`
 	Schemas     *Schemas    `json:"schemas,omitempty"`
 }
 
+// ServicePlanCost is the conventional representation of a service plan cost
+// in service plan metadata.
+type ServicePlanCost struct {
+	Amount map[string]float64 `json:"amount"`
+	Unit   string             `json:"unit"`
+}
+
 // Schemas may be provided for a service plan.
 type Schemas struct {
 	ServiceInstance *ServiceInstanceSchema `json:"service_instance,omitempty"`
@@ -64,8 +64,32 @@ const (
 	ErrorResourceNotFound ErrorType = "ResourceNotFound"
 
 	// ErrorResourceGone means that a delete request has failed because the
-	// requested resource does not exist.
+	// requested resource does not exist, or a read request has failed because
+	// the requested resource has expired.
 	ErrorResourceGone ErrorType = "ResourceGone"
+
+	// ErrorMethodNotAllowed means that the requested path does not support the
+	// request method.
+	ErrorMethodNotAllowed ErrorType = "MethodNotAllowed"
+
+	// ErrorForbidden means that the authenticated principal is not authorized to
+	// perform the request.
+	ErrorForbidden ErrorType = "Forbidden"
+
+	// ErrorNamespaceConflict means that a service instance cannot be provisioned
+	// because its resources would collide with those of another service instance.
+	ErrorNamespaceConflict ErrorType = "NamespaceConflict"
+
+	// ErrorQuotaExceeded means that a request cannot be serviced because a limit
+	// has been reached, it may be retried later.
+	ErrorQuotaExceeded ErrorType = "QuotaExceeded"
+
+	// ErrorOperationTimeout means that an operation did not complete in time.
+	ErrorOperationTimeout ErrorType = "OperationTimeout"
+
+	// ErrorOperationCancelled means that an operation was cancelled by another
+	// request before it completed.
+	ErrorOperationCancelled ErrorType = "OperationCancelled"
 )
 
 // PollState is returned when an asynchronous request is polled.
@@ -97,6 +121,22 @@ type Error struct {
 	// Service Instance can still be used, false otherwise. This field MUST NOT
 	// be present for errors of other operations. Defaults to true.
 	InstanceUsable *bool `json:"instance_usable,omitempty"`
+
+	// ValidationFailures describes which parameters failed JSON schema validation
+	// for ValidationError errors.
+	ValidationFailures []ValidationFailure `json:"validation_failures,omitempty"`
+}
+
+// ValidationFailure describes a single parameter that failed JSON schema validation.
+type ValidationFailure struct {
+	// Path is a JSON pointer to the parameter that failed validation.
+	Path string `json:"path"`
+
+	// Constraint is the JSON schema keyword that failed e.g. "minimum", if known.
+	Constraint string `json:"constraint,omitempty"`
+
+	// Message describes why validation failed.
+	Message string `json:"message"`
 }
 
 // MaintenanceInfo is submitted by the client to provide versioning information.
@@ -135,6 +175,61 @@ type GetServiceInstanceResponse struct {
 	Parameters   *runtime.RawExtension `json:"parameters,omitempty"`
 }
 
+// ServiceInstanceManifest is a rendered resource template applied to a service instance.
+type ServiceInstanceManifest struct {
+	Name     string                `json:"name"`
+	Resource *runtime.RawExtension `json:"resource,omitempty"`
+}
+
+// GetServiceInstanceManifestsResponse is returned by the server when a service instance's
+// manifests are read.
+type GetServiceInstanceManifestsResponse struct {
+	Manifests []ServiceInstanceManifest `json:"manifests"`
+}
+
+// ReconcileServiceInstanceResponse is returned by the server when a service instance
+// is reconciled.
+type ReconcileServiceInstanceResponse struct {
+	// Recreated lists the resources that no longer existed, and were recreated.
+	Recreated []string `json:"recreated"`
+}
+
+// RegistryBackupEntry is a single registry entry in a backup.
+type RegistryBackupEntry struct {
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Data      map[string][]byte `json:"data,omitempty"`
+}
+
+// RegistryBackup is returned by the server when the registry is exported, and
+// submitted by the client when it is imported.
+type RegistryBackup struct {
+	Entries []RegistryBackupEntry `json:"entries"`
+}
+
+// Version is returned by the server when its version is read.
+type Version struct {
+	Application       string `json:"application"`
+	Version           string `json:"version"`
+	GitCommit         string `json:"git_commit"`
+	ConfigurationHash string `json:"configuration_hash"`
+	Uptime            string `json:"uptime"`
+}
+
+// OperationCompletion is sent to the completion webhook when an asynchronous operation
+// completes.  The idempotency token is stable across retries so receivers can discard
+// duplicate deliveries.  The request identity is that of the request that started the
+// operation.
+type OperationCompletion struct {
+	IdempotencyToken string    `json:"idempotency_token"`
+	RequestIdentity  string    `json:"request_identity,omitempty"`
+	Operation        string    `json:"operation"`
+	InstanceID       string    `json:"instance_id"`
+	BindingID        string    `json:"binding_id,omitempty"`
+	State            PollState `json:"state"`
+	Description      string    `json:"description,omitempty"`
+}
+
 // UpdateServiceInstanceRequest is submitted by the client when updating a service instance.
 type UpdateServiceInstanceRequest struct {
 	Context         *runtime.RawExtension                       `json:"context,omitempty"`
@@ -170,6 +265,10 @@ type CreateServiceBindingRequest struct {
 	AppGUID      string                `json:"app_guid"`
 	BindResource *runtime.RawExtension `json:"bind_resource"`
 	Parameters   *runtime.RawExtension `json:"parameters"`
+
+	// PredecessorBindingID is set when a binding is created to rotate the
+	// credentials of an existing binding.
+	PredecessorBindingID string `json:"predecessor_binding_id,omitempty"`
 }
 
 // CreateServiceBindingResponse is returned to the client when an aysnc request
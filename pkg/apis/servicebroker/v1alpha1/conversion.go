@@ -15,6 +15,9 @@
 package v1alpha1
 
 import (
+	"encoding/json"
+	"strconv"
+
 	"github.com/couchbase/service-broker/pkg/api"
 )
 
@@ -33,14 +36,16 @@ func (in ServiceCatalog) Convert() api.ServiceCatalog {
 // Convert reformats a Kubernetes catalog object as an Open Service Broker object.
 func (in ServiceOffering) Convert() api.ServiceOffering {
 	out := api.ServiceOffering{
-		Name:          in.Name,
-		ID:            in.ID,
-		Description:   in.Description,
-		Tags:          in.Tags,
-		Requires:      in.Requires,
-		Bindable:      in.Bindable,
-		Metadata:      in.Metadata,
-		PlanUpdatable: in.PlanUpdatable,
+		Name:                 in.Name,
+		ID:                   in.ID,
+		Description:          in.Description,
+		Tags:                 in.Tags,
+		Requires:             in.Requires,
+		Bindable:             in.Bindable,
+		Metadata:             in.Metadata,
+		PlanUpdatable:        in.PlanUpdatable,
+		InstancesRetrievable: in.InstancesRetrievable,
+		BindingsRetrievable:  in.BindingsRetrievable,
 	}
 
 	if in.DashboardClient != nil {
@@ -51,6 +56,15 @@ func (in ServiceOffering) Convert() api.ServiceOffering {
 	out.Plans = make([]api.ServicePlan, len(in.Plans))
 	for i, o := range in.Plans {
 		out.Plans[i] = o.Convert()
+
+		// Emit the effective bindable value for each plan, a plan override
+		// takes precedence over the service offering default.
+		bindable := in.Bindable
+		if o.Bindable != nil {
+			bindable = *o.Bindable
+		}
+
+		out.Plans[i].Bindable = &bindable
 	}
 
 	return out
@@ -59,9 +73,9 @@ func (in ServiceOffering) Convert() api.ServiceOffering {
 // Convert reformats a Kubernetes catalog object as an Open Service Broker object.
 func (in DashboardClient) Convert() api.DashboardClient {
 	return api.DashboardClient{
-		ID:            in.ID,
-		Secret:        in.Secret,
-		RedirectedURI: in.RedirectedURI,
+		ID:          in.ID,
+		Secret:      in.Secret,
+		RedirectURI: in.RedirectedURI,
 	}
 }
 
@@ -71,7 +85,7 @@ func (in ServicePlan) Convert() api.ServicePlan {
 		ID:          in.ID,
 		Name:        in.Name,
 		Description: in.Description,
-		Metadata:    in.Metadata,
+		Metadata:    in.convertMetadata(),
 		Free:        in.Free,
 		Bindable:    in.Bindable,
 	}
@@ -84,6 +98,47 @@ func (in ServicePlan) Convert() api.ServicePlan {
 	return out
 }
 
+// convertMetadata merges any structured cost metadata into the opaque
+// Service Plan metadata.
+func (in ServicePlan) convertMetadata() interface{} {
+	if len(in.CostMetadata) == 0 {
+		return in.Metadata
+	}
+
+	metadata := map[string]interface{}{}
+
+	if in.Metadata != nil && in.Metadata.Raw != nil {
+		if err := json.Unmarshal(in.Metadata.Raw, &metadata); err != nil {
+			return in.Metadata
+		}
+	}
+
+	costs := make([]api.ServicePlanCost, len(in.CostMetadata))
+	for i, o := range in.CostMetadata {
+		costs[i] = o.Convert()
+	}
+
+	metadata["costs"] = costs
+
+	return metadata
+}
+
+// Convert reformats a Kubernetes catalog object as an Open Service Broker object.
+// Amounts are expected to have been validated as decimal numbers.
+func (in ServicePlanCost) Convert() api.ServicePlanCost {
+	out := api.ServicePlanCost{
+		Amount: map[string]float64{},
+		Unit:   in.Unit,
+	}
+
+	for currency, amount := range in.Amount {
+		value, _ := strconv.ParseFloat(amount, 64)
+		out.Amount[currency] = value
+	}
+
+	return out
+}
+
 // Convert reformats a Kubernetes catalog object as an Open Service Broker object.
 func (in Schemas) Convert() api.Schemas {
 	out := api.Schemas{}
@@ -35,6 +35,25 @@ func (config *ServiceBrokerConfig) GetServiceAndPlanNames(serviceID, planID stri
 	return "", "", fmt.Errorf("%w: unable to locate service for ID %s", ErrResourceReferenceMissing, serviceID)
 }
 
+// GetServicePlan returns the service plan associated with a service and plan ID.
+func (config *ServiceBrokerConfig) GetServicePlan(serviceID, planID string) (*ServicePlan, error) {
+	for _, service := range config.Spec.Catalog.Services {
+		if service.ID != serviceID {
+			continue
+		}
+
+		for index := range service.Plans {
+			if service.Plans[index].ID == planID {
+				return &service.Plans[index], nil
+			}
+		}
+
+		return nil, fmt.Errorf("%w: unable to locate plan for ID %s", ErrResourceReferenceMissing, planID)
+	}
+
+	return nil, fmt.Errorf("%w: unable to locate service for ID %s", ErrResourceReferenceMissing, serviceID)
+}
+
 // GetTemplateBindings returns the template bindings associated with a creation request's
 // service and plan IDs.
 func (config *ServiceBrokerConfig) GetTemplateBindings(serviceID, planID string) (*ConfigurationBinding, error) {
@@ -51,3 +70,35 @@ func (config *ServiceBrokerConfig) GetTemplateBindings(serviceID, planID string)
 
 	return nil, fmt.Errorf("%w: unable to locate template bindings for service plan %s/%s", ErrResourceReferenceMissing, service, plan)
 }
+
+// GetFeatures returns the feature flags associated with a service and plan ID.  Flags
+// defined by the plan take precedence over those defined by the service.
+func (config *ServiceBrokerConfig) GetFeatures(serviceID, planID string) (map[string]bool, error) {
+	for _, service := range config.Spec.Catalog.Services {
+		if service.ID != serviceID {
+			continue
+		}
+
+		for _, plan := range service.Plans {
+			if plan.ID != planID {
+				continue
+			}
+
+			features := map[string]bool{}
+
+			for name, value := range service.Features {
+				features[name] = value
+			}
+
+			for name, value := range plan.Features {
+				features[name] = value
+			}
+
+			return features, nil
+		}
+
+		return nil, fmt.Errorf("%w: unable to locate plan for ID %s", ErrResourceReferenceMissing, planID)
+	}
+
+	return nil, fmt.Errorf("%w: unable to locate service for ID %s", ErrResourceReferenceMissing, serviceID)
+}
@@ -29,6 +29,10 @@ const (
 
 	// ResourceAnnotation records the resource for updates.
 	ResourceAnnotation = labelBase + "/resource"
+
+	// ConfigurationLabel marks a configuration as a fragment that contributes
+	// to the named service broker configuration.
+	ConfigurationLabel = labelBase + "/configuration"
 )
 
 // +genclient
@@ -63,6 +67,29 @@ type ServiceBrokerConfigSpec struct {
 	// +listType=map
 	// +listMapKey=name
 	Bindings []ConfigurationBinding `json:"bindings"`
+
+	// Lookups is a set of static tables that map keys to values, and may be
+	// read by templates with the lookup function.  This allows, for example,
+	// a region parameter to be mapped to an endpoint without having to encode
+	// the mapping in conditional template logic.
+	// +listType=map
+	// +listMapKey=name
+	Lookups []LookupTable `json:"lookups,omitempty"`
+}
+
+// LookupTable is a static map from keys to values.
+type LookupTable struct {
+	// Name is the unique name of the lookup table.
+	Name string `json:"name"`
+
+	// Entries is a map from key to value.  All values must be strings.
+	// +kubebuilder:validation:Type=object
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Entries *runtime.RawExtension `json:"entries"`
+
+	// Default is the value returned when a key is not found in the entries.
+	// If not specified, a missing key yields a nil value.
+	Default *string `json:"default,omitempty"`
 }
 
 // ServiceCatalog is defined by:
@@ -130,6 +157,16 @@ type ServiceOffering struct {
 	// instead of fixing it and thus breaking backward compatibility. Defaults to false.
 	PlanUpdatable bool `json:"planUpdatable,omitempty"`
 
+	// InstancesRetrievable specifies whether the Fetching a Service Instance endpoint is supported
+	// for all Service Plans.  When explicitly false, service instance reads will respond with
+	// not found.  If not specified, service instances may be read for backwards compatibility.
+	InstancesRetrievable *bool `json:"instancesRetrievable,omitempty"`
+
+	// BindingsRetrievable specifies whether the Fetching a Service Binding endpoint is supported
+	// for all Service Plans.  When explicitly false, service binding reads will respond with
+	// not found.  If not specified, service bindings may be read for backwards compatibility.
+	BindingsRetrievable *bool `json:"bindingsRetrievable,omitempty"`
+
 	// ServicePlan is a list of Service Plans for this Service Offering, schema is defined below. MUST
 	// contain at least one Service Plan. More info:
 	// https://github.com/couchbase/service-broker/tree/master/documentation/modules/ROOT/pages/concepts/catalog.adoc#service-plans
@@ -137,6 +174,34 @@ type ServiceOffering struct {
 	// +listType=map
 	// +listMapKey=name
 	Plans []ServicePlan `json:"plans"`
+
+	// DefaultPlanRollout allows service instances to be created without an explicit
+	// Service Plan.  A plan is selected at random, in proportion to its weight, and
+	// is fixed for the lifetime of the service instance.
+	DefaultPlanRollout []ServicePlanWeight `json:"defaultPlanRollout,omitempty"`
+
+	// Features are named boolean flags that may be read by templates to toggle
+	// behavior for all Service Plans of this Service Offering.  Service Plans can
+	// override individual flags.
+	Features map[string]bool `json:"features,omitempty"`
+
+	// MaxConcurrentProvisions bounds the number of Service Instances of this Service
+	// Offering that are provisioned at the same time.  Excess provisioning operations
+	// are queued, other Service Offerings are unaffected.  Zero is unlimited.
+	// +kubebuilder:validation:Minimum=0
+	MaxConcurrentProvisions int `json:"maxConcurrentProvisions,omitempty"`
+}
+
+// ServicePlanWeight is a weighted reference to a Service Plan.
+type ServicePlanWeight struct {
+	// Plan is the name of a Service Plan belonging to the Service Offering.
+	// +kubebuilder:validation:MinLength=1
+	Plan string `json:"plan"`
+
+	// Weight is the relative proportion of service instances that will be
+	// created with the Service Plan.
+	// +kubebuilder:validation:Minimum=1
+	Weight int `json:"weight"`
 }
 
 // DashboardClient is defined by:
@@ -147,14 +212,30 @@ type DashboardClient struct {
 	ID string `json:"id"`
 
 	// Secret is a secret for the dashboard client. If present, MUST be a non-empty string.
+	// Exactly one of Secret or SecretRef must be specified.
 	// +kubebuilder:validation:MinLength=1
-	Secret string `json:"secret"`
+	Secret string `json:"secret,omitempty"`
+
+	// SecretRef is a key of a Secret, in the Service Broker namespace, that contains
+	// the secret for the dashboard client, so it need not be stored in the configuration.
+	SecretRef *DashboardClientSecretRef `json:"secretRef,omitempty"`
 
 	// RedirectedURI is a URI for the service dashboard. Validated by the OAuth token server when the dashboard
-	// requests a token.
+	// requests a token.  If present, MUST be an absolute HTTP or HTTPS URI.
 	RedirectedURI string `json:"redirectedURI,omitempty"`
 }
 
+// DashboardClientSecretRef references a key of a Secret.
+type DashboardClientSecretRef struct {
+	// Name is the name of the Secret.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Key is the key of the Secret's data that holds the dashboard client secret.
+	// +kubebuilder:validation:MinLength=1
+	Key string `json:"key"`
+}
+
 // ServicePlan is defined by:
 // https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#body
 type ServicePlan struct {
@@ -181,7 +262,11 @@ type ServicePlan struct {
 	Metadata *runtime.RawExtension `json:"metadata,omitempty"`
 
 	// Free, when false, Service Instances of this Service Plan have a cost. The default is true.
-	Free bool `json:"free,omitempty"`
+	Free *bool `json:"free,omitempty"`
+
+	// CostMetadata describes the costs associated with the Service Plan.  When specified,
+	// costs are added to the Service Plan metadata as the conventional "costs" attribute.
+	CostMetadata []ServicePlanCost `json:"costMetadata,omitempty"`
 
 	// Bindable specifies whether Service Instances of the Service Plan can be bound to applications.
 	// This field is OPTIONAL. If specified, this takes precedence over the bindable attribute of
@@ -192,6 +277,71 @@ type ServicePlan struct {
 	// Plan. More info:
 	// https://github.com/couchbase/service-broker/tree/master/documentation/modules/ROOT/pages/concepts/catalog.adoc#json-schemas
 	Schemas *Schemas `json:"schemas,omitempty"`
+
+	// Features are named boolean flags that may be read by templates to toggle
+	// behavior for the Service Plan.  These take precedence over those defined
+	// by the Service Offering.
+	Features map[string]bool `json:"features,omitempty"`
+
+	// SynchronousTimeout allows Service Instances of this Service Plan to be created by
+	// clients that do not support asynchronous operations.  Provisioning is run to completion
+	// before responding, and if it takes longer than this timeout it is rolled back and the
+	// client is told that asynchronous operation is required.
+	SynchronousTimeout *metav1.Duration `json:"synchronousTimeout,omitempty"`
+
+	// SynchronousDelete allows Service Instances of this Service Plan to be deleted
+	// by clients that do not support asynchronous operations.  Use this only when
+	// deprovisioning has no asynchronous work, it is always run to completion before
+	// responding.
+	SynchronousDelete bool `json:"synchronousDelete,omitempty"`
+
+	// BindingTTL, if set, is how long Service Binding credentials for this Service
+	// Plan are valid for.  The expiry is returned to the client, and an expired Service
+	// Binding is recreated with new credentials when next requested.
+	BindingTTL *metav1.Duration `json:"bindingTTL,omitempty"`
+
+	// BindingEndpoints, if set, allows a Service Binding to select one of the endpoints
+	// exposed by its Service Instance with a parameter, e.g. read-only or read-write.
+	BindingEndpoints *ServicePlanBindingEndpoints `json:"bindingEndpoints,omitempty"`
+
+	// MaxBindingsPerInstance, if set, limits the number of Service Bindings that may
+	// exist for each Service Instance of this Service Plan.
+	// +kubebuilder:validation:Minimum=0
+	MaxBindingsPerInstance *int `json:"maxBindingsPerInstance,omitempty"`
+
+	// MaxRangeItems, if set, limits the number of instances any ranged template may
+	// create for each Service Instance or Service Binding of this Service Plan.
+	// +kubebuilder:validation:Minimum=0
+	MaxRangeItems *int `json:"maxRangeItems,omitempty"`
+}
+
+// ServicePlanBindingEndpoints describes how a Service Binding selects an endpoint.
+// The selected endpoint is recorded in the "endpoint" registry key of the Service
+// Binding for use by credentials.
+type ServicePlanBindingEndpoints struct {
+	// Registry is the Service Instance registry key that records the available
+	// endpoints, as an object mapping endpoint names to values.
+	Registry string `json:"registry"`
+
+	// Parameter is a JSON pointer to the Service Binding parameter that names
+	// the endpoint to select.  This defaults to "/endpoint".
+	Parameter string `json:"parameter,omitempty"`
+
+	// Default is the endpoint selected when the parameter is not specified.  If
+	// not set the parameter is required.
+	Default string `json:"default,omitempty"`
+}
+
+// ServicePlanCost describes a cost associated with a Service Plan.
+type ServicePlanCost struct {
+	// Amount maps lower case ISO 4217 currency codes e.g. "usd" to a decimal
+	// amount e.g. "9.99".
+	// +kubebuilder:validation:MinProperties=1
+	Amount map[string]string `json:"amount"`
+
+	// Unit is the unit the cost is charged by e.g. "MONTHLY".
+	// +kubebuilder:validation:MinLength=1
+	Unit string `json:"unit"`
 }
 
 // Schemas is defined by:
@@ -229,6 +379,30 @@ type InputParamtersSchema struct {
 	// expressed as a property within a JSON object.
 	// +kubebuilder:pruning:PreserveUnknownFields
 	Parameters *runtime.RawExtension `json:"parameters,omitempty"`
+
+	// Sanitizers are applied, in order, to user-provided string parameters before
+	// they are validated against the schema and used to render templates.
+	Sanitizers []ParameterSanitizer `json:"sanitizers,omitempty"`
+}
+
+// ParameterSanitizer defines how a user-provided string parameter is cleaned up
+// before use.  Rules are applied in the order trim, lowercase then DNS label.
+type ParameterSanitizer struct {
+	// Path is a JSON pointer to the parameter to sanitize.  Parameters that are
+	// not specified by the request are ignored.
+	// +kubebuilder:validation:Pattern="^/.+"
+	Path string `json:"path"`
+
+	// Trim removes any leading and trailing white space.
+	Trim bool `json:"trim,omitempty"`
+
+	// Lowercase converts the parameter to lower case.
+	Lowercase bool `json:"lowercase,omitempty"`
+
+	// DNSLabel replaces any characters that are not allowed in a DNS-1123 label
+	// with a hyphen, and removes any leading or trailing hyphens.  If the result
+	// is still not a valid label, the request is rejected.
+	DNSLabel bool `json:"dnsLabel,omitempty"`
 }
 
 // MaintenanceInfo is defined by:
@@ -249,11 +423,100 @@ type ConfigurationTemplate struct {
 	// +kubebuilder:pruning:PreserveUnknownFields
 	Template *runtime.RawExtension `json:"template"`
 
+	// Namespace is the namespace the resource is created in, rather than that of
+	// the service instance, e.g. to place monitoring in a shared namespace.  This
+	// overrides any namespace defined by the template.  More info:
+	// https://github.com/couchbase/service-broker/tree/master/documentation/modules/ROOT/pages/concepts/dynamic-attributes.adoc
+	Namespace string `json:"namespace,omitempty"`
+
 	// Singleton alters the behaviour of resource creation.  Typically we will
 	// create a resource and use parameters to alter it's name, ensuring it
 	// doesn't already exist.  Singleton resources will first check to see
 	// whether they exist before attempting creation.
 	Singleton bool `json:"singleton,omitempty"`
+
+	// Includes splices other rendered templates into this one, allowing reusable
+	// partials e.g. labels or resource limits to be shared between templates.
+	// Includes are applied in order, after this template has been rendered.
+	// +listType=atomic
+	Includes []ConfigurationTemplateInclude `json:"includes,omitempty"`
+
+	// Range instantiates the template once per element of a list, allowing
+	// a variable number of identical resources to be created e.g. data nodes.
+	Range *ConfigurationTemplateRange `json:"range,omitempty"`
+
+	// PreDelete actions are performed, in order, before the resource is deleted
+	// e.g. a Job that snapshots data.  If any fail, the resource is not deleted.
+	// +listType=atomic
+	PreDelete []ConfigurationTemplatePreDelete `json:"preDelete,omitempty"`
+
+	// WaitForDeletion waits for the resource to be removed when it is deleted, rather
+	// than just requesting deletion e.g. a Namespace that takes a while to terminate.
+	WaitForDeletion *ConfigurationTemplateWaitForDeletion `json:"waitForDeletion,omitempty"`
+}
+
+// ConfigurationTemplateWaitForDeletion defines how long to wait for a deleted resource
+// to be removed.
+type ConfigurationTemplateWaitForDeletion struct {
+	// Timeout is how long to wait for the resource to be removed, after which
+	// deletion fails.
+	// +kubebuilder:default="5m"
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// ConfigurationTemplatePreDelete creates a resource, and waits for it to complete,
+// before the resource rendered by a template is deleted.
+type ConfigurationTemplatePreDelete struct {
+	// Template is the name of the template to render and create e.g. a Job.
+	// +kubebuilder:validation:MinLength=1
+	Template string `json:"template"`
+
+	// ReadinessChecks must all pass before the resource is deleted e.g. the
+	// Job has completed.
+	// +listType=map
+	// +listMapKey=name
+	ReadinessChecks []ConfigurationReadinessCheck `json:"readinessChecks,omitempty"`
+
+	// Timeout is how long to wait for the readiness checks to pass.
+	// +kubebuilder:default="5m"
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// ConfigurationTemplateRange instantiates a template once per element of a list.
+// Each instance is rendered with the template data {{ .index }}, the zero based
+// index, and {{ .element }}, the list element.
+type ConfigurationTemplateRange struct {
+	// Over is a dynamic attribute that must resolve to either a list, or a count
+	// of instances to create e.g. {{ parameter "/nodes" }}.
+	// +kubebuilder:validation:MinLength=1
+	Over string `json:"over"`
+
+	// MaxItems limits the number of instances that may be created.
+	// +kubebuilder:validation:Minimum=0
+	MaxItems *int `json:"maxItems,omitempty"`
+}
+
+// ConfigurationTemplateInclude splices a named template into another.
+type ConfigurationTemplateInclude struct {
+	// Name is the name of the template to include.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Path is a JSON pointer to where the included template is placed.  Missing
+	// objects along the path are created.  If an object already exists at the
+	// path, the included template must also be an object and is merged into it.
+	Path string `json:"path"`
+
+	// Parameters are passed to the included template, and may be referenced as
+	// the template data e.g. {{ .replicas }}.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Parameters *runtime.RawExtension `json:"parameters,omitempty"`
+
+	// Overrides is a template that is rendered and merged over the included
+	// template before it is placed, allowing individual fields of a shared
+	// partial to be replaced e.g. a label specific to service bindings.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Overrides *runtime.RawExtension `json:"overrides,omitempty"`
 }
 
 // RegistryValue sets a registry key using a template.
@@ -261,6 +524,11 @@ type RegistryValue struct {
 	// Name is the name of the registry key to set.
 	Name string `json:"name"`
 
+	// Names are additional registry keys to set to the same value, for example
+	// when a generated password is consumed by different templates.  Either all
+	// keys are set, or none are.  Only valid for registry values.
+	Names []string `json:"names,omitempty"`
+
 	// Value is the templated string value to calculate. More info:
 	// https://github.com/couchbase/service-broker/tree/master/documentation/modules/ROOT/pages/concepts/dynamic-attributes.adoc
 	Value string `json:"value"`
@@ -330,18 +598,51 @@ type ConfigurationBinding struct {
 // ServiceBrokerTemplateList is an ordered list of templates to use
 // when performing a specific operation.
 type ServiceBrokerTemplateList struct {
+	// Inherit, when set for a service binding, prepends the service instance's
+	// annotations to those defined here, so they need not be duplicated.  Values
+	// defined here override inherited values with the same name.  Registry values
+	// are always inherited as they were rendered for the service instance.
+	Inherit bool `json:"inherit,omitempty"`
+
 	// Registry allows the pre-calculation of dynamic configuration from
 	// request inputs i.e. registry or parameters, or generated e.g. passwords.
 	// +listType=map
 	// +listMapKey=name
 	Registry []RegistryValue `json:"registry,omitempty"`
 
+	// CredentialFormats allows a service binding to return multiple named
+	// representations of its credentials e.g. a URI and individual fields.
+	// Each is rendered from a template and added to the binding credentials.
+	// +listType=map
+	// +listMapKey=name
+	CredentialFormats []RegistryValue `json:"credentialFormats,omitempty"`
+
+	// CACertificate is the name of a registry key holding a PEM encoded CA
+	// certificate, or certificate chain, that a service binding returns in its
+	// credentials as "ca.crt".  Use the "instance." prefix to select the value
+	// generated by the service instance.
+	CACertificate string `json:"caCertificate,omitempty"`
+
+	// Annotations are added to every resource created for the service instance
+	// or binding, unless defined by the template, e.g. a cost center.  Singleton
+	// resources are shared, so are not annotated.
+	// +listType=map
+	// +listMapKey=name
+	Annotations []RegistryValue `json:"annotations,omitempty"`
+
 	// Templates defines all the templates that will be created, in order,
 	// by the service broker for this operation.
 	// This field is deprecated, use steps instead.
 	// +listType=set
 	Templates []string `json:"templates,omitempty"`
 
+	// ConditionalTemplates defines templates that are created, in order, after
+	// templates, only if their condition is true.  This allows a single service
+	// plan to create different resources based on request parameters.  Conditional
+	// templates cannot be used at the same time as steps.
+	// +listType=atomic
+	ConditionalTemplates []ServiceBrokerConditionalTemplates `json:"conditionalTemplates,omitempty"`
+
 	// ReadinessChecks defines a set of tests that define whether a service instance
 	// or service binding is actually ready as reported by the service broker polling
 	// API.
@@ -349,6 +650,18 @@ type ServiceBrokerTemplateList struct {
 	// +listMapKey=name
 	ReadinessChecks []ConfigurationReadinessCheck `json:"readinessChecks,omitempty"`
 
+	// ReadinessDeadline is how long an operation may wait for readiness checks,
+	// including those of steps, before it fails.  It is measured from the start of
+	// the operation and if not specified each check is bounded by its own timeout.
+	ReadinessDeadline *metav1.Duration `json:"readinessDeadline,omitempty"`
+
+	// PostProvisionProbes are run, in order, once all resources have been created
+	// and step readiness checks have passed.  They must all succeed before the
+	// operation is reported as successful, e.g. to check a service is responding.
+	// +listType=map
+	// +listMapKey=name
+	PostProvisionProbes []ConfigurationProbe `json:"postProvisionProbes,omitempty"`
+
 	// Steps allows a service instance or binding deployment to be split into steps.
 	// A steps will block until the readiness check, if defined, passes, before
 	// continuing on to the next one.  Steps cannot be used at the same time as
@@ -358,6 +671,20 @@ type ServiceBrokerTemplateList struct {
 	Steps []ServiceBrokerTemplateListStep `json:"steps,omitempty"`
 }
 
+// ServiceBrokerConditionalTemplates is a list of templates that are only created
+// when a condition is true.
+type ServiceBrokerConditionalTemplates struct {
+	// Condition is a dynamic attribute that must resolve to a boolean, or null
+	// which is treated as false e.g. {{ parameter "/ha" }}.
+	// +kubebuilder:validation:MinLength=1
+	Condition string `json:"condition"`
+
+	// Templates defines all the templates that will be created, in order,
+	// if the condition is true.
+	// +listType=set
+	Templates []string `json:"templates"`
+}
+
 // ServiceBrokerTemplateListStep allows a service instance to be provisioned in steps
 // blocking until a readiness check has completed before moving on to the next one.
 type ServiceBrokerTemplateListStep struct {
@@ -388,6 +715,16 @@ type ConfigurationReadinessCheck struct {
 	// in order to determine whether a specific resource is ready.
 	Condition *ConfigurationReadinessCheckCondition `json:"condition,omitempty"`
 
+	// Resource allows the service broker to wait for a resource to exist.  This is
+	// typically used for resources created by other controllers in response to
+	// resources created by the service broker.
+	Resource *ConfigurationReadinessCheckResource `json:"resource,omitempty"`
+
+	// Field allows the service broker to poll an arbitrary field of a resource,
+	// and compare it with a value e.g. the number of ready replicas is at least
+	// the number requested.
+	Field *ConfigurationReadinessCheckField `json:"field,omitempty"`
+
 	// Timeout is the timeout durations for this check.
 	// +kubebuilder:default="1m"
 	Timeout *metav1.Duration `json:"timeout,omitempty"`
@@ -416,6 +753,133 @@ type ConfigurationReadinessCheckCondition struct {
 	Status string `json:"status"`
 }
 
+// ReadinessOperator defines how a resource field is compared with a value.
+// +kubebuilder:validation:Enum=Equal;NotEqual;GreaterThan;GreaterThanOrEqual;LessThan;LessThanOrEqual;In;Matches
+type ReadinessOperator string
+
+const (
+	// ReadinessOperatorEqual is ready when the field equals the value.
+	ReadinessOperatorEqual ReadinessOperator = "Equal"
+
+	// ReadinessOperatorNotEqual is ready when the field does not equal the value.
+	ReadinessOperatorNotEqual ReadinessOperator = "NotEqual"
+
+	// ReadinessOperatorGreaterThan is ready when the field is numerically greater
+	// than the value.
+	ReadinessOperatorGreaterThan ReadinessOperator = "GreaterThan"
+
+	// ReadinessOperatorGreaterThanOrEqual is ready when the field is numerically
+	// greater than or equal to the value.
+	ReadinessOperatorGreaterThanOrEqual ReadinessOperator = "GreaterThanOrEqual"
+
+	// ReadinessOperatorLessThan is ready when the field is numerically less than
+	// the value.
+	ReadinessOperatorLessThan ReadinessOperator = "LessThan"
+
+	// ReadinessOperatorLessThanOrEqual is ready when the field is numerically less
+	// than or equal to the value.
+	ReadinessOperatorLessThanOrEqual ReadinessOperator = "LessThanOrEqual"
+
+	// ReadinessOperatorIn is ready when the field equals any element of the value,
+	// which must be a list.
+	ReadinessOperatorIn ReadinessOperator = "In"
+
+	// ReadinessOperatorMatches is ready when the field, which must be a string,
+	// matches the value, which must be a regular expression.
+	ReadinessOperatorMatches ReadinessOperator = "Matches"
+)
+
+// ConfigurationReadinessCheckField allows the service broker to poll an arbitrary
+// field of a resource, and compare it with a value.
+type ConfigurationReadinessCheckField struct {
+	// APIVersion is the resource api version e.g. "apps/v1"
+	APIVersion string `json:"apiVersion"`
+
+	// Kind is the resource kind to poll e.g. "Deployment"
+	Kind string `json:"kind"`
+
+	// Namespace is the namespace the resource resides in.
+	Namespace string `json:"namespace"`
+
+	// Name is the resource name to poll.
+	Name string `json:"name"`
+
+	// Path is a JSON pointer to the field to compare e.g. "/status/readyReplicas".
+	// The check is unready while the field does not exist.
+	// +kubebuilder:validation:MinLength=1
+	Path string `json:"path"`
+
+	// Operator is how the field is compared with the value.
+	Operator ReadinessOperator `json:"operator"`
+
+	// Value is the value the field is compared with.  This may be a dynamic
+	// attribute e.g. {{ parameter "/replicas" }}.
+	Value string `json:"value"`
+}
+
+// ConfigurationReadinessCheckResource allows the service broker to wait for a resource
+// that it did not create to exist.
+type ConfigurationReadinessCheckResource struct {
+	// APIVersion is the resource api version e.g. "v1"
+	APIVersion string `json:"apiVersion"`
+
+	// Kind is the resource kind to poll e.g. "Service"
+	Kind string `json:"kind"`
+
+	// Namespace is the namespace the resource resides in.
+	Namespace string `json:"namespace"`
+
+	// Name is the resource name to poll.
+	Name string `json:"name"`
+}
+
+// ConfigurationProbe checks that a provisioned service is actually working, retrying
+// until it succeeds or the attempts are exhausted.  Exactly one probe type must be
+// specified.
+type ConfigurationProbe struct {
+	// Name is a unique name for the probe for debugging purposes.
+	Name string `json:"name"`
+
+	// HTTP probes an HTTP endpoint.
+	HTTP *ConfigurationProbeHTTP `json:"http,omitempty"`
+
+	// TCP probes that a TCP endpoint accepts connections.
+	TCP *ConfigurationProbeTCP `json:"tcp,omitempty"`
+
+	// Attempts is the maximum number of times the probe is attempted.
+	// +kubebuilder:default=3
+	// +kubebuilder:validation:Minimum=1
+	Attempts *int `json:"attempts,omitempty"`
+
+	// Period is the delay between probe attempts.
+	// +kubebuilder:default="10s"
+	Period *metav1.Duration `json:"period,omitempty"`
+
+	// Timeout is the timeout for each probe attempt.
+	// +kubebuilder:default="5s"
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// ConfigurationProbeHTTP probes an HTTP endpoint with a GET request.
+type ConfigurationProbeHTTP struct {
+	// URL is a dynamic attribute that must resolve to the URL to probe
+	// e.g. {{ registry "dashboard-url" }}.
+	// +kubebuilder:validation:MinLength=1
+	URL string `json:"url"`
+
+	// Status is the expected HTTP status code.
+	// +kubebuilder:default=200
+	Status *int `json:"status,omitempty"`
+}
+
+// ConfigurationProbeTCP probes that a TCP endpoint accepts connections.
+type ConfigurationProbeTCP struct {
+	// Address is a dynamic attribute that must resolve to the host and port to
+	// probe e.g. my-service.my-namespace.svc:5432.
+	// +kubebuilder:validation:MinLength=1
+	Address string `json:"address"`
+}
+
 // ServiceBrokerConfigStatus records status information about a configuration
 // as the Service Broker processes it.
 type ServiceBrokerConfigStatus struct {
@@ -46,6 +46,84 @@ func (in *ConfigurationBinding) DeepCopy() *ConfigurationBinding {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigurationProbe) DeepCopyInto(out *ConfigurationProbe) {
+	*out = *in
+	if in.HTTP != nil {
+		in, out := &in.HTTP, &out.HTTP
+		*out = new(ConfigurationProbeHTTP)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TCP != nil {
+		in, out := &in.TCP, &out.TCP
+		*out = new(ConfigurationProbeTCP)
+		**out = **in
+	}
+	if in.Attempts != nil {
+		in, out := &in.Attempts, &out.Attempts
+		*out = new(int)
+		**out = **in
+	}
+	if in.Period != nil {
+		in, out := &in.Period, &out.Period
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigurationProbe.
+func (in *ConfigurationProbe) DeepCopy() *ConfigurationProbe {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigurationProbe)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigurationProbeHTTP) DeepCopyInto(out *ConfigurationProbeHTTP) {
+	*out = *in
+	if in.Status != nil {
+		in, out := &in.Status, &out.Status
+		*out = new(int)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigurationProbeHTTP.
+func (in *ConfigurationProbeHTTP) DeepCopy() *ConfigurationProbeHTTP {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigurationProbeHTTP)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigurationProbeTCP) DeepCopyInto(out *ConfigurationProbeTCP) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigurationProbeTCP.
+func (in *ConfigurationProbeTCP) DeepCopy() *ConfigurationProbeTCP {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigurationProbeTCP)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ConfigurationReadinessCheck) DeepCopyInto(out *ConfigurationReadinessCheck) {
 	*out = *in
@@ -54,6 +132,16 @@ func (in *ConfigurationReadinessCheck) DeepCopyInto(out *ConfigurationReadinessC
 		*out = new(ConfigurationReadinessCheckCondition)
 		**out = **in
 	}
+	if in.Resource != nil {
+		in, out := &in.Resource, &out.Resource
+		*out = new(ConfigurationReadinessCheckResource)
+		**out = **in
+	}
+	if in.Field != nil {
+		in, out := &in.Field, &out.Field
+		*out = new(ConfigurationReadinessCheckField)
+		**out = **in
+	}
 	if in.Timeout != nil {
 		in, out := &in.Timeout, &out.Timeout
 		*out = new(v1.Duration)
@@ -88,6 +176,37 @@ func (in *ConfigurationReadinessCheckCondition) DeepCopy() *ConfigurationReadine
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigurationReadinessCheckField) DeepCopyInto(out *ConfigurationReadinessCheckField) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigurationReadinessCheckField.
+func (in *ConfigurationReadinessCheckField) DeepCopy() *ConfigurationReadinessCheckField {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigurationReadinessCheckField)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigurationReadinessCheckResource) DeepCopyInto(out *ConfigurationReadinessCheckResource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigurationReadinessCheckResource.
+func (in *ConfigurationReadinessCheckResource) DeepCopy() *ConfigurationReadinessCheckResource {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigurationReadinessCheckResource)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ConfigurationTemplate) DeepCopyInto(out *ConfigurationTemplate) {
 	*out = *in
@@ -96,6 +215,30 @@ func (in *ConfigurationTemplate) DeepCopyInto(out *ConfigurationTemplate) {
 		*out = new(runtime.RawExtension)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Includes != nil {
+		in, out := &in.Includes, &out.Includes
+		*out = make([]ConfigurationTemplateInclude, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Range != nil {
+		in, out := &in.Range, &out.Range
+		*out = new(ConfigurationTemplateRange)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PreDelete != nil {
+		in, out := &in.PreDelete, &out.PreDelete
+		*out = make([]ConfigurationTemplatePreDelete, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.WaitForDeletion != nil {
+		in, out := &in.WaitForDeletion, &out.WaitForDeletion
+		*out = new(ConfigurationTemplateWaitForDeletion)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -109,9 +252,110 @@ func (in *ConfigurationTemplate) DeepCopy() *ConfigurationTemplate {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigurationTemplateInclude) DeepCopyInto(out *ConfigurationTemplateInclude) {
+	*out = *in
+	if in.Parameters != nil {
+		in, out := &in.Parameters, &out.Parameters
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Overrides != nil {
+		in, out := &in.Overrides, &out.Overrides
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigurationTemplateInclude.
+func (in *ConfigurationTemplateInclude) DeepCopy() *ConfigurationTemplateInclude {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigurationTemplateInclude)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigurationTemplatePreDelete) DeepCopyInto(out *ConfigurationTemplatePreDelete) {
+	*out = *in
+	if in.ReadinessChecks != nil {
+		in, out := &in.ReadinessChecks, &out.ReadinessChecks
+		*out = make([]ConfigurationReadinessCheck, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigurationTemplatePreDelete.
+func (in *ConfigurationTemplatePreDelete) DeepCopy() *ConfigurationTemplatePreDelete {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigurationTemplatePreDelete)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigurationTemplateRange) DeepCopyInto(out *ConfigurationTemplateRange) {
+	*out = *in
+	if in.MaxItems != nil {
+		in, out := &in.MaxItems, &out.MaxItems
+		*out = new(int)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigurationTemplateRange.
+func (in *ConfigurationTemplateRange) DeepCopy() *ConfigurationTemplateRange {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigurationTemplateRange)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigurationTemplateWaitForDeletion) DeepCopyInto(out *ConfigurationTemplateWaitForDeletion) {
+	*out = *in
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigurationTemplateWaitForDeletion.
+func (in *ConfigurationTemplateWaitForDeletion) DeepCopy() *ConfigurationTemplateWaitForDeletion {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigurationTemplateWaitForDeletion)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DashboardClient) DeepCopyInto(out *DashboardClient) {
 	*out = *in
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(DashboardClientSecretRef)
+		**out = **in
+	}
 	return
 }
 
@@ -125,6 +369,22 @@ func (in *DashboardClient) DeepCopy() *DashboardClient {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DashboardClientSecretRef) DeepCopyInto(out *DashboardClientSecretRef) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DashboardClientSecretRef.
+func (in *DashboardClientSecretRef) DeepCopy() *DashboardClientSecretRef {
+	if in == nil {
+		return nil
+	}
+	out := new(DashboardClientSecretRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InputParamtersSchema) DeepCopyInto(out *InputParamtersSchema) {
 	*out = *in
@@ -133,6 +393,11 @@ func (in *InputParamtersSchema) DeepCopyInto(out *InputParamtersSchema) {
 		*out = new(runtime.RawExtension)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Sanitizers != nil {
+		in, out := &in.Sanitizers, &out.Sanitizers
+		*out = make([]ParameterSanitizer, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -146,6 +411,32 @@ func (in *InputParamtersSchema) DeepCopy() *InputParamtersSchema {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LookupTable) DeepCopyInto(out *LookupTable) {
+	*out = *in
+	if in.Entries != nil {
+		in, out := &in.Entries, &out.Entries
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Default != nil {
+		in, out := &in.Default, &out.Default
+		*out = new(string)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LookupTable.
+func (in *LookupTable) DeepCopy() *LookupTable {
+	if in == nil {
+		return nil
+	}
+	out := new(LookupTable)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MaintenanceInfo) DeepCopyInto(out *MaintenanceInfo) {
 	*out = *in
@@ -162,9 +453,30 @@ func (in *MaintenanceInfo) DeepCopy() *MaintenanceInfo {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ParameterSanitizer) DeepCopyInto(out *ParameterSanitizer) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ParameterSanitizer.
+func (in *ParameterSanitizer) DeepCopy() *ParameterSanitizer {
+	if in == nil {
+		return nil
+	}
+	out := new(ParameterSanitizer)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RegistryValue) DeepCopyInto(out *RegistryValue) {
 	*out = *in
+	if in.Names != nil {
+		in, out := &in.Names, &out.Names
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -225,6 +537,27 @@ func (in *ServiceBindingSchema) DeepCopy() *ServiceBindingSchema {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceBrokerConditionalTemplates) DeepCopyInto(out *ServiceBrokerConditionalTemplates) {
+	*out = *in
+	if in.Templates != nil {
+		in, out := &in.Templates, &out.Templates
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceBrokerConditionalTemplates.
+func (in *ServiceBrokerConditionalTemplates) DeepCopy() *ServiceBrokerConditionalTemplates {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceBrokerConditionalTemplates)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceBrokerConfig) DeepCopyInto(out *ServiceBrokerConfig) {
 	*out = *in
@@ -321,6 +654,13 @@ func (in *ServiceBrokerConfigSpec) DeepCopyInto(out *ServiceBrokerConfigSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Lookups != nil {
+		in, out := &in.Lookups, &out.Lookups
+		*out = make([]LookupTable, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -363,13 +703,36 @@ func (in *ServiceBrokerTemplateList) DeepCopyInto(out *ServiceBrokerTemplateList
 	if in.Registry != nil {
 		in, out := &in.Registry, &out.Registry
 		*out = make([]RegistryValue, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.CredentialFormats != nil {
+		in, out := &in.CredentialFormats, &out.CredentialFormats
+		*out = make([]RegistryValue, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make([]RegistryValue, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 	if in.Templates != nil {
 		in, out := &in.Templates, &out.Templates
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.ConditionalTemplates != nil {
+		in, out := &in.ConditionalTemplates, &out.ConditionalTemplates
+		*out = make([]ServiceBrokerConditionalTemplates, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.ReadinessChecks != nil {
 		in, out := &in.ReadinessChecks, &out.ReadinessChecks
 		*out = make([]ConfigurationReadinessCheck, len(*in))
@@ -377,6 +740,18 @@ func (in *ServiceBrokerTemplateList) DeepCopyInto(out *ServiceBrokerTemplateList
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.ReadinessDeadline != nil {
+		in, out := &in.ReadinessDeadline, &out.ReadinessDeadline
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.PostProvisionProbes != nil {
+		in, out := &in.PostProvisionProbes, &out.PostProvisionProbes
+		*out = make([]ConfigurationProbe, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.Steps != nil {
 		in, out := &in.Steps, &out.Steps
 		*out = make([]ServiceBrokerTemplateListStep, len(*in))
@@ -495,6 +870,16 @@ func (in *ServiceOffering) DeepCopyInto(out *ServiceOffering) {
 	if in.DashboardClient != nil {
 		in, out := &in.DashboardClient, &out.DashboardClient
 		*out = new(DashboardClient)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.InstancesRetrievable != nil {
+		in, out := &in.InstancesRetrievable, &out.InstancesRetrievable
+		*out = new(bool)
+		**out = **in
+	}
+	if in.BindingsRetrievable != nil {
+		in, out := &in.BindingsRetrievable, &out.BindingsRetrievable
+		*out = new(bool)
 		**out = **in
 	}
 	if in.Plans != nil {
@@ -504,6 +889,18 @@ func (in *ServiceOffering) DeepCopyInto(out *ServiceOffering) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.DefaultPlanRollout != nil {
+		in, out := &in.DefaultPlanRollout, &out.DefaultPlanRollout
+		*out = make([]ServicePlanWeight, len(*in))
+		copy(*out, *in)
+	}
+	if in.Features != nil {
+		in, out := &in.Features, &out.Features
+		*out = make(map[string]bool, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	return
 }
 
@@ -525,6 +922,18 @@ func (in *ServicePlan) DeepCopyInto(out *ServicePlan) {
 		*out = new(runtime.RawExtension)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Free != nil {
+		in, out := &in.Free, &out.Free
+		*out = new(bool)
+		**out = **in
+	}
+	if in.CostMetadata != nil {
+		in, out := &in.CostMetadata, &out.CostMetadata
+		*out = make([]ServicePlanCost, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.Bindable != nil {
 		in, out := &in.Bindable, &out.Bindable
 		*out = new(bool)
@@ -535,6 +944,38 @@ func (in *ServicePlan) DeepCopyInto(out *ServicePlan) {
 		*out = new(Schemas)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Features != nil {
+		in, out := &in.Features, &out.Features
+		*out = make(map[string]bool, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.SynchronousTimeout != nil {
+		in, out := &in.SynchronousTimeout, &out.SynchronousTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.BindingTTL != nil {
+		in, out := &in.BindingTTL, &out.BindingTTL
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.BindingEndpoints != nil {
+		in, out := &in.BindingEndpoints, &out.BindingEndpoints
+		*out = new(ServicePlanBindingEndpoints)
+		**out = **in
+	}
+	if in.MaxBindingsPerInstance != nil {
+		in, out := &in.MaxBindingsPerInstance, &out.MaxBindingsPerInstance
+		*out = new(int)
+		**out = **in
+	}
+	if in.MaxRangeItems != nil {
+		in, out := &in.MaxRangeItems, &out.MaxRangeItems
+		*out = new(int)
+		**out = **in
+	}
 	return
 }
 
@@ -547,3 +988,58 @@ func (in *ServicePlan) DeepCopy() *ServicePlan {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServicePlanBindingEndpoints) DeepCopyInto(out *ServicePlanBindingEndpoints) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServicePlanBindingEndpoints.
+func (in *ServicePlanBindingEndpoints) DeepCopy() *ServicePlanBindingEndpoints {
+	if in == nil {
+		return nil
+	}
+	out := new(ServicePlanBindingEndpoints)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServicePlanCost) DeepCopyInto(out *ServicePlanCost) {
+	*out = *in
+	if in.Amount != nil {
+		in, out := &in.Amount, &out.Amount
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServicePlanCost.
+func (in *ServicePlanCost) DeepCopy() *ServicePlanCost {
+	if in == nil {
+		return nil
+	}
+	out := new(ServicePlanCost)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServicePlanWeight) DeepCopyInto(out *ServicePlanWeight) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServicePlanWeight.
+func (in *ServicePlanWeight) DeepCopy() *ServicePlanWeight {
+	if in == nil {
+		return nil
+	}
+	out := new(ServicePlanWeight)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,275 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/config"
+
+	"github.com/golang/glog"
+)
+
+// Action is a mutating operation that is audited.
+type Action string
+
+const (
+	// ActionCreateServiceInstance is recorded when a service instance is created.
+	ActionCreateServiceInstance Action = "create-service-instance"
+
+	// ActionUpdateServiceInstance is recorded when a service instance is updated.
+	ActionUpdateServiceInstance Action = "update-service-instance"
+
+	// ActionDeleteServiceInstance is recorded when a service instance is deleted.
+	ActionDeleteServiceInstance Action = "delete-service-instance"
+
+	// ActionUndeleteServiceInstance is recorded when a soft-deleted service instance
+	// is restored.
+	ActionUndeleteServiceInstance Action = "undelete-service-instance"
+
+	// ActionReconcileServiceInstance is recorded when a service instance's
+	// resources are reconciled on request.
+	ActionReconcileServiceInstance Action = "reconcile-service-instance"
+
+	// ActionCreateServiceBinding is recorded when a service binding is created.
+	ActionCreateServiceBinding Action = "create-service-binding"
+
+	// ActionDeleteServiceBinding is recorded when a service binding is deleted.
+	ActionDeleteServiceBinding Action = "delete-service-binding"
+)
+
+// Outcome is the result of an audited operation.
+type Outcome string
+
+const (
+	// OutcomeSucceeded is recorded when an operation completed successfully.
+	OutcomeSucceeded Outcome = "succeeded"
+
+	// OutcomeAccepted is recorded when an asynchronous operation was started.
+	OutcomeAccepted Outcome = "accepted"
+
+	// OutcomeFailed is recorded when an operation was rejected or failed.
+	OutcomeFailed Outcome = "failed"
+)
+
+// stdout is the audit log path that writes to standard output.
+const stdout = "-"
+
+// OriginatingIdentity is the platform user that initiated the request, as defined
+// by the X-Broker-API-Originating-Identity header.
+type OriginatingIdentity struct {
+	// Platform is the type of platform e.g. "kubernetes".
+	Platform string `json:"platform"`
+
+	// Value is the platform specific user identity.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Record is a single audit log record.
+type Record struct {
+	// Timestamp is when the request was received.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Principal is the user that authenticated with the service broker.
+	Principal string `json:"principal"`
+
+	// ClientIP is the address of the client, resolved through any trusted proxies.
+	ClientIP string `json:"clientIP,omitempty"`
+
+	// RequestIdentity correlates the request with platform logs, as defined by the
+	// X-Broker-API-Request-Identity header.
+	RequestIdentity string `json:"requestIdentity,omitempty"`
+
+	// OriginatingIdentity is the platform user that initiated the request, if known.
+	OriginatingIdentity *OriginatingIdentity `json:"originatingIdentity,omitempty"`
+
+	// Action is the operation that was requested.
+	Action Action `json:"action"`
+
+	// InstanceID is the service instance operated on.
+	InstanceID string `json:"instanceID"`
+
+	// BindingID is the service binding operated on, if any.
+	BindingID string `json:"bindingID,omitempty"`
+
+	// ServiceID is the service offering of the service instance, if known.
+	ServiceID string `json:"serviceID,omitempty"`
+
+	// PlanID is the service plan of the service instance, if known.
+	PlanID string `json:"planID,omitempty"`
+
+	// OperationID is the asynchronous operation started by the request, if any.
+	OperationID string `json:"operationID,omitempty"`
+
+	// Status is the HTTP status code returned to the client.  This is omitted
+	// when recording the completion of an asynchronous operation.
+	Status int `json:"status,omitempty"`
+
+	// Outcome is the result of the operation.
+	Outcome Outcome `json:"outcome"`
+}
+
+// contextKey is used to store audit records in a request context.
+type contextKey struct{}
+
+// lock serializes writes to the audit log.
+var lock sync.Mutex
+
+// NewRecord returns a new audit record for a request.
+func NewRecord(r *http.Request, principal string, action Action) *Record {
+	return &Record{
+		Timestamp:           time.Now(),
+		Principal:           principal,
+		RequestIdentity:     r.Header.Get("X-Broker-API-Request-Identity"),
+		OriginatingIdentity: originatingIdentity(r),
+		Action:              action,
+	}
+}
+
+// originatingIdentity decodes the X-Broker-API-Originating-Identity header, which is
+// the platform followed by a base64 encoded JSON object.
+func originatingIdentity(r *http.Request) *OriginatingIdentity {
+	header := r.Header.Get("X-Broker-API-Originating-Identity")
+	if header == "" {
+		return nil
+	}
+
+	fields := strings.Fields(header)
+
+	identity := &OriginatingIdentity{
+		Platform: fields[0],
+	}
+
+	if len(fields) > 1 {
+		value, err := base64.StdEncoding.DecodeString(fields[1])
+		if err == nil && json.Valid(value) {
+			identity.Value = value
+		}
+	}
+
+	return identity
+}
+
+// NewContext returns a context that carries the audit record.
+func NewContext(ctx context.Context, record *Record) context.Context {
+	return context.WithValue(ctx, contextKey{}, record)
+}
+
+// FromContext returns the audit record carried by the context, or nil.
+func FromContext(ctx context.Context) *Record {
+	record, _ := ctx.Value(contextKey{}).(*Record)
+
+	return record
+}
+
+// SetPlan records the service offering and plan once they are known.
+func SetPlan(ctx context.Context, serviceID, planID string) {
+	record := FromContext(ctx)
+	if record == nil {
+		return
+	}
+
+	record.ServiceID = serviceID
+	record.PlanID = planID
+}
+
+// SetOperation records the asynchronous operation started by the request.
+func SetOperation(ctx context.Context, operationID string) {
+	record := FromContext(ctx)
+	if record == nil {
+		return
+	}
+
+	record.OperationID = operationID
+}
+
+// Complete sets the outcome of the record from the response status code, and
+// writes the record to the audit log.
+func (r *Record) Complete(status int) {
+	r.Status = status
+
+	switch {
+	case status == http.StatusAccepted:
+		r.Outcome = OutcomeAccepted
+	case status >= http.StatusOK && status < http.StatusMultipleChoices:
+		r.Outcome = OutcomeSucceeded
+	default:
+		r.Outcome = OutcomeFailed
+	}
+
+	if err := write(r); err != nil {
+		glog.Errorf("failed to write audit record: %v", err)
+	}
+}
+
+// CompleteOperation records the outcome of the asynchronous operation that was
+// started by the audited request, and writes the record to the audit log.
+func (r *Record) CompleteOperation(status error) {
+	r.Timestamp = time.Now()
+	r.Status = 0
+	r.Outcome = OutcomeSucceeded
+
+	if status != nil {
+		r.Outcome = OutcomeFailed
+	}
+
+	if err := write(r); err != nil {
+		glog.Errorf("failed to write audit record: %v", err)
+	}
+}
+
+// write appends a record to the audit log as a line of JSON.
+func write(record *Record) error {
+	path := config.GetOptions().AuditLog
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if path == stdout {
+		_, err := os.Stdout.Write(data)
+
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,254 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/operation"
+	"github.com/couchbase/service-broker/pkg/provisioners"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
+
+	"github.com/golang/glog"
+)
+
+// abandonedCreateDeadline returns when a create operation is considered abandoned,
+// because the client has stopped polling for it.
+func abandonedCreateDeadline(entry *registry.Entry) (time.Time, error) {
+	var lastPolled time.Time
+
+	ok, err := entry.Get(registry.OperationLastPolled, &lastPolled)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !ok {
+		lastPolled = util.DefaultClock().Now()
+	}
+
+	return lastPolled.Add(config.GetOptions().AbandonedCreateTimeout), nil
+}
+
+// recordPoll records that a client has polled for an operation, so it is not reaped
+// as abandoned.  To limit registry writes this is only updated once it is half way to
+// the deadline, and failure is not fatal to polling.
+func recordPoll(entry *registry.Entry) {
+	timeout := config.GetOptions().AbandonedCreateTimeout
+	if timeout == 0 {
+		return
+	}
+
+	var lastPolled time.Time
+
+	if _, err := entry.Get(registry.OperationLastPolled, &lastPolled); err != nil {
+		glog.Infof("failed to read operation last polled time: %v", err)
+		return
+	}
+
+	now := util.DefaultClock().Now()
+
+	if now.Sub(lastPolled) < timeout/2 {
+		return
+	}
+
+	if err := entry.Set(registry.OperationLastPolled, now); err != nil {
+		glog.Infof("failed to record operation last polled time: %v", err)
+		return
+	}
+
+	if err := entry.Commit(); err != nil {
+		glog.Infof("failed to record operation last polled time: %v", err)
+	}
+}
+
+// scheduleAbandonedCreateReap schedules a create operation to be reaped if it is
+// abandoned.
+func scheduleAbandonedCreateReap(configuration *ServerConfiguration, instanceID string, entry *registry.Entry) {
+	operationID, _, err := entry.GetString(registry.OperationID)
+	if err != nil {
+		glog.Infof("failed to read service instance %s operation ID: %v", instanceID, err)
+		return
+	}
+
+	deadline, err := abandonedCreateDeadline(entry)
+	if err != nil {
+		glog.Infof("failed to read service instance %s operation deadline: %v", instanceID, err)
+		return
+	}
+
+	go reapAbandonedCreateAfter(configuration, instanceID, operationID, deadline)
+}
+
+// reapAbandonedCreateAfter waits until a create operation's deadline, then reaps it
+// if it has been abandoned.  Polling pushes the deadline back.
+func reapAbandonedCreateAfter(configuration *ServerConfiguration, instanceID, operationID string, deadline time.Time) {
+	for {
+		util.Sleep(deadline.Sub(util.DefaultClock().Now()))
+
+		next, err := reapAbandonedCreate(configuration, instanceID, operationID)
+		if err != nil {
+			glog.Infof("failed to reap abandoned create of service instance %s: %v", instanceID, err)
+
+			next = util.DefaultClock().Now().Add(config.GetOptions().AbandonedCreateTimeout)
+		}
+
+		if next.IsZero() {
+			return
+		}
+
+		deadline = next
+	}
+}
+
+// reapAbandonedCreate completes a create operation that has not been polled before its
+// deadline if it has succeeded, otherwise it is cancelled and the service instance is
+// deleted.  If the operation has ended, it is ignored, and if it has been polled, the new
+// deadline is returned.
+func reapAbandonedCreate(configuration *ServerConfiguration, instanceID, operationID string) (time.Time, error) {
+	instanceLock, err := lockServiceInstance(configuration, instanceID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	defer instanceLock.Release()
+
+	dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+	entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	id, ok, err := entry.GetString(registry.OperationID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !ok || id != operationID {
+		return time.Time{}, nil
+	}
+
+	deadline, err := abandonedCreateDeadline(entry)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if util.DefaultClock().Now().Before(deadline) {
+		return deadline, nil
+	}
+
+	cancelled, err := operation.Cancel(entry)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if cancelled {
+		if entry, err = registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	status, ok, err := entry.GetString(registry.OperationStatus)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if ok && status == "" {
+		serviceID, _, err := entry.GetString(registry.ServiceID)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		planID, _, err := entry.GetString(registry.PlanID)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if err := provisioners.Ready(provisioners.ResourceTypeServiceInstance, entry, serviceID, planID); err == nil {
+			if err := operation.End(entry); err != nil {
+				return time.Time{}, err
+			}
+
+			glog.Infof("completed abandoned create of service instance %s", instanceID)
+
+			return time.Time{}, nil
+		}
+	}
+
+	if err := operation.End(entry); err != nil {
+		return time.Time{}, err
+	}
+
+	if err := operation.Start(entry, operation.TypeDeprovision, ""); err != nil {
+		return time.Time{}, err
+	}
+
+	runOperation(entry, provisioners.NewDeleter().Run)
+
+	// The deleter removes the registry entry on success.  If it still exists then
+	// deletion failed, so end the operation, leaving the service instance for the
+	// client to delete, and keep its directory entry so it can be found.
+	remaining, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if remaining.Exists() {
+		if err := operation.End(remaining); err != nil {
+			return time.Time{}, err
+		}
+
+		return time.Time{}, fmt.Errorf("%w: failed to delete abandoned create of service instance %s", ErrUnexpected, instanceID)
+	}
+
+	deleteDirectoryInstance(configuration.Namespace, instanceID)
+
+	glog.Infof("deleted abandoned create of service instance %s", instanceID)
+
+	return time.Time{}, nil
+}
+
+// resumeAbandonedCreates schedules reaping of create operations that were started
+// before the broker was restarted.
+func resumeAbandonedCreates(configuration *ServerConfiguration) {
+	directory, err := registry.NewDirectory(configuration.Namespace)
+	if err != nil {
+		glog.Infof("failed to read directory for abandoned creates: %v", err)
+		return
+	}
+
+	for _, instanceID := range directory.InstanceIDs() {
+		dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+		entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, true)
+		if err != nil {
+			glog.Infof("failed to read service instance %s: %v", instanceID, err)
+			continue
+		}
+
+		op, ok, err := entry.GetString(registry.Operation)
+		if err != nil {
+			glog.Infof("failed to read service instance %s operation: %v", instanceID, err)
+			continue
+		}
+
+		if ok && operation.Type(op) == operation.TypeProvision {
+			scheduleAbandonedCreateReap(configuration, instanceID, entry)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/service-broker/pkg/errors"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/julienschmidt/httprouter"
+)
+
+// AuthorizationAction is an action a principal may be authorized to perform.
+type AuthorizationAction string
+
+const (
+	// AuthorizationActionRead is requested when reading a resource.
+	AuthorizationActionRead AuthorizationAction = "read"
+
+	// AuthorizationActionCreate is requested when creating a resource.
+	AuthorizationActionCreate AuthorizationAction = "create"
+
+	// AuthorizationActionUpdate is requested when updating a resource.
+	AuthorizationActionUpdate AuthorizationAction = "update"
+
+	// AuthorizationActionDelete is requested when deleting a resource.
+	AuthorizationActionDelete AuthorizationAction = "delete"
+)
+
+// AuthorizationResource is a type of resource that is authorized.
+type AuthorizationResource string
+
+const (
+	// AuthorizationResourceCatalog is the service catalog.
+	AuthorizationResourceCatalog AuthorizationResource = "catalog"
+
+	// AuthorizationResourceServiceInstance is a service instance, its last operation
+	// and manifests.
+	AuthorizationResourceServiceInstance AuthorizationResource = "service_instance"
+
+	// AuthorizationResourceServiceBinding is a service binding.
+	AuthorizationResourceServiceBinding AuthorizationResource = "service_binding"
+
+	// AuthorizationResourceRegistry is the registry backup.  This is privileged.
+	AuthorizationResourceRegistry AuthorizationResource = "registry"
+
+	// AuthorizationResourceVersion is the service broker version.
+	AuthorizationResourceVersion AuthorizationResource = "version"
+)
+
+// authorizationWildcard matches any principal, action or resource in a policy rule.
+const authorizationWildcard = "*"
+
+// privileged returns whether access to a resource must be granted explicitly.  Privileged
+// resources expose, or can overwrite, every credential the broker holds, so are not matched
+// by wildcard policy rules, and are forbidden when there is no authorizer.
+func (r AuthorizationResource) privileged() bool {
+	return r == AuthorizationResourceRegistry
+}
+
+// AuthorizationRequest describes a request to be authorized.
+type AuthorizationRequest struct {
+	// Principal is the user that authenticated with the service broker.
+	Principal string
+
+	// Action is what the principal is trying to do.
+	Action AuthorizationAction
+
+	// Resource is what the principal is trying to do it to.
+	Resource AuthorizationResource
+
+	// InstanceID is the service instance being accessed, if any.
+	InstanceID string
+
+	// BindingID is the service binding being accessed, if any.
+	BindingID string
+}
+
+// Authorizer decides whether an authenticated principal may perform a request.  This
+// may be implemented by external policy engines.  An error is returned if a decision
+// cannot be made.
+type Authorizer interface {
+	Authorize(request *AuthorizationRequest) (bool, error)
+}
+
+// AuthorizationRule allows or denies principals from performing actions on resources.
+type AuthorizationRule struct {
+	// Principals the rule applies to, "*" matches any principal.
+	Principals []string `json:"principals"`
+
+	// Actions the rule applies to, "*" matches any action.
+	Actions []string `json:"actions"`
+
+	// Resources the rule applies to, "*" matches any resource.
+	Resources []string `json:"resources"`
+
+	// Allow permits matching requests when true, and forbids them otherwise.
+	Allow bool `json:"allow"`
+}
+
+// AuthorizationPolicy is a built in authorizer.  Rules are evaluated in order and the
+// first matching rule decides the outcome, if no rules match the request is denied.
+type AuthorizationPolicy struct {
+	// Rules are the authorization rules.
+	Rules []AuthorizationRule `json:"rules"`
+}
+
+// LoadAuthorizationPolicy reads an authorization policy from a YAML or JSON file.
+func LoadAuthorizationPolicy(path string) (*AuthorizationPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &AuthorizationPolicy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// matches returns whether a value is matched by a list of rule values.
+func matches(values []string, value string) bool {
+	for _, v := range values {
+		if v == authorizationWildcard || v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesResource returns whether a resource is matched by a list of rule resources.
+// Privileged resources must be named explicitly.
+func matchesResource(resources []string, resource AuthorizationResource) bool {
+	if !resource.privileged() {
+		return matches(resources, string(resource))
+	}
+
+	for _, r := range resources {
+		if r == string(resource) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authorize evaluates the policy rules against the request.
+func (p *AuthorizationPolicy) Authorize(request *AuthorizationRequest) (bool, error) {
+	for _, rule := range p.Rules {
+		if matches(rule.Principals, request.Principal) && matches(rule.Actions, string(request.Action)) && matchesResource(rule.Resources, request.Resource) {
+			return rule.Allow, nil
+		}
+	}
+
+	return false, nil
+}
+
+// principalKey is used to store the authenticated principal in a request context.
+type principalKey struct{}
+
+// withPrincipal returns a request whose context carries the authenticated principal.
+func withPrincipal(r *http.Request, principal string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+// principal returns the user that authenticated with the service broker.
+func principal(r *http.Request) string {
+	principal, _ := r.Context().Value(principalKey{}).(string)
+
+	return principal
+}
+
+// authorized wraps a handler, only allowing it to run if the configured authorizer
+// permits the principal to perform the action on the resource.  Without an authorizer
+// all authenticated principals are allowed, except to privileged resources.
+func authorized(configuration *ServerConfiguration, action AuthorizationAction, resource AuthorizationResource, handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if configuration.Authorizer == nil && resource.privileged() {
+			glog.Infof("principal %s forbidden to %s %s without an authorization policy", principal(r), action, resource)
+			jsonError(w, errors.NewForbiddenError("%s requires an authorization policy", resource))
+
+			return
+		}
+
+		if configuration.Authorizer != nil {
+			request := &AuthorizationRequest{
+				Principal:  principal(r),
+				Action:     action,
+				Resource:   resource,
+				InstanceID: params.ByName("instance_id"),
+				BindingID:  params.ByName("binding_id"),
+			}
+
+			allowed, err := configuration.Authorizer.Authorize(request)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			if !allowed {
+				glog.Infof("principal %s forbidden to %s %s", request.Principal, action, resource)
+				jsonError(w, errors.NewForbiddenError("principal %s is not authorized to %s %s", request.Principal, action, resource))
+
+				return
+			}
+		}
+
+		handler(w, r, params)
+	}
+}
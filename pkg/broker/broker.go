@@ -16,25 +16,36 @@ package broker
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/couchbase/service-broker/pkg/accesslog"
 	"github.com/couchbase/service-broker/pkg/apis"
+	"github.com/couchbase/service-broker/pkg/audit"
 	"github.com/couchbase/service-broker/pkg/client"
 	"github.com/couchbase/service-broker/pkg/config"
 	"github.com/couchbase/service-broker/pkg/log"
+	"github.com/couchbase/service-broker/pkg/operation"
+	"github.com/couchbase/service-broker/pkg/util"
 
 	"github.com/golang/glog"
+	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
+// requestIdentityHeader is used by platforms to correlate their logs with ours.
+const requestIdentityHeader = "X-Broker-API-Request-Identity"
+
 // ErrInternalError is returned when something really bad happened.
 var ErrInternalError = errors.New("internal error")
 
@@ -47,6 +58,9 @@ var ErrRequestUnsupported = errors.New("request unsupported")
 // ErrServiceUnready is raised when the service is not ready to run.
 var ErrServiceUnready = errors.New("service not ready")
 
+// ErrCertificateExpiring is raised when the TLS certificate has expired, or is about to.
+var ErrCertificateExpiring = errors.New("TLS certificate expiring")
+
 // ErrUnauthorized is raised when a user is not permitted to perform the request.
 var ErrUnauthorized = errors.New("request is unauthorized")
 
@@ -77,6 +91,26 @@ func getHeaderSingle(r *http.Request, name string) (string, error) {
 	return headers[0], nil
 }
 
+// requestIdentity returns the X-Broker-API-Request-Identity header.
+func requestIdentity(r *http.Request) string {
+	return r.Header.Get(requestIdentityHeader)
+}
+
+// handleRequestIdentity looks for the X-Broker-API-Request-Identity header, generating
+// one if the platform did not supply it, and echoes it back in the response.
+func handleRequestIdentity(w http.ResponseWriter, r *http.Request) string {
+	identity := requestIdentity(r)
+	if identity == "" {
+		identity = uuid.New().String()
+
+		r.Header.Set(requestIdentityHeader, identity)
+	}
+
+	w.Header().Set(requestIdentityHeader, identity)
+
+	return identity
+}
+
 // handleReadiness returns 503 until the configuration is correct.
 func handleReadiness(w http.ResponseWriter) error {
 	if config.Config() == nil {
@@ -87,36 +121,83 @@ func handleReadiness(w http.ResponseWriter) error {
 	return nil
 }
 
-// handleBrokerBearerToken implements RFC-6750.
-func handleBrokerBearerToken(c *ServerConfiguration, w http.ResponseWriter, r *http.Request) error {
-	header, err := getHeaderSingle(r, "Authorization")
+// checkCertificateExpiry returns an error if the TLS certificate has expired, or will
+// expire within the configured window.
+func checkCertificateExpiry(c *ServerConfiguration) error {
+	if c.InsecureHTTP {
+		return nil
+	}
+
+	certificate, err := currentCertificate(c)
 	if err != nil {
-		httpResponse(w, http.StatusUnauthorized)
 		return err
 	}
 
-	if header != "Bearer "+*c.Token {
-		httpResponse(w, http.StatusUnauthorized)
-		return fmt.Errorf("%w: authorization failed", ErrUnauthorized)
+	if len(certificate.Certificate) == 0 {
+		return nil
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	if util.DefaultClock().Now().Add(c.CertificateExpiryWindow).After(leaf.NotAfter) {
+		return fmt.Errorf("%w: certificate expires at %v", ErrCertificateExpiring, leaf.NotAfter)
 	}
 
 	return nil
 }
 
-// handleBrokerBasicAuth implements RFC-7617.
-func handleBrokerBasicAuth(c *ServerConfiguration, w http.ResponseWriter, r *http.Request) error {
+// handleBrokerBearerToken implements RFC-6750, returning the authenticated principal.
+func handleBrokerBearerToken(c *ServerConfiguration, w http.ResponseWriter, r *http.Request) (string, error) {
 	header, err := getHeaderSingle(r, "Authorization")
 	if err != nil {
 		httpResponse(w, http.StatusUnauthorized)
-		return err
+		return "", err
+	}
+
+	if c.Token != nil && header == "Bearer "+*c.Token {
+		return c.TokenPrincipal, nil
+	}
+
+	for principal, token := range c.Tokens {
+		if header == "Bearer "+token {
+			return principal, nil
+		}
+	}
+
+	httpResponse(w, http.StatusUnauthorized)
+
+	return "", fmt.Errorf("%w: authorization failed", ErrUnauthorized)
+}
+
+// handleBrokerBasicAuth implements RFC-7617, returning the authenticated principal.
+func handleBrokerBasicAuth(c *ServerConfiguration, w http.ResponseWriter, r *http.Request) (string, error) {
+	header, err := getHeaderSingle(r, "Authorization")
+	if err != nil {
+		httpResponse(w, http.StatusUnauthorized)
+		return "", err
 	}
 
 	if header != "Basic "+base64.StdEncoding.EncodeToString([]byte(c.BasicAuth.Username+":"+c.BasicAuth.Password)) {
 		httpResponse(w, http.StatusUnauthorized)
-		return fmt.Errorf("%w: authorization failed", ErrUnauthorized)
+		return "", fmt.Errorf("%w: authorization failed", ErrUnauthorized)
 	}
 
-	return nil
+	return c.BasicAuth.Username, nil
+}
+
+// handleBrokerClientCertificate implements mutual TLS authentication, returning the
+// authenticated principal.  The certificate itself is verified during the handshake.
+func handleBrokerClientCertificate(w http.ResponseWriter, r *http.Request) (string, error) {
+	certificate := clientCertificate(r)
+	if certificate == nil {
+		httpResponse(w, http.StatusUnauthorized)
+		return "", fmt.Errorf("%w: client certificate required", ErrUnauthorized)
+	}
+
+	return certificate.Subject.CommonName, nil
 }
 
 // handleBrokerAPIHeader looks for and verifies the X-Broker-API-Version header.
@@ -163,31 +244,40 @@ func handleContentTypeHeader(w http.ResponseWriter, r *http.Request) error {
 }
 
 // handleRequestHeaders checks that required headers are sent and are
-// valid, and that content encodings are correct.
-func handleRequestHeaders(c *ServerConfiguration, w http.ResponseWriter, r *http.Request) error {
+// valid, and that content encodings are correct.  It returns the authenticated
+// principal.
+func handleRequestHeaders(c *ServerConfiguration, w http.ResponseWriter, r *http.Request) (string, error) {
+	var principal string
+
+	var err error
+
 	switch {
-	case c.Token != nil:
-		if err := handleBrokerBearerToken(c, w, r); err != nil {
-			return err
+	case c.Token != nil || len(c.Tokens) != 0:
+		if principal, err = handleBrokerBearerToken(c, w, r); err != nil {
+			return "", err
 		}
 	case c.BasicAuth != nil:
-		if err := handleBrokerBasicAuth(c, w, r); err != nil {
-			return err
+		if principal, err = handleBrokerBasicAuth(c, w, r); err != nil {
+			return "", err
+		}
+	case c.ClientCAs != nil:
+		if principal, err = handleBrokerClientCertificate(w, r); err != nil {
+			return "", err
 		}
 	default:
 		httpResponse(w, http.StatusInternalServerError)
-		return ErrInternalError
+		return "", ErrInternalError
 	}
 
 	if err := handleBrokerAPIHeader(w, r); err != nil {
-		return err
+		return "", err
 	}
 
 	if err := handleContentTypeHeader(w, r); err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return principal, nil
 }
 
 // OpenServiceBrokerHandler wraps up a standard router but performs Open Service Broker
@@ -198,19 +288,77 @@ type openServiceBrokerHandler struct {
 	configuration *ServerConfiguration
 }
 
-// NewOpenServiceBrokerHandler initializes the main router with the Open Service Broker API.
-func NewOpenServiceBrokerHandler(configuration *ServerConfiguration) http.Handler {
+// Route is a method and path served by the Open Service Broker handler.
+type Route struct {
+	// Method is the HTTP method.
+	Method string
+
+	// Path is the path, with parameters in httprouter format.
+	Path string
+}
+
+// routeRecorder registers routes with a router, and keeps a record of them so
+// they can be checked against the OpenAPI document.
+type routeRecorder struct {
+	router *httprouter.Router
+	routes []Route
+}
+
+// handle registers a route.
+func (r *routeRecorder) handle(method, path string, handle httprouter.Handle) {
+	r.router.Handle(method, path, handle)
+	r.routes = append(r.routes, Route{Method: method, Path: path})
+}
+
+// newRouter creates a router with the Open Service Broker API, and returns the
+// routes that were registered with it.
+func newRouter(configuration *ServerConfiguration) (*httprouter.Router, []Route) {
 	router := httprouter.New()
+	router.NotFound = handleNotFound()
+	router.MethodNotAllowed = handleMethodNotAllowed()
+
+	routes := &routeRecorder{
+		router: router,
+	}
 
-	router.GET("/readyz", handleReadyz)
-	router.GET("/v2/catalog", handleReadCatalog)
-	router.PUT("/v2/service_instances/:instance_id", handleCreateServiceInstance(configuration))
-	router.GET("/v2/service_instances/:instance_id", handleReadServiceInstance(configuration))
-	router.PATCH("/v2/service_instances/:instance_id", handleUpdateServiceInstance(configuration))
-	router.DELETE("/v2/service_instances/:instance_id", handleDeleteServiceInstance(configuration))
-	router.GET("/v2/service_instances/:instance_id/last_operation", handlePollServiceInstance(configuration))
-	router.PUT("/v2/service_instances/:instance_id/service_bindings/:binding_id", handleCreateServiceBinding(configuration))
-	router.DELETE("/v2/service_instances/:instance_id/service_bindings/:binding_id", handleDeleteServiceBinding(configuration))
+	routes.handle(http.MethodGet, "/readyz", handleReadyz(configuration))
+	routes.handle(http.MethodGet, openAPIPath, handleOpenAPI(configuration))
+	routes.handle(http.MethodGet, "/v2/catalog", authorized(configuration, AuthorizationActionRead, AuthorizationResourceCatalog, handleReadCatalog(configuration)))
+	routes.handle(http.MethodPut, "/v2/service_instances/:instance_id", audited(audit.ActionCreateServiceInstance, authorized(configuration, AuthorizationActionCreate, AuthorizationResourceServiceInstance, validated(handleCreateServiceInstance(configuration)))))
+	routes.handle(http.MethodGet, "/v2/service_instances/:instance_id", authorized(configuration, AuthorizationActionRead, AuthorizationResourceServiceInstance, validated(handleReadServiceInstance(configuration))))
+	routes.handle(http.MethodPatch, "/v2/service_instances/:instance_id", audited(audit.ActionUpdateServiceInstance, authorized(configuration, AuthorizationActionUpdate, AuthorizationResourceServiceInstance, validated(handleUpdateServiceInstance(configuration)))))
+	routes.handle(http.MethodDelete, "/v2/service_instances/:instance_id", audited(audit.ActionDeleteServiceInstance, authorized(configuration, AuthorizationActionDelete, AuthorizationResourceServiceInstance, validated(handleDeleteServiceInstance(configuration)))))
+	routes.handle(http.MethodGet, "/v2/service_instances/:instance_id/last_operation", authorized(configuration, AuthorizationActionRead, AuthorizationResourceServiceInstance, validated(handlePollServiceInstance(configuration))))
+	routes.handle(http.MethodGet, "/v2/service_instances/:instance_id/manifests", authorized(configuration, AuthorizationActionRead, AuthorizationResourceServiceInstance, validated(handleReadServiceInstanceManifests(configuration))))
+	routes.handle(http.MethodPost, "/v2/service_instances/:instance_id/reconcile", audited(audit.ActionReconcileServiceInstance, authorized(configuration, AuthorizationActionUpdate, AuthorizationResourceServiceInstance, validated(handleReconcileServiceInstance(configuration)))))
+	routes.handle(http.MethodPost, "/v2/service_instances/:instance_id/undelete", audited(audit.ActionUndeleteServiceInstance, authorized(configuration, AuthorizationActionUpdate, AuthorizationResourceServiceInstance, validated(handleUndeleteServiceInstance(configuration)))))
+	routes.handle(http.MethodPut, "/v2/service_instances/:instance_id/service_bindings/:binding_id", audited(audit.ActionCreateServiceBinding, authorized(configuration, AuthorizationActionCreate, AuthorizationResourceServiceBinding, validated(handleCreateServiceBinding(configuration)))))
+	routes.handle(http.MethodGet, "/v2/service_instances/:instance_id/service_bindings/:binding_id", authorized(configuration, AuthorizationActionRead, AuthorizationResourceServiceBinding, validated(handleReadServiceBinding(configuration))))
+	routes.handle(http.MethodDelete, "/v2/service_instances/:instance_id/service_bindings/:binding_id", audited(audit.ActionDeleteServiceBinding, authorized(configuration, AuthorizationActionDelete, AuthorizationResourceServiceBinding, validated(handleDeleteServiceBinding(configuration)))))
+
+	if configuration.RegistryBackup {
+		routes.handle(http.MethodGet, "/v2/registry", authorized(configuration, AuthorizationActionRead, AuthorizationResourceRegistry, handleExportRegistry(configuration)))
+		routes.handle(http.MethodPut, "/v2/registry", authorized(configuration, AuthorizationActionUpdate, AuthorizationResourceRegistry, handleImportRegistry(configuration)))
+	}
+
+	if configuration.Version {
+		routes.handle(http.MethodGet, "/version", authorized(configuration, AuthorizationActionRead, AuthorizationResourceVersion, handleReadVersion(configuration)))
+	}
+
+	return router, routes.routes
+}
+
+// Routes returns the routes served by the Open Service Broker handler for a
+// configuration.
+func Routes(configuration *ServerConfiguration) []Route {
+	_, routes := newRouter(configuration)
+
+	return routes
+}
+
+// NewOpenServiceBrokerHandler initializes the main router with the Open Service Broker API.
+func NewOpenServiceBrokerHandler(configuration *ServerConfiguration) http.Handler {
+	router, _ := newRouter(configuration)
 
 	return &openServiceBrokerHandler{
 		Handler:       router,
@@ -218,6 +366,41 @@ func NewOpenServiceBrokerHandler(configuration *ServerConfiguration) http.Handle
 	}
 }
 
+// validated wraps a handler that accepts service instance or binding IDs, rejecting
+// those that cannot be used to name registry entries and resources.
+func validated(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		for _, name := range []string{"instance_id", "binding_id"} {
+			if err := validateID(name, params.ByName(name)); err != nil {
+				jsonError(w, err)
+				return
+			}
+		}
+
+		handler(w, r, params)
+	}
+}
+
+// audited wraps a handler that mutates service instances or bindings, writing an
+// audit record of the request and its outcome once it has been handled.
+func audited(action audit.Action, handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		record := audit.NewRecord(r, principal(r), action)
+		record.InstanceID = params.ByName("instance_id")
+		record.BindingID = params.ByName("binding_id")
+		record.ClientIP = clientIP(r)
+
+		writer := &responseWriter{
+			writer: w,
+			status: http.StatusOK,
+		}
+
+		handler(writer, r.WithContext(audit.NewContext(r.Context(), record)), params)
+
+		record.Complete(writer.status)
+	}
+}
+
 // responseWriter wraps the standard response writer so we can extract the response data.
 type responseWriter struct {
 	writer http.ResponseWriter
@@ -251,14 +434,51 @@ func (handler *openServiceBrokerHandler) ServeHTTP(w http.ResponseWriter, r *htt
 	config.Lock()
 	defer config.Unlock()
 
+	// Compress large responses for clients that accept it.  Readiness checks are
+	// tiny and polled frequently, so are never compressed.
+	if threshold := handler.configuration.ResponseCompressionThreshold; threshold > 0 && r.URL.Path != "/readyz" && acceptsGzip(r) {
+		compressor := &compressingResponseWriter{
+			writer:    w,
+			threshold: threshold,
+		}
+
+		defer compressor.flush()
+
+		w = compressor
+	}
+
 	// Use the wrapped writer so we can capture the status code etc.
 	writer := &responseWriter{
 		writer: w,
 	}
 
+	// Tag the request so it can be traced between the platform and broker.
+	identity := handleRequestIdentity(writer, r)
+
+	// Resolve the real client address when behind a trusted proxy.
+	ip := resolveClientIP(handler.configuration.TrustedProxies, r)
+
+	r = withClientIP(r, ip)
+
+	// Only a sample of requests are logged at info level, as polling in particular
+	// is very frequent.  The rest are logged at debug level.
+	route := accesslog.RouteOf(r)
+
+	logf := glog.V(log.LevelDebug).Infof
+
+	if accesslog.Sampled(route) {
+		logf = glog.Infof
+
+		record := accesslog.NewRecord(r, route, ip, identity)
+
+		defer func() {
+			record.Complete(writer.status)
+		}()
+	}
+
 	// Print out request logging information.
 	// DO NOT print out headers at info level as that will leak credentials into the log stream.
-	glog.Infof(`HTTP req: "%s %v %s" %s `, r.Method, r.URL, r.Proto, r.RemoteAddr)
+	logf(`HTTP req: "%s %v %s" %s %s`, r.Method, r.URL, r.Proto, ip, identity)
 
 	for name, values := range r.Header {
 		for _, value := range values {
@@ -267,7 +487,7 @@ func (handler *openServiceBrokerHandler) ServeHTTP(w http.ResponseWriter, r *htt
 	}
 
 	defer func() {
-		glog.Infof(`HTTP rsp: "%d %s" %v`, writer.status, http.StatusText(writer.status), time.Since(start))
+		logf(`HTTP rsp: "%d %s" %v %s`, writer.status, http.StatusText(writer.status), time.Since(start), identity)
 	}()
 
 	// Indicate that the service is not ready until configured.
@@ -276,13 +496,16 @@ func (handler *openServiceBrokerHandler) ServeHTTP(w http.ResponseWriter, r *htt
 		return
 	}
 
-	// Ignore security checks for the readiness handler
-	if r.URL.Path != "/readyz" {
+	// Ignore security checks for the readiness handler and API description.
+	if r.URL.Path != "/readyz" && r.URL.Path != openAPIPath {
 		// Process headers, API versions, content types.
-		if err := handleRequestHeaders(handler.configuration, writer, r); err != nil {
+		principal, err := handleRequestHeaders(handler.configuration, writer, r)
+		if err != nil {
 			glog.V(log.LevelDebug).Info(err)
 			return
 		}
+
+		r = withPrincipal(r, principal)
 	}
 
 	// Route and process the request.
@@ -307,11 +530,100 @@ type ServerConfiguration struct {
 	// Token is set when using bearer token authentication.
 	Token *string
 
+	// TokenPrincipal is the principal authenticated by Token.
+	TokenPrincipal string
+
+	// Tokens are additional bearer tokens, keyed by the principal they authenticate,
+	// allowing different principals to be authorized to do different things.
+	Tokens map[string]string
+
 	// BasicAuth is set when using basic authentication.
 	BasicAuth *ServerConfigurationBasicAuth
 
+	// ClientCAs is set when using mutual TLS authentication.  Clients must present
+	// a certificate signed by one of these CAs, and are identified by its common name.
+	ClientCAs *x509.CertPool
+
 	// Certificate is the TLS key/certificate to serve with.
 	Certificate tls.Certificate
+
+	// CertificatePath and PrivateKeyPath, if set, are the PEM encoded files the
+	// TLS key/certificate are loaded from in preference to Certificate.  They are
+	// reloaded when changed, so rotated certificates take effect without a restart.
+	CertificatePath string
+	PrivateKeyPath  string
+
+	// certificates serves certificates loaded from disk.
+	certificates *certificateReloader
+
+	// CertificateExpiryWindow is how long before the certificate expires that the
+	// readiness check will report not ready.
+	CertificateExpiryWindow time.Duration
+
+	// InsecureHTTP serves plain HTTP rather than HTTPS, the certificate is ignored.
+	// This must only be used behind a trusted proxy that terminates TLS.
+	InsecureHTTP bool
+
+	// Address is the address to listen on.
+	// If not set, this defaults to DefaultAddress.
+	Address string
+
+	// RegistryBackup enables endpoints to export and import the registry.
+	// As these expose all registry data, they are disabled by default.
+	RegistryBackup bool
+
+	// Version enables an endpoint that reports the service broker version and
+	// build information.
+	Version bool
+
+	// MaxRequestBodySize is the maximum size of a request body in bytes.
+	// If not set, this defaults to DefaultMaxRequestBodySize.
+	MaxRequestBodySize int64
+
+	// ResponseCompressionThreshold, if set, is the size in bytes at or above which
+	// response bodies are gzip compressed, when the client accepts it.
+	ResponseCompressionThreshold int
+
+	// ReconcileInterval, if set, is how often service instances are reconciled,
+	// recreating any of their resources that have been deleted.
+	ReconcileInterval time.Duration
+
+	// AsyncOptional are the operations that are accepted when the client does not
+	// set accepts_incomplete, for platforms that do not support asynchronous
+	// operations.  These are run to completion before responding.
+	AsyncOptional map[operation.Type]bool
+
+	// TrustedProxies are the networks whose Forwarded and X-Forwarded-For headers
+	// are honored when resolving the client IP address.
+	TrustedProxies []*net.IPNet
+
+	// Authorizer, if set, decides whether an authenticated principal may perform
+	// a request.  If not set, all authenticated principals may do anything.
+	Authorizer Authorizer
+
+	// CatalogOverlay, if set, patches the service catalog before it is served.
+	CatalogOverlay *CatalogOverlay
+
+	// RegistrySelfTestInterval, if set, is how often the registry is checked to
+	// be usable by writing, reading and deleting a canary entry.  The readiness
+	// check reports not ready while this is failing.
+	RegistrySelfTestInterval time.Duration
+
+	// registrySelfTestError is the result of the last registry self test.
+	registrySelfTestError error
+
+	// Registration, if set, registers the Service Broker with the Kubernetes
+	// Service Catalog when the server is configured.
+	Registration *Registration
+
+	// PlanRolloutSource, if set, is the source of randomness used to select service
+	// plans for default plan rollouts, for example a seeded source that makes selection
+	// deterministic.  If not set, a source seeded with the current time is used.
+	PlanRolloutSource rand.Source
+
+	// Options are the service broker options installed when the server is configured.
+	// If not set, the defaults are used.
+	Options *config.Options
 }
 
 // ConfigureServer is the main entry point for both the container and test.
@@ -322,24 +634,82 @@ func ConfigureServer(clients client.Clients, configuration *ServerConfiguration)
 	}
 
 	// Setup globals.
+	options := configuration.Options
+	if options == nil {
+		options = config.NewOptions()
+	}
+
+	config.SetOptions(options)
+
 	if err := config.Configure(clients, configuration.Namespace); err != nil {
 		return err
 	}
 
+	if configuration.Registration != nil {
+		if err := Register(clients, configuration); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// RunServer listens on the configured address and serves the Service Broker API.
 func RunServer(configuration *ServerConfiguration) error {
+	address := configuration.Address
+	if address == "" {
+		address = DefaultAddress
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return Serve(configuration, listener)
+}
+
+// Serve serves the Service Broker API on an existing listener until it is closed.
+// The configured address is ignored.
+func Serve(configuration *ServerConfiguration, listener net.Listener) error {
+	// Background tasks that run for the lifetime of the server are stopped
+	// when it shuts down.
+	stop := make(chan struct{})
+	defer close(stop)
+
+	if configuration.ReconcileInterval > 0 {
+		go reconcileServiceInstances(configuration, stop)
+	}
+
+	if configuration.RegistrySelfTestInterval > 0 {
+		go selfTestRegistry(configuration, stop)
+	}
+
+	if config.GetOptions().OperationRetention > 0 {
+		go pruneOperationResults(configuration, stop)
+	}
+
+	go resumeSoftDeletes(configuration)
+
+	if config.GetOptions().AbandonedCreateTimeout > 0 {
+		go resumeAbandonedCreates(configuration)
+	}
+
 	// Start the server.
 	server := &http.Server{
-		Addr:    ":8443",
 		Handler: NewOpenServiceBrokerHandler(configuration),
-		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{
-				configuration.Certificate,
-			},
-		},
 	}
 
-	return server.ListenAndServeTLS("", "")
+	if configuration.InsecureHTTP {
+		return server.Serve(listener)
+	}
+
+	tlsConfig, err := NewTLSConfig(configuration)
+	if err != nil {
+		return err
+	}
+
+	server.TLSConfig = tlsConfig
+
+	return server.ServeTLS(listener, "", "")
 }
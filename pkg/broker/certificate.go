@@ -0,0 +1,198 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// fileVersion identifies a version of a file.
+type fileVersion struct {
+	modified time.Time
+	size     int64
+}
+
+// certificateReloader serves a TLS certificate loaded from disk, reloading it when
+// the files change, so rotated certificates take effect without a restart.
+type certificateReloader struct {
+	// certificatePath is the PEM encoded certificate chain file.
+	certificatePath string
+
+	// privateKeyPath is the PEM encoded private key file.
+	privateKeyPath string
+
+	// lock protects the fields below.
+	lock sync.Mutex
+
+	// certificate is the most recently loaded certificate.
+	certificate *tls.Certificate
+
+	// versions are the versions of the files the certificate was loaded from.
+	versions [2]fileVersion
+}
+
+// newCertificateReloader creates a certificate reloader, and does the initial load
+// so any errors are raised immediately.
+func newCertificateReloader(certificatePath, privateKeyPath string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certificatePath: certificatePath,
+		privateKeyPath:  privateKeyPath,
+	}
+
+	if _, err := r.get(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// fileVersions returns the current versions of the certificate files.
+func (r *certificateReloader) fileVersions() ([2]fileVersion, error) {
+	var versions [2]fileVersion
+
+	for i, path := range []string{r.certificatePath, r.privateKeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return versions, err
+		}
+
+		versions[i] = fileVersion{
+			modified: info.ModTime(),
+			size:     info.Size(),
+		}
+	}
+
+	return versions, nil
+}
+
+// get returns the current certificate, reloading it if the files have changed.
+// Once loaded, errors are logged and the old certificate is retained, as the files
+// may be only partially updated, and will be retried on the next call.
+func (r *certificateReloader) get() (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	versions, err := r.fileVersions()
+	if err != nil {
+		if r.certificate == nil {
+			return nil, err
+		}
+
+		glog.Warningf("failed to check TLS certificate for changes: %v", err)
+
+		return r.certificate, nil
+	}
+
+	if r.certificate != nil && versions == r.versions {
+		return r.certificate, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certificatePath, r.privateKeyPath)
+	if err != nil {
+		if r.certificate == nil {
+			return nil, err
+		}
+
+		glog.Warningf("failed to reload TLS certificate: %v", err)
+
+		return r.certificate, nil
+	}
+
+	if r.certificate != nil {
+		glog.Info("TLS certificate reloaded")
+	}
+
+	r.certificate = &certificate
+	r.versions = versions
+
+	return r.certificate, nil
+}
+
+// getCertificate implements the tls.Config GetCertificate callback.
+func (r *certificateReloader) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.get()
+}
+
+// NewTLSConfig returns the TLS configuration for the server.  If the certificate is
+// loaded from disk, it is reloaded when the files change.
+func NewTLSConfig(configuration *ServerConfiguration) (*tls.Config, error) {
+	if configuration.CertificatePath == "" {
+		config := &tls.Config{
+			Certificates: []tls.Certificate{
+				configuration.Certificate,
+			},
+		}
+
+		configureClientAuth(configuration, config)
+
+		return config, nil
+	}
+
+	reloader, err := newCertificateReloader(configuration.CertificatePath, configuration.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	configuration.certificates = reloader
+
+	config := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+	}
+
+	configureClientAuth(configuration, config)
+
+	return config, nil
+}
+
+// configureClientAuth requires and verifies client certificates when using mutual
+// TLS authentication.
+func configureClientAuth(configuration *ServerConfiguration, config *tls.Config) {
+	if configuration.ClientCAs == nil {
+		return
+	}
+
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = configuration.ClientCAs
+}
+
+// clientCertificate returns the verified client certificate of a request, if any.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// currentCertificate returns the certificate currently being served.
+func currentCertificate(c *ServerConfiguration) (tls.Certificate, error) {
+	if c.certificates == nil {
+		return c.Certificate, nil
+	}
+
+	certificate, err := c.certificates.get()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return *certificate, nil
+}
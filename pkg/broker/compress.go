@@ -0,0 +1,127 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// acceptsGzip returns whether the client will accept a gzip encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, encoding := range strings.Split(header, ",") {
+			fields := strings.Split(encoding, ";")
+
+			name := strings.TrimSpace(fields[0])
+			if name != "gzip" && name != "*" {
+				continue
+			}
+
+			rejected := false
+
+			for _, parameter := range fields[1:] {
+				parameter = strings.TrimSpace(parameter)
+				if !strings.HasPrefix(parameter, "q=") {
+					continue
+				}
+
+				if q, err := strconv.ParseFloat(parameter[2:], 64); err == nil && q == 0 {
+					rejected = true
+				}
+			}
+
+			if !rejected {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// compressingResponseWriter buffers a response, and when it is complete, gzip
+// compresses the body if it is large enough to be worthwhile.
+type compressingResponseWriter struct {
+	writer    http.ResponseWriter
+	threshold int
+	status    int
+	body      bytes.Buffer
+}
+
+// Header returns a reference to the response headers.
+func (w *compressingResponseWriter) Header() http.Header {
+	return w.writer.Header()
+}
+
+// Write buffers the response body.
+func (w *compressingResponseWriter) Write(body []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.body.Write(body)
+}
+
+// WriteHeader records the status code, it is written when the response is flushed.
+func (w *compressingResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+// flush writes the buffered response, compressing the body if it is at least the
+// threshold size.
+func (w *compressingResponseWriter) flush() {
+	if w.status == 0 {
+		return
+	}
+
+	body := w.body.Bytes()
+
+	w.writer.Header().Add("Vary", "Accept-Encoding")
+
+	if len(body) >= w.threshold && w.writer.Header().Get("Content-Encoding") == "" {
+		compressed := &bytes.Buffer{}
+
+		gz := gzip.NewWriter(compressed)
+
+		if _, err := gz.Write(body); err != nil {
+			glog.Infof("failed to compress response: %v", err)
+		} else if err := gz.Close(); err != nil {
+			glog.Infof("failed to compress response: %v", err)
+		} else {
+			w.writer.Header().Set("Content-Encoding", "gzip")
+			w.writer.Header().Del("Content-Length")
+
+			body = compressed.Bytes()
+		}
+	}
+
+	w.writer.WriteHeader(w.status)
+
+	if len(body) == 0 {
+		return
+	}
+
+	if _, err := w.writer.Write(body); err != nil {
+		glog.Infof("error writing response: %v", err)
+	}
+}
@@ -17,4 +17,13 @@ package broker
 const (
 	// minBrokerAPIVersion is the minimum supported version of the broker API
 	minBrokerAPIVersion = 2.13
+
+	// DefaultAddress is the default address the server listens on.
+	DefaultAddress = ":8443"
+
+	// DefaultMaxRequestBodySize is the default maximum size of a request body in bytes.
+	DefaultMaxRequestBodySize = 256 << 10
+
+	// redacted replaces credentials in manifests that are returned to clients.
+	redacted = "[REDACTED]"
 )
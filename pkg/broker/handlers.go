@@ -15,52 +15,150 @@
 package broker
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	goerrors "errors"
 	"fmt"
 	"net/http"
 	"reflect"
+	"time"
 
 	"github.com/couchbase/service-broker/pkg/api"
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/audit"
 	"github.com/couchbase/service-broker/pkg/config"
 	"github.com/couchbase/service-broker/pkg/errors"
 	"github.com/couchbase/service-broker/pkg/operation"
 	"github.com/couchbase/service-broker/pkg/provisioners"
 	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/version"
 
 	"github.com/golang/glog"
 	"github.com/julienschmidt/httprouter"
 
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // ErrUnexpected is highly unlikely to happen...
 var ErrUnexpected = goerrors.New("unexpected error")
 
+// handleNotFound reports requests that do not match any route as an API error,
+// rather than leaking router details.
+func handleNotFound() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonError(w, errors.NewResourceNotFoundError("no route for %s", r.URL.Path))
+	})
+}
+
+// handleMethodNotAllowed reports requests whose route does not support the method
+// as an API error.  The router sets the Allow header before this is called.
+func handleMethodNotAllowed() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonError(w, errors.NewMethodNotAllowedError("method %s not allowed for %s", r.Method, r.URL.Path))
+	})
+}
+
+// readinessCheck is a named readiness subcheck and its result.
+type readinessCheck struct {
+	name string
+	err  error
+}
+
 // handleReadyz is a handler for Kubernetes readiness checks.  It is less verbose than the
-// other API calls as it's called significantly more often.
-func handleReadyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	httpResponse(w, http.StatusOK)
+// other API calls as it's called significantly more often.  When not ready, the result
+// of each subcheck is reported in the body.
+func handleReadyz(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		checks := []readinessCheck{
+			{name: "certificate", err: checkCertificateExpiry(configuration)},
+			{name: "registry", err: checkRegistry(configuration)},
+		}
+
+		ready := true
+
+		for _, check := range checks {
+			if check.err != nil {
+				glog.Warning(check.err)
+
+				ready = false
+			}
+		}
+
+		if ready {
+			httpResponse(w, http.StatusOK)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		httpResponse(w, http.StatusServiceUnavailable)
+
+		for _, check := range checks {
+			if check.err != nil {
+				fmt.Fprintf(w, "[-]%s failed: %v\n", check.name, check.err)
+				continue
+			}
+
+			fmt.Fprintf(w, "[+]%s ok\n", check.name)
+		}
+	}
 }
 
 // handleReadCatalog advertises the classes of service we offer, and specifc plans to
-// implement those classes.
-func handleReadCatalog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	JSONResponse(w, http.StatusOK, config.Config().Spec.Catalog.Convert())
+// implement those classes.  The catalog may be optionally filtered with query
+// parameters.
+func handleReadCatalog(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		catalog := config.Config().Spec.Catalog.Convert()
+
+		if configuration.CatalogOverlay != nil {
+			c, err := configuration.CatalogOverlay.Apply(catalog)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			catalog = c
+		}
+
+		catalog, err := filterCatalog(catalog, r)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if err := resolveDashboardClientSecrets(config.Config(), &catalog, configuration.Namespace); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		JSONResponse(w, http.StatusOK, catalog)
+	}
 }
 
 // handleCreateServiceInstance creates a service instance of a plan.
 func handleCreateServiceInstance(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-		// Ensure the client supports async operation.
-		if err := asyncRequired(r); err != nil {
-			jsonError(w, err)
+		// Ensure the client supports async operation, unless the service plan
+		// allows synchronous provisioning, or async operation is optional, which is
+		// checked once the plan is known.  Otherwise provisioning is synchronous.
+		asyncErr := asyncRequired(r)
+		if asyncErr != nil && !errors.IsAsyncRequiredError(asyncErr) {
+			jsonError(w, asyncErr)
 			return
 		}
 
-		// Parse the creation request.
+		// Parse the creation request.  A malformed request from a client that does not
+		// support asynchronous operations is reported as such.
 		request := &api.CreateServiceInstanceRequest{}
-		if err := jsonRequest(r, request); err != nil {
+		if err := jsonRequest(w, r, configuration, request); err != nil {
+			if asyncErr != nil {
+				err = asyncErr
+			}
+
 			jsonError(w, err)
+
 			return
 		}
 
@@ -71,11 +169,64 @@ func handleCreateServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
-		if err := validateServicePlan(config.Config(), request.ServiceID, request.PlanID); err != nil {
+		instanceLock, err := lockServiceInstance(configuration, instanceID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		defer instanceLock.Release()
+
+		// The service plan may be omitted if the service offering has a default
+		// plan rollout.
+		if request.PlanID == "" {
+			planID, err := resolveRolloutPlan(configuration, instanceID, request.ServiceID)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			request.PlanID = planID
+		}
+
+		audit.SetPlan(r.Context(), request.ServiceID, request.PlanID)
+
+		plan, err := getServicePlan(config.Config(), request.ServiceID, request.PlanID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		synchronous := asyncErr != nil
+
+		// Synchronous provisioning is bounded by the service plan, if async
+		// operation is optional then it runs until complete.
+		var synchronousTimeout time.Duration
+
+		if synchronous {
+			switch {
+			case plan.SynchronousTimeout != nil:
+				synchronousTimeout = plan.SynchronousTimeout.Duration
+			case !configuration.AsyncOptional[operation.TypeProvision]:
+				jsonError(w, asyncErr)
+				return
+			}
+		}
+
+		defaulted, err := defaultParameters(config.Config(), request.ServiceID, request.PlanID, schemaTypeServiceInstance, schemaOperationCreate, request.Parameters)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		sanitized, err := sanitizeParameters(config.Config(), request.ServiceID, request.PlanID, schemaTypeServiceInstance, schemaOperationCreate, defaulted)
+		if err != nil {
 			jsonError(w, err)
 			return
 		}
 
+		request.Parameters = sanitized
+
 		if err := validateParameters(config.Config(), request.ServiceID, request.PlanID, schemaTypeServiceInstance, schemaOperationCreate, request.Parameters); err != nil {
 			jsonError(w, err)
 			return
@@ -94,6 +245,17 @@ func handleCreateServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
+		deleted, err := softDeleted(entry)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if deleted {
+			jsonError(w, errors.NewResourceConflictError("service instance is deleted, and must be undeleted before use"))
+			return
+		}
+
 		if entry.Exists() {
 			// If the instance already exists either return 200 if provisioned or
 			// a 202 if it is still provisioning, or a 409 if provisioned or
@@ -241,6 +403,11 @@ func handleCreateServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
+		if err := validateNamespace(namespace, configuration.Namespace); err != nil {
+			jsonError(w, err)
+			return
+		}
+
 		if err := entry.Set(registry.Namespace, namespace); err != nil {
 			jsonError(w, err)
 			return
@@ -271,7 +438,12 @@ func handleCreateServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
-		if err := entry.Commit(); err != nil {
+		if err := entry.Set(registry.Query, getQueryParameters(r)); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if err := setClientCertificate(r, entry); err != nil {
 			jsonError(w, err)
 			return
 		}
@@ -291,29 +463,73 @@ func handleCreateServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
-		if err := operation.Start(entry, operation.TypeProvision); err != nil {
+		// Reject the request before anything is committed if it would collide with
+		// resources belonging to another service instance.
+		if err := provisioner.CheckConflicts(entry); err != nil {
 			jsonError(w, err)
 			return
 		}
 
-		frozenEntry := entry.Clone()
-
-		go provisioner.Run(entry)
+		if err := checkOperationLimit(); err != nil {
+			jsonError(w, err)
+			return
+		}
 
-		operationID, ok, err := frozenEntry.GetString(registry.OperationID)
-		if err != nil {
+		if err := entry.Commit(); err != nil {
 			jsonError(w, err)
 			return
 		}
 
-		if !ok {
-			jsonError(w, fmt.Errorf("%w: service instance missing operation ID", ErrUnexpected))
+		if err := startOperation(entry, operation.TypeProvision, r, synchronous); err != nil {
+			jsonError(w, err)
 			return
 		}
 
+		frozenEntry := entry.Clone()
+
+		// Clients that do not support asynchronous operations wait for provisioning
+		// to complete.  If it was abandoned then it has been rolled back, so forget
+		// about the service instance.
+		if synchronous {
+			if err := runSynchronously(entry, provisioner.Run, synchronousTimeout); err != nil {
+				if errors.IsAsyncRequiredError(err) {
+					deleteDirectoryInstance(configuration.Namespace, instanceID)
+
+					if err := entry.Delete(); err != nil {
+						glog.Infof("failed to delete abandoned service instance: %v", err)
+					}
+				}
+
+				jsonError(w, err)
+
+				return
+			}
+		} else {
+			go runLockedOperation(instanceLock.Retain(), entry, provisioner.Run)
+
+			if config.GetOptions().AbandonedCreateTimeout > 0 {
+				scheduleAbandonedCreateReap(configuration, instanceID, frozenEntry)
+			}
+		}
+
 		// Return a response to the client.
-		response := &api.CreateServiceInstanceResponse{
-			Operation: operationID,
+		status := http.StatusCreated
+		response := &api.CreateServiceInstanceResponse{}
+
+		if !synchronous {
+			operationID, ok, err := frozenEntry.GetString(registry.OperationID)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			if !ok {
+				jsonError(w, fmt.Errorf("%w: service instance missing operation ID", ErrUnexpected))
+				return
+			}
+
+			status = http.StatusAccepted
+			response.Operation = operationID
 		}
 
 		dashboardURL, ok, err := frozenEntry.GetString(registry.DashboardURL)
@@ -326,7 +542,7 @@ func handleCreateServiceInstance(configuration *ServerConfiguration) func(http.R
 			response.DashboardURL = dashboardURL
 		}
 
-		JSONResponse(w, http.StatusAccepted, response)
+		JSONResponse(w, status, response)
 	}
 }
 
@@ -348,8 +564,14 @@ func handleReadServiceInstance(configuration *ServerConfiguration) func(http.Res
 			return
 		}
 
+		exists, err := serviceInstanceExists(entry)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
 		// Not found, return a 404
-		if !entry.Exists() {
+		if !exists {
 			jsonError(w, errors.NewResourceNotFoundError("service instance does not exist"))
 			return
 		}
@@ -379,6 +601,18 @@ func handleReadServiceInstance(configuration *ServerConfiguration) func(http.Res
 			return
 		}
 
+		// Service offerings may explicitly opt out of service instance retrieval.
+		offering, err := getServiceOffering(config.Config(), serviceInstanceServiceID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if offering.InstancesRetrievable != nil && !*offering.InstancesRetrievable {
+			jsonError(w, errors.NewResourceNotFoundError("service offering %s does not support service instance retrieval", offering.Name))
+			return
+		}
+
 		serviceInstancePlanID, ok, err := entry.GetString(registry.PlanID)
 		if err != nil {
 			jsonError(w, err)
@@ -435,11 +669,147 @@ func handleReadServiceInstance(configuration *ServerConfiguration) func(http.Res
 	}
 }
 
+// handleReadServiceInstanceManifests returns the rendered resource templates that were
+// last applied to a service instance.
+func handleReadServiceInstanceManifests(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		instanceID := params.ByName("instance_id")
+		if instanceID == "" {
+			jsonError(w, fmt.Errorf("%w: request missing instance_id parameter", ErrUnexpected))
+			return
+		}
+
+		dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+		// Check if the instance exists.
+		entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, true)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		exists, err := serviceInstanceExists(entry)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		// Not found, return a 404
+		if !exists {
+			jsonError(w, errors.NewResourceNotFoundError("service instance does not exist"))
+			return
+		}
+
+		manifests := []v1.ConfigurationTemplate{}
+
+		if _, err := entry.Get(registry.Manifests, &manifests); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		response := &api.GetServiceInstanceManifestsResponse{
+			Manifests: []api.ServiceInstanceManifest{},
+		}
+
+		for _, manifest := range manifests {
+			resource, err := redactManifest(entry, manifest.Template)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			response.Manifests = append(response.Manifests, api.ServiceInstanceManifest{
+				Name:     manifest.Name,
+				Resource: resource,
+			})
+		}
+
+		JSONResponse(w, http.StatusOK, response)
+	}
+}
+
+// redactManifest removes credentials from a rendered manifest before it is returned.
+// Secret data is always redacted, as are sensitive registry values that may have been
+// rendered into other resources.
+func redactManifest(entry *registry.Entry, manifest *runtime.RawExtension) (*runtime.RawExtension, error) {
+	if manifest == nil || manifest.Raw == nil {
+		return manifest, nil
+	}
+
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(manifest.Raw, object); err != nil {
+		return nil, err
+	}
+
+	if object.GetAPIVersion() == "v1" && object.GetKind() == "Secret" {
+		for _, field := range []string{"data", "stringData"} {
+			data, ok := object.Object[field].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			for key := range data {
+				data[key] = redacted
+			}
+		}
+	}
+
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.RawExtension{Raw: []byte(entry.Redact(string(raw)))}, nil
+}
+
+// handleReconcileServiceInstance recreates any resources belonging to a service instance
+// that have been deleted.
+func handleReconcileServiceInstance(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		instanceID := params.ByName("instance_id")
+		if instanceID == "" {
+			jsonError(w, fmt.Errorf("%w: request missing instance_id parameter", ErrUnexpected))
+			return
+		}
+
+		recreated, err := reconcileServiceInstance(configuration, instanceID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		response := &api.ReconcileServiceInstanceResponse{
+			Recreated: recreated,
+		}
+		JSONResponse(w, http.StatusOK, response)
+	}
+}
+
+// handleUndeleteServiceInstance restores a soft-deleted service instance.
+func handleUndeleteServiceInstance(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		instanceID := params.ByName("instance_id")
+		if instanceID == "" {
+			jsonError(w, fmt.Errorf("%w: request missing instance_id parameter", ErrUnexpected))
+			return
+		}
+
+		if err := undeleteServiceInstance(configuration, instanceID); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		JSONResponse(w, http.StatusOK, struct{}{})
+	}
+}
+
 // handleUpdateServiceInstance allows a service instance to be modified.
 func handleUpdateServiceInstance(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-		// Ensure the client supports async operation.
-		if err := asyncRequired(r); err != nil {
+		// Ensure the client supports async operation, unless it is optional, in
+		// which case the update is synchronous.
+		synchronous, err := asyncOptional(configuration, operation.TypeUpdate, r)
+		if err != nil {
 			jsonError(w, err)
 			return
 		}
@@ -452,11 +822,19 @@ func handleUpdateServiceInstance(configuration *ServerConfiguration) func(http.R
 
 		// Parse the update request.
 		request := &api.UpdateServiceInstanceRequest{}
-		if err := jsonRequest(r, request); err != nil {
+		if err := jsonRequest(w, r, configuration, request); err != nil {
 			jsonError(w, err)
 			return
 		}
 
+		instanceLock, err := lockServiceInstance(configuration, instanceID)
+		if err != nil {
+			jsonErrorUsable(w, err)
+			return
+		}
+
+		defer instanceLock.Release()
+
 		dirent := getDirectoryInstance(configuration.Namespace, instanceID)
 
 		// Check if the instance already exists.
@@ -467,12 +845,23 @@ func handleUpdateServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
+		exists, err := serviceInstanceExists(entry)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
 		// Not found, return a 404
-		if !entry.Exists() {
+		if !exists {
 			jsonError(w, errors.NewResourceNotFoundError("service instance does not exist"))
 			return
 		}
 
+		if err := verifyNamespaceUnchanged(entry, request.Context); err != nil {
+			jsonError(w, err)
+			return
+		}
+
 		// Get the plan from the registry, it is not guaranteed to be in the request.
 		// Override with the request if specified.
 		planID, ok, err := entry.GetString(registry.PlanID)
@@ -491,6 +880,8 @@ func handleUpdateServiceInstance(configuration *ServerConfiguration) func(http.R
 			newPlanID = request.PlanID
 		}
 
+		audit.SetPlan(r.Context(), request.ServiceID, newPlanID)
+
 		// Check parameters.
 		if err := validateServicePlan(config.Config(), request.ServiceID, newPlanID); err != nil {
 			jsonError(w, err)
@@ -502,14 +893,48 @@ func handleUpdateServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
-		if err := validateParameters(config.Config(), request.ServiceID, planID, schemaTypeServiceInstance, schemaOperationUpdate, request.Parameters); err != nil {
+		sanitized, err := sanitizeParameters(config.Config(), request.ServiceID, planID, schemaTypeServiceInstance, schemaOperationUpdate, request.Parameters)
+		if err != nil {
 			jsonErrorUsable(w, err)
 			return
 		}
 
-		parameters := &runtime.RawExtension{}
-		if request.Parameters != nil {
-			parameters = request.Parameters
+		request.Parameters = sanitized
+
+		if err := validateParameters(config.Config(), request.ServiceID, planID, schemaTypeServiceInstance, schemaOperationUpdate, request.Parameters); err != nil {
+			jsonErrorUsable(w, err)
+			return
+		}
+
+		parameters := &runtime.RawExtension{}
+		if request.Parameters != nil {
+			parameters = request.Parameters
+		}
+
+		// Retain the parameters being replaced so templates can carry values
+		// forward that the update does not specify.  These accumulate over all
+		// updates, so a value is retained until an update specifies a new one.
+		currentParameters := &runtime.RawExtension{}
+		if _, err := entry.Get(registry.Parameters, currentParameters); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		previousParameters := &runtime.RawExtension{}
+		if _, err := entry.Get(registry.PreviousParameters, previousParameters); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		previousParameters, err = mergeParameters(previousParameters, currentParameters)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if err := entry.Set(registry.PreviousParameters, previousParameters); err != nil {
+			jsonError(w, err)
+			return
 		}
 
 		if err := entry.Set(registry.Parameters, parameters); err != nil {
@@ -528,14 +953,30 @@ func handleUpdateServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
-		if err := operation.Start(entry, operation.TypeUpdate); err != nil {
+		if err := checkOperationLimit(); err != nil {
+			jsonErrorUsable(w, err)
+			return
+		}
+
+		if err := startOperation(entry, operation.TypeUpdate, r, synchronous); err != nil {
 			jsonError(w, err)
 			return
 		}
 
+		if synchronous {
+			if err := runSynchronously(entry, updater.Run, 0); err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			JSONResponse(w, http.StatusOK, &api.UpdateServiceInstanceResponse{})
+
+			return
+		}
+
 		frozenEntry := entry.Clone()
 
-		go updater.Run(entry)
+		go runLockedOperation(instanceLock.Retain(), entry, updater.Run)
 
 		operationID, ok, err := frozenEntry.GetString(registry.OperationID)
 		if err != nil {
@@ -559,10 +1000,19 @@ func handleUpdateServiceInstance(configuration *ServerConfiguration) func(http.R
 // handleDeleteServiceInstance deletes a service instance.
 func handleDeleteServiceInstance(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-		// Ensure the client supports async operation.
-		if err := asyncRequired(r); err != nil {
-			jsonError(w, err)
-			return
+		// Ensure the client supports async operation, unless the service plan is
+		// always deleted synchronously, or async operation is optional, in which case
+		// the client waits for deletion.
+		synchronous := synchronousDelete(config.Config(), r)
+
+		if !synchronous {
+			optional, err := asyncOptional(configuration, operation.TypeDeprovision, r)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			synchronous = optional
 		}
 
 		// Check parameters.
@@ -572,10 +1022,23 @@ func handleDeleteServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
+		instanceLock, err := lockServiceInstance(configuration, instanceID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		defer instanceLock.Release()
+
 		dirent := getDirectoryInstance(configuration.Namespace, instanceID)
 
-		// Probably the wrong place for this...
-		deleteDirectoryInstance(configuration.Namespace, instanceID)
+		softDeleteGracePeriod := config.GetOptions().SoftDeleteGracePeriod
+
+		// Probably the wrong place for this...  Soft-deleted service instances
+		// retain their directory entry so they can be undeleted.
+		if softDeleteGracePeriod == 0 {
+			deleteDirectoryInstance(configuration.Namespace, instanceID)
+		}
 
 		entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false)
 		if err != nil {
@@ -583,7 +1046,13 @@ func handleDeleteServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
-		if !entry.Exists() {
+		exists, err := serviceInstanceExists(entry)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if !exists {
 			jsonError(w, errors.NewResourceGoneError("service instance does not exist"))
 			return
 		}
@@ -600,6 +1069,8 @@ func handleDeleteServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
+		audit.SetPlan(r.Context(), serviceID, planID)
+
 		serviceInstanceServiceID, ok, err := entry.GetString(registry.ServiceID)
 		if err != nil {
 			jsonError(w, err)
@@ -632,17 +1103,99 @@ func handleDeleteServiceInstance(configuration *ServerConfiguration) func(http.R
 			return
 		}
 
+		// Deprovisioning while provisioning is in progress cancels provisioning, which
+		// rolls back any resources created so far.  Once stopped the registry entry
+		// will have changed, so reload it and clear the failed operation.
+		op, ok, err := entry.GetString(registry.Operation)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if ok && op == string(operation.TypeProvision) {
+			cancelled, err := operation.Cancel(entry)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			if cancelled {
+				glog.Infof("cancelled provisioning of service instance: %s", instanceID)
+
+				if entry, err = registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false); err != nil {
+					jsonError(w, err)
+					return
+				}
+
+				if err := operation.End(entry); err != nil {
+					jsonError(w, err)
+					return
+				}
+			}
+		}
+
+		// Soft-deleted service instances appear deleted to the client, but are
+		// retained for the grace period.  Service instances whose provisioning was
+		// cancelled have nothing worth restoring, so are deleted immediately.
+		if softDeleteGracePeriod > 0 && !(ok && op == string(operation.TypeProvision)) {
+			if err := softDeleteServiceInstance(configuration, entry, instanceID); err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			// Soft-deletion is complete as far as the client is concerned, there
+			// is no operation to poll, so this is synchronous even when the client
+			// accepts incomplete operations.
+			JSONResponse(w, http.StatusOK, struct{}{})
+
+			return
+		}
+
+		if softDeleteGracePeriod > 0 {
+			deleteDirectoryInstance(configuration.Namespace, instanceID)
+		}
+
+		if err := checkOperationLimit(); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		// Deletion must not race with another operation, whether or not deletion is
+		// synchronous.
+		current, ok, err := entry.GetString(registry.Operation)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if ok {
+			jsonError(w, errors.NewConcurrencyError("existing %v operation in progress", current))
+			return
+		}
+
 		deleter := provisioners.NewDeleter()
 
-		// Start the delete operation in the background.
-		if err := operation.Start(entry, operation.TypeDeprovision); err != nil {
+		if err := startOperation(entry, operation.TypeDeprovision, r, synchronous); err != nil {
 			jsonError(w, err)
 			return
 		}
 
-		go deleter.Run(entry)
+		if synchronous {
+			if err := runSynchronously(entry, deleter.Run, 0); err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			JSONResponse(w, http.StatusOK, struct{}{})
+
+			return
+		}
+
+		frozenEntry := entry.Clone()
+
+		go runLockedOperation(instanceLock.Retain(), entry, deleter.Run)
 
-		operationID, ok, err := entry.GetString(registry.OperationID)
+		operationID, ok, err := frozenEntry.GetString(registry.OperationID)
 		if err != nil {
 			jsonError(w, err)
 			return
@@ -668,6 +1221,20 @@ func handlePollServiceInstance(configuration *ServerConfiguration) func(http.Res
 			return
 		}
 
+		// Polling modifies the registry entry, so must hold the lock.  If another
+		// broker replica holds it, the operation is running there, so report it as
+		// in progress without modifying anything.
+		instanceLock, err := lockServiceInstance(configuration, instanceID)
+		if err != nil && !errors.IsConcurrencyError(err) {
+			jsonError(w, err)
+			return
+		}
+
+		locked := err == nil
+		if locked {
+			defer instanceLock.Release()
+		}
+
 		dirent := getDirectoryInstance(configuration.Namespace, instanceID)
 
 		entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false)
@@ -676,7 +1243,13 @@ func handlePollServiceInstance(configuration *ServerConfiguration) func(http.Res
 			return
 		}
 
-		if !entry.Exists() {
+		exists, err := serviceInstanceExists(entry)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if !exists {
 			JSONResponse(w, http.StatusGone, struct{}{})
 			return
 		}
@@ -710,7 +1283,8 @@ func handlePollServiceInstance(configuration *ServerConfiguration) func(http.Res
 		}
 
 		if !ok {
-			jsonError(w, fmt.Errorf("%w: service instance missing operation ID", ErrUnexpected))
+			jsonError(w, fmt.Errorf("%w: service instance missing service ID", ErrUnexpected))
+			return
 		}
 
 		instancePlanID, ok, err := entry.GetString(registry.PlanID)
@@ -720,19 +1294,16 @@ func handlePollServiceInstance(configuration *ServerConfiguration) func(http.Res
 		}
 
 		if !ok {
-			jsonError(w, fmt.Errorf("%w: service instance missing operation ID", ErrUnexpected))
+			jsonError(w, fmt.Errorf("%w: service instance missing plan ID", ErrUnexpected))
+			return
 		}
 
-		instanceOperationID, ok, err := entry.GetString(registry.OperationID)
+		instanceOperationID, operationInProgress, err := entry.GetString(registry.OperationID)
 		if err != nil {
 			jsonError(w, err)
 			return
 		}
 
-		if !ok {
-			jsonError(w, fmt.Errorf("%w: service instance missing operation ID", ErrUnexpected))
-		}
-
 		// While not specified, we check that the provided service ID matches the one
 		// we expect.  It may be indicative of a client error.
 		if serviceIDProvided && serviceID != instanceServiceID {
@@ -747,11 +1318,43 @@ func handlePollServiceInstance(configuration *ServerConfiguration) func(http.Res
 			return
 		}
 
+		// The operation may have completed, and its result been retained, if this
+		// poll is a retry.
+		if !operationInProgress {
+			status, ok, err := operation.Result(entry, operationID)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			if !ok {
+				jsonError(w, errors.NewQueryError("provided operation %s does not exist", operationID))
+				return
+			}
+
+			response := &api.PollServiceInstanceResponse{
+				State: api.PollStateSucceeded,
+			}
+
+			if status != "" {
+				response.State = api.PollStateFailed
+				response.Description = status
+			}
+
+			JSONResponse(w, http.StatusOK, response)
+
+			return
+		}
+
 		if operationID != instanceOperationID {
 			jsonError(w, errors.NewQueryError("provided operation %s does not match operation %s", operationID, instanceOperationID))
 			return
 		}
 
+		if locked {
+			recordPoll(entry)
+		}
+
 		operationStatus, ok, err := entry.GetString(registry.OperationStatus)
 		if err != nil {
 			jsonError(w, err)
@@ -759,10 +1362,23 @@ func handlePollServiceInstance(configuration *ServerConfiguration) func(http.Res
 		}
 
 		// If there is no status then the provisioning operation is still in progress (or has crashed...)
-		if !ok {
+		if !ok || !locked {
+			description := "asynchronous provisioning in progress"
+
+			// Report any checkpoints recorded by the provisioner.
+			progress, ok, err := entry.GetString(registry.OperationProgress)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			if ok {
+				description += ": " + progress
+			}
+
 			response := &api.PollServiceInstanceResponse{
 				State:       api.PollStateInProgress,
-				Description: "asynchronous provisioning in progress",
+				Description: description,
 			}
 			JSONResponse(w, http.StatusOK, response)
 
@@ -771,6 +1387,45 @@ func handlePollServiceInstance(configuration *ServerConfiguration) func(http.Res
 
 		// If the status isn't empty then we have encountered an error and need to report failure.
 		if operationStatus != "" {
+			description := operationStatus
+
+			// Report exactly what was, and was not, deleted by a failed deprovision.
+			report := []provisioners.DeletionReport{}
+
+			ok, err := entry.Get(registry.DeletionReport, &report)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			if ok {
+				raw, err := json.Marshal(report)
+				if err != nil {
+					jsonError(w, err)
+					return
+				}
+
+				description += ": " + string(raw)
+			}
+
+			// Explain why the operation failed, for example the underlying
+			// Kubernetes error.
+			diagnostics, err := operation.Diagnostics(entry)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
+
+			if len(diagnostics) != 0 {
+				raw, err := json.Marshal(diagnostics)
+				if err != nil {
+					jsonError(w, err)
+					return
+				}
+
+				description += ": diagnostics: " + string(raw)
+			}
+
 			if err := operation.End(entry); err != nil {
 				jsonError(w, err)
 				return
@@ -778,7 +1433,7 @@ func handlePollServiceInstance(configuration *ServerConfiguration) func(http.Res
 
 			response := &api.PollServiceInstanceResponse{
 				State:       api.PollStateFailed,
-				Description: operationStatus,
+				Description: description,
 			}
 			JSONResponse(w, http.StatusOK, response)
 
@@ -803,7 +1458,7 @@ func handleCreateServiceBinding(configuration *ServerConfiguration) func(http.Re
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		// Parse the creation request.
 		request := &api.CreateServiceBindingRequest{}
-		if err := jsonRequest(r, request); err != nil {
+		if err := jsonRequest(w, r, configuration, request); err != nil {
 			jsonError(w, err)
 			return
 		}
@@ -821,6 +1476,16 @@ func handleCreateServiceBinding(configuration *ServerConfiguration) func(http.Re
 			return
 		}
 
+		instanceLock, err := lockServiceInstance(configuration, instanceID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		defer instanceLock.Release()
+
+		audit.SetPlan(r.Context(), request.ServiceID, request.PlanID)
+
 		if err := validateServicePlan(config.Config(), request.ServiceID, request.PlanID); err != nil {
 			jsonError(w, err)
 			return
@@ -831,6 +1496,26 @@ func handleCreateServiceBinding(configuration *ServerConfiguration) func(http.Re
 			return
 		}
 
+		capabilities, err := verifyRequires(config.Config(), request.ServiceID, request.Context)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		defaulted, err := defaultParameters(config.Config(), request.ServiceID, request.PlanID, schemaTypeServiceBinding, schemaOperationCreate, request.Parameters)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		sanitized, err := sanitizeParameters(config.Config(), request.ServiceID, request.PlanID, schemaTypeServiceBinding, schemaOperationCreate, defaulted)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		request.Parameters = sanitized
+
 		if err := validateParameters(config.Config(), request.ServiceID, request.PlanID, schemaTypeServiceBinding, schemaOperationCreate, request.Parameters); err != nil {
 			jsonError(w, err)
 			return
@@ -845,7 +1530,13 @@ func handleCreateServiceBinding(configuration *ServerConfiguration) func(http.Re
 			return
 		}
 
-		if !instanceEntry.Exists() {
+		exists, err := serviceInstanceExists(instanceEntry)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if !exists {
 			jsonError(w, errors.NewParameterError("service instance %s not found", instanceID))
 			return
 		}
@@ -970,18 +1661,56 @@ func handleCreateServiceBinding(configuration *ServerConfiguration) func(http.Re
 				}
 
 				response.Operation = operationID
+
+				JSONResponse(w, status, response)
+
+				return
 			}
 
-			JSONResponse(w, status, response)
+			// Identical requests are idempotent, so the existing binding is returned,
+			// along with its expiry, even if it has expired.  Credentials are only
+			// rotated explicitly with a predecessor binding.
+			existing, err := bindingResponse(entry, capabilities)
+			if err != nil {
+				jsonError(w, err)
+				return
+			}
 
+			JSONResponse(w, status, existing)
+
+			return
+		}
+
+		// Only bind to service instances that are known to work.
+		if err := verifyServiceInstanceUsable(instanceEntry, instanceID); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if err := verifyBindingLimit(config.Config(), request.ServiceID, request.PlanID, dirent.Namespace, instanceID); err != nil {
+			jsonError(w, err)
 			return
 		}
 
+		if request.PredecessorBindingID != "" {
+			if err := verifyPredecessorBinding(dirent.Namespace, instanceID, request.PredecessorBindingID); err != nil {
+				jsonError(w, err)
+				return
+			}
+		}
+
 		// The binding gets a copy of all service instance data, this could be used
 		// to communicate TLS or other password information.  The context and parameters
 		// are overridden buy those related to the binding.
 		entry.Inherit(instanceEntry)
 
+		if request.PredecessorBindingID != "" {
+			if err := entry.Set(registry.PredecessorBindingID, request.PredecessorBindingID); err != nil {
+				jsonError(w, err)
+				return
+			}
+		}
+
 		context := &runtime.RawExtension{}
 		if request.Context != nil {
 			context = request.Context
@@ -1007,6 +1736,26 @@ func handleCreateServiceBinding(configuration *ServerConfiguration) func(http.Re
 			return
 		}
 
+		if err := entry.Set(registry.Query, getQueryParameters(r)); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if err := setClientCertificate(r, entry); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if err := setBindingExpiry(config.Config(), request.ServiceID, request.PlanID, entry); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if err := setBindingEndpoint(config.Config(), request.ServiceID, request.PlanID, parameters, entry); err != nil {
+			jsonError(w, err)
+			return
+		}
+
 		if err := entry.Commit(); err != nil {
 			jsonError(w, err)
 			return
@@ -1027,49 +1776,177 @@ func handleCreateServiceBinding(configuration *ServerConfiguration) func(http.Re
 			return
 		}
 
-		if err := operation.Start(entry, operation.TypeProvision); err != nil {
+		if err := operation.Start(entry, operation.TypeProvision, requestIdentity(r)); err != nil {
 			jsonError(w, err)
 			return
 		}
 
 		frozenEntry := entry.Clone()
 
-		provisioner.Run(entry)
+		runErr := provisioner.Run(entry)
 
-		operationStatus, ok, err := entry.GetString(registry.OperationStatus)
+		// Stop the operation to allow other things to happen now.
+		if err := operation.End(entry); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if runErr != nil {
+			jsonError(w, operationError(runErr))
+			return
+		}
+
+		response, err := bindingResponse(frozenEntry, capabilities)
 		if err != nil {
 			jsonError(w, err)
 			return
 		}
 
-		if !ok {
-			jsonError(w, fmt.Errorf("%w: expected operation status not found", ErrUnexpected))
+		JSONResponse(w, http.StatusCreated, response)
+	}
+}
+
+// handleReadServiceBinding allows a service binding to be read.  A service binding
+// with an operation in progress does not exist as far as the client is concerned,
+// so its credentials are only returned once it has been created successfully.
+func handleReadServiceBinding(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		instanceID := params.ByName("instance_id")
+		if instanceID == "" {
+			jsonError(w, fmt.Errorf("%w: request missing instance_id parameter", ErrUnexpected))
 			return
 		}
 
-		// Stop the operation to allow other things to happen now.
-		if err := operation.End(entry); err != nil {
+		bindingID := params.ByName("binding_id")
+		if bindingID == "" {
+			jsonError(w, fmt.Errorf("%w: request missing binding_id parameter", ErrUnexpected))
+			return
+		}
+
+		dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+		entry, err := registry.New(registry.ServiceBinding, dirent.Namespace, bindingID, true)
+		if err != nil {
 			jsonError(w, err)
 			return
 		}
 
-		if operationStatus != "" {
-			// Work needed: properly propagate the error type.
-			jsonError(w, errors.NewConfigurationError(operationStatus))
+		if !entry.Exists() {
+			jsonError(w, errors.NewResourceNotFoundError("service binding does not exist"))
 			return
 		}
 
-		credentials := &runtime.RawExtension{}
+		bindingInstanceID, ok, err := entry.GetString(registry.InstanceID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if !ok || bindingInstanceID != instanceID {
+			jsonError(w, errors.NewResourceNotFoundError("service binding does not exist for service instance %s", instanceID))
+			return
+		}
+
+		// service_id is optional and provoded as a hint.
+		serviceID, serviceIDProvided, err := maygetSingleParameter(r, "service_id")
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
 
-		if _, err := frozenEntry.Get(registry.Credentials, credentials); err != nil {
+		// plan_id is optional and provoded as a hint.
+		planID, planIDProvided, err := maygetSingleParameter(r, "plan_id")
+		if err != nil {
 			jsonError(w, err)
 			return
 		}
 
-		response := &api.GetServiceBindingResponse{
-			Credentials: credentials,
+		serviceBindingServiceID, _, err := entry.GetString(registry.ServiceID)
+		if err != nil {
+			jsonError(w, err)
+			return
 		}
-		JSONResponse(w, http.StatusCreated, response)
+
+		serviceBindingPlanID, _, err := entry.GetString(registry.PlanID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if serviceIDProvided && serviceID != serviceBindingServiceID {
+			jsonError(w, errors.NewQueryError("specified service ID %s does not match %s", serviceID, serviceBindingServiceID))
+			return
+		}
+
+		if planIDProvided && planID != serviceBindingPlanID {
+			jsonError(w, errors.NewQueryError("specified plan ID %s does not match %s", planID, serviceBindingPlanID))
+			return
+		}
+
+		// Service offerings may explicitly opt out of service binding retrieval.
+		offering, err := getServiceOffering(config.Config(), serviceBindingServiceID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if offering.BindingsRetrievable != nil && !*offering.BindingsRetrievable {
+			jsonError(w, errors.NewResourceNotFoundError("service offering %s does not support service binding retrieval", offering.Name))
+			return
+		}
+
+		op, ok, err := entry.GetString(registry.Operation)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if ok {
+			jsonError(w, errors.NewResourceNotFoundError("service binding %s operation in progress", op))
+			return
+		}
+
+		// Expired credentials are no longer valid, so are not returned.
+		expired, err := bindingExpired(entry)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if expired {
+			jsonError(w, errors.NewResourceGoneError("service binding %s has expired", bindingID))
+			return
+		}
+
+		context := &runtime.RawExtension{}
+		if _, err := entry.Get(registry.Context, context); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		capabilities, err := getCapabilities(context)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		response, err := bindingResponse(entry, capabilities)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		parameters := &runtime.RawExtension{}
+		if _, err := entry.Get(registry.Parameters, parameters); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if parameters.Raw != nil {
+			response.Parameters = parameters
+		}
+
+		JSONResponse(w, http.StatusOK, response)
 	}
 }
 
@@ -1082,6 +1959,14 @@ func handleDeleteServiceBinding(configuration *ServerConfiguration) func(http.Re
 			return
 		}
 
+		instanceLock, err := lockServiceInstance(configuration, instanceID)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		defer instanceLock.Release()
+
 		dirent := getDirectoryInstance(configuration.Namespace, instanceID)
 
 		instanceEntry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, true)
@@ -1125,6 +2010,8 @@ func handleDeleteServiceBinding(configuration *ServerConfiguration) func(http.Re
 			return
 		}
 
+		audit.SetPlan(r.Context(), serviceID, planID)
+
 		serviceInstanceServiceID, ok, err := entry.GetString(registry.ServiceID)
 		if err != nil {
 			jsonError(w, err)
@@ -1159,9 +2046,73 @@ func handleDeleteServiceBinding(configuration *ServerConfiguration) func(http.Re
 
 		deleter := provisioners.NewDeleter()
 
-		deleter.Run(entry)
+		if err := deleter.Run(entry); err != nil {
+			jsonError(w, err)
+			return
+		}
 
 		response := &api.DeleteServiceBindingResponse{}
 		JSONResponse(w, http.StatusOK, response)
 	}
 }
+
+// handleExportRegistry returns a backup of all registry entries.
+func handleExportRegistry(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		backup, err := registry.Export(configuration.Namespace)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		glog.Infof("exported %d registry entries", len(backup.Entries))
+
+		JSONResponse(w, http.StatusOK, backup)
+	}
+}
+
+// handleImportRegistry restores registry entries from a backup.
+func handleImportRegistry(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		backup := &api.RegistryBackup{}
+		if err := jsonRequest(w, r, configuration, backup); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		if err := registry.Import(configuration.Namespace, backup); err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		glog.Infof("imported %d registry entries", len(backup.Entries))
+
+		JSONResponse(w, http.StatusOK, struct{}{})
+	}
+}
+
+// handleReadVersion returns the service broker version and build information, along
+// with a hash of the live configuration so replicas can be checked for consistency.
+func handleReadVersion(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	start := time.Now()
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		spec, err := json.Marshal(config.Config().Spec)
+		if err != nil {
+			jsonError(w, err)
+			return
+		}
+
+		digest := sha256.Sum256(spec)
+
+		response := &api.Version{
+			Application:       version.Application,
+			Version:           version.Version,
+			GitCommit:         version.GitCommit,
+			ConfigurationHash: hex.EncodeToString(digest[:]),
+			Uptime:            time.Since(start).Truncate(time.Second).String(),
+		}
+
+		JSONResponse(w, http.StatusOK, response)
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/service-broker/pkg/api"
+	"github.com/couchbase/service-broker/pkg/version"
+
+	"github.com/julienschmidt/httprouter"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// openAPIVersion is the version of the OpenAPI specification we generate.
+	openAPIVersion = "3.0.3"
+
+	// openAPIPath is where the OpenAPI document is served.
+	openAPIPath = "/openapi.json"
+
+	// openAPISchemaPrefix is how schemas are referenced.
+	openAPISchemaPrefix = "#/components/schemas/"
+)
+
+// openAPIRoute describes a single API operation.
+type openAPIRoute struct {
+	// method is the HTTP method.
+	method string
+
+	// path is the path, with parameters in OpenAPI format.
+	path string
+
+	// summary is a short description of the operation.
+	summary string
+
+	// query is a list of supported query parameters.
+	query []string
+
+	// request is the type of the request body, if any.
+	request interface{}
+
+	// status is the HTTP status returned on success.
+	status int
+
+	// response is the type of the response body, if any.
+	response interface{}
+
+	// unauthenticated routes require no authentication or API version header.
+	unauthenticated bool
+}
+
+// openAPIRoutes returns all API operations supported by the server.  These must be
+// kept in sync with the routes registered in newRouter, and are checked against
+// them by the unit tests.
+func openAPIRoutes(configuration *ServerConfiguration) []openAPIRoute {
+	routes := []openAPIRoute{
+		{
+			method:          http.MethodGet,
+			path:            "/readyz",
+			summary:         "Check the service broker is ready to serve requests",
+			status:          http.StatusOK,
+			unauthenticated: true,
+		},
+		{
+			method:          http.MethodGet,
+			path:            openAPIPath,
+			summary:         "Read this OpenAPI document",
+			status:          http.StatusOK,
+			unauthenticated: true,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v2/catalog",
+			summary:  "Read the service catalog",
+			query:    []string{"service_name", "tag", "free", "bindable"},
+			status:   http.StatusOK,
+			response: api.ServiceCatalog{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v2/service_instances/{instance_id}",
+			summary:  "Create a service instance",
+			query:    []string{"accepts_incomplete"},
+			request:  api.CreateServiceInstanceRequest{},
+			status:   http.StatusAccepted,
+			response: api.CreateServiceInstanceResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v2/service_instances/{instance_id}",
+			summary:  "Read a service instance",
+			query:    []string{"service_id", "plan_id"},
+			status:   http.StatusOK,
+			response: api.GetServiceInstanceResponse{},
+		},
+		{
+			method:   http.MethodPatch,
+			path:     "/v2/service_instances/{instance_id}",
+			summary:  "Update a service instance",
+			query:    []string{"accepts_incomplete"},
+			request:  api.UpdateServiceInstanceRequest{},
+			status:   http.StatusAccepted,
+			response: api.UpdateServiceInstanceResponse{},
+		},
+		{
+			method:   http.MethodDelete,
+			path:     "/v2/service_instances/{instance_id}",
+			summary:  "Delete a service instance",
+			query:    []string{"service_id", "plan_id", "accepts_incomplete"},
+			status:   http.StatusAccepted,
+			response: api.CreateServiceInstanceResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v2/service_instances/{instance_id}/last_operation",
+			summary:  "Poll a service instance operation",
+			query:    []string{"service_id", "plan_id", "operation"},
+			status:   http.StatusOK,
+			response: api.PollServiceInstanceResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v2/service_instances/{instance_id}/manifests",
+			summary:  "Read the resources rendered for a service instance",
+			status:   http.StatusOK,
+			response: api.GetServiceInstanceManifestsResponse{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v2/service_instances/{instance_id}/reconcile",
+			summary:  "Recreate any missing service instance resources",
+			status:   http.StatusOK,
+			response: api.ReconcileServiceInstanceResponse{},
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/v2/service_instances/{instance_id}/undelete",
+			summary: "Restore a soft-deleted service instance",
+			status:  http.StatusOK,
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v2/service_instances/{instance_id}/service_bindings/{binding_id}",
+			summary:  "Create a service binding",
+			query:    []string{"accepts_incomplete"},
+			request:  api.CreateServiceBindingRequest{},
+			status:   http.StatusCreated,
+			response: api.GetServiceBindingResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v2/service_instances/{instance_id}/service_bindings/{binding_id}",
+			summary:  "Read a service binding",
+			query:    []string{"service_id", "plan_id"},
+			status:   http.StatusOK,
+			response: api.GetServiceBindingResponse{},
+		},
+		{
+			method:   http.MethodDelete,
+			path:     "/v2/service_instances/{instance_id}/service_bindings/{binding_id}",
+			summary:  "Delete a service binding",
+			query:    []string{"service_id", "plan_id", "accepts_incomplete"},
+			status:   http.StatusOK,
+			response: api.DeleteServiceBindingResponse{},
+		},
+	}
+
+	if configuration.RegistryBackup {
+		routes = append(routes,
+			openAPIRoute{
+				method:   http.MethodGet,
+				path:     "/v2/registry",
+				summary:  "Export the registry",
+				status:   http.StatusOK,
+				response: api.RegistryBackup{},
+			},
+			openAPIRoute{
+				method:  http.MethodPut,
+				path:    "/v2/registry",
+				summary: "Import the registry",
+				request: api.RegistryBackup{},
+				status:  http.StatusOK,
+			},
+		)
+	}
+
+	if configuration.Version {
+		routes = append(routes, openAPIRoute{
+			method:   http.MethodGet,
+			path:     "/version",
+			summary:  "Read the service broker version",
+			status:   http.StatusOK,
+			response: api.Version{},
+		})
+	}
+
+	return routes
+}
+
+// openAPISchemas generates JSON schemas from Go types, registering named structures
+// as reusable components.
+type openAPISchemas map[string]interface{}
+
+// schema returns the schema for a type.
+func (s openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	// Raw extensions are arbitrary JSON, in practice always objects.
+	if t == reflect.TypeOf(runtime.RawExtension{}) {
+		return map[string]interface{}{
+			"type": "object",
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{
+			"type": "boolean",
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{
+			"type": "integer",
+		}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{
+			"type": "number",
+		}
+	case reflect.String:
+		return map[string]interface{}{
+			"type": "string",
+		}
+	case reflect.Slice, reflect.Array:
+		// Byte slices are encoded as base64 strings.
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{
+				"type":   "string",
+				"format": "byte",
+			}
+		}
+
+		return map[string]interface{}{
+			"type":  "array",
+			"items": s.schema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": s.schema(t.Elem()),
+		}
+	case reflect.Struct:
+		return s.structSchema(t)
+	}
+
+	// Interfaces may be anything.
+	return map[string]interface{}{}
+}
+
+// structSchema registers a structure as a component, if not already done, and
+// returns a reference to it.
+func (s openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	ref := map[string]interface{}{
+		"$ref": openAPISchemaPrefix + t.Name(),
+	}
+
+	if _, ok := s[t.Name()]; ok {
+		return ref
+	}
+
+	// Register a placeholder first so recursive types terminate.
+	s[t.Name()] = nil
+
+	properties := map[string]interface{}{}
+
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("json"), ",")
+
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = s.schema(field.Type)
+
+		omitempty := false
+
+		for _, option := range tag[1:] {
+			if option == "omitempty" {
+				omitempty = true
+			}
+		}
+
+		if !omitempty && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+
+	if len(required) != 0 {
+		schema["required"] = required
+	}
+
+	s[t.Name()] = schema
+
+	return ref
+}
+
+// openAPIParameter returns a parameter definition.
+func openAPIParameter(name, in string, required bool) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     name,
+		"in":       in,
+		"required": required,
+		"schema": map[string]interface{}{
+			"type": "string",
+		},
+	}
+}
+
+// openAPIContent returns JSON content of the given type.
+func (s openAPISchemas) content(data interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": s.schema(reflect.TypeOf(data)),
+		},
+	}
+}
+
+// openAPIDocument generates an OpenAPI document describing the server.
+func openAPIDocument(configuration *ServerConfiguration) map[string]interface{} {
+	schemas := openAPISchemas{}
+
+	paths := map[string]interface{}{}
+
+	for _, route := range openAPIRoutes(configuration) {
+		parameters := []interface{}{}
+
+		if !route.unauthenticated {
+			parameters = append(parameters, openAPIParameter("X-Broker-API-Version", "header", true))
+		}
+
+		parameters = append(parameters, openAPIParameter(requestIdentityHeader, "header", false))
+
+		for _, segment := range strings.Split(route.path, "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				parameters = append(parameters, openAPIParameter(strings.Trim(segment, "{}"), "path", true))
+			}
+		}
+
+		for _, name := range route.query {
+			parameters = append(parameters, openAPIParameter(name, "query", false))
+		}
+
+		success := map[string]interface{}{
+			"description": http.StatusText(route.status),
+		}
+
+		if route.response != nil {
+			success["content"] = schemas.content(route.response)
+		}
+
+		operation := map[string]interface{}{
+			"summary":    route.summary,
+			"parameters": parameters,
+			"responses": map[string]interface{}{
+				strconv.Itoa(route.status): success,
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content":     schemas.content(api.Error{}),
+				},
+			},
+		}
+
+		// An empty security requirement overrides the global one.
+		if route.unauthenticated {
+			operation["security"] = []interface{}{}
+		}
+
+		if route.request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  schemas.content(route.request),
+			}
+		}
+
+		if _, ok := paths[route.path]; !ok {
+			paths[route.path] = map[string]interface{}{}
+		}
+
+		paths[route.path].(map[string]interface{})[strings.ToLower(route.method)] = operation
+	}
+
+	securitySchemes := map[string]interface{}{}
+	security := []interface{}{}
+
+	if configuration.BasicAuth != nil {
+		securitySchemes["basic"] = map[string]interface{}{
+			"type":   "http",
+			"scheme": "basic",
+		}
+
+		security = append(security, map[string]interface{}{"basic": []string{}})
+	}
+
+	if configuration.Token != nil {
+		securitySchemes["bearer"] = map[string]interface{}{
+			"type":   "http",
+			"scheme": "bearer",
+		}
+
+		security = append(security, map[string]interface{}{"bearer": []string{}})
+	}
+
+	// The version is mandatory, but only set for release builds.
+	documentVersion := version.Version
+	if documentVersion == "" {
+		documentVersion = "unknown"
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "Couchbase Service Broker",
+			"version": documentVersion,
+		},
+		"paths":    paths,
+		"security": security,
+		"components": map[string]interface{}{
+			"schemas":         schemas,
+			"securitySchemes": securitySchemes,
+		},
+	}
+}
+
+// handleOpenAPI returns an OpenAPI document describing the server's API.
+func handleOpenAPI(configuration *ServerConfiguration) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	document := openAPIDocument(configuration)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		JSONResponse(w, http.StatusOK, document)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/couchbase/service-broker/pkg/api"
+
+	"github.com/ghodss/yaml"
+)
+
+// CatalogOverlay patches the service catalog before it is served.  This allows
+// catalog metadata, e.g. display names, to be customized without editing the
+// service broker configuration.  Service offerings and plans are identified by ID.
+type CatalogOverlay struct {
+	// Services are patches applied to service offerings.
+	Services []CatalogOverlayService `json:"services"`
+}
+
+// CatalogOverlayService patches a service offering.
+type CatalogOverlayService struct {
+	// ID is the ID of the service offering to patch.
+	ID string `json:"id"`
+
+	// Description, if set, replaces the service offering description.
+	Description *string `json:"description,omitempty"`
+
+	// Metadata is merged into the service offering metadata, replacing any
+	// fields with the same name e.g. displayName.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+
+	// Tags are added to the service offering tags.
+	Tags []string `json:"tags,omitempty"`
+
+	// Plans are patches applied to the service offering's plans.
+	Plans []CatalogOverlayPlan `json:"plans,omitempty"`
+}
+
+// CatalogOverlayPlan patches a service plan.
+type CatalogOverlayPlan struct {
+	// ID is the ID of the service plan to patch.
+	ID string `json:"id"`
+
+	// Description, if set, replaces the service plan description.
+	Description *string `json:"description,omitempty"`
+
+	// Metadata is merged into the service plan metadata, replacing any fields
+	// with the same name e.g. displayName.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// LoadCatalogOverlay reads a catalog overlay from a YAML or JSON file.
+func LoadCatalogOverlay(path string) (*CatalogOverlay, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	overlay := &CatalogOverlay{}
+	if err := yaml.Unmarshal(data, overlay); err != nil {
+		return nil, err
+	}
+
+	return overlay, nil
+}
+
+// mergeMetadata returns a copy of catalog metadata with the overlay fields merged
+// into it.  The original metadata is shared with the configuration, so must not be
+// modified.
+func mergeMetadata(metadata interface{}, overlay map[string]interface{}) (interface{}, error) {
+	if len(overlay) == 0 {
+		return metadata, nil
+	}
+
+	merged := map[string]interface{}{}
+
+	if metadata != nil {
+		raw, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		// Metadata that isn't an object is discarded.
+		if err := json.Unmarshal(raw, &merged); err != nil || merged == nil {
+			merged = map[string]interface{}{}
+		}
+	}
+
+	for k, v := range overlay {
+		merged[k] = v
+	}
+
+	return merged, nil
+}
+
+// Apply patches the service catalog with the overlay.  Patches for service offerings
+// or plans that do not exist are ignored.
+func (o *CatalogOverlay) Apply(catalog api.ServiceCatalog) (api.ServiceCatalog, error) {
+	services := make([]api.ServiceOffering, len(catalog.Services))
+
+	for index := range catalog.Services {
+		service := catalog.Services[index]
+
+		for _, patch := range o.Services {
+			if patch.ID != service.ID {
+				continue
+			}
+
+			if patch.Description != nil {
+				service.Description = *patch.Description
+			}
+
+			metadata, err := mergeMetadata(service.Metadata, patch.Metadata)
+			if err != nil {
+				return catalog, err
+			}
+
+			service.Metadata = metadata
+
+			if len(patch.Tags) != 0 {
+				service.Tags = append(append([]string{}, service.Tags...), patch.Tags...)
+			}
+
+			plans, err := patch.applyPlans(service.Plans)
+			if err != nil {
+				return catalog, err
+			}
+
+			service.Plans = plans
+		}
+
+		services[index] = service
+	}
+
+	return api.ServiceCatalog{Services: services}, nil
+}
+
+// applyPlans patches service plans with the overlay.
+func (o *CatalogOverlayService) applyPlans(plans []api.ServicePlan) ([]api.ServicePlan, error) {
+	patched := make([]api.ServicePlan, len(plans))
+
+	for index := range plans {
+		plan := plans[index]
+
+		for _, patch := range o.Plans {
+			if patch.ID != plan.ID {
+				continue
+			}
+
+			if patch.Description != nil {
+				plan.Description = *patch.Description
+			}
+
+			metadata, err := mergeMetadata(plan.Metadata, patch.Metadata)
+			if err != nil {
+				return nil, err
+			}
+
+			plan.Metadata = metadata
+		}
+
+		patched[index] = plan
+	}
+
+	return patched, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPKey is used to store the resolved client IP address in a request context.
+type clientIPKey struct{}
+
+// withClientIP returns a request whose context carries the client IP address.
+func withClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// clientIP returns the client IP address resolved when the request was received.
+func clientIP(r *http.Request) string {
+	ip, _ := r.Context().Value(clientIPKey{}).(string)
+
+	return ip
+}
+
+// trusted returns whether the address belongs to a trusted proxy.
+func trusted(proxies []*net.IPNet, ip net.IP) bool {
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedFor returns the chain of addresses a request was forwarded for, client first.
+// The standard Forwarded header takes precedence over X-Forwarded-For.
+func forwardedFor(r *http.Request) []string {
+	var addresses []string
+
+	for _, header := range r.Header["Forwarded"] {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					addresses = append(addresses, strings.Trim(pair[4:], `"`))
+				}
+			}
+		}
+	}
+
+	if len(addresses) != 0 {
+		return addresses
+	}
+
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, address := range strings.Split(header, ",") {
+			addresses = append(addresses, strings.TrimSpace(address))
+		}
+	}
+
+	return addresses
+}
+
+// parseForwardedAddress parses an address from a forwarding header, which may have
+// an optional port, and IPv6 addresses may be enclosed in brackets.
+func parseForwardedAddress(address string) net.IP {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+
+	return net.ParseIP(strings.Trim(address, "[]"))
+}
+
+// resolveClientIP returns the IP address of the client.  Forwarding headers are only
+// honored when the peer is a trusted proxy, in which case the chain is walked from
+// the most recent hop, skipping trusted proxies, so a client cannot spoof its address
+// by adding its own header.
+func resolveClientIP(proxies []*net.IPNet, r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted(proxies, ip) {
+		return host
+	}
+
+	addresses := forwardedFor(r)
+
+	for i := len(addresses) - 1; i >= 0; i-- {
+		forwarded := parseForwardedAddress(addresses[i])
+		if forwarded == nil {
+			break
+		}
+
+		ip = forwarded
+
+		if !trusted(proxies, ip) {
+			break
+		}
+	}
+
+	return ip.String()
+}
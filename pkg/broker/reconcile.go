@@ -0,0 +1,105 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"github.com/couchbase/service-broker/pkg/errors"
+	"github.com/couchbase/service-broker/pkg/provisioners"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
+
+	"github.com/golang/glog"
+)
+
+// reconcileServiceInstance recreates any resources belonging to a service instance that
+// have been deleted.  Service instances with operations in progress are not reconciled
+// as their resources are expected to change.
+func reconcileServiceInstance(configuration *ServerConfiguration, instanceID string) ([]string, error) {
+	instanceLock, err := lockServiceInstance(configuration, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer instanceLock.Release()
+
+	dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+	entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := serviceInstanceExists(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, errors.NewResourceNotFoundError("service instance does not exist")
+	}
+
+	op, ok, err := entry.GetString(registry.Operation)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		return nil, errors.NewResourceConflictError("existing %v operation in progress", op)
+	}
+
+	return provisioners.Reconcile(entry)
+}
+
+// ReconcileServiceInstances reconciles all service instances registered in the
+// directory.  Service instances locked by another broker replica are skipped, they
+// will be reconciled by a later sweep.  Errors are logged and reconciliation continues.
+func ReconcileServiceInstances(configuration *ServerConfiguration) {
+	directory, err := registry.NewDirectory(configuration.Namespace)
+	if err != nil {
+		glog.Infof("failed to read directory for reconciliation: %v", err)
+		return
+	}
+
+	for _, instanceID := range directory.InstanceIDs() {
+		recreated, err := reconcileServiceInstance(configuration, instanceID)
+		if err != nil {
+			if errors.IsConcurrencyError(err) {
+				continue
+			}
+
+			glog.Infof("failed to reconcile service instance %s: %v", instanceID, err)
+
+			continue
+		}
+
+		if len(recreated) != 0 {
+			glog.Infof("reconciled service instance %s, recreated %v", instanceID, recreated)
+		}
+	}
+}
+
+// reconcileServiceInstances periodically reconciles all service instances, once per
+// reconcile interval, until stopped.
+func reconcileServiceInstances(configuration *ServerConfiguration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-util.DefaultClock().After(configuration.ReconcileInterval):
+		}
+
+		ReconcileServiceInstances(configuration)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/couchbase/service-broker/pkg/client"
+
+	"github.com/golang/glog"
+
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+var (
+	// ClusterServiceBrokerResource is the Kubernetes Service Catalog resource used to
+	// register a cluster scoped Service Broker.
+	ClusterServiceBrokerResource = schema.GroupVersionResource{
+		Group:    "servicecatalog.k8s.io",
+		Version:  "v1beta1",
+		Resource: "clusterservicebrokers",
+	}
+
+	// ServiceBrokerResource is the Kubernetes Service Catalog resource used to
+	// register a namespace scoped Service Broker.
+	ServiceBrokerResource = schema.GroupVersionResource{
+		Group:    "servicecatalog.k8s.io",
+		Version:  "v1beta1",
+		Resource: "servicebrokers",
+	}
+)
+
+// Registration describes how the Service Broker registers itself with the Kubernetes
+// Service Catalog.
+type Registration struct {
+	// Name is the name of the Service Catalog broker resource.
+	Name string
+
+	// URL is the URL the Service Catalog uses to contact the Service Broker.
+	URL string
+
+	// CABundle, if set, is a PEM encoded CA certificate used by the Service Catalog
+	// to verify the Service Broker's TLS certificate.
+	CABundle []byte
+
+	// SecretName is the name of a secret in the Service Broker namespace that contains
+	// the credentials the Service Catalog authenticates with.
+	SecretName string
+
+	// Namespaced registers a namespace scoped ServiceBroker in the Service Broker
+	// namespace, rather than a cluster scoped ClusterServiceBroker.
+	Namespaced bool
+}
+
+// registrationObject returns the Service Catalog broker resource that registers the
+// Service Broker.
+func registrationObject(configuration *ServerConfiguration) *unstructured.Unstructured {
+	registration := configuration.Registration
+
+	kind := "ClusterServiceBroker"
+
+	secretRef := map[string]interface{}{
+		"name":      registration.SecretName,
+		"namespace": configuration.Namespace,
+	}
+
+	if registration.Namespaced {
+		kind = "ServiceBroker"
+
+		delete(secretRef, "namespace")
+	}
+
+	// The Service Catalog authenticates in the same way as the Service Broker expects.
+	authType := "basic"
+	if configuration.Token != nil {
+		authType = "bearer"
+	}
+
+	spec := map[string]interface{}{
+		"url": registration.URL,
+		"authInfo": map[string]interface{}{
+			authType: map[string]interface{}{
+				"secretRef": secretRef,
+			},
+		},
+	}
+
+	if registration.CABundle != nil {
+		spec["caBundle"] = base64.StdEncoding.EncodeToString(registration.CABundle)
+	}
+
+	object := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": ClusterServiceBrokerResource.GroupVersion().String(),
+			"kind":       kind,
+			"spec":       spec,
+		},
+	}
+
+	object.SetName(registration.Name)
+
+	if registration.Namespaced {
+		object.SetNamespace(configuration.Namespace)
+	}
+
+	return object
+}
+
+// Register registers the Service Broker with the Kubernetes Service Catalog, creating
+// the broker resource if it does not exist, or updating it if it does.
+func Register(clients client.Clients, configuration *ServerConfiguration) error {
+	object := registrationObject(configuration)
+
+	var resource dynamic.ResourceInterface = clients.Dynamic().Resource(ClusterServiceBrokerResource)
+	if configuration.Registration.Namespaced {
+		resource = clients.Dynamic().Resource(ServiceBrokerResource).Namespace(configuration.Namespace)
+	}
+
+	existing, err := resource.Get(context.TODO(), object.GetName(), metav1.GetOptions{})
+	if err != nil {
+		if !k8s_errors.IsNotFound(err) {
+			return err
+		}
+
+		glog.Infof("registering service broker %s at %s", object.GetName(), configuration.Registration.URL)
+
+		if _, err := resource.Create(context.TODO(), object, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	glog.Infof("updating service broker %s registration at %s", object.GetName(), configuration.Registration.URL)
+
+	existing.Object["spec"] = object.Object["spec"]
+
+	if _, err := resource.Update(context.TODO(), existing, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+
+	return nil
+}
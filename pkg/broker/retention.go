@@ -0,0 +1,91 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/errors"
+	"github.com/couchbase/service-broker/pkg/operation"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
+
+	"github.com/golang/glog"
+)
+
+// pruneOperationResult removes the expired operation result of a service instance.
+// Service instances locked by another broker replica are skipped, they will be
+// pruned by a later sweep.
+func pruneOperationResult(configuration *ServerConfiguration, instanceID string) error {
+	instanceLock, err := lockServiceInstance(configuration, instanceID)
+	if err != nil {
+		if errors.IsConcurrencyError(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	defer instanceLock.Release()
+
+	dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+	entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false)
+	if err != nil {
+		return err
+	}
+
+	if !entry.Exists() {
+		return nil
+	}
+
+	if _, err := operation.PruneResult(entry); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// PruneOperationResults removes expired operation results from all service instances
+// registered in the directory, so they do not linger when the client never polls
+// again.  Errors are logged and pruning continues.
+func PruneOperationResults(configuration *ServerConfiguration) {
+	directory, err := registry.NewDirectory(configuration.Namespace)
+	if err != nil {
+		glog.Infof("failed to read directory for operation result pruning: %v", err)
+		return
+	}
+
+	for _, instanceID := range directory.InstanceIDs() {
+		if err := pruneOperationResult(configuration, instanceID); err != nil {
+			glog.Infof("failed to prune operation result of service instance %s: %v", instanceID, err)
+		}
+	}
+}
+
+// pruneOperationResults periodically prunes expired operation results, once per
+// retention period, until stopped.
+func pruneOperationResults(configuration *ServerConfiguration, stop <-chan struct{}) {
+	interval := config.GetOptions().OperationRetention
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-util.DefaultClock().After(interval):
+		}
+
+		PruneOperationResults(configuration)
+	}
+}
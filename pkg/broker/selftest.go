@@ -0,0 +1,74 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
+
+	"github.com/golang/glog"
+)
+
+// defaultSelfTestName names the registry self test canary when this replica has no
+// lock identity.
+const defaultSelfTestName = "canary"
+
+// registrySelfTestLock guards registry self test results, which are written
+// periodically and read by readiness checks.
+var registrySelfTestLock sync.Mutex
+
+// SelfTestRegistry checks the registry is usable, recording the result so that
+// the readiness check reports not ready while it is broken.
+func SelfTestRegistry(configuration *ServerConfiguration) error {
+	name := config.GetOptions().LockIdentity
+	if name == "" {
+		name = defaultSelfTestName
+	}
+
+	err := registry.SelfTest(configuration.Namespace, name)
+
+	registrySelfTestLock.Lock()
+	defer registrySelfTestLock.Unlock()
+
+	configuration.registrySelfTestError = err
+
+	return err
+}
+
+// checkRegistry returns the result of the last registry self test.
+func checkRegistry(configuration *ServerConfiguration) error {
+	registrySelfTestLock.Lock()
+	defer registrySelfTestLock.Unlock()
+
+	return configuration.registrySelfTestError
+}
+
+// selfTestRegistry periodically checks the registry is usable, until stopped.
+func selfTestRegistry(configuration *ServerConfiguration, stop <-chan struct{}) {
+	for {
+		if err := SelfTestRegistry(configuration); err != nil {
+			glog.Warningf("registry self test failed: %v", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-util.DefaultClock().After(configuration.RegistrySelfTestInterval):
+		}
+	}
+}
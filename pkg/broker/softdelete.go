@@ -0,0 +1,254 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/errors"
+	"github.com/couchbase/service-broker/pkg/operation"
+	"github.com/couchbase/service-broker/pkg/provisioners"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
+
+	"github.com/golang/glog"
+)
+
+// softDeleteRetryInterval is how long to wait before retrying the deletion of a
+// soft-deleted service instance that failed to delete.
+const softDeleteRetryInterval = time.Minute
+
+// softDeleted returns whether a service instance has been deprovisioned, but is
+// retained until its deletion deadline so it can be undeleted.  Soft-deleted service
+// instances appear not to exist to the Open Service Broker API.
+func softDeleted(entry *registry.Entry) (bool, error) {
+	var deadline time.Time
+
+	return entry.Get(registry.DeletionDeadline, &deadline)
+}
+
+// serviceInstanceExists returns whether a service instance exists, and has not been
+// soft-deleted.
+func serviceInstanceExists(entry *registry.Entry) (bool, error) {
+	if !entry.Exists() {
+		return false, nil
+	}
+
+	deleted, err := softDeleted(entry)
+	if err != nil {
+		return false, err
+	}
+
+	return !deleted, nil
+}
+
+// softDeleteServiceInstance marks a service instance as deleted, and schedules it
+// to be deleted once the grace period has elapsed.
+func softDeleteServiceInstance(configuration *ServerConfiguration, entry *registry.Entry, instanceID string) error {
+	op, ok, err := entry.GetString(registry.Operation)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return errors.NewResourceConflictError("existing %v operation in progress", op)
+	}
+
+	deadline := util.DefaultClock().Now().Add(config.GetOptions().SoftDeleteGracePeriod)
+
+	if err := entry.Set(registry.DeletionDeadline, deadline); err != nil {
+		return err
+	}
+
+	if err := entry.Commit(); err != nil {
+		return err
+	}
+
+	glog.Infof("soft-deleted service instance %s, deleting at %v", instanceID, deadline)
+
+	go deleteServiceInstanceAfter(configuration, instanceID, deadline)
+
+	return nil
+}
+
+// undeleteServiceInstance restores a soft-deleted service instance before its
+// deletion deadline.
+func undeleteServiceInstance(configuration *ServerConfiguration, instanceID string) error {
+	instanceLock, err := lockServiceInstance(configuration, instanceID)
+	if err != nil {
+		return err
+	}
+
+	defer instanceLock.Release()
+
+	dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+	entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false)
+	if err != nil {
+		return err
+	}
+
+	if !entry.Exists() {
+		return errors.NewResourceNotFoundError("service instance does not exist")
+	}
+
+	deleted, err := softDeleted(entry)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return errors.NewResourceNotFoundError("service instance is not deleted")
+	}
+
+	op, ok, err := entry.GetString(registry.Operation)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return errors.NewResourceConflictError("existing %v operation in progress", op)
+	}
+
+	entry.Unset(registry.DeletionDeadline)
+
+	if err := entry.Commit(); err != nil {
+		return err
+	}
+
+	glog.Infof("undeleted service instance %s", instanceID)
+
+	return nil
+}
+
+// deleteServiceInstanceAfter waits until the deletion deadline, then deletes the
+// soft-deleted service instance, retrying until it succeeds.
+func deleteServiceInstanceAfter(configuration *ServerConfiguration, instanceID string, deadline time.Time) {
+	util.Sleep(deadline.Sub(util.DefaultClock().Now()))
+
+	for {
+		err := hardDeleteServiceInstance(configuration, instanceID)
+		if err == nil {
+			return
+		}
+
+		glog.Infof("failed to delete soft-deleted service instance %s, retrying in %v: %v", instanceID, softDeleteRetryInterval, err)
+
+		util.Sleep(softDeleteRetryInterval)
+	}
+}
+
+// hardDeleteServiceInstance deletes a soft-deleted service instance's resources and
+// registry entry.  Service instances that have been undeleted, or soft-deleted again
+// with a later deadline, are ignored.  The service instance is only removed from the
+// directory once it has been deleted, so a failed deletion can be resumed when the
+// broker restarts.
+func hardDeleteServiceInstance(configuration *ServerConfiguration, instanceID string) error {
+	instanceLock, err := lockServiceInstance(configuration, instanceID)
+	if err != nil {
+		return err
+	}
+
+	defer instanceLock.Release()
+
+	dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+	entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false)
+	if err != nil {
+		return err
+	}
+
+	if !entry.Exists() {
+		return nil
+	}
+
+	var deadline time.Time
+
+	ok, err := entry.Get(registry.DeletionDeadline, &deadline)
+	if err != nil {
+		return err
+	}
+
+	if !ok || util.DefaultClock().Now().Before(deadline) {
+		return nil
+	}
+
+	if err := operation.Start(entry, operation.TypeDeprovision, ""); err != nil {
+		return err
+	}
+
+	runOperation(entry, provisioners.NewDeleter().Run)
+
+	// The registry entry is only removed by a successful deletion, otherwise the
+	// failure is recorded in it.  Nothing polls for the result, so the operation
+	// is ended here, allowing it to be retried.
+	entry, err = registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, false)
+	if err != nil {
+		return err
+	}
+
+	if entry.Exists() {
+		status, _, err := entry.GetString(registry.OperationStatus)
+		if err != nil {
+			return err
+		}
+
+		if err := operation.End(entry); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("%w: soft-deleted service instance %s not deleted: %s", ErrUnexpected, instanceID, status)
+	}
+
+	deleteDirectoryInstance(configuration.Namespace, instanceID)
+
+	glog.Infof("deleted soft-deleted service instance %s", instanceID)
+
+	return nil
+}
+
+// resumeSoftDeletes schedules deletion of service instances that were soft-deleted
+// before the broker was restarted.
+func resumeSoftDeletes(configuration *ServerConfiguration) {
+	directory, err := registry.NewDirectory(configuration.Namespace)
+	if err != nil {
+		glog.Infof("failed to read directory for soft-deleted service instances: %v", err)
+		return
+	}
+
+	for _, instanceID := range directory.InstanceIDs() {
+		dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+		entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, true)
+		if err != nil {
+			glog.Infof("failed to read service instance %s: %v", instanceID, err)
+			continue
+		}
+
+		var deadline time.Time
+
+		ok, err := entry.Get(registry.DeletionDeadline, &deadline)
+		if err != nil {
+			glog.Infof("failed to read service instance %s deletion deadline: %v", instanceID, err)
+			continue
+		}
+
+		if ok {
+			go deleteServiceInstanceAfter(configuration, instanceID, deadline)
+		}
+	}
+}
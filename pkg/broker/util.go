@@ -15,25 +15,46 @@
 package broker
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	goerrors "errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/couchbase/service-broker/pkg/api"
 	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/audit"
+	"github.com/couchbase/service-broker/pkg/config"
 	"github.com/couchbase/service-broker/pkg/errors"
+	"github.com/couchbase/service-broker/pkg/lock"
 	"github.com/couchbase/service-broker/pkg/log"
+	"github.com/couchbase/service-broker/pkg/operation"
 	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/schema"
+	"github.com/couchbase/service-broker/pkg/util"
 
+	openapierrors "github.com/go-openapi/errors"
 	"github.com/go-openapi/jsonpointer"
-	"github.com/go-openapi/spec"
 	"github.com/go-openapi/strfmt"
 	"github.com/go-openapi/validate"
 	"github.com/golang/glog"
 
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // httpResponse is the canonical writer for HTTP responses.
@@ -43,10 +64,20 @@ func httpResponse(w http.ResponseWriter, status int) {
 
 // jsonRequest reads the JSON body into the give structure and raises the
 // appropriate errors on error.
-func jsonRequest(r *http.Request, data interface{}) error {
+func jsonRequest(w http.ResponseWriter, r *http.Request, configuration *ServerConfiguration, data interface{}) error {
+	limit := configuration.MaxRequestBodySize
+	if limit <= 0 {
+		limit = DefaultMaxRequestBodySize
+	}
+
 	// Parse the creation request.
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
 	if err != nil {
+		// The reader will return exactly the limit before raising an error.
+		if int64(len(body)) >= limit {
+			return errors.NewRequestTooLargeError("request body exceeds maximum size of %d bytes", limit)
+		}
+
 		return fmt.Errorf("unable to read body: %w", err)
 	}
 
@@ -62,15 +93,28 @@ func jsonRequest(r *http.Request, data interface{}) error {
 // JSONResponse sends generic JSON data back to the client and replies
 // with a HTTP status code.
 func JSONResponse(w http.ResponseWriter, status int, data interface{}) {
-	resp, err := json.Marshal(data)
+	var resp []byte
+
+	var err error
+
+	// Pretty printing is intended for humans debugging the API.
+	if config.GetOptions().PrettyJSON {
+		resp, err = json.MarshalIndent(data, "", "  ")
+	} else {
+		resp, err = json.Marshal(data)
+	}
+
 	if err != nil {
 		glog.Infof("failed to marshal body: %v", err)
 		httpResponse(w, http.StatusInternalServerError)
+
+		return
 	}
 
 	glog.V(log.LevelDebug).Infof("JSON rsp: %s", string(resp))
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
 
 	httpResponse(w, status)
 
@@ -98,6 +142,22 @@ func translateError(err error) (int, api.ErrorType) {
 		return http.StatusNotFound, api.ErrorResourceNotFound
 	case errors.IsResourceGoneError(err):
 		return http.StatusGone, api.ErrorResourceGone
+	case errors.IsMethodNotAllowedError(err):
+		return http.StatusMethodNotAllowed, api.ErrorMethodNotAllowed
+	case errors.IsForbiddenError(err):
+		return http.StatusForbidden, api.ErrorForbidden
+	case errors.IsRequestTooLargeError(err):
+		return http.StatusRequestEntityTooLarge, api.ErrorParameterError
+	case errors.IsNamespaceConflictError(err):
+		return http.StatusUnprocessableEntity, api.ErrorNamespaceConflict
+	case errors.IsQuotaExceededError(err):
+		return http.StatusTooManyRequests, api.ErrorQuotaExceeded
+	case errors.IsOperationTimeoutError(err):
+		return http.StatusGatewayTimeout, api.ErrorOperationTimeout
+	case errors.IsOperationCancelledError(err):
+		return http.StatusUnprocessableEntity, api.ErrorOperationCancelled
+	case errors.IsConcurrencyError(err):
+		return http.StatusUnprocessableEntity, api.ErrorConcurrencyError
 	default:
 		return http.StatusInternalServerError, api.ErrorInternalServerError
 	}
@@ -107,8 +167,9 @@ func translateError(err error) (int, api.ErrorType) {
 func jsonError(w http.ResponseWriter, err error) {
 	status, apiError := translateError(err)
 	e := &api.Error{
-		Error:       apiError,
-		Description: err.Error(),
+		Error:              apiError,
+		Description:        err.Error(),
+		ValidationFailures: errors.ValidationFailures(err),
 	}
 	JSONResponse(w, status, e)
 }
@@ -120,9 +181,10 @@ func jsonErrorUsable(w http.ResponseWriter, err error) {
 	status, apiError := translateError(err)
 	usable := true
 	e := &api.Error{
-		Error:          apiError,
-		Description:    err.Error(),
-		InstanceUsable: &usable,
+		Error:              apiError,
+		Description:        err.Error(),
+		InstanceUsable:     &usable,
+		ValidationFailures: errors.ValidationFailures(err),
 	}
 	JSONResponse(w, status, e)
 }
@@ -163,6 +225,119 @@ func getSingleParameter(r *http.Request, name string) (string, error) {
 	return value, nil
 }
 
+// maygetBoolParameter gets a named boolean parameter from the request URL.
+func maygetBoolParameter(r *http.Request, name string) (bool, bool, error) {
+	value, exists, err := maygetSingleParameter(r, name)
+	if err != nil || !exists {
+		return false, exists, err
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, true, errors.NewQueryError("query parameter %s not a boolean: %v", name, err)
+	}
+
+	return b, true, nil
+}
+
+// filterCatalog optionally filters the service catalog by tag, service name and
+// plan free and bindable flags given as query parameters.  Service offerings
+// that have no plans left after plan filtering are omitted.
+func filterCatalog(catalog api.ServiceCatalog, r *http.Request) (api.ServiceCatalog, error) {
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return catalog, errors.NewQueryError("malformed query data: %v", err)
+	}
+
+	tags := query["tag"]
+
+	serviceName, serviceNameExists, err := maygetSingleParameter(r, "service_name")
+	if err != nil {
+		return catalog, err
+	}
+
+	free, freeExists, err := maygetBoolParameter(r, "free")
+	if err != nil {
+		return catalog, err
+	}
+
+	bindable, bindableExists, err := maygetBoolParameter(r, "bindable")
+	if err != nil {
+		return catalog, err
+	}
+
+	if len(tags) == 0 && !serviceNameExists && !freeExists && !bindableExists {
+		return catalog, nil
+	}
+
+	filtered := api.ServiceCatalog{
+		Services: []api.ServiceOffering{},
+	}
+
+	for _, service := range catalog.Services {
+		if serviceNameExists && service.Name != serviceName {
+			continue
+		}
+
+		if !hasTags(service.Tags, tags) {
+			continue
+		}
+
+		if freeExists || bindableExists {
+			plans := []api.ServicePlan{}
+
+			for _, plan := range service.Plans {
+				planFree := plan.Free == nil || *plan.Free
+
+				planBindable := service.Bindable
+				if plan.Bindable != nil {
+					planBindable = *plan.Bindable
+				}
+
+				if freeExists && planFree != free {
+					continue
+				}
+
+				if bindableExists && planBindable != bindable {
+					continue
+				}
+
+				plans = append(plans, plan)
+			}
+
+			if len(plans) == 0 {
+				continue
+			}
+
+			service.Plans = plans
+		}
+
+		filtered.Services = append(filtered.Services, service)
+	}
+
+	return filtered, nil
+}
+
+// hasTags returns whether all the required tags are present.
+func hasTags(tags, required []string) bool {
+	for _, r := range required {
+		found := false
+
+		for _, tag := range tags {
+			if tag == r {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 // asyncRequired is called when the handler only supports async requests.
 // Don't use getSingleParameter as we need to selectively return the correct
 // status codes.
@@ -179,6 +354,129 @@ func asyncRequired(r *http.Request) error {
 	return nil
 }
 
+// asyncOptional is called when the handler supports async requests, and sync requests
+// only if the operator has made async operation optional for the operation.  It returns
+// whether the operation must be run synchronously, as the client does not support async
+// operation.
+func asyncOptional(configuration *ServerConfiguration, op operation.Type, r *http.Request) (bool, error) {
+	err := asyncRequired(r)
+	if err != nil && errors.IsAsyncRequiredError(err) && configuration.AsyncOptional[op] {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// mergeParameters merges parameters into a base set of parameters, returning a new
+// set.  Objects are merged recursively, any other value in the parameters replaces
+// the corresponding value in the base.
+func mergeParameters(base, parameters *runtime.RawExtension) (*runtime.RawExtension, error) {
+	var baseValue, value interface{}
+
+	if len(base.Raw) != 0 {
+		if err := json.Unmarshal(base.Raw, &baseValue); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(parameters.Raw) != 0 {
+		if err := json.Unmarshal(parameters.Raw, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := json.Marshal(mergeParameterValues(baseValue, value))
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.RawExtension{Raw: raw}, nil
+}
+
+// mergeParameterValues recursively merges a parameter value into a base value.
+func mergeParameterValues(base, value interface{}) interface{} {
+	if value == nil {
+		return base
+	}
+
+	baseObject, baseOK := base.(map[string]interface{})
+	object, ok := value.(map[string]interface{})
+
+	if !baseOK || !ok {
+		return value
+	}
+
+	for k, v := range object {
+		baseObject[k] = mergeParameterValues(baseObject[k], v)
+	}
+
+	return baseObject
+}
+
+// synchronousDelete returns whether the service plan named by a delete request is always
+// deleted synchronously.  The request is validated later, so an invalid service plan is
+// treated as asynchronous.
+func synchronousDelete(config *v1.ServiceBrokerConfig, r *http.Request) bool {
+	query := r.URL.Query()
+
+	plan, err := getServicePlan(config, query.Get("service_id"), query.Get("plan_id"))
+	if err != nil {
+		return false
+	}
+
+	return plan.SynchronousDelete
+}
+
+// resolveDashboardClientSecrets populates dashboard client secrets that are stored
+// in a Kubernetes secret.
+func resolveDashboardClientSecrets(config *v1.ServiceBrokerConfig, catalog *api.ServiceCatalog, namespace string) error {
+	for index := range catalog.Services {
+		service := &catalog.Services[index]
+
+		if service.DashboardClient == nil {
+			continue
+		}
+
+		offering, err := getServiceOffering(config, service.ID)
+		if err != nil {
+			return err
+		}
+
+		ref := offering.DashboardClient.SecretRef
+		if ref == nil {
+			continue
+		}
+
+		secret, err := getSecretKey(namespace, ref.Name, ref.Key)
+		if err != nil {
+			return err
+		}
+
+		service.DashboardClient.Secret = secret
+	}
+
+	return nil
+}
+
+// getSecretKey returns a key from a secret.
+func getSecretKey(namespace, name, key string) (string, error) {
+	secret, err := config.Clients().Kubernetes().CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return "", errors.NewConfigurationError("secret %s not found", name)
+		}
+
+		return "", err
+	}
+
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", errors.NewConfigurationError("secret %s has no key %s", name, key)
+	}
+
+	return string(value), nil
+}
+
 // getServiceOffering returns the service offering for a given service offering ID.
 func getServiceOffering(config *v1.ServiceBrokerConfig, serviceID string) (*v1.ServiceOffering, error) {
 	for index, service := range config.Spec.Catalog.Services {
@@ -215,6 +513,119 @@ func validateServicePlan(config *v1.ServiceBrokerConfig, serviceID, planID strin
 	return nil
 }
 
+// verifyPredecessorBinding checks that a binding being rotated exists and belongs to
+// the same service instance.
+func verifyPredecessorBinding(namespace, instanceID, bindingID string) error {
+	entry, err := registry.New(registry.ServiceBinding, namespace, bindingID, true)
+	if err != nil {
+		return err
+	}
+
+	if !entry.Exists() {
+		return errors.NewParameterError("predecessor service binding %s not found", bindingID)
+	}
+
+	predecessorInstanceID, _, err := entry.GetString(registry.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	if predecessorInstanceID != instanceID {
+		return errors.NewParameterError("predecessor service binding %s does not belong to service instance %s", bindingID, instanceID)
+	}
+
+	return nil
+}
+
+var (
+	// rolloutRandom selects service plans for default plan rollouts, unless the
+	// server is configured with its own source.
+	rolloutRandom = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint:gosec
+
+	// rolloutRandomLock serializes service plan selection.
+	rolloutRandomLock sync.Mutex
+)
+
+// rolloutSelection returns a random number in the range [0, n) for service plan
+// selection.
+func rolloutSelection(configuration *ServerConfiguration, n int) int {
+	rolloutRandomLock.Lock()
+	defer rolloutRandomLock.Unlock()
+
+	if configuration.PlanRolloutSource != nil {
+		return rand.New(configuration.PlanRolloutSource).Intn(n) // nolint:gosec
+	}
+
+	return rolloutRandom.Intn(n)
+}
+
+// selectRolloutPlan returns a service plan ID selected at random, in proportion to its
+// weight, from the service offering's default plan rollout.
+func selectRolloutPlan(configuration *ServerConfiguration, service *v1.ServiceOffering) (string, error) {
+	total := 0
+
+	for _, weight := range service.DefaultPlanRollout {
+		total += weight.Weight
+	}
+
+	selection := rolloutSelection(configuration, total)
+
+	for _, weight := range service.DefaultPlanRollout {
+		if selection >= weight.Weight {
+			selection -= weight.Weight
+			continue
+		}
+
+		for _, plan := range service.Plans {
+			if plan.Name == weight.Plan {
+				glog.Infof("selected service plan %s for service offering %s", plan.Name, service.Name)
+				return plan.ID, nil
+			}
+		}
+
+		return "", errors.NewConfigurationError("service plan %s not defined for service offering %s", weight.Plan, service.ID)
+	}
+
+	return "", fmt.Errorf("%w: weighted service plan selection failed", ErrUnexpected)
+}
+
+// resolveRolloutPlan returns the service plan ID for a service instance created without
+// one.  This is only allowed when the service offering has a default plan rollout.
+// Existing service instances retain the plan they were created with, so retried
+// requests are stable.
+func resolveRolloutPlan(configuration *ServerConfiguration, instanceID, serviceID string) (string, error) {
+	service, err := getServiceOffering(config.Config(), serviceID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(service.DefaultPlanRollout) == 0 {
+		return "", errors.NewParameterError("service offering %s requires a service plan", serviceID)
+	}
+
+	dirent := getDirectoryInstance(configuration.Namespace, instanceID)
+
+	entry, err := registry.New(registry.ServiceInstance, dirent.Namespace, instanceID, true)
+	if err != nil {
+		return "", err
+	}
+
+	if entry.Exists() {
+		planID, ok, err := entry.GetString(registry.PlanID)
+		if err != nil {
+			return "", err
+		}
+
+		if !ok {
+			return "", fmt.Errorf("%w: unable to lookup existing plan ID", ErrUnexpected)
+		}
+
+		return planID, nil
+	}
+
+	return selectRolloutPlan(configuration, service)
+}
+
 // schemaType is the type of schema we are referring to, either for a service instance
 // or a service binding.
 type schemaType string
@@ -273,91 +684,533 @@ func getSchema(config *v1.ServiceBrokerConfig, serviceID, planID string, t schem
 	}
 }
 
-// validateParameters validates any supplied parameters against an JSON schema if it exists.
-func validateParameters(config *v1.ServiceBrokerConfig, serviceID, planID string, t schemaType, o schemaOperation, parametersRaw *runtime.RawExtension) error {
+// defaultParameters fills in any parameters that are omitted, but have a default defined
+// by the JSON schema if it exists.
+func defaultParameters(config *v1.ServiceBrokerConfig, serviceID, planID string, t schemaType, o schemaOperation, parametersRaw *runtime.RawExtension) (*runtime.RawExtension, error) {
 	schemaRaw, err := getSchema(config, serviceID, planID, t, o)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if schemaRaw != nil {
-		// Default to an empty object, that way we can detect when required
-		// fields are missing.
-		data := []byte("{}")
-		if parametersRaw != nil {
-			data = parametersRaw.Raw
-		}
+	if schemaRaw == nil {
+		return parametersRaw, nil
+	}
 
-		schema := &spec.Schema{}
-		if err := json.Unmarshal(schemaRaw.Parameters.Raw, schema); err != nil {
-			return errors.NewParameterError("schema unmarshal failed: %v", err)
-		}
+	data := []byte("{}")
+	if parametersRaw != nil {
+		data = parametersRaw.Raw
+	}
 
-		var parameters interface{}
-		if err := json.Unmarshal(data, &parameters); err != nil {
-			return errors.NewParameterError("parameters unmarshal failed: %v", err)
-		}
+	parametersSchema, err := schema.Parse(schemaRaw.Parameters.Raw)
+	if err != nil {
+		return nil, errors.NewParameterError("schema unmarshal failed: %v", err)
+	}
 
-		if err := validate.AgainstSchema(schema, parameters, strfmt.NewFormats()); err != nil {
-			return errors.NewValidationError("schema validation failed: %v", err)
-		}
+	var parameters interface{}
+	if err := json.Unmarshal(data, &parameters); err != nil {
+		return nil, errors.NewParameterError("parameters unmarshal failed: %v", err)
 	}
 
-	return nil
-}
+	parameters = schema.Default(parametersSchema, parameters)
 
-// planUpdatable accepts the service ID the original plan ID, and the new one, returning
-// an error if the service catalog doesn't allow it.
-func planUpdatable(config *v1.ServiceBrokerConfig, serviceID, planID, newPlanID string) error {
-	service, err := getServiceOffering(config, serviceID)
-	if err != nil {
-		return err
+	// Preserve omitted parameters when there is nothing to default.
+	if object, ok := parameters.(map[string]interface{}); ok && len(object) == 0 && parametersRaw == nil {
+		return nil, nil
 	}
 
-	if !service.PlanUpdatable && (planID != newPlanID) {
-		return errors.NewParameterError("service plan %s for service %s cannot be updated", planID, serviceID)
+	raw, err := json.Marshal(parameters)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return &runtime.RawExtension{Raw: raw}, nil
 }
 
-// verifyBindable returns an error if the plan cannot be bound to.
-func verifyBindable(config *v1.ServiceBrokerConfig, serviceID, planID string) error {
-	service, err := getServiceOffering(config, serviceID)
-	if err != nil {
-		return err
-	}
+// dnsLabelIllegalCharacters matches runs of characters that may not appear in a
+// DNS-1123 label.
+var dnsLabelIllegalCharacters = regexp.MustCompile(`[^a-z0-9-]+`)
 
-	plan, err := getServicePlan(config, serviceID, planID)
-	if err != nil {
-		return err
+// sanitizeParameter applies a sanitizer's rules to a single string parameter.
+func sanitizeParameter(sanitizer *v1.ParameterSanitizer, value string) (string, error) {
+	if sanitizer.Trim {
+		value = strings.TrimSpace(value)
 	}
 
-	bindable := service.Bindable
-	if plan.Bindable != nil {
-		bindable = *plan.Bindable
+	if sanitizer.Lowercase {
+		value = strings.ToLower(value)
 	}
 
-	if !bindable {
-		return errors.NewConfigurationError("service plan %s for service %s is not bindable", planID, serviceID)
+	if sanitizer.DNSLabel {
+		value = strings.Trim(dnsLabelIllegalCharacters.ReplaceAllString(value, "-"), "-")
+
+		if errs := validation.IsDNS1123Label(value); len(errs) != 0 {
+			return "", errors.NewParameterError("parameter %s cannot be sanitized to a valid label: %s", sanitizer.Path, strings.Join(errs, ", "))
+		}
 	}
 
-	return nil
+	return value, nil
 }
 
-// getNamespace returns the namespace to provision resources in.  This is the namespace
-// the broker lives in by default, however when operating as a kubernetes cluster service
-// broker then this information is passed as request context.
-func getNamespace(context *runtime.RawExtension, namespace string) (string, error) {
-	if context != nil {
-		var ctx interface{}
+// sanitizeParameters applies any sanitizers defined for the schema to the parameters,
+// so that messy user input is cleaned up before it is validated and used.
+func sanitizeParameters(config *v1.ServiceBrokerConfig, serviceID, planID string, t schemaType, o schemaOperation, parametersRaw *runtime.RawExtension) (*runtime.RawExtension, error) {
+	schemaRaw, err := getSchema(config, serviceID, planID, t, o)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := json.Unmarshal(context.Raw, &ctx); err != nil {
-			glog.Infof("unmarshal of client context failed: %v", err)
-			return "", err
+	if schemaRaw == nil || len(schemaRaw.Sanitizers) == 0 || parametersRaw == nil {
+		return parametersRaw, nil
+	}
+
+	var parameters interface{}
+	if err := json.Unmarshal(parametersRaw.Raw, &parameters); err != nil {
+		return nil, errors.NewParameterError("parameters unmarshal failed: %v", err)
+	}
+
+	for i := range schemaRaw.Sanitizers {
+		sanitizer := &schemaRaw.Sanitizers[i]
+
+		pointer, err := jsonpointer.New(sanitizer.Path)
+		if err != nil {
+			return nil, errors.NewConfigurationError("parameter sanitizer path %s malformed: %v", sanitizer.Path, err)
 		}
 
-		pointer, err := jsonpointer.New("/namespace")
+		v, _, err := pointer.Get(parameters)
+		if err != nil {
+			continue
+		}
+
+		value, ok := v.(string)
+		if !ok {
+			return nil, errors.NewParameterError("parameter %s must be a string", sanitizer.Path)
+		}
+
+		value, err = sanitizeParameter(sanitizer, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := pointer.Set(parameters, value); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := json.Marshal(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.RawExtension{Raw: raw}, nil
+}
+
+// validationConstraints maps schema validation failure codes to the JSON schema
+// keyword that failed.
+var validationConstraints = map[int32]string{
+	openapierrors.InvalidTypeCode:           "type",
+	openapierrors.RequiredFailCode:          "required",
+	openapierrors.TooLongFailCode:           "maxLength",
+	openapierrors.TooShortFailCode:          "minLength",
+	openapierrors.PatternFailCode:           "pattern",
+	openapierrors.EnumFailCode:              "enum",
+	openapierrors.MultipleOfFailCode:        "multipleOf",
+	openapierrors.MaxFailCode:               "maximum",
+	openapierrors.MinFailCode:               "minimum",
+	openapierrors.UniqueFailCode:            "uniqueItems",
+	openapierrors.MaxItemsFailCode:          "maxItems",
+	openapierrors.MinItemsFailCode:          "minItems",
+	openapierrors.NoAdditionalItemsCode:     "additionalItems",
+	openapierrors.TooFewPropertiesCode:      "minProperties",
+	openapierrors.TooManyPropertiesCode:     "maxProperties",
+	openapierrors.UnallowedPropertyCode:     "additionalProperties",
+	openapierrors.FailedAllPatternPropsCode: "patternProperties",
+}
+
+// validationFailures translates schema validation errors into a list of the parameters
+// that failed, identified by JSON pointer.
+func validationFailures(err error) []api.ValidationFailure {
+	switch t := err.(type) {
+	case *openapierrors.CompositeError:
+		failures := []api.ValidationFailure{}
+
+		for _, e := range t.Errors {
+			failures = append(failures, validationFailures(e)...)
+		}
+
+		return failures
+	case *openapierrors.Validation:
+		path := ""
+
+		if t.Name != "" && t.Name != "." {
+			for _, token := range strings.Split(strings.TrimPrefix(t.Name, "."), ".") {
+				path += "/" + jsonpointer.Escape(token)
+			}
+		}
+
+		return []api.ValidationFailure{
+			{
+				Path:       path,
+				Constraint: validationConstraints[t.Code()],
+				Message:    t.Error(),
+			},
+		}
+	default:
+		return []api.ValidationFailure{
+			{
+				Message: err.Error(),
+			},
+		}
+	}
+}
+
+// validateParameters validates any supplied parameters against an JSON schema if it exists.
+func validateParameters(config *v1.ServiceBrokerConfig, serviceID, planID string, t schemaType, o schemaOperation, parametersRaw *runtime.RawExtension) error {
+	schemaRaw, err := getSchema(config, serviceID, planID, t, o)
+	if err != nil {
+		return err
+	}
+
+	if schemaRaw != nil {
+		// Default to an empty object, that way we can detect when required
+		// fields are missing.
+		data := []byte("{}")
+		if parametersRaw != nil {
+			data = parametersRaw.Raw
+		}
+
+		parametersSchema, err := schema.Parse(schemaRaw.Parameters.Raw)
+		if err != nil {
+			return errors.NewParameterError("schema unmarshal failed: %v", err)
+		}
+
+		var parameters interface{}
+		if err := json.Unmarshal(data, &parameters); err != nil {
+			return errors.NewParameterError("parameters unmarshal failed: %v", err)
+		}
+
+		if err := validate.AgainstSchema(parametersSchema, parameters, strfmt.NewFormats()); err != nil {
+			return errors.NewValidationErrorWithFailures(validationFailures(err), "schema validation failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// verifyServiceInstanceUsable checks that a service instance has been successfully
+// provisioned, so it can be bound to.  Service instances with an operation in progress,
+// or whose last operation failed, are rejected.
+func verifyServiceInstanceUsable(entry *registry.Entry, instanceID string) error {
+	op, ok, err := entry.GetString(registry.Operation)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return errors.NewParameterError("service instance %s %s operation in progress", instanceID, op)
+	}
+
+	status, ok, err := entry.GetString(registry.OperationLastStatus)
+	if err != nil {
+		return err
+	}
+
+	if ok && status != "" {
+		return errors.NewParameterError("service instance %s last operation failed: %s", instanceID, status)
+	}
+
+	return nil
+}
+
+// planUpdatable accepts the service ID the original plan ID, and the new one, returning
+// an error if the service catalog doesn't allow it.
+func planUpdatable(config *v1.ServiceBrokerConfig, serviceID, planID, newPlanID string) error {
+	service, err := getServiceOffering(config, serviceID)
+	if err != nil {
+		return err
+	}
+
+	if !service.PlanUpdatable && (planID != newPlanID) {
+		return errors.NewParameterError("service plan %s for service %s cannot be updated", planID, serviceID)
+	}
+
+	return nil
+}
+
+// verifyBindable returns an error if the plan cannot be bound to.
+func verifyBindable(config *v1.ServiceBrokerConfig, serviceID, planID string) error {
+	service, err := getServiceOffering(config, serviceID)
+	if err != nil {
+		return err
+	}
+
+	plan, err := getServicePlan(config, serviceID, planID)
+	if err != nil {
+		return err
+	}
+
+	bindable := service.Bindable
+	if plan.Bindable != nil {
+		bindable = *plan.Bindable
+	}
+
+	if !bindable {
+		return errors.NewConfigurationError("service plan %s for service %s is not bindable", planID, serviceID)
+	}
+
+	return nil
+}
+
+// Service offering requirements that platforms must support to receive the associated
+// service binding response fields.
+const (
+	requiresSyslogDrain     = "syslog_drain"
+	requiresRouteForwarding = "route_forwarding"
+	requiresVolumeMount     = "volume_mount"
+)
+
+// getCapabilities returns the service offering requirements that the platform supports,
+// as listed by the request context "capabilities" attribute.
+func getCapabilities(context *runtime.RawExtension) ([]string, error) {
+	if context == nil || len(context.Raw) == 0 {
+		return nil, nil
+	}
+
+	ctx := struct {
+		Capabilities []string `json:"capabilities"`
+	}{}
+
+	if err := json.Unmarshal(context.Raw, &ctx); err != nil {
+		return nil, errors.NewParameterError("request context capabilities must be a list of strings: %v", err)
+	}
+
+	return ctx.Capabilities, nil
+}
+
+// supports returns whether the platform supports a service offering requirement.
+func supports(capabilities []string, requirement string) bool {
+	return hasTags(capabilities, []string{requirement})
+}
+
+// verifyRequires returns an error if the service offering requires something that
+// the platform does not support, otherwise the platform's capabilities.
+func verifyRequires(config *v1.ServiceBrokerConfig, serviceID string, context *runtime.RawExtension) ([]string, error) {
+	service, err := getServiceOffering(config, serviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities, err := getCapabilities(context)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, requirement := range service.Requires {
+		if !supports(capabilities, requirement) {
+			return nil, errors.NewParameterError("service %s requires %s, which the platform does not support", serviceID, requirement)
+		}
+	}
+
+	return capabilities, nil
+}
+
+// bindingResponse returns the response for a new service binding.  Fields associated
+// with a service offering requirement are only returned when the platform supports it.
+func bindingResponse(entry *registry.Entry, capabilities []string) (*api.GetServiceBindingResponse, error) {
+	response := &api.GetServiceBindingResponse{
+		Credentials: &runtime.RawExtension{},
+	}
+
+	if _, err := entry.Get(registry.Credentials, response.Credentials); err != nil {
+		return nil, err
+	}
+
+	if supports(capabilities, requiresSyslogDrain) {
+		if _, err := entry.Get(registry.SyslogDrainURL, &response.SyslogDrainURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if supports(capabilities, requiresRouteForwarding) {
+		if _, err := entry.Get(registry.RouteServiceURL, &response.RouteServiceURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if supports(capabilities, requiresVolumeMount) {
+		if _, err := entry.Get(registry.VolumeMounts, &response.VolumeMounts); err != nil {
+			return nil, err
+		}
+	}
+
+	var expiry time.Time
+
+	ok, err := entry.Get(registry.BindingExpiresAt, &expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		response.Metadata = &api.BindingMetadata{
+			ExpiresAt: expiry.UTC().Format(time.RFC3339),
+		}
+	}
+
+	return response, nil
+}
+
+// bindingExpired returns whether a service binding's credentials have expired.
+func bindingExpired(entry *registry.Entry) (bool, error) {
+	var expiry time.Time
+
+	ok, err := entry.Get(registry.BindingExpiresAt, &expiry)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return util.DefaultClock().Now().After(expiry), nil
+}
+
+// setBindingExpiry records when a service binding's credentials expire, if the
+// service plan limits their lifetime.
+func setBindingExpiry(config *v1.ServiceBrokerConfig, serviceID, planID string, entry *registry.Entry) error {
+	plan, err := getServicePlan(config, serviceID, planID)
+	if err != nil {
+		return err
+	}
+
+	if plan.BindingTTL == nil {
+		return nil
+	}
+
+	return entry.Set(registry.BindingExpiresAt, util.DefaultClock().Now().Add(plan.BindingTTL.Duration))
+}
+
+// defaultBindingEndpointParameter is the binding parameter used to select an endpoint
+// when one is not configured.
+const defaultBindingEndpointParameter = "/endpoint"
+
+// setBindingEndpoint records the service instance endpoint selected by a service binding's
+// parameters, if the service plan allows selection.  The available endpoints are read from
+// the service instance registry, inherited by the service binding.
+func setBindingEndpoint(config *v1.ServiceBrokerConfig, serviceID, planID string, parameters *runtime.RawExtension, entry *registry.Entry) error {
+	plan, err := getServicePlan(config, serviceID, planID)
+	if err != nil {
+		return err
+	}
+
+	endpoints := plan.BindingEndpoints
+	if endpoints == nil {
+		return nil
+	}
+
+	available, ok, err := entry.GetUser(endpoints.Registry)
+	if err != nil {
+		return err
+	}
+
+	values, isMap := available.(map[string]interface{})
+	if !ok || !isMap {
+		return errors.NewConfigurationError("service instance registry key %s does not define endpoints", endpoints.Registry)
+	}
+
+	path := endpoints.Parameter
+	if path == "" {
+		path = defaultBindingEndpointParameter
+	}
+
+	name := endpoints.Default
+
+	if parameters != nil && len(parameters.Raw) != 0 {
+		var params interface{}
+
+		if err := json.Unmarshal(parameters.Raw, &params); err != nil {
+			return errors.NewParameterError("unable to parse parameters: %v", err)
+		}
+
+		pointer, err := jsonpointer.New(path)
+		if err != nil {
+			return errors.NewConfigurationError("binding endpoint parameter %s malformed: %v", path, err)
+		}
+
+		if v, _, err := pointer.Get(params); err == nil {
+			s, ok := v.(string)
+			if !ok {
+				return errors.NewParameterError("parameter %s must be a string", path)
+			}
+
+			name = s
+		}
+	}
+
+	if name == "" {
+		return errors.NewParameterError("parameter %s must be specified", path)
+	}
+
+	value, ok := values[name]
+	if !ok {
+		names := make([]string, 0, len(values))
+		for endpoint := range values {
+			names = append(names, endpoint)
+		}
+
+		sort.Strings(names)
+
+		return errors.NewParameterError("endpoint %s not available, must be one of %s", name, strings.Join(names, ", "))
+	}
+
+	return entry.Set(registry.Endpoint, value)
+}
+
+// verifyBindingLimit checks that a new service binding would not exceed the
+// service plan's limit of bindings per service instance.
+func verifyBindingLimit(config *v1.ServiceBrokerConfig, serviceID, planID, namespace, instanceID string) error {
+	plan, err := getServicePlan(config, serviceID, planID)
+	if err != nil {
+		return err
+	}
+
+	if plan.MaxBindingsPerInstance == nil {
+		return nil
+	}
+
+	entries, err := registry.List(registry.ServiceBinding, namespace)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+
+	for _, entry := range entries {
+		id, ok, err := entry.GetString(registry.InstanceID)
+		if err != nil {
+			return err
+		}
+
+		if ok && id == instanceID {
+			count++
+		}
+	}
+
+	if count >= *plan.MaxBindingsPerInstance {
+		return errors.NewQuotaExceededError("limit of %d service bindings reached for service instance %s", *plan.MaxBindingsPerInstance, instanceID)
+	}
+
+	return nil
+}
+
+// getNamespace returns the namespace to provision resources in.  This is the namespace
+// the broker lives in by default, however when operating as a kubernetes cluster service
+// broker then this information is passed as request context.
+func getNamespace(context *runtime.RawExtension, namespace string) (string, error) {
+	if context != nil {
+		var ctx interface{}
+
+		if err := json.Unmarshal(context.Raw, &ctx); err != nil {
+			glog.Infof("unmarshal of client context failed: %v", err)
+			return "", err
+		}
+
+		pointer, err := jsonpointer.New("/namespace")
 		if err != nil {
 			glog.Infof("failed to parse JSON pointer: %v", err)
 			return "", err
@@ -379,6 +1232,119 @@ func getNamespace(context *runtime.RawExtension, namespace string) (string, erro
 	return namespace, nil
 }
 
+// verifyNamespaceUnchanged checks that an update request context does not move the
+// service instance to a different namespace.  Resources cannot be safely migrated
+// between namespaces, so such requests are rejected.
+func verifyNamespaceUnchanged(entry *registry.Entry, context *runtime.RawExtension) error {
+	namespace, err := getNamespace(context, "")
+	if err != nil {
+		return err
+	}
+
+	if namespace == "" {
+		return nil
+	}
+
+	current, ok, err := entry.GetString(registry.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if ok && namespace != current {
+		return errors.NewParameterError("service instance cannot be moved from namespace %s to %s", current, namespace)
+	}
+
+	return nil
+}
+
+// getQueryParameters returns the request query parameters that templates are allowed
+// to read.  Where a parameter is specified multiple times, only the first is used.
+func getQueryParameters(r *http.Request) map[string]string {
+	query := map[string]string{}
+
+	for _, name := range config.GetOptions().QueryParameters {
+		if values, ok := r.URL.Query()[name]; ok && len(values) > 0 {
+			query[name] = values[0]
+		}
+	}
+
+	return query
+}
+
+// setClientCertificate records the subject and fingerprint of the verified client
+// certificate, if any, so templates can tell which platform made the request.
+func setClientCertificate(r *http.Request, entry *registry.Entry) error {
+	certificate := clientCertificate(r)
+	if certificate == nil {
+		return nil
+	}
+
+	if err := entry.Set(registry.ClientCertificateSubject, certificate.Subject.String()); err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(certificate.Raw)
+
+	return entry.Set(registry.ClientCertificateFingerprint, hex.EncodeToString(digest[:]))
+}
+
+// validateID checks that a service instance or binding ID, if specified, is within
+// the configured maximum length and can be used in Kubernetes resource names.
+func validateID(name, id string) error {
+	if id == "" {
+		return nil
+	}
+
+	maxIDLength := config.GetOptions().MaxIDLength
+
+	if len(id) > maxIDLength {
+		return errors.NewParameterError("%s '%s' exceeds maximum length of %d", name, id, maxIDLength)
+	}
+
+	if errs := validation.IsDNS1123Subdomain(id); len(errs) != 0 {
+		return errors.NewParameterError("%s '%s' is illegal: %s", name, id, strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// validateNamespace checks that a namespace to provision resources in is legal and
+// exists.  The broker namespace always exists, so is not checked.  If configured to
+// do so, a missing namespace will be created.
+func validateNamespace(namespace, brokerNamespace string) error {
+	if namespace == brokerNamespace {
+		return nil
+	}
+
+	if errs := validation.IsDNS1123Label(namespace); len(errs) != 0 {
+		return errors.NewParameterError("request context namespace '%s' is illegal: %s", namespace, strings.Join(errs, ", "))
+	}
+
+	if _, err := config.Clients().Kubernetes().CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{}); err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return err
+		}
+
+		if !config.GetOptions().CreateNamespaces {
+			return errors.NewParameterError("request context namespace '%s' does not exist", namespace)
+		}
+
+		glog.Infof("creating namespace %s", namespace)
+
+		object := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: namespace,
+			},
+		}
+
+		if _, err := config.Clients().Kubernetes().CoreV1().Namespaces().Create(context.TODO(), object, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // registerDirectoryInstance allows the namespace of the registry to be chosen so garbage
 // collection works as intended.  All service instances get a directory entry for simplicity.
 func registerDirectoryInstance(config *v1.ServiceBrokerConfig, context *runtime.RawExtension, namespace, instanceID, serviceID, planID string) (*registry.DirectoryEntry, error) {
@@ -450,3 +1416,263 @@ func deleteDirectoryInstance(namespace, instanceID string) {
 
 	_ = directory.Remove(instanceID)
 }
+
+// checkOperationLimit rejects an asynchronous operation if it would need to be queued
+// and the Service Broker is configured to reject excess operations.
+func checkOperationLimit() error {
+	options := config.GetOptions()
+
+	if options.RejectExcessOperations && operation.Saturated() {
+		return errors.NewQuotaExceededError("limit of %d concurrent operations reached", options.MaxConcurrentOperations)
+	}
+
+	return nil
+}
+
+// provisioningLimit returns the service ID and the number of service instances of that
+// service offering that may be provisioned concurrently, if the operation is provisioning.
+// A limit of zero is unlimited.
+func provisioningLimit(entry *registry.Entry) (string, int, error) {
+	op, ok, err := entry.GetString(registry.Operation)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !ok || operation.Type(op) != operation.TypeProvision {
+		return "", 0, nil
+	}
+
+	serviceID, ok, err := entry.GetString(registry.ServiceID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !ok {
+		return "", 0, fmt.Errorf("%w: service instance missing service ID", ErrUnexpected)
+	}
+
+	service, err := getServiceOffering(config.Config(), serviceID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return serviceID, service.MaxConcurrentProvisions, nil
+}
+
+// acquireSlots reserves the slots an asynchronous operation needs to run, returning a
+// function that releases them.  Service offering slots are acquired first, so operations
+// queued behind a service offering's limit do not hold slots that other service offerings
+// could use.
+func acquireSlots(ctx context.Context, entry *registry.Entry) (func(), error) {
+	serviceID, limit, err := provisioningLimit(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 {
+		if err := operation.AcquireService(ctx, entry, serviceID, limit); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := operation.Acquire(ctx, entry); err != nil {
+		if limit > 0 {
+			operation.ReleaseService(serviceID)
+		}
+
+		return nil, err
+	}
+
+	release := func() {
+		operation.Release()
+
+		if limit > 0 {
+			operation.ReleaseService(serviceID)
+		}
+	}
+
+	return release, nil
+}
+
+// startOperation starts an operation on a service instance.  Asynchronous operations
+// outlive the request, so the request's audit record is retained with the operation
+// in order to audit its outcome once it completes.
+func startOperation(entry *registry.Entry, t operation.Type, r *http.Request, synchronous bool) error {
+	if !synchronous {
+		if err := operation.Audit(entry, audit.FromContext(r.Context())); err != nil {
+			return err
+		}
+	}
+
+	if err := operation.Start(entry, t, requestIdentity(r)); err != nil {
+		return err
+	}
+
+	if !synchronous {
+		id, _, err := entry.GetString(registry.OperationID)
+		if err != nil {
+			return err
+		}
+
+		audit.SetOperation(r.Context(), id)
+	}
+
+	return nil
+}
+
+// runOperation runs an asynchronous operation once a slot is available.  Provisioning
+// may be cancelled, while queued or running, by deprovisioning the service instance.
+func runOperation(entry *registry.Entry, run func(*registry.Entry) error) {
+	ctx, finished, err := operation.Context(entry)
+	if err != nil {
+		if err := operation.Complete(entry, err); err != nil {
+			glog.Infof("failed to complete operation: %v", err)
+		}
+
+		return
+	}
+
+	release, err := acquireSlots(ctx, entry)
+	if err != nil {
+		if operation.Aborted(ctx) {
+			finished()
+
+			return
+		}
+
+		if err := operation.Complete(entry, err); err != nil {
+			glog.Infof("failed to complete operation: %v", err)
+		}
+
+		finished()
+
+		return
+	}
+
+	// The operation remains cancellable until it has finished running.
+	defer finished()
+	defer release()
+
+	if err := run(entry); err != nil {
+		glog.Infof("asynchronous operation failed: %v", err)
+	}
+}
+
+// lockServiceInstance locks a service instance against mutation by other broker
+// replicas, raising a concurrency error if another replica holds the lock.
+func lockServiceInstance(configuration *ServerConfiguration, instanceID string) (*lock.Lock, error) {
+	instanceLock, err := lock.Acquire(configuration.Namespace, instanceID, config.GetOptions().LockIdentity)
+	if err != nil {
+		if goerrors.Is(err, lock.ErrLockHeld) {
+			return nil, errors.NewConcurrencyError("service instance %s is being modified by another broker replica", instanceID)
+		}
+
+		return nil, err
+	}
+
+	return instanceLock, nil
+}
+
+// runLockedOperation runs an asynchronous operation, then releases the service
+// instance lock.  If the lock is lost, e.g. taken over by another broker replica,
+// the operation is aborted, leaving the service instance to the new lock holder.
+func runLockedOperation(instanceLock *lock.Lock, entry *registry.Entry, run func(*registry.Entry) error) {
+	defer instanceLock.Release()
+
+	// The entry is modified by the operation once started, so the operation ID is
+	// read beforehand, allowing cancellation without touching the entry.
+	id, _, err := entry.GetString(registry.OperationID)
+	if err != nil {
+		glog.Infof("failed to read operation ID: %v", err)
+	}
+
+	finished := make(chan interface{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-instanceLock.Lost():
+			glog.Errorf("service instance lock lost, aborting operation %s", id)
+
+			operation.AbortID(id)
+		case <-finished:
+		}
+	}()
+
+	runOperation(entry, run)
+}
+
+// runSynchronously runs an operation to completion for clients that do not support
+// asynchronous operations.  If the operation does not complete within the timeout it
+// is cancelled, and the client is told that asynchronous operation is required.  A zero
+// timeout waits for the operation to complete, however long it takes.
+func runSynchronously(entry *registry.Entry, run func(*registry.Entry) error, timeout time.Duration) error {
+	// The entry is modified by the operation once started, so the operation ID is
+	// read beforehand, allowing cancellation without touching the entry.
+	id, _, err := entry.GetString(registry.OperationID)
+	if err != nil {
+		return err
+	}
+
+	var status error
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		runOperation(entry, func(entry *registry.Entry) error {
+			status = run(entry)
+			return status
+		})
+	}()
+
+	var expired <-chan time.Time
+
+	if timeout > 0 {
+		expired = util.DefaultClock().After(timeout)
+	}
+
+	select {
+	case <-done:
+	case <-expired:
+		cancelled := operation.CancelID(id)
+
+		<-done
+
+		if cancelled {
+			return errors.NewAsyncRequiredError("service plan did not provision within %v, client must support asynchronous instance creation", timeout)
+		}
+	}
+
+	// A cancelled operation has been superseded by whatever cancelled it, e.g.
+	// deprovisioning, which now owns the registry entry, so it must be left alone.
+	if goerrors.Is(status, operation.ErrOperationCancelled) {
+		return operationError(status)
+	}
+
+	// Successful deprovisioning deletes the registry entry, so there is no
+	// operation left to end.
+	if err := operation.End(entry); err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	if status != nil {
+		return operationError(status)
+	}
+
+	return nil
+}
+
+// operationError translates an error raised by a synchronous operation into a typed
+// error that can be returned to the client.
+func operationError(err error) error {
+	switch {
+	case goerrors.Is(err, util.ErrTimeout):
+		return errors.NewOperationTimeoutError("%v", err)
+	case goerrors.Is(err, operation.ErrOperationCancelled):
+		return errors.NewOperationCancelledError("%v", err)
+	default:
+		return errors.NewConfigurationError("%v", err)
+	}
+}
@@ -36,14 +36,47 @@ import (
 const (
 	// ConfigurationNameDefault is the default configuration name.
 	ConfigurationNameDefault = "couchbase-service-broker"
+
+	// CompletionWebhookAttemptsDefault is the default maximum number of completion
+	// webhook delivery attempts.
+	CompletionWebhookAttemptsDefault = 5
+
+	// DeleteConcurrencyDefault is the default number of resources that are deleted
+	// at the same time.
+	DeleteConcurrencyDefault = 1
+
+	// CompletionWebhookBackoffDefault is the default delay before the first completion
+	// webhook delivery retry.
+	CompletionWebhookBackoffDefault = time.Second
+
+	// MaxIDLengthDefault is the default maximum length of service instance and binding
+	// IDs, this leaves room for registry entry name prefixes.
+	MaxIDLengthDefault = 128
+
+	// RollbackAttemptsDefault is the default maximum number of attempts to delete
+	// each resource when rolling back a cancelled or failed operation.
+	RollbackAttemptsDefault = 3
+
+	// RollbackBackoffDefault is the default delay before the first retry of a failed
+	// rollback deletion.
+	RollbackBackoffDefault = time.Second
+
+	// ApplyTimeoutDefault is the default time allowed for a single resource to be
+	// created or updated, zero disables the timeout.
+	ApplyTimeoutDefault = 0
+
+	// NameCollisionStrategyDefault is the default way over long resource names
+	// are shortened.
+	NameCollisionStrategyDefault = NameCollisionStrategyHash
+
+	// ClusterDomainDefault is the default Kubernetes cluster DNS domain.
+	ClusterDomainDefault = "cluster.local"
+
+	// MaxIncludeDepthDefault is the default maximum depth of nested template includes.
+	MaxIncludeDepthDefault = 8
 )
 
 var (
-	// ConfigurationName is the configuration resource name.
-	// This has a default for the benfit of testing, it is overidden
-	// by flags for the main binary.
-	ConfigurationName = ConfigurationNameDefault
-
 	// ErrCacheSync is raised when a shared informer failed to synchronize.
 	ErrCacheSync = errors.New("cache synchronization error")
 )
@@ -54,9 +87,13 @@ type configuration struct {
 	// by a test framework.
 	clients client.Clients
 
-	// config is the user supplied configuration custom resource.
+	// config is the user supplied configuration custom resource, with any
+	// fragments merged into it.
 	config *v1.ServiceBrokerConfig
 
+	// store caches the configuration and any fragments.
+	store cache.Store
+
 	// lock is used to remove races around the use of the context.
 	// The context can be read by many, but can only be written
 	// by one when there are no readers.
@@ -68,61 +105,96 @@ type configuration struct {
 // c is the global configuration struct.
 var c *configuration
 
-// createHandler add the service broker configuration when the underlying
-// resource is created.
-func createHandler(obj interface{}) {
+// relevant returns whether the object is the service broker configuration or
+// a fragment that contributes to it.
+func relevant(obj interface{}, event string) bool {
 	brokerConfiguration, ok := obj.(*v1.ServiceBrokerConfig)
 	if !ok {
-		glog.Error("unexpected object type in config add")
-		return
+		glog.Errorf("unexpected object type in config %s", event)
+		return false
 	}
 
-	if brokerConfiguration.Name != ConfigurationName {
-		glog.V(log.LevelDebug).Info("unexpected object name in config delete:", brokerConfiguration.Name)
+	if brokerConfiguration.Name != GetOptions().ConfigurationName && !isFragment(brokerConfiguration) {
+		glog.V(log.LevelDebug).Infof("unexpected object name in config %s: %s", event, brokerConfiguration.Name)
+		return false
+	}
+
+	return true
+}
+
+// createHandler add the service broker configuration when the underlying
+// resource is created.
+func createHandler(obj interface{}) {
+	if !relevant(obj, "add") {
 		return
 	}
 
-	if err := updateStatus(brokerConfiguration); err != nil {
-		glog.Info("service broker configuration invalid, see resource status for details")
-		glog.V(1).Info(err)
+	assemble()
+}
 
-		c.lock.Lock()
-		defer c.lock.Unlock()
+// updateHandler modifies the service broker configuration when the underlying
+// resource updates.
+func updateHandler(oldObj, newObj interface{}) {
+	if !relevant(newObj, "update") {
+		return
+	}
 
-		c.config = nil
+	assemble()
+}
 
+// deleteHandler deletes the service broker configuration when the underlying
+// resource is deleted.
+func deleteHandler(obj interface{}) {
+	if !relevant(obj, "delete") {
 		return
 	}
 
-	glog.Info("service broker configuration created, service ready")
+	assemble()
+}
 
-	if glog.V(1) {
-		object, err := json.Marshal(brokerConfiguration)
-		if err == nil {
-			glog.V(1).Info(string(object))
+// assemble builds the effective service broker configuration from the named
+// configuration and any fragments that contribute to it.  The named configuration
+// takes precedence, then fragments are merged in name order.  A fragment that
+// conflicts with what has already been merged, or makes the result invalid, is
+// rejected, however does not affect the rest of the configuration.
+func assemble() {
+	var primary *v1.ServiceBrokerConfig
+
+	var fragments []*v1.ServiceBrokerConfig
+
+	for _, obj := range c.store.List() {
+		brokerConfiguration, ok := obj.(*v1.ServiceBrokerConfig)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case brokerConfiguration.Name == GetOptions().ConfigurationName:
+			primary = brokerConfiguration
+		case isFragment(brokerConfiguration):
+			fragments = append(fragments, brokerConfiguration)
 		}
 	}
 
-	c.lock.Lock()
-	c.config = brokerConfiguration
-	c.lock.Unlock()
-}
+	if primary == nil {
+		glog.Info("service broker configuration deleted, service unready")
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		c.config = nil
 
-// updateHandler modifies the service broker configuration when the underlying
-// resource updates.
-func updateHandler(oldObj, newObj interface{}) {
-	brokerConfiguration, ok := newObj.(*v1.ServiceBrokerConfig)
-	if !ok {
-		glog.Error("unexpected object type in config update")
 		return
 	}
 
-	if brokerConfiguration.Name != ConfigurationName {
-		glog.V(log.LevelDebug).Info("unexpected object name in config update:", brokerConfiguration.Name)
-		return
+	expanded, err := expandEnvironment(primary)
+	if err == nil {
+		err = validate(expanded)
 	}
 
-	if err := updateStatus(brokerConfiguration); err != nil {
+	updateStatus(primary, err)
+
+	if err != nil {
 		glog.Info("service broker configuration invalid, see resource status for details")
 		glog.V(1).Info(err)
 
@@ -134,10 +206,27 @@ func updateHandler(oldObj, newObj interface{}) {
 		return
 	}
 
-	glog.Info("service broker configuration updated")
+	sortFragments(fragments)
+
+	for _, fragment := range fragments {
+		merged, err := mergeFragment(expanded, fragment)
+
+		updateStatus(fragment, err)
+
+		if err != nil {
+			glog.Infof("service broker configuration fragment %s invalid, see resource status for details", fragment.Name)
+			glog.V(1).Info(err)
+
+			continue
+		}
+
+		expanded = merged
+	}
+
+	glog.Info("service broker configuration updated, service ready")
 
 	if glog.V(1) {
-		object, err := json.Marshal(brokerConfiguration)
+		object, err := json.Marshal(expanded)
 		if err == nil {
 			glog.V(1).Info(string(object))
 		}
@@ -146,28 +235,7 @@ func updateHandler(oldObj, newObj interface{}) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	c.config = brokerConfiguration
-}
-
-// deleteHandler deletes the service broker configuration when the underlying
-// resource is deleted.
-func deleteHandler(obj interface{}) {
-	brokerConfiguration, ok := obj.(*v1.ServiceBrokerConfig)
-	if !ok {
-		glog.Error("unexpected object type in config delete")
-		return
-	}
-
-	if brokerConfiguration.Name != ConfigurationName {
-		glog.V(log.LevelDebug).Info("unexpected object name in config delete:", brokerConfiguration.Name)
-		return
-	}
-
-	glog.Info("service broker configuration deleted, service unready")
-
-	c.lock.Lock()
-	c.config = nil
-	c.lock.Unlock()
+	c.config = expanded
 }
 
 // Configure initializes global configuration and must be called before starting
@@ -189,6 +257,8 @@ func Configure(clients client.Clients, namespace string) error {
 	informer := informerv1.NewServiceBrokerConfigInformer(clients.Broker(), namespace, time.Minute, nil)
 	informer.AddEventHandler(handlers)
 
+	c.store = informer.GetStore()
+
 	stop := make(chan struct{})
 
 	go informer.Run(stop)
@@ -222,13 +292,9 @@ func Config() *v1.ServiceBrokerConfig {
 	return c.config
 }
 
-// updateStatus runs any analysis on the confiuration, makes and commits any modifications.
+// updateStatus commits the result of validating a configuration to its status.
 // In particular this allows the status to say you have made a configuration error.
-// A returned error means don't accept the configuration, set to nil so the service broker
-// reports unready and doesn't serve any API requests.
-func updateStatus(config *v1.ServiceBrokerConfig) error {
-	var rerr error
-
+func updateStatus(config *v1.ServiceBrokerConfig, err error) {
 	// Assume the configuration is valid, then modify if an error
 	// has occurred, finally retain the transition time if an existing
 	// condition exists and it has the same status.
@@ -241,12 +307,10 @@ func updateStatus(config *v1.ServiceBrokerConfig) error {
 		Reason: "ValidationSucceeded",
 	}
 
-	if err := validate(config); err != nil {
+	if err != nil {
 		validCondition.Status = v1.ConditionFalse
 		validCondition.Reason = "ValidationFailed"
 		validCondition.Message = err.Error()
-
-		rerr = err
 	}
 
 	for _, condition := range config.Status.Conditions {
@@ -267,7 +331,7 @@ func updateStatus(config *v1.ServiceBrokerConfig) error {
 	}
 
 	if reflect.DeepEqual(config.Status, status) {
-		return rerr
+		return
 	}
 
 	newConfig := config.DeepCopy()
@@ -275,8 +339,5 @@ func updateStatus(config *v1.ServiceBrokerConfig) error {
 
 	if _, err := c.clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(newConfig.Namespace).Update(context.TODO(), newConfig, metav1.UpdateOptions{}); err != nil {
 		glog.Infof("failed to update service broker configuration status: %v", err)
-		return rerr
 	}
-
-	return rerr
 }
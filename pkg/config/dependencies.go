@@ -0,0 +1,217 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+)
+
+// ErrDependencyCycle is raised when registry values depend on one another.
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// ErrDependencyUnknown is raised when a registry value references a registry key
+// or snippet whose name is computed, so its dependencies cannot be determined.
+var ErrDependencyUnknown = errors.New("unknown dependency")
+
+var (
+	// actionRegexp matches template actions, function calls only occur within these.
+	actionRegexp = regexp.MustCompile(`(?s){{.*?}}`)
+
+	// registryReferenceRegexp matches references to registry keys in a dynamic attribute.
+	// Keys scoped to the service binding are the same as the unscoped key, keys scoped
+	// to the service instance never match a value being rendered.
+	registryReferenceRegexp = regexp.MustCompile(`\bregistry\s+"(?:binding\.)?([^"]+)"`)
+
+	// snippetReferenceRegexp matches references to snippets in a dynamic attribute.
+	snippetReferenceRegexp = regexp.MustCompile(`\bsnippet(?:Array)?\s+"([^"]+)"`)
+
+	// computedReferenceRegexp matches references to registry keys or snippets
+	// whose names are not string literals.
+	computedReferenceRegexp = regexp.MustCompile(`\b(registry|snippet|snippetArray)\s+[^"\s]`)
+)
+
+// templateStrings returns all strings in a template, as these are where dynamic
+// attributes are found.
+func templateStrings(object interface{}) []string {
+	var strs []string
+
+	switch t := object.(type) {
+	case string:
+		strs = append(strs, t)
+	case []interface{}:
+		for _, value := range t {
+			strs = append(strs, templateStrings(value)...)
+		}
+	case map[string]interface{}:
+		for key, value := range t {
+			strs = append(strs, key)
+			strs = append(strs, templateStrings(value)...)
+		}
+	}
+
+	return strs
+}
+
+// templateSources returns the sources a dynamic attribute may be rendered from.  This
+// is the attribute itself, plus any snippets it references, and their includes,
+// recursively.
+func templateSources(templates []v1.ConfigurationTemplate, value string) []string {
+	sources := []string{value}
+	visited := map[string]bool{}
+
+	for index := 0; index < len(sources); index++ {
+		var names []string
+
+		for _, action := range actionRegexp.FindAllString(sources[index], -1) {
+			for _, match := range snippetReferenceRegexp.FindAllStringSubmatch(action, -1) {
+				names = append(names, match[1])
+			}
+		}
+
+		for len(names) > 0 {
+			name := names[0]
+			names = names[1:]
+
+			if visited[name] {
+				continue
+			}
+
+			visited[name] = true
+
+			for i := range templates {
+				if templates[i].Name != name {
+					continue
+				}
+
+				if templates[i].Template != nil && templates[i].Template.Raw != nil {
+					var object interface{}
+
+					if err := json.Unmarshal(templates[i].Template.Raw, &object); err == nil {
+						sources = append(sources, templateStrings(object)...)
+					}
+				}
+
+				for _, include := range templates[i].Includes {
+					names = append(names, include.Name)
+				}
+			}
+		}
+	}
+
+	return sources
+}
+
+// registryDependencies returns the indices of all registry values that the value
+// at the given index references, either directly or via snippets.
+func registryDependencies(templates []v1.ConfigurationTemplate, values []v1.RegistryValue, index int, names map[string]int) ([]int, error) {
+	var dependencies []int
+
+	for _, source := range templateSources(templates, values[index].Value) {
+		for _, action := range actionRegexp.FindAllString(source, -1) {
+			if match := computedReferenceRegexp.FindStringSubmatch(action); match != nil {
+				return nil, fmt.Errorf("%w: registry value %s calls %s with a computed name", ErrDependencyUnknown, values[index].Name, match[1])
+			}
+
+			for _, match := range registryReferenceRegexp.FindAllStringSubmatch(action, -1) {
+				dependency, ok := names[match[1]]
+				if !ok || dependency == index {
+					continue
+				}
+
+				dependencies = append(dependencies, dependency)
+			}
+		}
+	}
+
+	return dependencies, nil
+}
+
+// OrderRegistryValues returns registry values ordered so that values are rendered
+// after any other values they reference, templates are used to resolve references
+// made by snippets.  Values are otherwise rendered in the order they are declared.
+// Cyclic references, and references that cannot be analysed, are an error.
+func OrderRegistryValues(templates []v1.ConfigurationTemplate, values []v1.RegistryValue) ([]v1.RegistryValue, error) {
+	names := map[string]int{}
+
+	for index, value := range values {
+		for _, name := range append([]string{value.Name}, value.Names...) {
+			names[name] = index
+		}
+	}
+
+	dependencies := make([][]int, len(values))
+
+	for index := range values {
+		d, err := registryDependencies(templates, values, index, names)
+		if err != nil {
+			return nil, err
+		}
+
+		dependencies[index] = d
+	}
+
+	ordered := make([]v1.RegistryValue, 0, len(values))
+	done := make([]bool, len(values))
+
+	for len(ordered) < len(values) {
+		progress := false
+
+		for index := range values {
+			if done[index] {
+				continue
+			}
+
+			ready := true
+
+			for _, dependency := range dependencies[index] {
+				if !done[dependency] {
+					ready = false
+					break
+				}
+			}
+
+			if !ready {
+				continue
+			}
+
+			ordered = append(ordered, values[index])
+			done[index] = true
+			progress = true
+
+			// Restart so declaration order is preserved where possible.
+			break
+		}
+
+		if !progress {
+			var cyclic []string
+
+			for index, value := range values {
+				if !done[index] {
+					cyclic = append(cyclic, value.Name)
+				}
+			}
+
+			return nil, fmt.Errorf("%w: registry values %s", ErrDependencyCycle, strings.Join(cyclic, ", "))
+		}
+	}
+
+	return ordered, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+)
+
+// ErrEnvironmentVariableUnset is raised when configuration references a required
+// environment variable that is not set.
+var ErrEnvironmentVariableUnset = errors.New("environment variable unset")
+
+// environmentRegexp matches environment variable references in configuration, either
+// ${ENV:NAME} which is required, or ${ENV:NAME:-default} which is optional.
+var environmentRegexp = regexp.MustCompile(`\$\{ENV:([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnvironment returns a copy of the configuration with environment variable
+// references substituted.  The original is left untouched so that it is not written
+// back to Kubernetes.  References may appear anywhere a string can, including template
+// bodies, so substitution is performed on the JSON encoded specification.
+func expandEnvironment(config *v1.ServiceBrokerConfig) (*v1.ServiceBrokerConfig, error) {
+	raw, err := json.Marshal(config.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if !environmentRegexp.Match(raw) {
+		return config, nil
+	}
+
+	var rerr error
+
+	expanded := environmentRegexp.ReplaceAllFunc(raw, func(reference []byte) []byte {
+		match := environmentRegexp.FindSubmatch(reference)
+		name := string(match[1])
+
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			// The default is already JSON encoded, as it is part of the specification.
+			if match[2] != nil {
+				return match[3]
+			}
+
+			if !ok {
+				rerr = fmt.Errorf("%w: %s", ErrEnvironmentVariableUnset, name)
+				return reference
+			}
+		}
+
+		// Values are substituted into JSON strings so must be escaped, without
+		// the enclosing quotes.
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			rerr = err
+			return reference
+		}
+
+		return encoded[1 : len(encoded)-1]
+	})
+
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	newConfig := config.DeepCopy()
+	newConfig.Spec = v1.ServiceBrokerConfigSpec{}
+
+	if err := json.Unmarshal(expanded, &newConfig.Spec); err != nil {
+		return nil, err
+	}
+
+	return newConfig, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+)
+
+// isFragment returns whether the configuration contributes to the service
+// broker configuration.
+func isFragment(config *v1.ServiceBrokerConfig) bool {
+	name := GetOptions().ConfigurationName
+
+	return config.Name != name && config.Labels[v1.ConfigurationLabel] == name
+}
+
+// sortFragments orders configuration fragments by name, this defines the order
+// in which they are merged into the service broker configuration.
+func sortFragments(fragments []*v1.ServiceBrokerConfig) {
+	sort.Slice(fragments, func(i, j int) bool {
+		return fragments[i].Name < fragments[j].Name
+	})
+}
+
+// checkFragmentConflicts ensures that nothing a configuration fragment defines
+// has already been defined by the configuration it is being merged into.
+func checkFragmentConflicts(config, fragment *v1.ServiceBrokerConfig) error {
+	serviceIDs := map[string]interface{}{}
+	serviceNames := map[string]interface{}{}
+	planIDs := map[string]interface{}{}
+
+	for _, service := range config.Spec.Catalog.Services {
+		serviceIDs[service.ID] = nil
+		serviceNames[service.Name] = nil
+
+		for _, plan := range service.Plans {
+			planIDs[plan.ID] = nil
+		}
+	}
+
+	for _, service := range fragment.Spec.Catalog.Services {
+		if _, ok := serviceIDs[service.ID]; ok {
+			return fmt.Errorf("%w: fragment '%s' service offering ID '%s' already defined", ErrConfigurationInvalid, fragment.Name, service.ID)
+		}
+
+		if _, ok := serviceNames[service.Name]; ok {
+			return fmt.Errorf("%w: fragment '%s' service offering '%s' already defined", ErrConfigurationInvalid, fragment.Name, service.Name)
+		}
+
+		for _, plan := range service.Plans {
+			if _, ok := planIDs[plan.ID]; ok {
+				return fmt.Errorf("%w: fragment '%s' service plan ID '%s' already defined", ErrConfigurationInvalid, fragment.Name, plan.ID)
+			}
+		}
+	}
+
+	for _, template := range fragment.Spec.Templates {
+		if getTemplateByName(config, template.Name) != nil {
+			return fmt.Errorf("%w: fragment '%s' template '%s' already defined", ErrConfigurationInvalid, fragment.Name, template.Name)
+		}
+	}
+
+	for _, binding := range fragment.Spec.Bindings {
+		for _, existing := range config.Spec.Bindings {
+			if existing.Name == binding.Name {
+				return fmt.Errorf("%w: fragment '%s' binding '%s' already defined", ErrConfigurationInvalid, fragment.Name, binding.Name)
+			}
+		}
+	}
+
+	for _, lookup := range fragment.Spec.Lookups {
+		for _, existing := range config.Spec.Lookups {
+			if existing.Name == lookup.Name {
+				return fmt.Errorf("%w: fragment '%s' lookup '%s' already defined", ErrConfigurationInvalid, fragment.Name, lookup.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// mergeFragment returns a new configuration with the service offerings, templates,
+// bindings and lookup tables of the fragment appended to the existing configuration.
+// The fragment has its environment expanded, and the result must be valid.
+func mergeFragment(config, fragment *v1.ServiceBrokerConfig) (*v1.ServiceBrokerConfig, error) {
+	expanded, err := expandEnvironment(fragment)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkFragmentConflicts(config, expanded); err != nil {
+		return nil, err
+	}
+
+	merged := config.DeepCopy()
+	merged.Spec.Catalog.Services = append(merged.Spec.Catalog.Services, expanded.Spec.Catalog.Services...)
+	merged.Spec.Templates = append(merged.Spec.Templates, expanded.Spec.Templates...)
+	merged.Spec.Bindings = append(merged.Spec.Bindings, expanded.Spec.Bindings...)
+	merged.Spec.Lookups = append(merged.Spec.Lookups, expanded.Spec.Lookups...)
+
+	if err := validate(merged); err != nil {
+		return nil, err
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNameCollisionStrategyInvalid is raised when an unknown name collision strategy
+// is requested.
+var ErrNameCollisionStrategyInvalid = errors.New("name collision strategy invalid")
+
+// NameCollisionStrategyType defines how resource names that are too long are
+// shortened without colliding with other resource names.
+type NameCollisionStrategyType string
+
+const (
+	// NameCollisionStrategyHash truncates names and appends a hash of the
+	// full name, so names that only differ after truncation remain unique.
+	NameCollisionStrategyHash NameCollisionStrategyType = "hash"
+
+	// NameCollisionStrategyReject rejects names that are too long.
+	NameCollisionStrategyReject NameCollisionStrategyType = "reject"
+
+	// NameCollisionStrategyTruncate truncates names.  This fails safe, as
+	// resources that collide are owned by another service instance or binding
+	// and are rejected when provisioning.
+	NameCollisionStrategyTruncate NameCollisionStrategyType = "truncate"
+)
+
+// Set sets the name collision strategy from CLI parameters.
+func (n *NameCollisionStrategyType) Set(s string) error {
+	switch t := NameCollisionStrategyType(s); t {
+	case NameCollisionStrategyHash, NameCollisionStrategyReject, NameCollisionStrategyTruncate:
+		*n = t
+	default:
+		return fmt.Errorf("%w: %s", ErrNameCollisionStrategyInvalid, s)
+	}
+
+	return nil
+}
+
+// Type returns the type of flag to display.
+func (n *NameCollisionStrategyType) Type() string {
+	return "string"
+}
+
+// String returns the name collision strategy.
+func (n *NameCollisionStrategyType) String() string {
+	return string(*n)
+}
@@ -0,0 +1,194 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"sync"
+	"time"
+)
+
+// Options are the service broker options that are fixed when the server is
+// configured, typically from flags for the main binary.  Unlike the configuration
+// resource they are not expected to change, and are read atomically so that
+// tests may safely replace them while the server is running.
+type Options struct {
+	// ConfigurationName is the configuration resource name.
+	ConfigurationName string
+
+	// SourceNamespaces is the list of namespaces, other than that of the service
+	// instance, that templates may read secrets and config maps from.
+	SourceNamespaces []string
+
+	// CreateNamespaces allows service instance namespaces that are supplied by
+	// the request context, and do not exist, to be created.
+	CreateNamespaces bool
+
+	// QueryParameters is the list of request query parameters that are recorded
+	// when a service instance or binding is created, and may be read by templates.
+	QueryParameters []string
+
+	// MaxConcurrentOperations bounds the number of asynchronous operations that may run
+	// at the same time, zero is unlimited.
+	MaxConcurrentOperations int
+
+	// RejectExcessOperations rejects asynchronous operations beyond the limit, rather
+	// than queuing them.
+	RejectExcessOperations bool
+
+	// DeleteConcurrency is the maximum number of resources that are deleted at the
+	// same time when deleting a service instance or binding.
+	DeleteConcurrency int
+
+	// CompletionWebhook is a URL that is sent a notification when an asynchronous
+	// operation completes.
+	CompletionWebhook string
+
+	// CompletionWebhookAttempts is the maximum number of completion webhook delivery
+	// attempts, after which the failure is recorded in the registry.
+	CompletionWebhookAttempts int
+
+	// CompletionWebhookBackoff is the delay before the first completion webhook
+	// delivery retry, this doubles, with jitter, for each subsequent retry.
+	CompletionWebhookBackoff time.Duration
+
+	// AbandonedCreateTimeout, if set, is how long an asynchronous create operation may go
+	// without being polled before it is reaped.  Successful operations are completed,
+	// otherwise the service instance is deleted.
+	AbandonedCreateTimeout time.Duration
+
+	// PrettyJSON indents JSON response bodies so they are easier for humans to read,
+	// otherwise they are compact.
+	PrettyJSON bool
+
+	// MaxIDLength is the maximum length of service instance and binding IDs.
+	MaxIDLength int
+
+	// MaxIncludeDepth is the maximum depth of nested template includes, a template
+	// that includes a partial has a depth of one.
+	MaxIncludeDepth int
+
+	// RollbackAttempts is the maximum number of attempts to delete each resource
+	// when rolling back a cancelled or failed operation, so transient errors do not
+	// orphan it.
+	RollbackAttempts int
+
+	// RollbackBackoff is the delay before the first retry of a failed rollback
+	// deletion, this doubles for each subsequent retry.
+	RollbackBackoff time.Duration
+
+	// ApplyTimeout is how long a single resource create or update may take before
+	// the operation fails, so a hung API server doesn't stall provisioning.  Zero
+	// disables the timeout.
+	ApplyTimeout time.Duration
+
+	// NameCollisionStrategy is how resource names generated by templates that are
+	// too long are shortened, without colliding with other resource names.
+	NameCollisionStrategy NameCollisionStrategyType
+
+	// AuditLog is where audit records of mutating operations are written, either a
+	// file path, or "-" for standard output.  Auditing is disabled if empty.
+	AuditLog string
+
+	// AccessLog is where access log records of API requests are written, either a
+	// file path, or "-" for standard output.  Access logging is disabled if empty.
+	AccessLog string
+
+	// AccessLogSampleRates is the fraction of requests, between 0 and 1, that are
+	// logged for each route.  Mutating requests, and routes without a rate, are
+	// always logged.
+	AccessLogSampleRates map[string]float64
+
+	// AccessLogBodies records request bodies in the access log, with sensitive
+	// values redacted.
+	AccessLogBodies bool
+
+	// OperationRetention is how long the result of a completed asynchronous operation
+	// is retained, so it can be polled for more than once.  Zero disables retention.
+	OperationRetention time.Duration
+
+	// SoftDeleteGracePeriod is how long a deprovisioned service instance is retained
+	// before it is actually deleted, during which it may be undeleted.  Zero deletes
+	// service instances immediately.
+	SoftDeleteGracePeriod time.Duration
+
+	// LockLeaseDuration is how long a lease that locks a service instance against
+	// mutation by other broker replicas is valid for without renewal.  Zero disables
+	// locking.
+	LockLeaseDuration time.Duration
+
+	// LockIdentity uniquely identifies this broker replica as the holder of service
+	// instance locks.
+	LockIdentity string
+
+	// Events enables Kubernetes events to be raised against service instances and
+	// bindings at key points in their lifecycle.
+	Events bool
+
+	// BrokerNamespace is the namespace the broker is running in, templates may read
+	// this.  This is set from the environment for the main binary.
+	BrokerNamespace string
+
+	// BrokerPodName is the name of the pod the broker is running in, templates may
+	// read this.  This is set from the environment for the main binary.
+	BrokerPodName string
+
+	// ClusterDomain is the Kubernetes cluster DNS domain, templates may read this
+	// to build service URLs.
+	ClusterDomain string
+}
+
+// NewOptions returns a set of options populated with their defaults.
+func NewOptions() *Options {
+	return &Options{
+		ConfigurationName:         ConfigurationNameDefault,
+		DeleteConcurrency:         DeleteConcurrencyDefault,
+		CompletionWebhookAttempts: CompletionWebhookAttemptsDefault,
+		CompletionWebhookBackoff:  CompletionWebhookBackoffDefault,
+		MaxIDLength:               MaxIDLengthDefault,
+		MaxIncludeDepth:           MaxIncludeDepthDefault,
+		RollbackAttempts:          RollbackAttemptsDefault,
+		RollbackBackoff:           RollbackBackoffDefault,
+		ApplyTimeout:              ApplyTimeoutDefault,
+		NameCollisionStrategy:     NameCollisionStrategyDefault,
+		ClusterDomain:             ClusterDomainDefault,
+	}
+}
+
+var (
+	// options are the current options.
+	options = NewOptions()
+
+	// optionsLock guards options against concurrent replacement.
+	optionsLock sync.RWMutex
+)
+
+// GetOptions returns a copy of the current options.
+func GetOptions() Options {
+	optionsLock.RLock()
+	defer optionsLock.RUnlock()
+
+	return *options
+}
+
+// SetOptions replaces the current options, a copy is taken so later modifications
+// to the argument have no effect.
+func SetOptions(o *Options) {
+	copied := *o
+
+	optionsLock.Lock()
+	defer optionsLock.Unlock()
+
+	options = &copied
+}
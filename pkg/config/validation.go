@@ -15,10 +15,17 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
 
 	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/schema"
+
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // ErrConfigurationInvalid is a generic configuration error.
@@ -35,6 +42,17 @@ func getBindingForServicePlan(config *v1.ServiceBrokerConfig, serviceName, planN
 	return nil
 }
 
+// getServicePlanByName looks up a service plan for a named service plan.
+func getServicePlanByName(service *v1.ServiceOffering, planName string) *v1.ServicePlan {
+	for index, plan := range service.Plans {
+		if plan.Name == planName {
+			return &service.Plans[index]
+		}
+	}
+
+	return nil
+}
+
 // getTemplateByName looks up a configuration template for a named template.
 func getTemplateByName(config *v1.ServiceBrokerConfig, templateName string) *v1.ConfigurationTemplate {
 	for index, template := range config.Spec.Templates {
@@ -46,12 +64,253 @@ func getTemplateByName(config *v1.ServiceBrokerConfig, templateName string) *v1.
 	return nil
 }
 
+var (
+	// currencyCodeRegexp matches a lower case ISO 4217 currency code.
+	currencyCodeRegexp = regexp.MustCompile(`^[a-z]{3}$`)
+
+	// amountRegexp matches a non-negative decimal amount.
+	amountRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+)
+
+// validateDashboardClient checks that any dashboard client has a secret and a well
+// formed redirect URI.
+func validateDashboardClient(service *v1.ServiceOffering) error {
+	client := service.DashboardClient
+	if client == nil {
+		return nil
+	}
+
+	if (client.Secret == "") == (client.SecretRef == nil) {
+		return fmt.Errorf("%w: dashboard client for offering '%s' must define exactly one of secret or secretRef", ErrConfigurationInvalid, service.Name)
+	}
+
+	if client.RedirectedURI == "" {
+		return nil
+	}
+
+	uri, err := url.Parse(client.RedirectedURI)
+	if err != nil {
+		return fmt.Errorf("%w: dashboard client for offering '%s' redirect URI malformed: %v", ErrConfigurationInvalid, service.Name, err)
+	}
+
+	if (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+		return fmt.Errorf("%w: dashboard client for offering '%s' redirect URI '%s' must be an absolute HTTP or HTTPS URI", ErrConfigurationInvalid, service.Name, client.RedirectedURI)
+	}
+
+	return nil
+}
+
+// validateServicePlanCosts checks that any cost metadata is well formed.
+func validateServicePlanCosts(service *v1.ServiceOffering, plan *v1.ServicePlan) error {
+	if len(plan.CostMetadata) == 0 {
+		return nil
+	}
+
+	// Costs are merged into the metadata, so that must be an object.
+	if plan.Metadata != nil && plan.Metadata.Raw != nil {
+		metadata := map[string]interface{}{}
+		if err := json.Unmarshal(plan.Metadata.Raw, &metadata); err != nil {
+			return fmt.Errorf("%w: service plan '%s' for offering '%s' metadata must be an object when cost metadata is specified", ErrConfigurationInvalid, plan.Name, service.Name)
+		}
+
+		if _, ok := metadata["costs"]; ok {
+			return fmt.Errorf("%w: service plan '%s' for offering '%s' defines costs in both metadata and cost metadata", ErrConfigurationInvalid, plan.Name, service.Name)
+		}
+	}
+
+	for _, cost := range plan.CostMetadata {
+		if cost.Unit == "" {
+			return fmt.Errorf("%w: service plan '%s' for offering '%s' cost unit must be specified", ErrConfigurationInvalid, plan.Name, service.Name)
+		}
+
+		if len(cost.Amount) == 0 {
+			return fmt.Errorf("%w: service plan '%s' for offering '%s' cost amount must be specified", ErrConfigurationInvalid, plan.Name, service.Name)
+		}
+
+		for currency, amount := range cost.Amount {
+			if !currencyCodeRegexp.MatchString(currency) {
+				return fmt.Errorf("%w: service plan '%s' for offering '%s' cost currency '%s' must be a lower case ISO 4217 code", ErrConfigurationInvalid, plan.Name, service.Name, currency)
+			}
+
+			if !amountRegexp.MatchString(amount) {
+				return fmt.Errorf("%w: service plan '%s' for offering '%s' cost amount '%s' must be a non-negative decimal", ErrConfigurationInvalid, plan.Name, service.Name, amount)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateServicePlanSchemas checks that any parameter schemas can be parsed and use
+// a supported draft.
+func validateServicePlanSchemas(service *v1.ServiceOffering, plan *v1.ServicePlan) error {
+	if plan.Schemas == nil {
+		return nil
+	}
+
+	schemas := map[string]*v1.InputParamtersSchema{}
+
+	if plan.Schemas.ServiceInstance != nil {
+		schemas["service instance create"] = plan.Schemas.ServiceInstance.Create
+		schemas["service instance update"] = plan.Schemas.ServiceInstance.Update
+	}
+
+	if plan.Schemas.ServiceBinding != nil {
+		schemas["service binding create"] = plan.Schemas.ServiceBinding.Create
+	}
+
+	for name, s := range schemas {
+		if s == nil || s.Parameters == nil {
+			continue
+		}
+
+		if _, err := schema.Parse(s.Parameters.Raw); err != nil {
+			return fmt.Errorf("%w: service plan '%s' for offering '%s' %s schema invalid: %v", ErrConfigurationInvalid, plan.Name, service.Name, name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateLookup checks that lookup table entries are a map of strings.
+func validateLookup(lookup *v1.LookupTable) error {
+	if lookup.Entries == nil {
+		return fmt.Errorf("%w: lookup '%s' does not define any entries", ErrConfigurationInvalid, lookup.Name)
+	}
+
+	entries := map[string]interface{}{}
+
+	if err := json.Unmarshal(lookup.Entries.Raw, &entries); err != nil {
+		return fmt.Errorf("%w: lookup '%s' entries must be a map: %v", ErrConfigurationInvalid, lookup.Name, err)
+	}
+
+	for key, value := range entries {
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%w: lookup '%s' entry '%s' must be a string", ErrConfigurationInvalid, lookup.Name, key)
+		}
+	}
+
+	return nil
+}
+
+// validateTemplateIncludes checks that templates included by a template exist, that
+// there are no include cycles and that includes are not nested too deeply.  The
+// includers are the templates that include this one.
+func validateTemplateIncludes(config *v1.ServiceBrokerConfig, template *v1.ConfigurationTemplate, includers []string) error {
+	includers = append(includers, template.Name)
+
+	maxIncludeDepth := GetOptions().MaxIncludeDepth
+
+	for _, include := range template.Includes {
+		for _, includer := range includers {
+			if includer == include.Name {
+				return fmt.Errorf("%w: template include cycle %s -> %s", ErrConfigurationInvalid, strings.Join(includers, " -> "), include.Name)
+			}
+		}
+
+		if len(includers) > maxIncludeDepth {
+			return fmt.Errorf("%w: template include depth exceeds maximum of %d %s -> %s", ErrConfigurationInvalid, maxIncludeDepth, strings.Join(includers, " -> "), include.Name)
+		}
+
+		included := getTemplateByName(config, include.Name)
+		if included == nil {
+			return fmt.Errorf("%w: template '%s', included by template '%s', must exist", ErrConfigurationInvalid, include.Name, template.Name)
+		}
+
+		if err := validateTemplateIncludes(config, included, includers); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateTemplatePreDelete checks that templates created by pre-delete actions exist.
+func validateTemplatePreDelete(config *v1.ServiceBrokerConfig, template *v1.ConfigurationTemplate) error {
+	for _, action := range template.PreDelete {
+		if getTemplateByName(config, action.Template) == nil {
+			return fmt.Errorf("%w: template '%s', used by a pre-delete action of template '%s', must exist", ErrConfigurationInvalid, action.Template, template.Name)
+		}
+	}
+
+	return nil
+}
+
+// validateTemplateList checks that templates, including conditional ones, referenced by
+// a binding exist.  Conditional templates are not supported by steps.
+func validateTemplateList(config *v1.ServiceBrokerConfig, templates *v1.ServiceBrokerTemplateList, binding, kind string) error {
+	names := append([]string{}, templates.Templates...)
+
+	for _, conditional := range templates.ConditionalTemplates {
+		names = append(names, conditional.Templates...)
+	}
+
+	for _, template := range names {
+		if getTemplateByName(config, template) == nil {
+			return fmt.Errorf("%w: template '%s', referenced by binding '%s' %s, must exist", ErrConfigurationInvalid, template, binding, kind)
+		}
+	}
+
+	if _, err := OrderRegistryValues(config.Spec.Templates, templates.Registry); err != nil {
+		return fmt.Errorf("%w: binding '%s' %s %v", ErrConfigurationInvalid, binding, kind, err)
+	}
+
+	for _, format := range templates.CredentialFormats {
+		if len(format.Names) != 0 {
+			return fmt.Errorf("%w: binding '%s' %s credential format '%s' defines additional names", ErrConfigurationInvalid, binding, kind, format.Name)
+		}
+	}
+
+	for _, annotation := range templates.Annotations {
+		if len(annotation.Names) != 0 {
+			return fmt.Errorf("%w: binding '%s' %s annotation '%s' defines additional names", ErrConfigurationInvalid, binding, kind, annotation.Name)
+		}
+
+		if errs := validation.IsQualifiedName(annotation.Name); len(errs) != 0 {
+			return fmt.Errorf("%w: binding '%s' %s annotation '%s' is not a valid name: %s", ErrConfigurationInvalid, binding, kind, annotation.Name, strings.Join(errs, ", "))
+		}
+	}
+
+	if len(templates.ConditionalTemplates) != 0 && len(templates.Steps) != 0 {
+		return fmt.Errorf("%w: binding '%s' %s defines both conditional templates and steps", ErrConfigurationInvalid, binding, kind)
+	}
+
+	return nil
+}
+
 // validate does any validation that cannot be performed by the JSON schema
 // included in the CRD.
 func validate(config *v1.ServiceBrokerConfig) error {
 	// Check that service offerings and plans are bound properly to configuration.
-	for _, service := range config.Spec.Catalog.Services {
-		for _, plan := range service.Plans {
+	for serviceIndex := range config.Spec.Catalog.Services {
+		service := &config.Spec.Catalog.Services[serviceIndex]
+
+		if err := validateDashboardClient(service); err != nil {
+			return err
+		}
+
+		// Default plan rollouts must reference plans belonging to the service offering.
+		for _, weight := range service.DefaultPlanRollout {
+			if getServicePlanByName(service, weight.Plan) == nil {
+				return fmt.Errorf("%w: default plan rollout for offering '%s' references undefined plan '%s'", ErrConfigurationInvalid, service.Name, weight.Plan)
+			}
+
+			if weight.Weight < 1 {
+				return fmt.Errorf("%w: default plan rollout for offering '%s' plan '%s' weight must be positive", ErrConfigurationInvalid, service.Name, weight.Plan)
+			}
+		}
+
+		for planIndex := range service.Plans {
+			plan := &service.Plans[planIndex]
+
+			if err := validateServicePlanCosts(service, plan); err != nil {
+				return err
+			}
+
+			if err := validateServicePlanSchemas(service, plan); err != nil {
+				return err
+			}
+
 			// Each service plan must have a service binding.
 			binding := getBindingForServicePlan(config, service.Name, plan.Name)
 			if binding == nil {
@@ -68,6 +327,10 @@ func validate(config *v1.ServiceBrokerConfig) error {
 				return fmt.Errorf("%w: service plan '%s' for offering '%s' not bindable, but binding '%s' defines service binding configuarion", ErrConfigurationInvalid, plan.Name, service.Name, binding.Name)
 			}
 
+			if !bindable && plan.BindingEndpoints != nil {
+				return fmt.Errorf("%w: service plan '%s' for offering '%s' not bindable, but defines binding endpoints", ErrConfigurationInvalid, plan.Name, service.Name)
+			}
+
 			if bindable && binding.ServiceBinding == nil {
 				return fmt.Errorf("%w: service plan '%s' for offering '%s' bindable, but binding '%s' does not define service binding configuarion", ErrConfigurationInvalid, plan.Name, service.Name, binding.Name)
 			}
@@ -77,31 +340,72 @@ func validate(config *v1.ServiceBrokerConfig) error {
 	// Check that configuration bindings are properly configured.
 	for _, binding := range config.Spec.Bindings {
 		// Bindings cannot do nothing.
-		if len(binding.ServiceInstance.Registry) == 0 && len(binding.ServiceInstance.Templates) == 0 {
+		if len(binding.ServiceInstance.Registry) == 0 && len(binding.ServiceInstance.Templates) == 0 && len(binding.ServiceInstance.ConditionalTemplates) == 0 {
 			return fmt.Errorf("%w: binding '%s' does nothing for service instances", ErrConfigurationInvalid, binding.Name)
 		}
 
+		// Only service bindings can inherit from service instances.
+		if binding.ServiceInstance.Inherit {
+			return fmt.Errorf("%w: binding '%s' service instance cannot inherit", ErrConfigurationInvalid, binding.Name)
+		}
+
+		// Only service bindings return credentials.
+		if len(binding.ServiceInstance.CredentialFormats) != 0 {
+			return fmt.Errorf("%w: binding '%s' defines credential formats for service instances", ErrConfigurationInvalid, binding.Name)
+		}
+
+		if binding.ServiceInstance.CACertificate != "" {
+			return fmt.Errorf("%w: binding '%s' defines a CA certificate for service instances", ErrConfigurationInvalid, binding.Name)
+		}
+
 		if binding.ServiceBinding != nil {
-			if len(binding.ServiceBinding.Registry) == 0 && len(binding.ServiceBinding.Templates) == 0 {
+			if len(binding.ServiceBinding.Registry) == 0 && len(binding.ServiceBinding.Templates) == 0 && len(binding.ServiceBinding.ConditionalTemplates) == 0 && len(binding.ServiceBinding.CredentialFormats) == 0 && binding.ServiceBinding.CACertificate == "" {
 				return fmt.Errorf("%w: binding '%s' does nothing for service bindings", ErrConfigurationInvalid, binding.Name)
 			}
 		}
 
 		// Binding templates must exist.
-		for _, template := range binding.ServiceInstance.Templates {
-			if getTemplateByName(config, template) == nil {
-				return fmt.Errorf("%w: template '%s', referenced by binding '%s' service instance, must exist", ErrConfigurationInvalid, template, binding.Name)
-			}
+		if err := validateTemplateList(config, &binding.ServiceInstance, binding.Name, "service instance"); err != nil {
+			return err
 		}
 
 		if binding.ServiceBinding != nil {
-			for _, template := range binding.ServiceBinding.Templates {
-				if getTemplateByName(config, template) == nil {
-					return fmt.Errorf("%w: template '%s', referenced by binding '%s' service binding, must exist", ErrConfigurationInvalid, template, binding.Name)
-				}
+			if err := validateTemplateList(config, binding.ServiceBinding, binding.Name, "service binding"); err != nil {
+				return err
 			}
 		}
 	}
 
+	// Template includes must exist and must not be cyclic.
+	for index := range config.Spec.Templates {
+		if err := validateTemplateIncludes(config, &config.Spec.Templates[index], nil); err != nil {
+			return err
+		}
+	}
+
+	// Templates created by pre-delete actions must exist.
+	for index := range config.Spec.Templates {
+		if err := validateTemplatePreDelete(config, &config.Spec.Templates[index]); err != nil {
+			return err
+		}
+	}
+
+	// Lookup tables must be uniquely named and map to strings.
+	lookups := map[string]interface{}{}
+
+	for index := range config.Spec.Lookups {
+		lookup := &config.Spec.Lookups[index]
+
+		if _, ok := lookups[lookup.Name]; ok {
+			return fmt.Errorf("%w: lookup '%s' defined more than once", ErrConfigurationInvalid, lookup.Name)
+		}
+
+		lookups[lookup.Name] = nil
+
+		if err := validateLookup(lookup); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -16,6 +16,8 @@ package errors
 
 import (
 	"fmt"
+
+	"github.com/couchbase/service-broker/pkg/api"
 )
 
 // configurationError errors are raised when the configuration is incorrect e.g. the
@@ -97,7 +99,8 @@ func (e *parameterError) Error() string {
 // validationError errors are raised when the parameter validation fails e.g.
 // the broker client has made a mistake.
 type validationError struct {
-	message string
+	message  string
+	failures []api.ValidationFailure
 }
 
 // NewValidationError returns a new validation error formatted like fmt.Errorf.
@@ -105,6 +108,22 @@ func NewValidationError(message string, arguments ...interface{}) error {
 	return &validationError{message: fmt.Sprintf(message, arguments...)}
 }
 
+// NewValidationErrorWithFailures returns a new validation error formatted like fmt.Errorf
+// that describes which parameters failed validation.
+func NewValidationErrorWithFailures(failures []api.ValidationFailure, message string, arguments ...interface{}) error {
+	return &validationError{message: fmt.Sprintf(message, arguments...), failures: failures}
+}
+
+// ValidationFailures returns the parameters that failed validation, if any.
+func ValidationFailures(err error) []api.ValidationFailure {
+	e, ok := err.(*validationError)
+	if !ok {
+		return nil
+	}
+
+	return e.failures
+}
+
 // IsValidationError returns whether an error is a validation error.
 func IsValidationError(err error) bool {
 	if _, ok := err.(*validationError); !ok {
@@ -215,3 +234,203 @@ func IsResourceGoneError(err error) bool {
 func (e *resourceGoneError) Error() string {
 	return e.message
 }
+
+// methodNotAllowedError errors are raised when a route exists but does not support
+// the request method.
+type methodNotAllowedError struct {
+	message string
+}
+
+// NewMethodNotAllowedError returns a new method not allowed error formatted like fmt.Errorf.
+func NewMethodNotAllowedError(message string, arguments ...interface{}) error {
+	return &methodNotAllowedError{message: fmt.Sprintf(message, arguments...)}
+}
+
+// IsMethodNotAllowedError returns whether an error is a method not allowed error.
+func IsMethodNotAllowedError(err error) bool {
+	if _, ok := err.(*methodNotAllowedError); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Error returns the method not allowed error string.
+func (e *methodNotAllowedError) Error() string {
+	return e.message
+}
+
+// forbiddenError errors are raised when a principal is not authorized to perform
+// a request.
+type forbiddenError struct {
+	message string
+}
+
+// NewForbiddenError returns a new forbidden error formatted like fmt.Errorf.
+func NewForbiddenError(message string, arguments ...interface{}) error {
+	return &forbiddenError{message: fmt.Sprintf(message, arguments...)}
+}
+
+// IsForbiddenError returns whether an error is a forbidden error.
+func IsForbiddenError(err error) bool {
+	if _, ok := err.(*forbiddenError); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Error returns the forbidden error string.
+func (e *forbiddenError) Error() string {
+	return e.message
+}
+
+// requestTooLargeError errors are raised when a request body exceeds the maximum
+// size allowed.
+type requestTooLargeError struct {
+	message string
+}
+
+// NewRequestTooLargeError returns a new request too large error formatted like fmt.Errorf.
+func NewRequestTooLargeError(message string, arguments ...interface{}) error {
+	return &requestTooLargeError{message: fmt.Sprintf(message, arguments...)}
+}
+
+// IsRequestTooLargeError returns whether an error is a request too large error.
+func IsRequestTooLargeError(err error) bool {
+	if _, ok := err.(*requestTooLargeError); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Error returns the request too large error string.
+func (e *requestTooLargeError) Error() string {
+	return e.message
+}
+
+// namespaceConflictError errors are raised when provisioning would collide with
+// resources belonging to another service instance in the same namespace.
+type namespaceConflictError struct {
+	message string
+}
+
+// NewNamespaceConflictError returns a new namespace conflict error formatted like fmt.Errorf.
+func NewNamespaceConflictError(message string, arguments ...interface{}) error {
+	return &namespaceConflictError{message: fmt.Sprintf(message, arguments...)}
+}
+
+// IsNamespaceConflictError returns whether an error is a namespace conflict error.
+func IsNamespaceConflictError(err error) bool {
+	if _, ok := err.(*namespaceConflictError); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Error returns the namespace conflict error string.
+func (e *namespaceConflictError) Error() string {
+	return e.message
+}
+
+// quotaExceededError errors are raised when a request cannot be serviced at present
+// because a limit has been reached e.g. the number of concurrent operations.
+type quotaExceededError struct {
+	message string
+}
+
+// NewQuotaExceededError returns a new quota exceeded error formatted like fmt.Errorf.
+func NewQuotaExceededError(message string, arguments ...interface{}) error {
+	return &quotaExceededError{message: fmt.Sprintf(message, arguments...)}
+}
+
+// IsQuotaExceededError returns whether an error is a quota exceeded error.
+func IsQuotaExceededError(err error) bool {
+	if _, ok := err.(*quotaExceededError); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Error returns the quota exceeded error string.
+func (e *quotaExceededError) Error() string {
+	return e.message
+}
+
+// operationTimeoutError errors are raised when an operation does not complete in time
+// e.g. a readiness check never passes.
+type operationTimeoutError struct {
+	message string
+}
+
+// NewOperationTimeoutError returns a new operation timeout error formatted like fmt.Errorf.
+func NewOperationTimeoutError(message string, arguments ...interface{}) error {
+	return &operationTimeoutError{message: fmt.Sprintf(message, arguments...)}
+}
+
+// IsOperationTimeoutError returns whether an error is an operation timeout error.
+func IsOperationTimeoutError(err error) bool {
+	if _, ok := err.(*operationTimeoutError); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Error returns the operation timeout error string.
+func (e *operationTimeoutError) Error() string {
+	return e.message
+}
+
+// operationCancelledError errors are raised when an operation is cancelled by another
+// request before it completes.
+type operationCancelledError struct {
+	message string
+}
+
+// NewOperationCancelledError returns a new operation cancelled error formatted like fmt.Errorf.
+func NewOperationCancelledError(message string, arguments ...interface{}) error {
+	return &operationCancelledError{message: fmt.Sprintf(message, arguments...)}
+}
+
+// IsOperationCancelledError returns whether an error is an operation cancelled error.
+func IsOperationCancelledError(err error) bool {
+	if _, ok := err.(*operationCancelledError); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Error returns the operation cancelled error string.
+func (e *operationCancelledError) Error() string {
+	return e.message
+}
+
+// concurrencyError errors are raised when another broker replica is mutating the
+// same resource.
+type concurrencyError struct {
+	message string
+}
+
+// NewConcurrencyError returns a new concurrency error formatted like fmt.Errorf.
+func NewConcurrencyError(message string, arguments ...interface{}) error {
+	return &concurrencyError{message: fmt.Sprintf(message, arguments...)}
+}
+
+// IsConcurrencyError returns whether an error is a concurrency error.
+func IsConcurrencyError(err error) bool {
+	if _, ok := err.(*concurrencyError); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Error returns the concurrency error string.
+func (e *concurrencyError) Error() string {
+	return e.message
+}
@@ -0,0 +1,396 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/util"
+
+	"github.com/golang/glog"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// leasePrefix is prepended to a service instance ID to name its lease.
+const leasePrefix = "service-broker-lock-"
+
+var (
+	// ErrLockHeld is raised when a lock is held by another broker replica.
+	ErrLockHeld = errors.New("lock held by another broker replica")
+
+	// locks are the locks currently held by this process, so they can be
+	// acquired again by concurrent operations e.g. a deletion that cancels
+	// a provision.  Concurrency within a replica is handled by operations.
+	// Locks remain here while being acquired or released, so the lease is
+	// only ever acquired or released by one goroutine at a time.
+	locks = map[string]*Lock{}
+
+	// locksMutex guards access to the held locks, and their references.  It is
+	// never held while making Kubernetes API calls.
+	locksMutex sync.Mutex
+)
+
+// Lock is a lease based lock on a service instance.
+type Lock struct {
+	// namespace is the namespace the lease lives in.
+	namespace string
+
+	// name is the name of the lease, empty if locking is disabled.
+	name string
+
+	// holder is the identity of the broker replica holding the lease.
+	holder string
+
+	// references is the number of times the lock has been acquired.  Once zero
+	// the lock is being released.
+	references int
+
+	// acquired is closed once the lease has been acquired, or failed to be.
+	acquired chan interface{}
+
+	// err is why the lease could not be acquired, valid once acquired is closed.
+	err error
+
+	// released is closed once the lease has been released.
+	released chan interface{}
+
+	// lost is closed if the lease cannot be renewed, and ownership is lost.
+	lost chan interface{}
+
+	// stop is closed to stop lease renewal.
+	stop chan interface{}
+
+	// done is closed when lease renewal has stopped.
+	done chan interface{}
+}
+
+// LeaseName returns the name of the lease that locks a service instance.
+func LeaseName(instanceID string) string {
+	return leasePrefix + instanceID
+}
+
+// key returns a unique key for a lock.
+func key(namespace, name, holder string) string {
+	return fmt.Sprintf("%s/%s/%s", namespace, name, holder)
+}
+
+// Acquire locks a service instance on behalf of a broker replica, taking over the
+// lease if it has expired.  The lease is renewed until the lock is released.
+// If locking is disabled this does nothing.
+func Acquire(namespace, instanceID, holder string) (*Lock, error) {
+	if config.GetOptions().LockLeaseDuration == 0 {
+		return &Lock{}, nil
+	}
+
+	name := LeaseName(instanceID)
+	k := key(namespace, name, holder)
+
+	for {
+		locksMutex.Lock()
+
+		lock, ok := locks[k]
+		if !ok {
+			break
+		}
+
+		// Wait for a lock that is being released, then try again.
+		if lock.references == 0 {
+			locksMutex.Unlock()
+
+			<-lock.released
+
+			continue
+		}
+
+		lock.references++
+
+		locksMutex.Unlock()
+
+		<-lock.acquired
+
+		if lock.err != nil {
+			return nil, lock.err
+		}
+
+		return lock, nil
+	}
+
+	lock := &Lock{
+		namespace:  namespace,
+		name:       name,
+		holder:     holder,
+		references: 1,
+		acquired:   make(chan interface{}),
+		released:   make(chan interface{}),
+		lost:       make(chan interface{}),
+		stop:       make(chan interface{}),
+		done:       make(chan interface{}),
+	}
+
+	locks[k] = lock
+
+	locksMutex.Unlock()
+
+	if err := acquireLease(namespace, name, holder); err != nil {
+		locksMutex.Lock()
+		delete(locks, k)
+		locksMutex.Unlock()
+
+		lock.err = err
+
+		close(lock.acquired)
+		close(lock.released)
+
+		return nil, err
+	}
+
+	go lock.renew()
+
+	close(lock.acquired)
+
+	return lock, nil
+}
+
+// Retain acquires the lock again, so it remains held when one holder releases it
+// e.g. when handing it to an asynchronous operation.
+func (l *Lock) Retain() *Lock {
+	if l.name == "" {
+		return l
+	}
+
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+
+	l.references++
+
+	return l
+}
+
+// Lost returns a channel that is closed if the lease could not be renewed, e.g.
+// because another broker replica has taken it over.  Anything done under the lock
+// should be stopped.  If locking is disabled the channel is never closed.
+func (l *Lock) Lost() <-chan interface{} {
+	return l.lost
+}
+
+// Release releases a lock, once all references have been released the lease
+// renewal is stopped and the lease is deleted.
+func (l *Lock) Release() {
+	if l.name == "" {
+		return
+	}
+
+	locksMutex.Lock()
+
+	l.references--
+
+	if l.references > 0 {
+		locksMutex.Unlock()
+
+		return
+	}
+
+	locksMutex.Unlock()
+
+	close(l.stop)
+	<-l.done
+
+	if err := releaseLease(l.namespace, l.name, l.holder); err != nil {
+		glog.Infof("failed to release lease %s/%s: %v", l.namespace, l.name, err)
+	}
+
+	locksMutex.Lock()
+	delete(locks, key(l.namespace, l.name, l.holder))
+	locksMutex.Unlock()
+
+	close(l.released)
+}
+
+// renew periodically renews the lease until stopped.  If the lease is taken over,
+// or cannot be renewed before it expires, ownership is lost and renewal stops.
+func (l *Lock) renew() {
+	defer close(l.done)
+
+	leaseDuration := config.GetOptions().LockLeaseDuration
+
+	ticker := time.NewTicker(leaseDuration / 3)
+	defer ticker.Stop()
+
+	renewed := util.DefaultClock().Now()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			err := renewLease(l.namespace, l.name, l.holder)
+			if err == nil {
+				renewed = util.DefaultClock().Now()
+
+				continue
+			}
+
+			glog.Infof("failed to renew lease %s/%s: %v", l.namespace, l.name, err)
+
+			if errors.Is(err, ErrLockHeld) || k8serrors.IsNotFound(err) || util.DefaultClock().Now().After(renewed.Add(leaseDuration)) {
+				glog.Errorf("lost lease %s/%s", l.namespace, l.name)
+
+				close(l.lost)
+
+				return
+			}
+		}
+	}
+}
+
+// leaseDurationSeconds returns the lease duration, rounded up to the nearest second.
+func leaseDurationSeconds() int32 {
+	return int32((config.GetOptions().LockLeaseDuration + time.Second - 1) / time.Second)
+}
+
+// expired returns whether a lease has not been renewed within its duration.
+func expired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+
+	return util.DefaultClock().Now().After(lease.Spec.RenewTime.Add(duration))
+}
+
+// acquireLease creates a lease, or takes over an existing one that has expired.
+func acquireLease(namespace, name, holder string) error {
+	leases := config.Clients().Kubernetes().CoordinationV1().Leases(namespace)
+
+	now := metav1.NewMicroTime(util.DefaultClock().Now())
+	duration := leaseDurationSeconds()
+
+	lease, err := leases.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return err
+		}
+
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+
+		if _, err := leases.Create(context.TODO(), lease, metav1.CreateOptions{}); err != nil {
+			if k8serrors.IsAlreadyExists(err) {
+				return ErrLockHeld
+			}
+
+			return err
+		}
+
+		return nil
+	}
+
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != holder && !expired(lease) {
+		return ErrLockHeld
+	}
+
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != holder {
+		glog.Infof("taking over expired lease %s/%s from %s", namespace, name, *lease.Spec.HolderIdentity)
+	}
+
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+
+	// The update is conditional on the resource version, so if another replica
+	// takes over the lease first, this will fail.
+	if _, err := leases.Update(context.TODO(), lease, metav1.UpdateOptions{}); err != nil {
+		if k8serrors.IsConflict(err) {
+			return ErrLockHeld
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// renewLease updates the renewal time of a lease, provided it is still held.
+func renewLease(namespace, name, holder string) error {
+	leases := config.Clients().Kubernetes().CoordinationV1().Leases(namespace)
+
+	lease, err := leases.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != holder {
+		return fmt.Errorf("%w: lease taken over", ErrLockHeld)
+	}
+
+	now := metav1.NewMicroTime(util.DefaultClock().Now())
+
+	lease.Spec.RenewTime = &now
+
+	if _, err := leases.Update(context.TODO(), lease, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// releaseLease deletes a lease, provided it is still held.
+func releaseLease(namespace, name, holder string) error {
+	leases := config.Clients().Kubernetes().CoordinationV1().Leases(namespace)
+
+	lease, err := leases.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != holder {
+		return nil
+	}
+
+	options := metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			ResourceVersion: &lease.ResourceVersion,
+		},
+	}
+
+	if err := leases.Delete(context.TODO(), name, options); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operation
+
+import (
+	"github.com/couchbase/service-broker/pkg/audit"
+	"github.com/couchbase/service-broker/pkg/registry"
+
+	"github.com/golang/glog"
+)
+
+// Audit sets the audit record of the request that is about to start an asynchronous
+// operation on the registry entry, so that the outcome of the operation can be
+// audited once it completes.  It is committed when the operation is started.
+func Audit(entry *registry.Entry, record *audit.Record) error {
+	if record == nil {
+		return nil
+	}
+
+	return entry.Set(registry.OperationAudit, record)
+}
+
+// AuditCompletion writes an audit record with the outcome of an asynchronous
+// operation, if the request that started it was audited.  Synchronous operations
+// are audited by the request, so are not recorded here.
+func AuditCompletion(entry *registry.Entry, status error) {
+	record := &audit.Record{}
+
+	ok, err := entry.Get(registry.OperationAudit, record)
+	if err != nil {
+		glog.Infof("failed to read operation audit record: %v", err)
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	id, _, err := entry.GetString(registry.OperationID)
+	if err != nil {
+		glog.Infof("failed to read operation ID: %v", err)
+	}
+
+	record.OperationID = id
+	record.CompleteOperation(status)
+}
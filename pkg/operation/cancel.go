@@ -0,0 +1,169 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/couchbase/service-broker/pkg/registry"
+)
+
+var (
+	// ErrOperationCancelled is raised when an operation is cancelled before completion.
+	ErrOperationCancelled = errors.New("operation cancelled")
+
+	// ErrOperationAborted is raised when an operation is stopped because this process
+	// no longer owns the service instance.
+	ErrOperationAborted = errors.New("operation aborted")
+)
+
+// cancellation allows a running operation to be signalled to stop, and for the
+// caller to wait for it to do so.
+type cancellation struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// aborted is set when the operation is stopped because ownership of the
+	// service instance has been lost, so must leave it untouched.
+	aborted bool
+}
+
+// cancellationKey is the context key used to look up an operation's cancellation.
+type cancellationKey struct{}
+
+var (
+	// cancellations maps from operation ID to running operations in this process.
+	cancellations = map[string]*cancellation{}
+
+	// cancellationsLock protects cancellations from concurrent access.
+	cancellationsLock sync.Mutex
+)
+
+// Context returns a context for an asynchronous operation on the registry entry.  The
+// context is cancelled by Cancel.  The returned function must be called when the operation
+// has finished.  If the operation already has a context, e.g. a provisioner running
+// within an operation, the returned context is derived from it and is cancelled with it.
+func Context(entry *registry.Entry) (context.Context, func(), error) {
+	id, ok, err := entry.GetString(registry.OperationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: operation ID does not exist for instance", ErrOperationDoesNotExist)
+	}
+
+	cancellationsLock.Lock()
+	defer cancellationsLock.Unlock()
+
+	if c, ok := cancellations[id]; ok {
+		ctx, cancel := context.WithCancel(c.ctx)
+
+		return ctx, cancel, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &cancellation{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	ctx = context.WithValue(ctx, cancellationKey{}, c)
+	c.ctx = ctx
+
+	cancellations[id] = c
+
+	finished := func() {
+		cancellationsLock.Lock()
+		delete(cancellations, id)
+		cancellationsLock.Unlock()
+
+		cancel()
+		close(c.done)
+	}
+
+	return ctx, finished, nil
+}
+
+// Cancel cancels an asynchronous operation on the registry entry and waits for it to
+// finish.  This returns false if the operation is not running in this process.
+func Cancel(entry *registry.Entry) (bool, error) {
+	id, ok, err := entry.GetString(registry.OperationID)
+	if err != nil {
+		return false, err
+	}
+
+	if !ok {
+		return false, nil
+	}
+
+	return CancelID(id), nil
+}
+
+// CancelID cancels an asynchronous operation by ID and waits for it to finish.  This
+// returns false if the operation is not running in this process.  Unlike Cancel, it
+// does not read a registry entry, so may be used while the operation is modifying it.
+func CancelID(id string) bool {
+	return stop(id, false)
+}
+
+// AbortID stops an asynchronous operation by ID and waits for it to finish, like
+// CancelID.  This is used when ownership of the service instance has been lost to
+// another broker replica, so the operation must stop without rolling back or recording
+// its status, as the new owner may be modifying the service instance.
+func AbortID(id string) bool {
+	return stop(id, true)
+}
+
+// stop cancels an asynchronous operation by ID, optionally aborting it, and waits for
+// it to finish.
+func stop(id string, abort bool) bool {
+	cancellationsLock.Lock()
+	c, ok := cancellations[id]
+
+	if ok && abort {
+		c.aborted = true
+	}
+
+	cancellationsLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	c.cancel()
+	<-c.done
+
+	return true
+}
+
+// Aborted returns whether the operation the context belongs to has been aborted, in
+// which case it must not modify the service instance any further.
+func Aborted(ctx context.Context) bool {
+	c, ok := ctx.Value(cancellationKey{}).(*cancellation)
+	if !ok {
+		return false
+	}
+
+	cancellationsLock.Lock()
+	defer cancellationsLock.Unlock()
+
+	return c.aborted
+}
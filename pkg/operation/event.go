@@ -0,0 +1,77 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
+	"github.com/couchbase/service-broker/pkg/version"
+
+	"github.com/golang/glog"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// EventReasonStarted is raised when an operation starts.
+	EventReasonStarted = "Started"
+
+	// EventReasonResourceApplied is raised when a resource is created or updated.
+	EventReasonResourceApplied = "ResourceApplied"
+
+	// EventReasonReady is raised when a provision or update operation succeeds.
+	EventReasonReady = "Ready"
+
+	// EventReasonFailed is raised when an operation fails.
+	EventReasonFailed = "Failed"
+)
+
+// Event raises a Kubernetes event against the registry entry, if enabled, so the
+// lifecycle of a service instance or binding is visible with kubectl describe.
+// Events are informational, so failure to raise one is logged and ignored.
+func Event(entry *registry.Entry, eventType, reason, format string, args ...interface{}) {
+	if !config.GetOptions().Events {
+		return
+	}
+
+	object := entry.GetObjectReference()
+	now := metav1.NewTime(util.DefaultClock().Now())
+
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", object.Name, now.UnixNano()),
+			Namespace: object.Namespace,
+		},
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        fmt.Sprintf(format, args...),
+		Type:           eventType,
+		Source: corev1.EventSource{
+			Component: version.Application,
+		},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := config.Clients().Kubernetes().CoreV1().Events(object.Namespace).Create(context.TODO(), event, metav1.CreateOptions{}); err != nil {
+		glog.Infof("failed to raise %s event for %s: %v", reason, object.Name, err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/registry"
+)
+
+// semaphore bounds the number of asynchronous operations that run concurrently,
+// queueing any excess in arrival order.
+type semaphore struct {
+	// limit is the number of operations that may run, zero is unlimited.
+	limit int
+
+	// running is the number of asynchronous operations holding a slot.
+	running int
+
+	// waiters are operations queued for a slot, in arrival order.  A waiter is
+	// handed a slot by closing its channel.
+	waiters []chan struct{}
+
+	// lock protects the semaphore from concurrent access.
+	lock sync.Mutex
+}
+
+var (
+	// slots bounds all asynchronous operations.
+	slots = &semaphore{}
+
+	// serviceSlots bound provisioning operations per service offering, keyed by
+	// service ID.
+	serviceSlots = map[string]*semaphore{}
+
+	// serviceSlotsLock protects serviceSlots from concurrent access.
+	serviceSlotsLock sync.Mutex
+)
+
+// limited returns whether no more asynchronous operations may run, this must be called
+// with the lock held.
+func (s *semaphore) limited() bool {
+	return s.limit > 0 && s.running >= s.limit
+}
+
+// saturated returns whether an asynchronous operation would need to be queued before it
+// could run.
+func (s *semaphore) saturated(limit int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.limit = limit
+
+	return s.limited() || len(s.waiters) != 0
+}
+
+// acquire reserves a slot, queueing the operation until one is released, or the context
+// is cancelled.  While queued the operation's progress is reported with the description.
+func (s *semaphore) acquire(ctx context.Context, entry *registry.Entry, limit int, description string) error {
+	s.lock.Lock()
+
+	s.limit = limit
+
+	if !s.limited() && len(s.waiters) == 0 {
+		s.running++
+		s.lock.Unlock()
+
+		return nil
+	}
+
+	waiter := make(chan struct{})
+	s.waiters = append(s.waiters, waiter)
+
+	s.lock.Unlock()
+
+	if err := Progress(entry, "queued waiting for %s", description); err != nil {
+		s.dequeue(waiter)
+
+		return err
+	}
+
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+		s.dequeue(waiter)
+
+		return fmt.Errorf("%w: operation cancelled while queued", ErrOperationCancelled)
+	}
+}
+
+// dequeue removes a waiter from the queue.  If it was handed a slot in the meantime
+// then the slot is released.
+func (s *semaphore) dequeue(waiter chan struct{}) {
+	s.lock.Lock()
+
+	for i := range s.waiters {
+		if s.waiters[i] == waiter {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			s.lock.Unlock()
+
+			return
+		}
+	}
+
+	s.lock.Unlock()
+
+	s.release()
+}
+
+// release frees a reserved slot, handing it to the next queued operation.
+func (s *semaphore) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.running--
+
+	if len(s.waiters) != 0 && !s.limited() {
+		s.running++
+
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+	}
+}
+
+// Saturated returns whether an asynchronous operation would need to be queued before it
+// could run.
+func Saturated() bool {
+	return slots.saturated(config.GetOptions().MaxConcurrentOperations)
+}
+
+// Acquire reserves a slot for an asynchronous operation on the registry entry, bounding
+// the number that run concurrently.  If none are available the operation is queued until
+// one is released, or the context is cancelled.  Release must be called when a slot is
+// no longer required.
+func Acquire(ctx context.Context, entry *registry.Entry) error {
+	limit := config.GetOptions().MaxConcurrentOperations
+
+	return slots.acquire(ctx, entry, limit, fmt.Sprintf("one of %d operation slots", limit))
+}
+
+// Release frees a slot reserved by Acquire, handing it to the next queued operation.
+func Release() {
+	slots.release()
+}
+
+// serviceSemaphore returns the semaphore bounding provisioning for a service offering.
+func serviceSemaphore(serviceID string) *semaphore {
+	serviceSlotsLock.Lock()
+	defer serviceSlotsLock.Unlock()
+
+	s, ok := serviceSlots[serviceID]
+	if !ok {
+		s = &semaphore{}
+		serviceSlots[serviceID] = s
+	}
+
+	return s
+}
+
+// AcquireService reserves a slot for provisioning a service instance of the service
+// offering, bounding the number that run concurrently to the limit, while other service
+// offerings are unaffected.  ReleaseService must be called when a slot is no longer
+// required.
+func AcquireService(ctx context.Context, entry *registry.Entry, serviceID string, limit int) error {
+	return serviceSemaphore(serviceID).acquire(ctx, entry, limit, fmt.Sprintf("one of %d provisioning slots for service %s", limit, serviceID))
+}
+
+// ReleaseService frees a slot reserved by AcquireService.
+func ReleaseService(serviceID string) {
+	serviceSemaphore(serviceID).release()
+}
@@ -17,10 +17,16 @@ package operation
 import (
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/couchbase/service-broker/pkg/config"
 	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
 
+	"github.com/golang/glog"
 	"github.com/google/uuid"
+
+	corev1 "k8s.io/api/core/v1"
 )
 
 // ErrOperatorExists is raised when an operation exists and it shouldn't.
@@ -29,6 +35,14 @@ var ErrOperatorExists = errors.New("operation exists")
 // ErrOperationDoesNotExist is raised when an operation doesn't exist and it should.
 var ErrOperationDoesNotExist = errors.New("operation doesn't exist")
 
+const (
+	// maxDiagnostics is the number of recent diagnostic messages retained.
+	maxDiagnostics = 10
+
+	// maxDiagnosticLength is the maximum length of a diagnostic message.
+	maxDiagnosticLength = 512
+)
+
 // Type is the type of operation being performed.
 type Type string
 
@@ -43,8 +57,9 @@ const (
 	TypeDeprovision Type = "deprovision"
 )
 
-// Start begins an asynchronous operation on the registry entry.
-func Start(entry *registry.Entry, t Type) error {
+// Start begins an asynchronous operation on the registry entry, recording the identity
+// of the request that started it.
+func Start(entry *registry.Entry, t Type, requestIdentity string) error {
 	op, ok, err := entry.GetString(registry.Operation)
 	if err != nil {
 		return err
@@ -56,6 +71,10 @@ func Start(entry *registry.Entry, t Type) error {
 
 	id := uuid.New().String()
 
+	// A new operation supersedes the result of the last one.
+	unsetResult(entry)
+	entry.Unset(registry.OperationDiagnostics)
+
 	if err := entry.Set(registry.Operation, string(t)); err != nil {
 		return err
 	}
@@ -64,13 +83,84 @@ func Start(entry *registry.Entry, t Type) error {
 		return err
 	}
 
+	if err := entry.Set(registry.OperationRequestIdentity, requestIdentity); err != nil {
+		return err
+	}
+
+	if err := entry.Set(registry.OperationLastPolled, util.DefaultClock().Now()); err != nil {
+		return err
+	}
+
 	if err := entry.Commit(); err != nil {
 		return err
 	}
 
+	Event(entry, corev1.EventTypeNormal, EventReasonStarted, "%s operation started", t)
+
 	return nil
 }
 
+// Progress records a checkpoint for an asynchronous operation on the registry entry.
+func Progress(entry *registry.Entry, format string, args ...interface{}) error {
+	op, ok, err := entry.GetString(registry.Operation)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: %s operation does not exist for instance", ErrOperationDoesNotExist, op)
+	}
+
+	if err := entry.Set(registry.OperationProgress, fmt.Sprintf(format, args...)); err != nil {
+		return err
+	}
+
+	if err := entry.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Diagnose records a diagnostic message for an asynchronous operation on the registry
+// entry, that is committed with the next checkpoint or completion.  Only the most recent
+// messages are retained, and sensitive values are redacted.
+func Diagnose(entry *registry.Entry, format string, args ...interface{}) {
+	message := entry.Redact(fmt.Sprintf(format, args...))
+
+	if len(message) > maxDiagnosticLength {
+		message = message[:maxDiagnosticLength] + "..."
+	}
+
+	diagnostics := []string{}
+
+	if _, err := entry.Get(registry.OperationDiagnostics, &diagnostics); err != nil {
+		glog.Infof("failed to read operation diagnostics: %v", err)
+	}
+
+	diagnostics = append(diagnostics, message)
+
+	if len(diagnostics) > maxDiagnostics {
+		diagnostics = diagnostics[len(diagnostics)-maxDiagnostics:]
+	}
+
+	if err := entry.Set(registry.OperationDiagnostics, diagnostics); err != nil {
+		glog.Infof("failed to record operation diagnostics: %v", err)
+	}
+}
+
+// Diagnostics returns the diagnostic messages recorded by an asynchronous operation
+// on the registry entry.
+func Diagnostics(entry *registry.Entry) ([]string, error) {
+	diagnostics := []string{}
+
+	if _, err := entry.Get(registry.OperationDiagnostics, &diagnostics); err != nil {
+		return nil, err
+	}
+
+	return diagnostics, nil
+}
+
 // Complete sets the asynchronous operation completion on the registry entry.
 func Complete(entry *registry.Entry, status error) error {
 	op, ok, err := entry.GetString(registry.Operation)
@@ -95,6 +185,21 @@ func Complete(entry *registry.Entry, status error) error {
 		return err
 	}
 
+	// Notify after committing, so a receiver that polls in response sees the
+	// operation as complete.
+	if err := Notify(entry, status); err != nil {
+		glog.Infof("failed to send completion webhook: %v", err)
+	}
+
+	AuditCompletion(entry, status)
+
+	switch {
+	case status != nil:
+		Event(entry, corev1.EventTypeWarning, EventReasonFailed, "%s operation failed: %v", op, status)
+	case Type(op) != TypeDeprovision:
+		Event(entry, corev1.EventTypeNormal, EventReasonReady, "%s operation succeeded", op)
+	}
+
 	return err
 }
 
@@ -109,9 +214,33 @@ func End(entry *registry.Entry) error {
 		return fmt.Errorf("%w: %s operation does not exist for instance", ErrOperationDoesNotExist, op)
 	}
 
+	if err := retain(entry); err != nil {
+		return err
+	}
+
+	// Operations that ended without completing, for example those that were
+	// cancelled, have no status to record.
+	status, ok, err := entry.GetString(registry.OperationStatus)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		if err := entry.Set(registry.OperationLastStatus, status); err != nil {
+			return err
+		}
+	}
+
 	entry.Unset(registry.Operation)
 	entry.Unset(registry.OperationID)
 	entry.Unset(registry.OperationStatus)
+	entry.Unset(registry.OperationRequestIdentity)
+	entry.Unset(registry.OperationAudit)
+	entry.Unset(registry.OperationProgress)
+	entry.Unset(registry.OperationLastPolled)
+	entry.Unset(registry.OperationDiagnostics)
+	entry.Unset(registry.DeletionReport)
+	entry.Unset(registry.ReadinessDeadline)
 
 	if err := entry.Commit(); err != nil {
 		return err
@@ -119,3 +248,104 @@ func End(entry *registry.Entry) error {
 
 	return nil
 }
+
+// retain records the result of a completed operation so it can be polled for until
+// the retention period expires.  Operations that ended without completing, for example
+// those that were cancelled, have no result to retain.
+func retain(entry *registry.Entry) error {
+	if config.GetOptions().OperationRetention == 0 {
+		return nil
+	}
+
+	id, ok, err := entry.GetString(registry.OperationID)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return nil
+	}
+
+	status, ok, err := entry.GetString(registry.OperationStatus)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return nil
+	}
+
+	if err := entry.Set(registry.OperationResultID, id); err != nil {
+		return err
+	}
+
+	if err := entry.Set(registry.OperationResultStatus, status); err != nil {
+		return err
+	}
+
+	if err := entry.Set(registry.OperationResultExpiry, util.DefaultClock().Now().Add(config.GetOptions().OperationRetention)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// unsetResult removes any retained operation result from the registry entry.
+func unsetResult(entry *registry.Entry) {
+	entry.Unset(registry.OperationResultID)
+	entry.Unset(registry.OperationResultStatus)
+	entry.Unset(registry.OperationResultExpiry)
+}
+
+// PruneResult removes the retained result of a completed operation from the registry
+// entry if it has expired, returning whether it has been removed.  Entries without a
+// retained result are left untouched.
+func PruneResult(entry *registry.Entry) (bool, error) {
+	var expiry time.Time
+
+	ok, err := entry.Get(registry.OperationResultExpiry, &expiry)
+	if err != nil {
+		return false, err
+	}
+
+	if !ok || !util.DefaultClock().Now().After(expiry) {
+		return false, nil
+	}
+
+	unsetResult(entry)
+
+	if err := entry.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Result returns the retained error string of a completed operation, if it exists
+// and has not expired.  Expired results are pruned from the registry entry.
+func Result(entry *registry.Entry, id string) (string, bool, error) {
+	pruned, err := PruneResult(entry)
+	if err != nil {
+		return "", false, err
+	}
+
+	if pruned {
+		return "", false, nil
+	}
+
+	resultID, ok, err := entry.GetString(registry.OperationResultID)
+	if err != nil {
+		return "", false, err
+	}
+
+	if !ok || resultID != id {
+		return "", false, nil
+	}
+
+	status, ok, err := entry.GetString(registry.OperationResultStatus)
+	if err != nil {
+		return "", false, err
+	}
+
+	return status, ok, nil
+}
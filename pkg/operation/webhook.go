@@ -0,0 +1,208 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/api"
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
+
+	"github.com/golang/glog"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ErrWebhookDelivery is raised when the completion webhook cannot be delivered.
+var ErrWebhookDelivery = errors.New("webhook delivery failed")
+
+const (
+	// webhookTimeout is how long to wait for the completion webhook to respond.
+	webhookTimeout = 10 * time.Second
+)
+
+var (
+	// webhookRandom adds jitter to completion webhook retries.
+	webhookRandom = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint:gosec
+
+	// webhookRandomLock serializes access to webhookRandom.
+	webhookRandomLock sync.Mutex
+)
+
+// webhookBackoff returns how long to wait before the given retry.  This doubles for
+// each attempt, and is jittered between half and the full value so retries from many
+// operations are spread out.
+func webhookBackoff(initial time.Duration, retry int) time.Duration {
+	backoff := initial << uint(retry)
+
+	webhookRandomLock.Lock()
+	defer webhookRandomLock.Unlock()
+
+	return backoff/2 + time.Duration(webhookRandom.Int63n(int64(backoff/2)+1))
+}
+
+// deliver makes a single attempt to send the completion webhook.
+func deliver(webhook string, body []byte) error {
+	client := &http.Client{
+		Timeout: webhookTimeout,
+	}
+
+	response, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("%w: unexpected status code %d", ErrWebhookDelivery, response.StatusCode)
+	}
+
+	return nil
+}
+
+// Notify sends the completion webhook, if configured, for an asynchronous operation
+// on the registry entry.  The webhook is delivered in the background, so it neither
+// delays the operation, nor is seen before the operation is committed as complete.
+// Delivery is retried with jittered exponential backoff, and if all attempts fail the
+// error is recorded in the registry entry.
+func Notify(entry *registry.Entry, status error) error {
+	options := config.GetOptions()
+
+	if options.CompletionWebhook == "" {
+		return nil
+	}
+
+	op, ok, err := entry.GetString(registry.Operation)
+	if err != nil {
+		return err
+	}
+
+	// Synchronous operations, e.g. service binding deletion, have nothing to notify.
+	if !ok {
+		return nil
+	}
+
+	id, _, err := entry.GetString(registry.OperationID)
+	if err != nil {
+		return err
+	}
+
+	instanceID, _, err := entry.GetString(registry.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	bindingID, _, err := entry.GetString(registry.BindingID)
+	if err != nil {
+		return err
+	}
+
+	requestIdentity, _, err := entry.GetString(registry.OperationRequestIdentity)
+	if err != nil {
+		return err
+	}
+
+	completion := &api.OperationCompletion{
+		IdempotencyToken: id,
+		RequestIdentity:  requestIdentity,
+		Operation:        op,
+		InstanceID:       instanceID,
+		BindingID:        bindingID,
+		State:            api.PollStateSucceeded,
+	}
+
+	// The webhook is an external endpoint, so secrets must not leak into it.
+	if status != nil {
+		completion.State = api.PollStateFailed
+		completion.Description = entry.Redact(status.Error())
+	}
+
+	body, err := json.Marshal(completion)
+	if err != nil {
+		return err
+	}
+
+	go notify(entry.GetObjectReference(), id, body, options)
+
+	return nil
+}
+
+// notify delivers the completion webhook, then records the outcome in the registry
+// entry.  The registry entry is read again, as the operation that triggered the
+// webhook may still be using its own copy.  Options are those in effect when the
+// operation completed.
+func notify(reference corev1.ObjectReference, id string, body []byte, options config.Options) {
+	var err error
+
+	for attempt := 0; attempt < options.CompletionWebhookAttempts; attempt++ {
+		if attempt != 0 {
+			util.Sleep(webhookBackoff(options.CompletionWebhookBackoff, attempt-1))
+		}
+
+		if err = deliver(options.CompletionWebhook, body); err == nil {
+			break
+		}
+
+		glog.Infof("completion webhook attempt %d of %d failed: %v", attempt+1, options.CompletionWebhookAttempts, err)
+	}
+
+	if err != nil {
+		glog.Errorf("completion webhook for operation %s abandoned: %v", id, err)
+	}
+
+	if err := recordDelivery(reference, err); err != nil {
+		glog.Infof("failed to record completion webhook delivery: %v", err)
+	}
+}
+
+// recordDelivery records why the completion webhook could not be delivered, or clears
+// any previous failure.  If the registry entry has been deleted, e.g. by deprovisioning,
+// there is nowhere to record the outcome, it is only logged.
+func recordDelivery(reference corev1.ObjectReference, status error) error {
+	entry, err := registry.NewFromReference(reference, false)
+	if err != nil {
+		return err
+	}
+
+	if !entry.Exists() {
+		return nil
+	}
+
+	if status == nil {
+		if _, ok, err := entry.GetString(registry.CompletionWebhookError); err != nil || !ok {
+			return err
+		}
+
+		entry.Unset(registry.CompletionWebhookError)
+
+		return entry.Commit()
+	}
+
+	if err := entry.Set(registry.CompletionWebhookError, status.Error()); err != nil {
+		return err
+	}
+
+	return entry.Commit()
+}
@@ -17,20 +17,25 @@ package provisioners
 import (
 	"context"
 	"encoding/json"
+	goerrors "errors"
 	"fmt"
 
 	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
 	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/errors"
 	"github.com/couchbase/service-broker/pkg/operation"
 	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
 
 	"github.com/golang/glog"
 
+	corev1 "k8s.io/api/core/v1"
 	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 type createStep struct {
@@ -53,6 +58,13 @@ type Creator struct {
 	// Each creation is modelled as a set of steps with optional barriers
 	// in between them.
 	steps []createStep
+
+	// probes are run once all steps have completed.
+	probes []v1.ConfigurationProbe
+
+	// readinessDeadline, if set, bounds how long readiness checks may be waited
+	// for, measured from the start of the operation.
+	readinessDeadline *metav1.Duration
 }
 
 // NewCreator initializes all the data required for
@@ -103,12 +115,6 @@ func (p *Creator) createResource(template *v1.ConfigurationTemplate, entry *regi
 		return err
 	}
 
-	// First we need to set up owner references so that we can garbage collect the
-	// cluster easily.  These should not be considered as part of the cached annotation
-	// defined above.
-	ownerReference := entry.GetOwnerReference()
-	object.SetOwnerReferences([]metav1.OwnerReference{ownerReference})
-
 	// Prepare the client code
 	gvk := object.GroupVersionKind()
 
@@ -136,20 +142,60 @@ func (p *Creator) createResource(template *v1.ConfigurationTemplate, entry *regi
 
 	glog.Infof("using namespace %s", namespace)
 
+	// Next we need to set up owner references so that we can garbage collect the
+	// cluster easily.  These should not be considered as part of the cached annotation
+	// defined above.  Owner references cannot cross namespaces, the garbage collector
+	// would consider the owner missing and delete the resource, so resources in other
+	// namespaces are only cleaned up by deprovisioning.
+	ownerReference := entry.GetOwnerReference()
+	owned := mapping.Scope.Name() == meta.RESTScopeNameRoot || namespace == entry.GetObjectReference().Namespace
+
+	if owned {
+		object.SetOwnerReferences([]metav1.OwnerReference{ownerReference})
+	}
+
 	// Create the object
 	client := config.Clients().Dynamic()
 
-	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-		_, err = client.Resource(mapping.Resource).Create(context.TODO(), object, metav1.CreateOptions{})
-	} else {
-		_, err = client.Resource(mapping.Resource).Namespace(namespace).Create(context.TODO(), object, metav1.CreateOptions{})
-	}
+	err = applyWithTimeout(object, func(ctx context.Context) error {
+		var err error
+
+		if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+			_, err = client.Resource(mapping.Resource).Create(ctx, object, metav1.CreateOptions{})
+		} else {
+			_, err = client.Resource(mapping.Resource).Namespace(namespace).Create(ctx, object, metav1.CreateOptions{})
+		}
+
+		return err
+	}, func(err error) {
+		// The operation has already failed and been rolled back, so a create that
+		// lands late would be orphaned, delete it by name.
+		if err != nil {
+			return
+		}
+
+		if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+			err = client.Resource(mapping.Resource).Delete(context.TODO(), object.GetName(), metav1.DeleteOptions{})
+		} else {
+			err = client.Resource(mapping.Resource).Namespace(namespace).Delete(context.TODO(), object.GetName(), metav1.DeleteOptions{})
+		}
+
+		if err != nil && !k8s_errors.IsNotFound(err) {
+			glog.Infof("failed to delete late created resource %s %s: %v", object.GetKind(), object.GetName(), err)
+		}
+	})
 
 	if err != nil {
 		// When the object already exists and it is marked as a singleton we need to
 		// update the owner references to include this new serivce instance so it
 		// will not be garbage collected when an existing service instance is removed.
 		if k8s_errors.IsAlreadyExists(err) && template.Singleton {
+			if !owned {
+				glog.Infof("singleton resource already exists in another namespace, not adding owner reference")
+
+				return nil
+			}
+
 			glog.Infof("singleton resource already exists, adding owner reference")
 
 			existing, err := client.Resource(mapping.Resource).Namespace(namespace).Get(context.TODO(), object.GetName(), metav1.GetOptions{})
@@ -181,26 +227,117 @@ func (p *Creator) createResource(template *v1.ConfigurationTemplate, entry *regi
 				return err
 			}
 
-			if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-				_, err = client.Resource(mapping.Resource).Update(context.TODO(), existing, metav1.UpdateOptions{})
-			} else {
-				_, err = client.Resource(mapping.Resource).Namespace(namespace).Update(context.TODO(), existing, metav1.UpdateOptions{})
-			}
+			err = applyWithTimeout(existing, func(ctx context.Context) error {
+				var err error
+
+				if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+					_, err = client.Resource(mapping.Resource).Update(ctx, existing, metav1.UpdateOptions{})
+				} else {
+					_, err = client.Resource(mapping.Resource).Namespace(namespace).Update(ctx, existing, metav1.UpdateOptions{})
+				}
+
+				return err
+			}, nil)
 
 			if err != nil {
 				glog.Infof("unable to update singleton resource owner references: %v", err)
 				return err
 			}
 
+			operation.Event(entry, corev1.EventTypeNormal, operation.EventReasonResourceApplied, "adopted %s %s", object.GetKind(), object.GetName())
+
 			return nil
 		}
 
 		return err
 	}
 
+	operation.Event(entry, corev1.EventTypeNormal, operation.EventReasonResourceApplied, "created %s %s", object.GetKind(), object.GetName())
+
 	return nil
 }
 
+// renderCredentialFormats renders any named credential representations and adds them
+// to the credentials returned by a service binding.
+func (p *Creator) renderCredentialFormats(templates *v1.ServiceBrokerTemplateList, entry *registry.Entry) error {
+	if len(templates.CredentialFormats) == 0 {
+		return nil
+	}
+
+	glog.Infof("rendering credential formats for binding")
+
+	credentials := map[string]interface{}{}
+
+	if _, err := entry.Get(registry.Credentials, &credentials); err != nil {
+		return errors.NewConfigurationError("credentials must be an object to add credential formats: %v", err)
+	}
+
+	for _, format := range templates.CredentialFormats {
+		value, err := renderTemplateString(format.Value, entry, nil)
+		if err != nil {
+			return err
+		}
+
+		// Rendered values are decoded from JSON, so are always serializable.
+		if value == nil {
+			continue
+		}
+
+		credentials[format.Name] = value
+	}
+
+	return entry.Set(registry.Credentials, credentials)
+}
+
+// caCertificateCredential is the credentials field a CA certificate is returned in.
+const caCertificateCredential = "ca.crt"
+
+// renderCACertificate adds a CA certificate, or certificate chain, from the registry
+// to the credentials returned by a service binding, so clients can trust the service
+// instance.
+func (p *Creator) renderCACertificate(templates *v1.ServiceBrokerTemplateList, entry *registry.Entry) error {
+	if templates.CACertificate == "" {
+		return nil
+	}
+
+	glog.Infof("adding CA certificate %s to credentials for binding", templates.CACertificate)
+
+	value, ok, err := entry.GetUser(templates.CACertificate)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.NewConfigurationError("CA certificate registry key %s does not exist", templates.CACertificate)
+	}
+
+	caPEM, ok := value.(string)
+	if !ok {
+		return errors.NewConfigurationError("CA certificate registry key %s is not a string", templates.CACertificate)
+	}
+
+	certs, err := util.DecodeCertificates([]byte(caPEM))
+	if err != nil {
+		return err
+	}
+
+	for _, cert := range certs {
+		if !cert.IsCA {
+			return errors.NewConfigurationError("CA certificate registry key %s contains non-CA certificate %s", templates.CACertificate, cert.Subject.CommonName)
+		}
+	}
+
+	credentials := map[string]interface{}{}
+
+	if _, err := entry.Get(registry.Credentials, &credentials); err != nil {
+		return errors.NewConfigurationError("credentials must be an object to add a CA certificate: %v", err)
+	}
+
+	credentials[caCertificateCredential] = string(util.EncodeCertificates(certs))
+
+	return entry.Set(registry.Credentials, credentials)
+}
+
 // Prepare does provisional synchronous tasks before provisioning.  This does
 // basic template collection and rendering.
 func (p *Creator) Prepare(entry *registry.Entry) error {
@@ -230,11 +367,19 @@ func (p *Creator) Prepare(entry *registry.Entry) error {
 		return err
 	}
 
+	// Parameters are clamped afresh each time they are rendered.
+	entry.Unset(registry.ClampedParameters)
+
 	// Render any parameters.  As they are not associated with any template they
 	// can only ever be committed to the registry.
 	glog.Infof("rendering parameters for binding")
 
-	for _, registry := range templates.Registry {
+	registries, err := config.OrderRegistryValues(config.Config().Spec.Templates, templates.Registry)
+	if err != nil {
+		return errors.NewConfigurationError("%v", err)
+	}
+
+	for _, registry := range registries {
 		value, err := renderTemplateString(registry.Value, entry, nil)
 		if err != nil {
 			return err
@@ -244,23 +389,44 @@ func (p *Creator) Prepare(entry *registry.Entry) error {
 			continue
 		}
 
-		if err := entry.SetUser(registry.Name, value); err != nil {
+		if err := entry.SetUsers(append([]string{registry.Name}, registry.Names...), value); err != nil {
 			return err
 		}
 	}
 
+	if err := p.renderCredentialFormats(templates, entry); err != nil {
+		return err
+	}
+
+	if err := p.renderCACertificate(templates, entry); err != nil {
+		return err
+	}
+
+	annotations, err := renderAnnotations(templates, entry)
+	if err != nil {
+		return err
+	}
+
 	glog.Infof("rendering templates for binding")
 
 	// Use either the provided steps, or implictly create a default step.
 	steps := templates.Steps
 	if steps == nil {
+		names, err := selectTemplates(templates, entry)
+		if err != nil {
+			return err
+		}
+
 		steps = append(steps, v1.ServiceBrokerTemplateListStep{
 			Name:            "default",
-			Templates:       templates.Templates,
+			Templates:       names,
 			ReadinessChecks: templates.ReadinessChecks,
 		})
 	}
 
+	// Keep a record of what was rendered so it can be inspected later.
+	manifests := []v1.ConfigurationTemplate{}
+
 	for _, step := range steps {
 		glog.Infof("rendering templates for step %s", step.Name)
 
@@ -275,44 +441,319 @@ func (p *Creator) Prepare(entry *registry.Entry) error {
 				return err
 			}
 
-			t, err := renderTemplate(template, entry, nil)
+			rendered, err := renderTemplates(template, entry)
 			if err != nil {
 				return err
 			}
 
-			createStep.templates = append(createStep.templates, t)
+			for _, t := range rendered {
+				if err := annotateTemplate(t, annotations); err != nil {
+					return err
+				}
+
+				createStep.templates = append(createStep.templates, t)
+				manifests = append(manifests, *t)
+			}
 		}
 
 		p.steps = append(p.steps, createStep)
 	}
 
+	if err := setManifests(entry, manifests); err != nil {
+		return err
+	}
+
+	p.probes = templates.PostProvisionProbes
+	p.readinessDeadline = templates.ReadinessDeadline
+
+	return nil
+}
+
+// CheckConflicts checks whether any rendered resources already exist and belong
+// to something other than this resource.  Singletons are expected to be shared, so
+// are ignored.  This must be called after Prepare.
+func (p *Creator) CheckConflicts(entry *registry.Entry) error {
+	owner := entry.GetOwnerReference()
+
+	for _, step := range p.steps {
+		for _, template := range step.templates {
+			if template.Singleton || template.Template == nil || template.Template.Raw == nil {
+				continue
+			}
+
+			object := &unstructured.Unstructured{}
+			if err := json.Unmarshal(template.Template.Raw, object); err != nil {
+				return err
+			}
+
+			gvk := object.GroupVersionKind()
+
+			// Unknown resource types will be reported when creation is attempted.
+			mapping, err := config.Clients().RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+			if err != nil {
+				continue
+			}
+
+			namespace := object.GetNamespace()
+			if namespace == "" {
+				n, ok, err := entry.GetString(registry.Namespace)
+				if err != nil {
+					return err
+				}
+
+				if !ok {
+					return fmt.Errorf("%w: unable to lookup namespace", ErrRegistryEntryMissing)
+				}
+
+				namespace = n
+			}
+
+			client := config.Clients().Dynamic()
+
+			var existing *unstructured.Unstructured
+
+			if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+				existing, err = client.Resource(mapping.Resource).Get(context.TODO(), object.GetName(), metav1.GetOptions{})
+			} else {
+				existing, err = client.Resource(mapping.Resource).Namespace(namespace).Get(context.TODO(), object.GetName(), metav1.GetOptions{})
+			}
+
+			if err != nil {
+				if k8s_errors.IsNotFound(err) {
+					continue
+				}
+
+				return err
+			}
+
+			owned := false
+
+			for _, reference := range existing.GetOwnerReferences() {
+				if isOwnerReference(reference, owner) {
+					owned = true
+					break
+				}
+			}
+
+			if !owned {
+				return errors.NewNamespaceConflictError("resource %s/%s %s in namespace %s already exists and belongs to another service instance", object.GetAPIVersion(), object.GetKind(), object.GetName(), namespace)
+			}
+		}
+	}
+
 	return nil
 }
 
+// isOwnerReference returns whether an owner reference refers to the same owner.  As
+// well as the kind and name, the API group must match, as kinds are only unique within
+// a group, and the UID must match, so a resource owned by a previous incarnation of the
+// owner, that is awaiting garbage collection, is not mistaken for one owned by this one.
+func isOwnerReference(reference, owner metav1.OwnerReference) bool {
+	referenceGroupVersion, err := schema.ParseGroupVersion(reference.APIVersion)
+	if err != nil {
+		return false
+	}
+
+	ownerGroupVersion, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return false
+	}
+
+	return referenceGroupVersion.Group == ownerGroupVersion.Group && reference.Kind == owner.Kind && reference.Name == owner.Name && reference.UID == owner.UID
+}
+
+// describeError formats an error for diagnostics, Kubernetes API errors include their
+// reason and code, which are otherwise lost.
+func describeError(err error) string {
+	var status k8s_errors.APIStatus
+
+	if goerrors.As(err, &status) {
+		return fmt.Sprintf("%v (reason %s, code %d)", err, status.Status().Reason, status.Status().Code)
+	}
+
+	return err.Error()
+}
+
 // run performs asynchronous creation tasks.
-func (p *Creator) run(entry *registry.Entry) error {
+func (p *Creator) run(ctx context.Context, entry *registry.Entry) error {
+	total := 0
+
 	for _, step := range p.steps {
+		total += len(step.templates)
+	}
+
+	// The readiness deadline is recorded as the operation starts, so it spans
+	// all steps.
+	if p.readinessDeadline != nil {
+		if err := entry.Set(registry.ReadinessDeadline, util.DefaultClock().Now().Add(p.readinessDeadline.Duration)); err != nil {
+			return err
+		}
+	}
+
+	created := []*v1.ConfigurationTemplate{}
+
+	for index, step := range p.steps {
 		glog.Infof("creating resources for step %s", step.name)
 
 		for _, template := range step.templates {
+			if ctx.Err() != nil {
+				return p.cancel(ctx, created, entry)
+			}
+
+			// The resource that failed is not rolled back, it may belong to
+			// something else.  The exception is a create that timed out, that
+			// may yet have happened, so is deleted by name.
 			if err := p.createResource(template, entry); err != nil {
+				operation.Diagnose(entry, "step %s: failed to create template %s: %s", step.name, template.Name, describeError(err))
+
+				if errors.IsOperationTimeoutError(err) {
+					created = append(created, template)
+				}
+
+				p.rollback(created, entry)
+
+				return err
+			}
+
+			operation.Diagnose(entry, "step %s: created template %s", step.name, template.Name)
+
+			created = append(created, template)
+
+			if err := operation.Progress(entry, "%d/%d resources created", len(created), total); err != nil {
 				return err
 			}
 		}
 
+		if len(step.readinessChecks) == 0 {
+			continue
+		}
+
+		if err := operation.Progress(entry, "%d/%d resources created, step %s (%d/%d) waiting for readiness", len(created), total, step.name, index+1, len(p.steps)); err != nil {
+			return err
+		}
+
 		for _, check := range step.readinessChecks {
-			if err := barrier(check, entry); err != nil {
+			if err := barrier(ctx, check, entry); err != nil {
+				if ctx.Err() != nil {
+					return p.cancel(ctx, created, entry)
+				}
+
+				operation.Diagnose(entry, "step %s: readiness check %s failed: %s", step.name, check.Name, describeError(err))
+				p.rollback(created, entry)
+
 				return err
 			}
 		}
 	}
 
+	for _, probe := range p.probes {
+		if err := operation.Progress(entry, "%d/%d resources created, running probe %s", len(created), total, probe.Name); err != nil {
+			return err
+		}
+
+		if err := runProbe(ctx, probe, entry); err != nil {
+			if ctx.Err() != nil {
+				return p.cancel(ctx, created, entry)
+			}
+
+			operation.Diagnose(entry, "probe %s failed: %s", probe.Name, describeError(err))
+			p.rollback(created, entry)
+
+			return err
+		}
+	}
+
 	return nil
 }
 
-// Run performs asynchronous creation tasks.
-func (p *Creator) Run(entry *registry.Entry) {
-	if err := operation.Complete(entry, p.run(entry)); err != nil {
+// cancel rolls back resources created by a cancelled operation, returning the
+// operation status.  Aborted operations are not rolled back, the service instance
+// now belongs to another broker replica.
+func (p *Creator) cancel(ctx context.Context, created []*v1.ConfigurationTemplate, entry *registry.Entry) error {
+	if operation.Aborted(ctx) {
+		glog.Infof("operation aborted")
+
+		return fmt.Errorf("%w: %d resources left in place", operation.ErrOperationAborted, len(created))
+	}
+
+	glog.Infof("operation cancelled")
+
+	p.rollback(created, entry)
+
+	return fmt.Errorf("%w: %d resources rolled back", operation.ErrOperationCancelled, len(created))
+}
+
+// rollback deletes resources created by a cancelled or failed operation, most recent
+// first.  Singletons are shared so are left for garbage collection.
+func (p *Creator) rollback(created []*v1.ConfigurationTemplate, entry *registry.Entry) {
+	glog.Infof("rolling back %d resources", len(created))
+
+	deleter := NewDeleter()
+
+	reports := []DeletionReport{}
+
+	for i := len(created) - 1; i >= 0; i-- {
+		template := created[i]
+
+		if template.Singleton || template.Template == nil || template.Template.Raw == nil {
+			continue
+		}
+
+		report := rollbackResource(deleter, template, entry)
+		if report.Result == DeletionResultFailed {
+			glog.Infof("failed to roll back resource %s: %s", report.Resource, report.Error)
+		}
+
+		reports = append(reports, report)
+	}
+
+	// The report is committed when the operation completes.
+	if err := entry.Set(registry.RollbackReport, reports); err != nil {
+		glog.Infof("failed to record rollback report: %v", err)
+	}
+}
+
+// rollbackResource deletes a resource created by a cancelled or failed operation,
+// retrying with backoff so transient errors do not orphan it.
+func rollbackResource(deleter *Deleter, template *v1.ConfigurationTemplate, entry *registry.Entry) DeletionReport {
+	options := config.GetOptions()
+
+	report := deleter.deleteResource(template, entry)
+
+	for attempt := 1; attempt < options.RollbackAttempts && report.Result == DeletionResultFailed; attempt++ {
+		glog.Infof("rollback of resource %s attempt %d of %d failed: %s", report.Resource, attempt, options.RollbackAttempts, report.Error)
+
+		util.Sleep(options.RollbackBackoff << uint(attempt-1))
+
+		report = deleter.deleteResource(template, entry)
+	}
+
+	return report
+}
+
+// Run performs asynchronous creation tasks, returning the operation status.
+func (p *Creator) Run(entry *registry.Entry) error {
+	ctx, finished, err := operation.Context(entry)
+	if err != nil {
+		if err := operation.Complete(entry, err); err != nil {
+			glog.Infof("failed to create instance: %v", err)
+		}
+
+		return err
+	}
+
+	defer finished()
+
+	status := p.run(ctx, entry)
+
+	// An aborted operation's registry entry belongs to another broker replica.
+	if operation.Aborted(ctx) {
+		return status
+	}
+
+	if err := operation.Complete(entry, status); err != nil {
 		glog.Infof("failed to create instance: %v", err)
 	}
+
+	return status
 }
@@ -15,22 +15,396 @@
 package provisioners
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/operation"
 	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
 
 	"github.com/golang/glog"
+
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// DeletionResult is the outcome of deleting a single resource.
+type DeletionResult string
+
+const (
+	// DeletionResultDeleted means the resource was deleted.
+	DeletionResultDeleted DeletionResult = "deleted"
+
+	// DeletionResultNotFound means the resource had already been deleted.
+	DeletionResultNotFound DeletionResult = "not-found"
+
+	// DeletionResultFailed means the resource could not be deleted.
+	DeletionResultFailed DeletionResult = "failed"
 )
 
+// DeletionReport records the outcome of deleting a single resource.
+type DeletionReport struct {
+	// Resource identifies the resource e.g. "v1/Pod my-pod".
+	Resource string `json:"resource"`
+
+	// Result is the outcome of the deletion.
+	Result DeletionResult `json:"result"`
+
+	// Error is the reason a deletion failed.
+	Error string `json:"error,omitempty"`
+}
+
 // Deleter caches various data associated with deleting a service instance.
-type Deleter struct{}
+type Deleter struct {
+	// lock serializes access to the registry entry, as resources may be
+	// deleted concurrently.
+	lock sync.Mutex
+}
 
 // NewDeleter returns a new controller capable of deleting a service instance.
 func NewDeleter() *Deleter {
 	return &Deleter{}
 }
 
-// Run performs asynchronous update tasks.
-func (d *Deleter) Run(entry *registry.Entry) {
-	if err := entry.Delete(); err != nil {
-		glog.Infof("failed to delete instance")
+// resourceClient returns a client for the resource rendered by a template.
+func (d *Deleter) resourceClient(object *unstructured.Unstructured, entry *registry.Entry) (dynamic.ResourceInterface, error) {
+	gvk := object.GroupVersionKind()
+
+	mapping, err := config.Clients().RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		return config.Clients().Dynamic().Resource(mapping.Resource), nil
+	}
+
+	// The namespace defaults to that configured in the object, if not
+	// specified we use the namespace defined in the context.
+	namespace := object.GetNamespace()
+	if namespace == "" {
+		d.lock.Lock()
+		n, ok, err := entry.GetString(registry.Namespace)
+		d.lock.Unlock()
+
+		if err != nil || !ok {
+			return nil, fmt.Errorf("%w: unable to lookup namespace", ErrRegistryEntryMissing)
+		}
+
+		namespace = n
+	}
+
+	return config.Clients().Dynamic().Resource(mapping.Resource).Namespace(namespace), nil
+}
+
+// resourceGone returns whether the resource rendered by a template has already been
+// deleted, or its type is no longer served.  Any error is treated as the resource
+// still existing, so deletion proceeds as normal.
+func (d *Deleter) resourceGone(template *v1.ConfigurationTemplate, entry *registry.Entry) bool {
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(template.Template.Raw, object); err != nil {
+		return false
+	}
+
+	client, err := d.resourceClient(object, entry)
+	if err != nil {
+		return meta.IsNoMatchError(err)
+	}
+
+	_, err = client.Get(context.TODO(), object.GetName(), metav1.GetOptions{})
+
+	return k8s_errors.IsNotFound(err)
+}
+
+// deleteResource deletes a single rendered template resource.  Resources that have
+// already been deleted, for example by hand, are not an error.
+func (d *Deleter) deleteResource(template *v1.ConfigurationTemplate, entry *registry.Entry) DeletionReport {
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(template.Template.Raw, object); err != nil {
+		return DeletionReport{
+			Resource: template.Name,
+			Result:   DeletionResultFailed,
+			Error:    err.Error(),
+		}
+	}
+
+	report := DeletionReport{
+		Resource: fmt.Sprintf("%s/%s %s", object.GetAPIVersion(), object.GetKind(), object.GetName()),
+		Result:   DeletionResultDeleted,
+	}
+
+	glog.Infof("deleting resource %s", report.Resource)
+
+	client, err := d.resourceClient(object, entry)
+	if err != nil {
+		// If the resource type is no longer served, e.g. its custom resource
+		// definition has been deleted, then so has the resource.
+		if meta.IsNoMatchError(err) {
+			report.Result = DeletionResultNotFound
+			return report
+		}
+
+		report.Result = DeletionResultFailed
+		report.Error = err.Error()
+
+		return report
+	}
+
+	if err := client.Delete(context.TODO(), object.GetName(), metav1.DeleteOptions{}); err != nil {
+		if k8s_errors.IsNotFound(err) {
+			report.Result = DeletionResultNotFound
+			return report
+		}
+
+		report.Result = DeletionResultFailed
+		report.Error = err.Error()
+
+		return report
+	}
+
+	if template.WaitForDeletion != nil {
+		if err := d.waitForDeletion(template.WaitForDeletion, client, object.GetName(), report.Resource, entry); err != nil {
+			report.Result = DeletionResultFailed
+			report.Error = err.Error()
+		}
+	}
+
+	return report
+}
+
+// progress reports progress to pollers, synchronous deletions have no operation.
+func (d *Deleter) progress(entry *registry.Entry, format string, args ...interface{}) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok, _ := entry.GetString(registry.Operation); !ok {
+		return nil
+	}
+
+	return operation.Progress(entry, format, args...)
+}
+
+// waitForDeletion waits for a deleted resource to be removed, for example once its
+// finalizers have run.
+func (d *Deleter) waitForDeletion(wait *v1.ConfigurationTemplateWaitForDeletion, client dynamic.ResourceInterface, name, resource string, entry *registry.Entry) error {
+	glog.Infof("waiting for resource %s to be removed", resource)
+
+	if err := d.progress(entry, "waiting for %s to be removed", resource); err != nil {
+		return err
+	}
+
+	timeout := 5 * time.Minute
+	if wait.Timeout != nil {
+		timeout = wait.Timeout.Duration
+	}
+
+	removed := func() error {
+		object, err := client.Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			if k8s_errors.IsNotFound(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if object.GetDeletionTimestamp() != nil {
+			return fmt.Errorf("%w: %s is stuck terminating", ErrResourceNotRemoved, resource)
+		}
+
+		return fmt.Errorf("%w: %s still exists", ErrResourceNotRemoved, resource)
+	}
+
+	if err := util.WaitForClock(context.Background(), util.DefaultClock(), removed, timeout); err != nil {
+		return fmt.Errorf("%s not removed within %v: %w", resource, timeout, err)
+	}
+
+	return nil
+}
+
+// preDelete performs any actions that must complete before the resource rendered by a
+// template is deleted.
+func (d *Deleter) preDelete(template *v1.ConfigurationTemplate, entry *registry.Entry) error {
+	for _, action := range template.PreDelete {
+		if err := d.preDeleteAction(action, entry); err != nil {
+			return fmt.Errorf("pre-delete action %s failed: %w", action.Template, err)
+		}
+	}
+
+	return nil
+}
+
+// preDeleteAction creates the resource for a pre-delete action, and waits for it to
+// complete.  The resource may already exist if a previous deletion failed.
+func (d *Deleter) preDeleteAction(action v1.ConfigurationTemplatePreDelete, entry *registry.Entry) error {
+	glog.Infof("running pre-delete action %s", action.Template)
+
+	if err := d.progress(entry, "running pre-delete action %s", action.Template); err != nil {
+		return err
+	}
+
+	template, err := getTemplate(action.Template)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := renderTemplate(template, entry, nil)
+	if err != nil {
+		return err
+	}
+
+	creator := &Creator{}
+
+	if err := creator.createResource(rendered, entry); err != nil && !k8s_errors.IsAlreadyExists(err) {
+		return err
+	}
+
+	timeout := 5 * time.Minute
+	if action.Timeout != nil {
+		timeout = action.Timeout.Duration
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, check := range action.ReadinessChecks {
+		if err := barrier(ctx, check, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run performs asynchronous deletion tasks.  Pre-delete actions are run in order,
+// then resources are deleted concurrently, up to the configured limit.
+func (d *Deleter) run(entry *registry.Entry) error {
+	manifests := []v1.ConfigurationTemplate{}
+
+	if _, err := entry.Get(registry.Manifests, &manifests); err != nil {
+		return err
+	}
+
+	reports := []DeletionReport{}
+	templates := []*v1.ConfigurationTemplate{}
+
+	for index := range manifests {
+		template := &manifests[index]
+
+		// Singletons are shared so must be left for garbage collection
+		// once all owners are gone.
+		if template.Singleton || template.Template == nil || template.Template.Raw == nil {
+			continue
+		}
+
+		// Pre-delete actions operate on the resource, so there is nothing for
+		// them to do once it has gone.
+		if len(template.PreDelete) != 0 && d.resourceGone(template, entry) {
+			glog.Infof("resource for template %s already deleted, skipping pre-delete actions", template.Name)
+
+			templates = append(templates, template)
+
+			continue
+		}
+
+		if err := d.preDelete(template, entry); err != nil {
+			glog.Infof("%v", err)
+
+			reports = append(reports, DeletionReport{
+				Resource: template.Name,
+				Result:   DeletionResultFailed,
+				Error:    err.Error(),
+			})
+
+			continue
+		}
+
+		templates = append(templates, template)
+	}
+
+	reports = append(reports, d.deleteResources(templates, entry)...)
+
+	failures := 0
+
+	for _, report := range reports {
+		if report.Result == DeletionResultFailed {
+			failures++
+		}
+	}
+
+	if failures != 0 {
+		if err := entry.Set(registry.DeletionReport, reports); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("%w: %d of %d resources failed to delete", ErrResourceDeletionFailed, failures, len(reports))
+	}
+
+	// Anything else will be garbage collected.
+	return entry.Delete()
+}
+
+// deleteResources deletes resources with at most the configured delete concurrency
+// in flight at any one time, returning reports in the same order as the templates.
+func (d *Deleter) deleteResources(templates []*v1.ConfigurationTemplate, entry *registry.Entry) []DeletionReport {
+	concurrency := config.GetOptions().DeleteConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	reports := make([]DeletionReport, len(templates))
+	semaphore := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	for index := range templates {
+		semaphore <- struct{}{}
+
+		wg.Add(1)
+
+		go func(index int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			reports[index] = d.deleteResource(templates[index], entry)
+		}(index)
+	}
+
+	wg.Wait()
+
+	return reports
+}
+
+// Run performs asynchronous deletion tasks, returning the operation status.
+func (d *Deleter) Run(entry *registry.Entry) error {
+	status := d.run(entry)
+	if status == nil {
+		// The registry entry has been deleted, so there is nowhere to record
+		// a delivery failure, it is only logged.
+		if err := operation.Notify(entry, nil); err != nil {
+			glog.Infof("failed to send completion webhook: %v", err)
+		}
+
+		operation.AuditCompletion(entry, nil)
+
+		return nil
 	}
+
+	glog.Infof("failed to delete instance: %v", status)
+
+	if err := operation.Complete(entry, status); err != nil {
+		glog.Infof("failed to complete operation: %v", err)
+	}
+
+	return status
 }
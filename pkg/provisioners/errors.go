@@ -30,3 +30,15 @@ var ErrResourceReferenceMissing = errors.New("resource reference missing")
 
 // ErrUndefinedType is raised when an bad enumeration or similar is provided.
 var ErrUndefinedType = errors.New("undefined type")
+
+// ErrResourceDeletionFailed is raised when resources could not be deleted.
+var ErrResourceDeletionFailed = errors.New("resource deletion failed")
+
+// ErrResourceNotRemoved is raised when a deleted resource still exists.
+var ErrResourceNotRemoved = errors.New("resource not removed")
+
+// ErrProbeFailed is raised when a post-provision probe does not succeed.
+var ErrProbeFailed = errors.New("probe failed")
+
+// ErrUnexpectedStatus is raised when an HTTP probe returns an unexpected status code.
+var ErrUnexpectedStatus = errors.New("unexpected status code")
@@ -0,0 +1,154 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisioners
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/errors"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/util"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// defaultProbeAttempts is the number of times a probe is attempted if not specified.
+	defaultProbeAttempts = 3
+
+	// defaultProbePeriod is the delay between probe attempts if not specified.
+	defaultProbePeriod = 10 * time.Second
+
+	// defaultProbeTimeout is the timeout of a probe attempt if not specified.
+	defaultProbeTimeout = 5 * time.Second
+)
+
+// renderProbeString renders a dynamic probe attribute that must be a string.
+func renderProbeString(entry *registry.Entry, name, attribute, value string) (string, error) {
+	raw, err := renderTemplateString(value, entry, nil)
+	if err != nil {
+		return "", err
+	}
+
+	s, ok := raw.(string)
+	if !ok {
+		return "", errors.NewConfigurationError("probe %s %s not a string %v", name, attribute, raw)
+	}
+
+	return s, nil
+}
+
+// probeHTTP checks an HTTP endpoint responds with the expected status code.
+func probeHTTP(entry *registry.Entry, name string, probe *v1.ConfigurationProbeHTTP, timeout time.Duration) error {
+	url, err := renderProbeString(entry, name, "url", probe.URL)
+	if err != nil {
+		return err
+	}
+
+	expected := http.StatusOK
+	if probe.Status != nil {
+		expected = *probe.Status
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+	}
+
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != expected {
+		return fmt.Errorf("%w: %s returned %d, expected %d", ErrUnexpectedStatus, url, response.StatusCode, expected)
+	}
+
+	return nil
+}
+
+// probeTCP checks a TCP endpoint accepts connections.
+func probeTCP(entry *registry.Entry, name string, probe *v1.ConfigurationProbeTCP, timeout time.Duration) error {
+	address, err := renderProbeString(entry, name, "address", probe.Address)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// probeOnce performs a single probe attempt.  Returns nil on success and an error otherwise.
+func probeOnce(entry *registry.Entry, probe v1.ConfigurationProbe) error {
+	timeout := defaultProbeTimeout
+	if probe.Timeout != nil {
+		timeout = probe.Timeout.Duration
+	}
+
+	switch {
+	case probe.HTTP != nil:
+		return probeHTTP(entry, probe.Name, probe.HTTP, timeout)
+	case probe.TCP != nil:
+		return probeTCP(entry, probe.Name, probe.TCP, timeout)
+	default:
+		return fmt.Errorf("%w: probe %s probe type undefined", ErrResourceAttributeMissing, probe.Name)
+	}
+}
+
+// runProbe attempts a probe until it succeeds, or the attempts are exhausted in which
+// case the last error is returned.
+func runProbe(ctx context.Context, probe v1.ConfigurationProbe, entry *registry.Entry) error {
+	attempts := defaultProbeAttempts
+	if probe.Attempts != nil {
+		attempts = *probe.Attempts
+	}
+
+	period := defaultProbePeriod
+	if probe.Period != nil {
+		period = probe.Period.Duration
+	}
+
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		if err = probeOnce(entry, probe); err == nil {
+			return nil
+		}
+
+		if errors.IsConfigurationError(err) || attempt >= attempts {
+			break
+		}
+
+		glog.Infof("probe %s attempt %d/%d failed: %v", probe.Name, attempt, attempts, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-util.DefaultClock().After(period):
+		}
+	}
+
+	return fmt.Errorf("%w: probe %s failed after %d attempts: %v", ErrProbeFailed, probe.Name, attempts, err)
+}
@@ -16,7 +16,10 @@ package provisioners
 
 import (
 	"context"
+	goerrors "errors"
 	"fmt"
+	"regexp"
+	"strconv"
 	"time"
 
 	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
@@ -26,6 +29,9 @@ import (
 	"github.com/couchbase/service-broker/pkg/registry"
 	"github.com/couchbase/service-broker/pkg/util"
 
+	"github.com/go-openapi/jsonpointer"
+
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -57,39 +63,64 @@ func (e *conditionUnreadyError) Error() string {
 	return e.message
 }
 
-// conditionReady waits for a condition on a resource to report as ready.  Returns nil on success and
-// an error otherwise.
-func conditionReady(entry *registry.Entry, condition *v1.ConfigurationReadinessCheckCondition) error {
-	namespaceRaw, err := renderTemplateString(condition.Namespace, entry, nil)
+// readinessDeadlineError is returned when readiness checks have remained unready for
+// longer than the configured readiness deadline.
+type readinessDeadlineError struct {
+	message string
+}
+
+// newReadinessDeadlineError returns a new readiness deadline error.
+func newReadinessDeadlineError(message string, arguments ...interface{}) error {
+	return &readinessDeadlineError{message: fmt.Sprintf(message, arguments...)}
+}
+
+// IsReadinessDeadlineError checks if the error is due to the readiness deadline expiring.
+func IsReadinessDeadlineError(e error) bool {
+	if _, ok := e.(*readinessDeadlineError); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Error returns the readiness deadline error string.
+func (e *readinessDeadlineError) Error() string {
+	return e.message
+}
+
+// getReadinessResource renders the namespace and name of a resource to poll, and returns
+// the resource.  A condition unready error is returned if the resource does not exist.
+func getReadinessResource(entry *registry.Entry, apiVersion, kind, namespaceTemplate, nameTemplate string) (*unstructured.Unstructured, error) {
+	namespaceRaw, err := renderTemplateString(namespaceTemplate, entry, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	namespace, ok := namespaceRaw.(string)
 	if !ok {
-		return errors.NewConfigurationError("condition resource namespace not a string %v", namespaceRaw)
+		return nil, errors.NewConfigurationError("readiness check resource namespace not a string %v", namespaceRaw)
 	}
 
-	nameRaw, err := renderTemplateString(condition.Name, entry, nil)
+	nameRaw, err := renderTemplateString(nameTemplate, entry, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	name, ok := nameRaw.(string)
 	if !ok {
-		return errors.NewConfigurationError("condition resource name not a string %v", nameRaw)
+		return nil, errors.NewConfigurationError("readiness check resource name not a string %v", nameRaw)
 	}
 
-	gv, err := schema.ParseGroupVersion(condition.APIVersion)
+	gv, err := schema.ParseGroupVersion(apiVersion)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	gvk := gv.WithKind(condition.Kind)
+	gvk := gv.WithKind(kind)
 
 	mapping, err := config.Clients().RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	client := config.Clients().Dynamic()
@@ -102,10 +133,36 @@ func conditionReady(entry *registry.Entry, condition *v1.ConfigurationReadinessC
 		object, err = client.Resource(mapping.Resource).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
 	}
 
+	if err != nil {
+		if k8s_errors.IsNotFound(err) {
+			return nil, newConditionUnreadyError("resource %s/%s %s does not exist", apiVersion, kind, name)
+		}
+
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// resourceReady waits for a resource to exist.  Returns nil on success and an error otherwise.
+func resourceReady(entry *registry.Entry, resource *v1.ConfigurationReadinessCheckResource) error {
+	if _, err := getReadinessResource(entry, resource.APIVersion, resource.Kind, resource.Namespace, resource.Name); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// conditionReady waits for a condition on a resource to report as ready.  Returns nil on success and
+// an error otherwise.
+func conditionReady(entry *registry.Entry, condition *v1.ConfigurationReadinessCheckCondition) error {
+	object, err := getReadinessResource(entry, condition.APIVersion, condition.Kind, condition.Namespace, condition.Name)
 	if err != nil {
 		return err
 	}
 
+	name := object.GetName()
+
 	conditions, ok, _ := unstructured.NestedSlice(object.Object, "status", "conditions")
 	if !ok {
 		return newConditionUnreadyError("resource %s/%s %s contains no status conditions", condition.APIVersion, condition.Kind, name)
@@ -141,6 +198,157 @@ func conditionReady(entry *registry.Entry, condition *v1.ConfigurationReadinessC
 	return newConditionUnreadyError("resource %s/%s %s doesn't contain the condition %s", condition.APIVersion, condition.Kind, name, condition.Type)
 }
 
+// fieldReady waits for a field of a resource to compare with a value.  Returns nil on
+// success and an error otherwise.
+func fieldReady(entry *registry.Entry, field *v1.ConfigurationReadinessCheckField) error {
+	object, err := getReadinessResource(entry, field.APIVersion, field.Kind, field.Namespace, field.Name)
+	if err != nil {
+		return err
+	}
+
+	name := object.GetName()
+
+	pointer, err := jsonpointer.New(field.Path)
+	if err != nil {
+		return errors.NewConfigurationError("readiness check field path %s malformed: %v", field.Path, err)
+	}
+
+	actual, _, err := pointer.Get(object.Object)
+	if err != nil {
+		return newConditionUnreadyError("resource %s/%s %s doesn't contain the field %s", field.APIVersion, field.Kind, name, field.Path)
+	}
+
+	expected, err := renderTemplateString(field.Value, entry, nil)
+	if err != nil {
+		return err
+	}
+
+	ready, err := compareField(field.Operator, actual, expected)
+	if err != nil {
+		return err
+	}
+
+	if !ready {
+		return newConditionUnreadyError("resource %s/%s %s field %s is %v, expected %s %v", field.APIVersion, field.Kind, name, field.Path, actual, field.Operator, expected)
+	}
+
+	return nil
+}
+
+// compareField compares a resource field with a value.  Returns whether the comparison
+// holds, and an error if the operator cannot be applied to the value.
+func compareField(operator v1.ReadinessOperator, actual, expected interface{}) (bool, error) {
+	switch operator {
+	case v1.ReadinessOperatorEqual:
+		return fieldEqual(actual, expected), nil
+	case v1.ReadinessOperatorNotEqual:
+		return !fieldEqual(actual, expected), nil
+	case v1.ReadinessOperatorGreaterThan, v1.ReadinessOperatorGreaterThanOrEqual, v1.ReadinessOperatorLessThan, v1.ReadinessOperatorLessThanOrEqual:
+		e, ok := fieldNumber(expected)
+		if !ok {
+			return false, errors.NewConfigurationError("readiness check value %v is not a number", expected)
+		}
+
+		// A field that isn't a number yet e.g. unset is not ready.
+		a, ok := fieldNumber(actual)
+		if !ok {
+			return false, nil
+		}
+
+		switch operator {
+		case v1.ReadinessOperatorGreaterThan:
+			return a > e, nil
+		case v1.ReadinessOperatorGreaterThanOrEqual:
+			return a >= e, nil
+		case v1.ReadinessOperatorLessThan:
+			return a < e, nil
+		default:
+			return a <= e, nil
+		}
+	case v1.ReadinessOperatorIn:
+		elements, ok := expected.([]interface{})
+		if !ok {
+			return false, errors.NewConfigurationError("readiness check value %v is not a list", expected)
+		}
+
+		for _, element := range elements {
+			if fieldEqual(actual, element) {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	case v1.ReadinessOperatorMatches:
+		pattern, ok := expected.(string)
+		if !ok {
+			return false, errors.NewConfigurationError("readiness check value %v is not a string", expected)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, errors.NewConfigurationError("readiness check value %s is not a regular expression: %v", pattern, err)
+		}
+
+		str, ok := actual.(string)
+		if !ok {
+			return false, nil
+		}
+
+		return re.MatchString(str), nil
+	default:
+		return false, errors.NewConfigurationError("readiness check operator %s undefined", operator)
+	}
+}
+
+// fieldEqual compares a field with a value.  Numbers are compared numerically, as
+// values are typically strings, anything else is compared by its string form.
+func fieldEqual(actual, expected interface{}) bool {
+	a, aok := fieldNumber(actual)
+	e, eok := fieldNumber(expected)
+
+	if aok && eok {
+		return a == e
+	}
+
+	return fmt.Sprint(actual) == fmt.Sprint(expected)
+}
+
+// fieldNumber converts a field or value to a number.  Returns false if it is not
+// numeric.
+func fieldNumber(value interface{}) (float64, bool) {
+	switch t := value.(type) {
+	case int64:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case float64:
+		return t, true
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		return f, true
+	default:
+		return 0, false
+	}
+}
+
+// checkReady performs a single readiness check.  Returns nil on success and an error otherwise.
+func checkReady(entry *registry.Entry, readinessCheck v1.ConfigurationReadinessCheck) error {
+	switch {
+	case readinessCheck.Condition != nil:
+		return conditionReady(entry, readinessCheck.Condition)
+	case readinessCheck.Resource != nil:
+		return resourceReady(entry, readinessCheck.Resource)
+	case readinessCheck.Field != nil:
+		return fieldReady(entry, readinessCheck.Field)
+	default:
+		return fmt.Errorf("%w: readiness check %s check type undefined", ErrResourceAttributeMissing, readinessCheck.Name)
+	}
+}
+
 // Ready processes any readiness checks and returns nil on success.  For now this is intended to
 // be called from the service instance polling code.  In the future we may allow waits within the
 // template rendering path.  Returns nil on success and an error otherwise.
@@ -168,32 +376,24 @@ func Ready(t ResourceType, entry *registry.Entry, serviceID, planID string) erro
 	}
 
 	for _, readinessCheck := range templates.ReadinessChecks {
-		switch {
-		case readinessCheck.Condition != nil:
-			if err := conditionReady(entry, readinessCheck.Condition); err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("%w: readiness check %s check type undefined", ErrResourceAttributeMissing, readinessCheck.Name)
+		if err := checkReady(entry, readinessCheck); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// barrier waits for a readiness check to complete before continuing.
-func barrier(readinessCheck v1.ConfigurationReadinessCheck, entry *registry.Entry) error {
+// barrier waits for a readiness check to complete before continuing.  If the operation
+// has a readiness deadline, and it passes first, a readiness deadline error is returned
+// with the last unready condition.
+func barrier(ctx context.Context, readinessCheck v1.ConfigurationReadinessCheck, entry *registry.Entry) error {
+	var unready error
+
 	doCheck := func() error {
-		switch {
-		case readinessCheck.Condition != nil:
-			if err := conditionReady(entry, readinessCheck.Condition); err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("%w: readiness check %s check type undefined", ErrResourceAttributeMissing, readinessCheck.Name)
-		}
+		unready = checkReady(entry, readinessCheck)
 
-		return nil
+		return unready
 	}
 
 	timeout := time.Minute
@@ -201,5 +401,29 @@ func barrier(readinessCheck v1.ConfigurationReadinessCheck, entry *registry.Entr
 		timeout = readinessCheck.Timeout.Duration
 	}
 
-	return util.WaitFor(doCheck, timeout)
+	var deadline time.Time
+
+	ok, err := entry.Get(registry.ReadinessDeadline, &deadline)
+	if err != nil {
+		return err
+	}
+
+	remaining := deadline.Sub(util.DefaultClock().Now())
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	if !ok || remaining >= timeout {
+		return util.WaitForClock(ctx, util.DefaultClock(), doCheck, timeout)
+	}
+
+	if err := util.WaitForClock(ctx, util.DefaultClock(), doCheck, remaining); err != nil {
+		if goerrors.Is(err, util.ErrTimeout) {
+			return newReadinessDeadlineError("readiness deadline exceeded: %v", unready)
+		}
+
+		return err
+	}
+
+	return nil
 }
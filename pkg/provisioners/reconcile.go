@@ -0,0 +1,126 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisioners
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/registry"
+
+	"github.com/golang/glog"
+
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// resourceExists checks whether a resource exists.
+func resourceExists(object *unstructured.Unstructured, entry *registry.Entry) (bool, error) {
+	gvk := object.GroupVersionKind()
+
+	mapping, err := config.Clients().RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return false, err
+	}
+
+	client := config.Clients().Dynamic()
+
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		_, err = client.Resource(mapping.Resource).Get(context.TODO(), object.GetName(), metav1.GetOptions{})
+	} else {
+		namespace := object.GetNamespace()
+		if namespace == "" {
+			n, ok, err := entry.GetString(registry.Namespace)
+			if err != nil {
+				return false, err
+			}
+
+			if !ok {
+				return false, fmt.Errorf("%w: unable to lookup namespace", ErrRegistryEntryMissing)
+			}
+
+			namespace = n
+		}
+
+		_, err = client.Resource(mapping.Resource).Namespace(namespace).Get(context.TODO(), object.GetName(), metav1.GetOptions{})
+	}
+
+	if err != nil {
+		if k8s_errors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Reconcile recreates any resources recorded in the manifests of a service instance
+// that no longer exist, e.g. because they were deleted out from under it.  Existing
+// resources are left alone so any modifications made by Kubernetes or other controllers
+// are preserved.  Returns the resources that were recreated.
+func Reconcile(entry *registry.Entry) ([]string, error) {
+	manifests := []v1.ConfigurationTemplate{}
+
+	if _, err := entry.Get(registry.Manifests, &manifests); err != nil {
+		return nil, err
+	}
+
+	creator := &Creator{
+		resourceType: ResourceTypeServiceInstance,
+	}
+
+	recreated := []string{}
+
+	for index := range manifests {
+		template := &manifests[index]
+
+		if template.Template == nil || template.Template.Raw == nil {
+			continue
+		}
+
+		object := &unstructured.Unstructured{}
+		if err := json.Unmarshal(template.Template.Raw, object); err != nil {
+			return nil, err
+		}
+
+		exists, err := resourceExists(object, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			continue
+		}
+
+		resource := fmt.Sprintf("%s/%s %s", object.GetAPIVersion(), object.GetKind(), object.GetName())
+
+		glog.Infof("resource %s missing, recreating", resource)
+
+		if err := creator.createResource(template, entry); err != nil {
+			return nil, err
+		}
+
+		recreated = append(recreated, resource)
+	}
+
+	return recreated, nil
+}
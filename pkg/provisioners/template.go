@@ -16,15 +16,22 @@ package provisioners
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	goerrors "errors"
 	"fmt"
 	"math/big"
+	"strconv"
 	"strings"
 	"text/template"
 	"text/template/parse"
 	"time"
 
+	"github.com/couchbase/service-broker/pkg/config"
 	"github.com/couchbase/service-broker/pkg/errors"
 	"github.com/couchbase/service-broker/pkg/log"
 	"github.com/couchbase/service-broker/pkg/registry"
@@ -33,6 +40,9 @@ import (
 	petname "github.com/dustinkirkland/golang-petname"
 	"github.com/go-openapi/jsonpointer"
 	"github.com/golang/glog"
+
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // templateFunctionRegistry looks up a registry value.
@@ -76,21 +86,282 @@ func templateFunctionParameter(entry *registry.Entry) func(string) (interface{},
 			return nil, fmt.Errorf("%w: unable to lookup parameters", ErrRegistryEntryMissing)
 		}
 
-		if parameters == nil {
+		return lookupParameter(parameters, path)
+	}
+}
+
+// templateFunctionPreviousParameter looks up a parameter that was in effect before
+// the service instance was last updated.  May return a nil value if the path does
+// not exist, or the service instance has never been updated.
+func templateFunctionPreviousParameter(entry *registry.Entry) func(string) (interface{}, error) {
+	return func(path string) (interface{}, error) {
+		glog.V(log.LevelDebug).Infof("previousParameter: path '%s'", path)
+
+		var parameters interface{}
+
+		if _, err := entry.Get(registry.PreviousParameters, &parameters); err != nil {
+			return nil, err
+		}
+
+		return lookupParameter(parameters, path)
+	}
+}
+
+// lookupParameter resolves a JSON pointer against a set of parameters.
+func lookupParameter(parameters interface{}, path string) (interface{}, error) {
+	if parameters == nil {
+		return nil, nil
+	}
+
+	pointer, err := jsonpointer.New(path)
+	if err != nil {
+		return nil, errors.NewConfigurationError("json pointer malformed: %v", err)
+	}
+
+	value, _, err := pointer.Get(parameters)
+	if err != nil {
+		return nil, nil
+	}
+
+	glog.V(log.LevelDebug).Infof("parameter: value '%v'", value)
+
+	return value, nil
+}
+
+// templateFunctionQueryParameter looks up a request query parameter recorded when
+// the service instance or binding was created.  Raises an error if the parameter is
+// not allowed.  May return a nil value if the parameter was not specified.
+func templateFunctionQueryParameter(entry *registry.Entry) func(string) (interface{}, error) {
+	return func(name string) (interface{}, error) {
+		glog.V(log.LevelDebug).Infof("queryParameter: name '%s'", name)
+
+		allowed := false
+
+		for _, parameter := range config.GetOptions().QueryParameters {
+			if name == parameter {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return nil, errors.NewConfigurationError("query parameter %s is not allowed", name)
+		}
+
+		query := map[string]string{}
+
+		ok, err := entry.Get(registry.Query, &query)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return nil, nil
+		}
+
+		value, ok := query[name]
+		if !ok {
 			return nil, nil
 		}
 
-		pointer, err := jsonpointer.New(path)
+		glog.V(log.LevelDebug).Infof("queryParameter: value '%v'", value)
+
+		return value, nil
+	}
+}
+
+// templateFunctionBroker looks up a value derived from the environment the broker
+// is running in, e.g. the cluster DNS domain.  Raises an error if the name is not
+// known.
+func templateFunctionBroker(name string) (string, error) {
+	glog.V(log.LevelDebug).Infof("broker: name '%s'", name)
+
+	var value string
+
+	switch name {
+	case "namespace":
+		value = config.GetOptions().BrokerNamespace
+	case "pod-name":
+		value = config.GetOptions().BrokerPodName
+	case "cluster-domain":
+		value = config.GetOptions().ClusterDomain
+	default:
+		return "", errors.NewConfigurationError("broker value %s is not defined", name)
+	}
+
+	glog.V(log.LevelDebug).Infof("broker: value '%v'", value)
+
+	return value, nil
+}
+
+// templateFunctionLookup maps a key to a value with a named lookup table.
+// Raises an error if the table does not exist or the key is not a string.
+// Returns the table's default, or nil if there is none, when the key is not
+// found.
+func templateFunctionLookup(name string, key interface{}) (interface{}, error) {
+	glog.V(log.LevelDebug).Infof("lookup: name '%s', key '%v'", name, key)
+
+	lookup, err := getLookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+
+	if lookup.Default != nil {
+		value = *lookup.Default
+	}
+
+	if key != nil {
+		k, ok := key.(string)
+		if !ok {
+			return nil, errors.NewConfigurationError("lookup key for %s must be a string, got %T", name, key)
+		}
+
+		entries := map[string]string{}
+
+		if err := json.Unmarshal(lookup.Entries.Raw, &entries); err != nil {
+			return nil, errors.NewConfigurationError("lookup %s entries not a map of strings: %v", name, err)
+		}
+
+		if v, ok := entries[k]; ok {
+			value = v
+		}
+	}
+
+	glog.V(log.LevelDebug).Infof("lookup: value '%v'", value)
+
+	return value, nil
+}
+
+// templateFunctionFeature looks up a feature flag for the service instance's plan.
+// Raises an error if we encountered an unexpected internal error.  Returns false if
+// the feature flag is not defined.
+func templateFunctionFeature(entry *registry.Entry) func(string) (bool, error) {
+	return func(name string) (bool, error) {
+		glog.V(log.LevelDebug).Infof("feature: name '%s'", name)
+
+		serviceID, ok, err := entry.GetString(registry.ServiceID)
+		if err != nil {
+			return false, err
+		}
+
+		if !ok {
+			return false, fmt.Errorf("%w: unable to lookup service ID", ErrRegistryEntryMissing)
+		}
+
+		planID, ok, err := entry.GetString(registry.PlanID)
 		if err != nil {
-			return nil, errors.NewConfigurationError("json pointer malformed: %v", err)
+			return false, err
+		}
+
+		if !ok {
+			return false, fmt.Errorf("%w: unable to lookup plan ID", ErrRegistryEntryMissing)
 		}
 
-		value, _, err := pointer.Get(parameters)
+		features, err := config.Config().GetFeatures(serviceID, planID)
 		if err != nil {
+			return false, err
+		}
+
+		value := features[name]
+
+		glog.V(log.LevelDebug).Infof("feature: value '%v'", value)
+
+		return value, nil
+	}
+}
+
+// resolveSourceNamespace returns the namespace to read a resource from.  This defaults
+// to the service instance namespace, other namespaces must be explicitly allowed by the
+// broker administrator to prevent privilege escalation.
+func resolveSourceNamespace(entry *registry.Entry, namespace interface{}) (string, error) {
+	instanceNamespace, ok, err := entry.GetString(registry.Namespace)
+	if err != nil {
+		return "", err
+	}
+
+	if !ok {
+		return "", fmt.Errorf("%w: unable to lookup namespace", ErrRegistryEntryMissing)
+	}
+
+	if namespace == nil {
+		return instanceNamespace, nil
+	}
+
+	typed, ok := namespace.(string)
+	if !ok {
+		return "", errors.NewConfigurationError("source namespace not a string")
+	}
+
+	if typed == instanceNamespace {
+		return typed, nil
+	}
+
+	for _, allowed := range config.GetOptions().SourceNamespaces {
+		if typed == allowed {
+			return typed, nil
+		}
+	}
+
+	return "", errors.NewConfigurationError("source namespace %s is not allowed", typed)
+}
+
+// templateFunctionSecret looks up a key from a secret.
+// Raises an error if the namespace is not allowed or we encountered an unexpected
+// internal error.  May return a nil value if the secret or key does not exist.
+func templateFunctionSecret(entry *registry.Entry) func(string, string, interface{}) (interface{}, error) {
+	return func(name, key string, namespace interface{}) (interface{}, error) {
+		glog.V(log.LevelDebug).Infof("secret: name '%s', key '%s', namespace '%v'", name, key, namespace)
+
+		ns, err := resolveSourceNamespace(entry, namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err := config.Clients().Kubernetes().CoreV1().Secrets(ns).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			if k8s_errors.IsNotFound(err) {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		value, ok := secret.Data[key]
+		if !ok {
 			return nil, nil
 		}
 
-		glog.V(log.LevelDebug).Infof("parameter: value '%v'", value)
+		return string(value), nil
+	}
+}
+
+// templateFunctionConfigMap looks up a key from a config map.
+// Raises an error if the namespace is not allowed or we encountered an unexpected
+// internal error.  May return a nil value if the config map or key does not exist.
+func templateFunctionConfigMap(entry *registry.Entry) func(string, string, interface{}) (interface{}, error) {
+	return func(name, key string, namespace interface{}) (interface{}, error) {
+		glog.V(log.LevelDebug).Infof("configMap: name '%s', key '%s', namespace '%v'", name, key, namespace)
+
+		ns, err := resolveSourceNamespace(entry, namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		configMap, err := config.Clients().Kubernetes().CoreV1().ConfigMaps(ns).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			if k8s_errors.IsNotFound(err) {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		value, ok := configMap.Data[key]
+		if !ok {
+			return nil, nil
+		}
 
 		return value, nil
 	}
@@ -175,9 +446,24 @@ func templateFunctionGeneratePetName(numWords int) (string, error) {
 	return petname.Generate(numWords, "-"), nil
 }
 
+const (
+	// passwordDictionaryAlphanumeric is the default dictionary used for password generation.
+	passwordDictionaryAlphanumeric = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// passwordDictionaries are named dictionary presets that may be used in place
+// of an explicit dictionary string when generating passwords.
+var passwordDictionaries = map[string]string{
+	"alphanumeric":         passwordDictionaryAlphanumeric,
+	"alphanumeric-symbols": passwordDictionaryAlphanumeric + "!#$%&()*+,-.:;<=>?@[]^_{|}~",
+	"hex":                  "0123456789abcdef",
+	"base58":               "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz",
+	"no-ambiguous":         "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789",
+}
+
 // templateFunctionGeneratePassword generates a password.
 func templateFunctionGeneratePassword(length int, dictionary interface{}) (string, error) {
-	d := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	d := passwordDictionaryAlphanumeric
 
 	if dictionary != nil {
 		typed, ok := dictionary.(string)
@@ -186,6 +472,11 @@ func templateFunctionGeneratePassword(length int, dictionary interface{}) (strin
 		}
 
 		d = typed
+
+		// Named presets take precedence over a literal dictionary.
+		if preset, ok := passwordDictionaries[typed]; ok {
+			d = preset
+		}
 	}
 
 	glog.V(log.LevelDebug).Infof("generatingPassword: length %d, dictionary '%s'", length, d)
@@ -217,6 +508,105 @@ func templateFunctionGeneratePassword(length int, dictionary interface{}) (strin
 	return value, nil
 }
 
+// templateFunctionGenerateToken generates a URL-safe, base64 encoded bearer token from
+// length bytes of cryptographically secure random data.
+func templateFunctionGenerateToken(length int) (string, error) {
+	if length < 1 {
+		return "", errors.NewConfigurationError("token length must be positive")
+	}
+
+	data := make([]byte, length)
+
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+
+	value := base64.RawURLEncoding.EncodeToString(data)
+
+	glog.V(log.LevelDebug).Infof("generateToken: value '%v'", value)
+
+	return value, nil
+}
+
+// templateFunctionSHA256 returns the hex encoded SHA-256 digest of a string, so that
+// a hash of a credential may be stored without the credential itself.
+func templateFunctionSHA256(value string) string {
+	digest := sha256.Sum256([]byte(value))
+
+	return hex.EncodeToString(digest[:])
+}
+
+const (
+	// maxResourceNameLength is the longest resource name generated by the
+	// resourceName function.  This is the DNS label limit, so names are valid
+	// for all resource types e.g. services.
+	maxResourceNameLength = 63
+
+	// resourceNameHashLength is the number of hex digits of hash appended to
+	// resource names shortened with the hash strategy.
+	resourceNameHashLength = 8
+)
+
+// templateFunctionResourceName returns a resource name that is no longer than the
+// maximum length, shortening it with the configured name collision strategy.
+func templateFunctionResourceName(name string) (string, error) {
+	glog.V(log.LevelDebug).Infof("resourceName: name '%s'", name)
+
+	value := name
+
+	if len(name) > maxResourceNameLength {
+		switch config.GetOptions().NameCollisionStrategy {
+		case config.NameCollisionStrategyHash:
+			digest := sha256.Sum256([]byte(name))
+			prefix := strings.TrimRight(name[:maxResourceNameLength-resourceNameHashLength-1], "-.")
+			value = prefix + "-" + hex.EncodeToString(digest[:])[:resourceNameHashLength]
+		case config.NameCollisionStrategyTruncate:
+			value = strings.TrimRight(name[:maxResourceNameLength], "-.")
+		default:
+			return "", errors.NewParameterError("resource name %s longer than %d characters", name, maxResourceNameLength)
+		}
+	}
+
+	glog.V(log.LevelDebug).Infof("resourceName: value '%s'", value)
+
+	return value, nil
+}
+
+// templateFunctionFingerprint returns the hex encoded SHA-256 fingerprint of a PEM
+// formatted certificate.
+func templateFunctionFingerprint(value string) (string, error) {
+	cert, err := util.DecodeCertificate([]byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(cert.Raw)
+
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// templateFunctionNotAfter returns the expiry time of a PEM formatted certificate,
+// formatted as per RFC3339.
+func templateFunctionNotAfter(value string) (string, error) {
+	cert, err := util.DecodeCertificate([]byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	return cert.NotAfter.UTC().Format(time.RFC3339), nil
+}
+
+// templateFunctionPublicKey returns the PEM formatted public key of a PEM formatted
+// certificate or private key.
+func templateFunctionPublicKey(value string) (string, error) {
+	pub, err := util.PublicKey([]byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	return string(pub), nil
+}
+
 // templateFunctionGeneratePrivatekey generates a private key.
 func templateFunctionGeneratePrivatekey(typ, encoding string, bits interface{}) (string, error) {
 	glog.V(log.LevelDebug).Infof("generatingPrivateKey: type '%s', encoding '%s', bits %v", typ, encoding, bits)
@@ -298,6 +688,95 @@ func templateFunctionGenerateCertificate(key, cn, lifetime, usage string, sans [
 	return value, nil
 }
 
+// templateFunctionGenerateCACertificate generates a self-signed CA certificate with
+// name constraints.
+func templateFunctionGenerateCACertificate(key, cn, lifetime string, constraints []interface{}) (string, error) {
+	glog.V(log.LevelDebug).Infof("generateCACertificate: key '%s', cn '%s', lifetime '%s', constraints %v", key, cn, lifetime, constraints)
+
+	duration, err := time.ParseDuration(lifetime)
+	if err != nil {
+		return "", err
+	}
+
+	constraintsTyped := make([]string, len(constraints))
+
+	for index, constraint := range constraints {
+		t, ok := constraint.(string)
+		if !ok {
+			return "", errors.NewConfigurationError("name constraint %v not a string", constraint)
+		}
+
+		constraintsTyped[index] = t
+	}
+
+	cert, err := util.GenerateCACertificate([]byte(key), cn, duration, constraintsTyped)
+	if err != nil {
+		return "", err
+	}
+
+	value := string(cert)
+
+	glog.V(log.LevelDebug).Infof("generateCACertificate: value '%v'", value)
+
+	return value, nil
+}
+
+const (
+	// timeLayoutRFC3339 formats times as per RFC3339, this is the default.
+	timeLayoutRFC3339 = "RFC3339"
+
+	// timeLayoutEpoch formats times as seconds since the UNIX epoch.
+	timeLayoutEpoch = "epoch"
+)
+
+// templateFunctionNow returns the current time, optionally offset by a duration,
+// formatted with the requested layout.
+func templateFunctionNow(layout, offset interface{}) (string, error) {
+	glog.V(log.LevelDebug).Infof("now: layout '%v', offset '%v'", layout, offset)
+
+	l := timeLayoutRFC3339
+
+	if layout != nil {
+		typed, ok := layout.(string)
+		if !ok {
+			return "", errors.NewConfigurationError("time layout not a string")
+		}
+
+		l = typed
+	}
+
+	now := util.DefaultClock().Now()
+
+	if offset != nil {
+		typed, ok := offset.(string)
+		if !ok {
+			return "", errors.NewConfigurationError("time offset not a string")
+		}
+
+		duration, err := time.ParseDuration(typed)
+		if err != nil {
+			return "", errors.NewConfigurationError("time offset invalid: %v", err)
+		}
+
+		now = now.Add(duration)
+	}
+
+	var value string
+
+	switch l {
+	case timeLayoutRFC3339:
+		value = now.UTC().Format(time.RFC3339)
+	case timeLayoutEpoch:
+		value = strconv.FormatInt(now.Unix(), 10)
+	default:
+		value = now.UTC().Format(l)
+	}
+
+	glog.V(log.LevelDebug).Infof("now: value '%v'", value)
+
+	return value, nil
+}
+
 // templateFunctionRequired returns an error if the input is nil.
 func templateFunctionRequired(value interface{}) (interface{}, error) {
 	if value == nil {
@@ -307,6 +786,84 @@ func templateFunctionRequired(value interface{}) (interface{}, error) {
 	return value, nil
 }
 
+// templateFunctionRequiredIf raises an error if the condition holds and its input
+// is nil.
+func templateFunctionRequiredIf(condition bool, value interface{}) (interface{}, error) {
+	if condition && value == nil {
+		return nil, errors.NewConfigurationError("conditionally required value is nil")
+	}
+
+	return value, nil
+}
+
+// templateFunctionClamp constrains a numeric input to be within a range, rather
+// than rejecting it.  Values outside the range are replaced by the nearest bound,
+// and this is recorded in the registry.  Nil inputs are passed through so they may
+// be defaulted.
+func templateFunctionClamp(entry *registry.Entry) func(min, max, value interface{}) (interface{}, error) {
+	return func(min, max, value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+
+		lower, ok := fieldNumber(min)
+		if !ok {
+			return nil, errors.NewConfigurationError("clamp minimum %v is not a number", min)
+		}
+
+		upper, ok := fieldNumber(max)
+		if !ok {
+			return nil, errors.NewConfigurationError("clamp maximum %v is not a number", max)
+		}
+
+		if lower > upper {
+			return nil, errors.NewConfigurationError("clamp minimum %v greater than maximum %v", min, max)
+		}
+
+		v, ok := fieldNumber(value)
+		if !ok {
+			return nil, errors.NewParameterError("value %v is not a number", value)
+		}
+
+		bound := value
+
+		switch {
+		case v < lower:
+			bound = min
+		case v > upper:
+			bound = max
+		default:
+			return value, nil
+		}
+
+		glog.Infof("clamp: value %v clamped to %v", value, bound)
+
+		if err := recordClamp(entry, fmt.Sprintf("value %v clamped to %v", value, bound)); err != nil {
+			return nil, err
+		}
+
+		return bound, nil
+	}
+}
+
+// recordClamp adds a message to the clamped parameters recorded in the registry, if
+// it is not already there, as the same template may be rendered more than once.
+func recordClamp(entry *registry.Entry, message string) error {
+	clamped := []string{}
+
+	if _, err := entry.Get(registry.ClampedParameters, &clamped); err != nil {
+		return err
+	}
+
+	for _, existing := range clamped {
+		if existing == message {
+			return nil
+		}
+	}
+
+	return entry.Set(registry.ClampedParameters, append(clamped, message))
+}
+
 // templateFunctionGenerateDefault sets a default if its input is nil.
 func templateFunctionGenerateDefault(def, value interface{}) interface{} {
 	glog.V(log.LevelDebug).Infof("default: default '%v',  value '%v'", def, value)
@@ -335,6 +892,57 @@ func templateFunctionTitle(value string) string {
 	return strings.Title(value)
 }
 
+// templateFunctionJoin concatenates a list of strings into a single string, with
+// each element separated by the separator.
+func templateFunctionJoin(separator string, value interface{}) (string, error) {
+	glog.V(log.LevelDebug).Infof("join: separator '%v', value '%v'", separator, value)
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return "", errors.NewParameterError("join value '%v' is not a list", value)
+	}
+
+	elements := make([]string, len(list))
+
+	for index, element := range list {
+		str, ok := element.(string)
+		if !ok {
+			return "", errors.NewParameterError("join element '%v' is not a string", element)
+		}
+
+		elements[index] = str
+	}
+
+	result := strings.Join(elements, separator)
+
+	glog.V(log.LevelDebug).Infof("join: value '%v'", result)
+
+	return result, nil
+}
+
+// templateFunctionSplit divides a string into a list of strings delimited by the
+// separator.  An empty string yields an empty list.
+func templateFunctionSplit(separator string, value interface{}) ([]interface{}, error) {
+	glog.V(log.LevelDebug).Infof("split: separator '%v', value '%v'", separator, value)
+
+	str, ok := value.(string)
+	if !ok {
+		return nil, errors.NewParameterError("split value '%v' is not a string", value)
+	}
+
+	result := []interface{}{}
+
+	if str != "" {
+		for _, element := range strings.Split(str, separator) {
+			result = append(result, element)
+		}
+	}
+
+	glog.V(log.LevelDebug).Infof("split: value '%v'", result)
+
+	return result, nil
+}
+
 // templateFunctionGenerateJSON marshals template output into a JSON string.  As template
 // processing assumes the output is a string, we have to encode to JSON to preserve structure
 // as a string.
@@ -405,6 +1013,18 @@ func transformActionsToJSON(n parse.Node) {
 	}
 }
 
+// isParameterError returns whether a template execution error was caused by a
+// function rejecting user supplied input.
+func isParameterError(err error) bool {
+	for ; err != nil; err = goerrors.Unwrap(err) {
+		if errors.IsParameterError(err) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // renderTemplateString takes a string and returns either the literal value if it's
 // not a template or the object returned after template rendering.
 func renderTemplateString(str string, entry *registry.Entry, data interface{}) (interface{}, error) {
@@ -420,21 +1040,40 @@ func renderTemplateString(str string, entry *registry.Entry, data interface{}) (
 	glog.V(log.LevelDebug).Infof("resolving dynamic attribute %s", str)
 
 	funcs := map[string]interface{}{
-		"registry":            templateFunctionRegistry(entry),
-		"parameter":           templateFunctionParameter(entry),
-		"snippet":             templateFunctionSnippet(entry),
-		"snippetArray":        templateFunctionSnippetArray(entry),
-		"list":                templateFunctionList,
-		"generatePassword":    templateFunctionGeneratePassword,
-		"generatePetName":     templateFunctionGeneratePetName,
-		"generatePrivateKey":  templateFunctionGeneratePrivatekey,
-		"generateCertificate": templateFunctionGenerateCertificate,
-		"required":            templateFunctionRequired,
-		"default":             templateFunctionGenerateDefault,
-		"upper":               templateFunctionUpper,
-		"lower":               templateFunctionLower,
-		"title":               templateFunctionTitle,
-		"json":                templateFunctionGenerateJSON,
+		"registry":              templateFunctionRegistry(entry),
+		"parameter":             templateFunctionParameter(entry),
+		"previousParameter":     templateFunctionPreviousParameter(entry),
+		"queryParameter":        templateFunctionQueryParameter(entry),
+		"feature":               templateFunctionFeature(entry),
+		"broker":                templateFunctionBroker,
+		"lookup":                templateFunctionLookup,
+		"secret":                templateFunctionSecret(entry),
+		"configMap":             templateFunctionConfigMap(entry),
+		"snippet":               templateFunctionSnippet(entry),
+		"snippetArray":          templateFunctionSnippetArray(entry),
+		"list":                  templateFunctionList,
+		"generatePassword":      templateFunctionGeneratePassword,
+		"generatePetName":       templateFunctionGeneratePetName,
+		"generateToken":         templateFunctionGenerateToken,
+		"generatePrivateKey":    templateFunctionGeneratePrivatekey,
+		"generateCertificate":   templateFunctionGenerateCertificate,
+		"generateCACertificate": templateFunctionGenerateCACertificate,
+		"now":                   templateFunctionNow,
+		"required":              templateFunctionRequired,
+		"requiredIf":            templateFunctionRequiredIf,
+		"clamp":                 templateFunctionClamp(entry),
+		"default":               templateFunctionGenerateDefault,
+		"upper":                 templateFunctionUpper,
+		"lower":                 templateFunctionLower,
+		"title":                 templateFunctionTitle,
+		"join":                  templateFunctionJoin,
+		"split":                 templateFunctionSplit,
+		"json":                  templateFunctionGenerateJSON,
+		"sha256":                templateFunctionSHA256,
+		"fingerprint":           templateFunctionFingerprint,
+		"notAfter":              templateFunctionNotAfter,
+		"publicKey":             templateFunctionPublicKey,
+		"resourceName":          templateFunctionResourceName,
 	}
 
 	tmpl, err := template.New("inline template").Funcs(funcs).Parse(str)
@@ -447,6 +1086,10 @@ func renderTemplateString(str string, entry *registry.Entry, data interface{}) (
 
 	buf := &bytes.Buffer{}
 	if err := tmpl.Execute(buf, data); err != nil {
+		if isParameterError(err) {
+			return nil, errors.NewParameterError("dynamic attribute resolution failed: %v", err)
+		}
+
 		return nil, errors.NewConfigurationError("dynamic attribute resolution failed: %v", err)
 	}
 
@@ -477,7 +1120,7 @@ func recurseRenderTemplate(object interface{}, entry *registry.Entry, data inter
 
 			if value == nil {
 				delete(t, k)
-				break
+				continue
 			}
 
 			t[k] = value
@@ -29,6 +29,7 @@ import (
 	"github.com/evanphx/json-patch"
 	"github.com/golang/glog"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -44,6 +45,14 @@ type Updater struct {
 	// resources is a list of resources that need to be updated as a result
 	// of any required update operations.
 	resources []*unstructured.Unstructured
+
+	// creates is a list of rendered templates that need to be created, because
+	// a range has grown.
+	creates []*v1.ConfigurationTemplate
+
+	// deletes is a list of previously applied templates that need to be deleted,
+	// because a range has shrunk.
+	deletes []*v1.ConfigurationTemplate
 }
 
 // NewUpdater returns a new controler capable of updaing a service instance.
@@ -85,10 +94,34 @@ func (u *Updater) Prepare(entry *registry.Entry) error {
 		return err
 	}
 
-	// Prepare the client code
-	client := config.Clients().Dynamic()
+	// Parameters are clamped afresh each time they are rendered.
+	entry.Unset(registry.ClampedParameters)
+
+	// Load the manifests applied by previous operations so we can keep them
+	// up to date.
+	manifests := []v1.ConfigurationTemplate{}
+
+	if _, err := entry.Get(registry.Manifests, &manifests); err != nil {
+		return err
+	}
+
+	names, err := selectTemplates(templates, entry)
+	if err != nil {
+		return err
+	}
+
+	annotations, err := renderAnnotations(templates, entry)
+	if err != nil {
+		return err
+	}
+
+	for index, templateName := range names {
+		// Conditional templates can only be updated if they were created.
+		if index >= len(templates.Templates) && !hasManifest(manifests, templateName) {
+			glog.Infof("conditional template %s not created, ignoring update", templateName)
+			continue
+		}
 
-	for _, templateName := range templates.Templates {
 		glog.Infof("getting resource for template %s", templateName)
 
 		// Lookup the template, the name may be dynamic e.g. based on instance
@@ -106,128 +139,275 @@ func (u *Updater) Prepare(entry *registry.Entry) error {
 			continue
 		}
 
-		t, err := renderTemplate(template, entry, nil)
+		rendered, err := renderTemplates(template, entry)
 		if err != nil {
 			return err
 		}
 
-		newJSON := t.Template.Raw
-
-		// Unmarshal the object so we can derive the kind and name.
-		newObject := &unstructured.Unstructured{}
-		if err := json.Unmarshal(newJSON, newObject); err != nil {
-			return err
-		}
-
-		gvk := newObject.GroupVersionKind()
-
-		mapping, err := config.Clients().RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
-		if err != nil {
-			return err
+		for _, t := range rendered {
+			if err := annotateTemplate(t, annotations); err != nil {
+				return err
+			}
 		}
 
-		// The namespace defaults to that configured in the object, if not
-		// specified we use the namespace defined in the context (where the
-		// service instance or binding is created).
-		namespace := newObject.GetNamespace()
-		if namespace == "" {
-			n, ok, err := entry.GetString(registry.Namespace)
-			if err != nil {
+		if template.Range != nil {
+			if err := u.prepareRange(entry, previousManifests(manifests, template.Name), rendered); err != nil {
 				return err
 			}
-
-			if !ok {
-				return fmt.Errorf("%w: unable to lookup namespace", ErrRegistryEntryMissing)
+		} else {
+			for _, t := range rendered {
+				if err := u.prepareResource(entry, t); err != nil {
+					return err
+				}
 			}
-
-			namespace = n
 		}
 
-		glog.Infof("using namespace %s", namespace)
+		manifests = replaceManifests(manifests, template.Name, rendered)
+	}
 
-		// Get the current resource.
-		// We will extract the annotation that contains the JSON we generated
-		// when creating the resource, then compare it against the JSON when
-		// we re-render the resource.  If those two differ then make a merge
-		// patch and apply it to the current resource.  This way we can and and
-		// remove configuration in response to parameter changes and also
-		// preserve any mutations that have been applied by Kubernetes or any
-		// other controller.
-		var currentObject *unstructured.Unstructured
+	if err := setManifests(entry, manifests); err != nil {
+		return err
+	}
 
-		if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-			currentObject, err = client.Resource(mapping.Resource).Get(context.TODO(), newObject.GetName(), metav1.GetOptions{})
-		} else {
-			currentObject, err = client.Resource(mapping.Resource).Namespace(namespace).Get(context.TODO(), newObject.GetName(), metav1.GetOptions{})
+	return nil
+}
+
+// replaceManifests replaces the manifests recorded for the named template with the
+// newly rendered ones, in place, or appends them if none were recorded.  Ranged
+// templates record a manifest per element, so the number of manifests may change.
+func replaceManifests(manifests []v1.ConfigurationTemplate, name string, rendered []*v1.ConfigurationTemplate) []v1.ConfigurationTemplate {
+	replaced := []v1.ConfigurationTemplate{}
+	inserted := false
+
+	for index := range manifests {
+		if manifests[index].Name != name {
+			replaced = append(replaced, manifests[index])
+			continue
 		}
 
-		if err != nil {
-			glog.Infof("failed to get resource %s/%s %s", newObject.GetAPIVersion(), newObject.GetKind(), newObject.GetName())
-			return err
+		if inserted {
+			continue
 		}
 
-		originalJSONString, ok, _ := unstructured.NestedString(currentObject.Object, "metadata", "annotations", v1.ResourceAnnotation)
-		if !ok {
-			return fmt.Errorf("%w: failed to lookup original resource", ErrResourceAttributeMissing)
+		for _, t := range rendered {
+			replaced = append(replaced, *t)
 		}
 
-		originalJSON := []byte(originalJSONString)
+		inserted = true
+	}
 
-		originalObject := &unstructured.Unstructured{}
-		if err := json.Unmarshal(originalJSON, originalObject); err != nil {
-			return err
+	if !inserted {
+		for _, t := range rendered {
+			replaced = append(replaced, *t)
 		}
+	}
 
-		glog.Infof("original resource: %s", string(originalJSON))
-		glog.Infof("new resource: %s", string(newJSON))
+	return replaced
+}
 
-		// jsonpatch.Equal is broken, so use reflection.
-		if reflect.DeepEqual(originalObject, newObject) {
-			glog.Infof("resource unchanged")
-			continue
+// previousManifests returns the manifests recorded for the named template.
+func previousManifests(manifests []v1.ConfigurationTemplate, name string) []*v1.ConfigurationTemplate {
+	previous := []*v1.ConfigurationTemplate{}
+
+	for index := range manifests {
+		if manifests[index].Name == name {
+			previous = append(previous, &manifests[index])
 		}
+	}
+
+	return previous
+}
+
+// resourceKey returns the identity of the resource rendered by a template.
+func resourceKey(t *v1.ConfigurationTemplate) (string, error) {
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(t.Template.Raw, object); err != nil {
+		return "", err
+	}
 
-		mergePatch, err := jsonpatch.CreateMergePatch(originalJSON, newJSON)
+	return fmt.Sprintf("%s/%s %s/%s", object.GetAPIVersion(), object.GetKind(), object.GetNamespace(), object.GetName()), nil
+}
+
+// prepareRange prepares the instances of a ranged template.  Instances are matched
+// against those previously applied by resource identity, so that existing instances
+// are updated, elements added to the range are created, and elements removed from the
+// range are deleted.
+func (u *Updater) prepareRange(entry *registry.Entry, previous, rendered []*v1.ConfigurationTemplate) error {
+	removed := map[string]bool{}
+
+	for _, t := range previous {
+		key, err := resourceKey(t)
 		if err != nil {
 			return err
 		}
 
-		glog.Infof("marge patch: %s", string(mergePatch))
+		removed[key] = true
+	}
 
-		currentJSON, err := json.Marshal(currentObject)
+	for _, t := range rendered {
+		key, err := resourceKey(t)
 		if err != nil {
 			return err
 		}
 
-		glog.Infof("current resource: %s", string(currentJSON))
+		if !removed[key] {
+			u.creates = append(u.creates, t)
+			continue
+		}
 
-		mergedJSON, err := jsonpatch.MergePatch(currentJSON, mergePatch)
-		if err != nil {
+		delete(removed, key)
+
+		if err := u.prepareResource(entry, t); err != nil {
 			return err
 		}
+	}
 
-		mergedObject := &unstructured.Unstructured{}
-		if err := json.Unmarshal(mergedJSON, mergedObject); err != nil {
+	for _, t := range previous {
+		key, err := resourceKey(t)
+		if err != nil {
 			return err
 		}
 
-		// Update the resource annotation with our new idealized representation
-		// of what we asked for, so future updates will diff against the right
-		// things.
-		if err := unstructured.SetNestedField(mergedObject.Object, string(newJSON), "metadata", "annotations", v1.ResourceAnnotation); err != nil {
+		if removed[key] {
+			u.deletes = append(u.deletes, t)
+		}
+	}
+
+	return nil
+}
+
+// hasManifest returns whether a manifest was recorded for the named template.
+func hasManifest(manifests []v1.ConfigurationTemplate, name string) bool {
+	for index := range manifests {
+		if manifests[index].Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prepareResource renders the update to an existing resource, diffing against what
+// was last applied, and queues it for update if it has changed.
+func (u *Updater) prepareResource(entry *registry.Entry, t *v1.ConfigurationTemplate) error {
+	client := config.Clients().Dynamic()
+
+	newJSON := t.Template.Raw
+
+	// Unmarshal the object so we can derive the kind and name.
+	newObject := &unstructured.Unstructured{}
+	if err := json.Unmarshal(newJSON, newObject); err != nil {
+		return err
+	}
+
+	gvk := newObject.GroupVersionKind()
+
+	mapping, err := config.Clients().RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+
+	// The namespace defaults to that configured in the object, if not
+	// specified we use the namespace defined in the context (where the
+	// service instance or binding is created).
+	namespace := newObject.GetNamespace()
+	if namespace == "" {
+		n, ok, err := entry.GetString(registry.Namespace)
+		if err != nil {
 			return err
 		}
 
-		glog.Infof("merged resource: %s", string(mergedJSON))
+		if !ok {
+			return fmt.Errorf("%w: unable to lookup namespace", ErrRegistryEntryMissing)
+		}
+
+		namespace = n
+	}
+
+	glog.Infof("using namespace %s", namespace)
+
+	// Get the current resource.
+	// We will extract the annotation that contains the JSON we generated
+	// when creating the resource, then compare it against the JSON when
+	// we re-render the resource.  If those two differ then make a merge
+	// patch and apply it to the current resource.  This way we can and and
+	// remove configuration in response to parameter changes and also
+	// preserve any mutations that have been applied by Kubernetes or any
+	// other controller.
+	var currentObject *unstructured.Unstructured
+
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		currentObject, err = client.Resource(mapping.Resource).Get(context.TODO(), newObject.GetName(), metav1.GetOptions{})
+	} else {
+		currentObject, err = client.Resource(mapping.Resource).Namespace(namespace).Get(context.TODO(), newObject.GetName(), metav1.GetOptions{})
+	}
+
+	if err != nil {
+		glog.Infof("failed to get resource %s/%s %s", newObject.GetAPIVersion(), newObject.GetKind(), newObject.GetName())
+		return err
+	}
+
+	originalJSONString, ok, _ := unstructured.NestedString(currentObject.Object, "metadata", "annotations", v1.ResourceAnnotation)
+	if !ok {
+		return fmt.Errorf("%w: failed to lookup original resource", ErrResourceAttributeMissing)
+	}
+
+	originalJSON := []byte(originalJSONString)
+
+	originalObject := &unstructured.Unstructured{}
+	if err := json.Unmarshal(originalJSON, originalObject); err != nil {
+		return err
+	}
+
+	glog.Infof("original resource: %s", string(originalJSON))
+	glog.Infof("new resource: %s", string(newJSON))
+
+	// jsonpatch.Equal is broken, so use reflection.
+	if reflect.DeepEqual(originalObject, newObject) {
+		glog.Infof("resource unchanged")
+		return nil
+	}
+
+	mergePatch, err := jsonpatch.CreateMergePatch(originalJSON, newJSON)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("marge patch: %s", string(mergePatch))
+
+	currentJSON, err := json.Marshal(currentObject)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("current resource: %s", string(currentJSON))
 
-		u.resources = append(u.resources, mergedObject)
+	mergedJSON, err := jsonpatch.MergePatch(currentJSON, mergePatch)
+	if err != nil {
+		return err
 	}
 
+	mergedObject := &unstructured.Unstructured{}
+	if err := json.Unmarshal(mergedJSON, mergedObject); err != nil {
+		return err
+	}
+
+	// Update the resource annotation with our new idealized representation
+	// of what we asked for, so future updates will diff against the right
+	// things.
+	if err := unstructured.SetNestedField(mergedObject.Object, string(newJSON), "metadata", "annotations", v1.ResourceAnnotation); err != nil {
+		return err
+	}
+
+	glog.Infof("merged resource: %s", string(mergedJSON))
+
+	u.resources = append(u.resources, mergedObject)
+
 	return nil
 }
 
 // run performs asynchronous update tasks.
-func (u *Updater) run() error {
+func (u *Updater) run(entry *registry.Entry) error {
 	glog.Info("updating resources")
 
 	// Prepare the client code
@@ -243,23 +423,54 @@ func (u *Updater) run() error {
 			return err
 		}
 
-		if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-			_, err = client.Resource(mapping.Resource).Update(context.TODO(), resource, metav1.UpdateOptions{})
-		} else {
-			_, err = client.Resource(mapping.Resource).Namespace(resource.GetNamespace()).Update(context.TODO(), resource, metav1.UpdateOptions{})
-		}
+		err = applyWithTimeout(resource, func(ctx context.Context) error {
+			var err error
+
+			if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+				_, err = client.Resource(mapping.Resource).Update(ctx, resource, metav1.UpdateOptions{})
+			} else {
+				_, err = client.Resource(mapping.Resource).Namespace(resource.GetNamespace()).Update(ctx, resource, metav1.UpdateOptions{})
+			}
+
+			return err
+		}, nil)
 
 		if err != nil {
 			return err
 		}
+
+		operation.Event(entry, corev1.EventTypeNormal, operation.EventReasonResourceApplied, "updated %s %s", resource.GetKind(), resource.GetName())
+	}
+
+	creator := &Creator{
+		resourceType: u.resourceType,
+	}
+
+	for _, t := range u.creates {
+		if err := creator.createResource(t, entry); err != nil {
+			return err
+		}
+	}
+
+	deleter := NewDeleter()
+
+	for _, t := range u.deletes {
+		report := deleter.deleteResource(t, entry)
+		if report.Result == DeletionResultFailed {
+			return fmt.Errorf("%w: %s: %s", ErrResourceDeletionFailed, report.Resource, report.Error)
+		}
 	}
 
 	return nil
 }
 
-// Run performs asynchronous update tasks.
-func (u *Updater) Run(entry *registry.Entry) {
-	if err := operation.Complete(entry, u.run()); err != nil {
+// Run performs asynchronous update tasks, returning the operation status.
+func (u *Updater) Run(entry *registry.Entry) error {
+	status := u.run(entry)
+
+	if err := operation.Complete(entry, status); err != nil {
 		glog.Infof("failed to delete instance")
 	}
+
+	return status
 }
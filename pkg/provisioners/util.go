@@ -15,8 +15,12 @@
 package provisioners
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
 	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
 	"github.com/couchbase/service-broker/pkg/config"
@@ -24,9 +28,51 @@ import (
 	"github.com/couchbase/service-broker/pkg/log"
 	"github.com/couchbase/service-broker/pkg/registry"
 
+	"github.com/go-openapi/jsonpointer"
 	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// applyWithTimeout performs a resource create or update, failing if it does not
+// complete within the apply timeout.  The apply is passed a context that is
+// cancelled on timeout, however we do not wait for it to honor the cancellation.
+// If the apply completes after the timeout, late (when not nil) is called with its
+// result so the caller can clean up anything the failed operation left behind.
+func applyWithTimeout(object *unstructured.Unstructured, apply func(context.Context) error, late func(error)) error {
+	timeout := config.GetOptions().ApplyTimeout
+	if timeout == 0 {
+		return apply(context.TODO())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+
+	go func() {
+		result <- apply(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		go func() {
+			err := <-result
+
+			glog.Infof("apply of %s %s completed after timeout: %v", object.GetKind(), object.GetName(), err)
+
+			if late != nil {
+				late(err)
+			}
+		}()
+
+		return errors.NewOperationTimeoutError("apply of %s %s timed out after %v", object.GetKind(), object.GetName(), timeout)
+	}
+}
+
 // getTemplateBinding returns the binding associated with a specific resource type.
 func getTemplateBinding(t ResourceType, serviceID, planID string) (*v1.ServiceBrokerTemplateList, error) {
 	bindings, err := config.Config().GetTemplateBindings(serviceID, planID)
@@ -49,9 +95,52 @@ func getTemplateBinding(t ResourceType, serviceID, planID string) (*v1.ServiceBr
 		return nil, errors.NewConfigurationError("missing bindings for type %s", string(t))
 	}
 
+	if t == ResourceTypeServiceBinding && templates.Inherit {
+		templates = inheritTemplateBinding(&bindings.ServiceInstance, templates)
+	}
+
 	return templates, nil
 }
 
+// inheritTemplateBinding returns a copy of the service binding templates with the
+// service instance's annotations prepended.  Service binding annotations override
+// inherited ones with the same name.  Registry values are not inherited here, as
+// the service binding registry already holds the values rendered for the service
+// instance, and rendering them again would replace generated values, such as
+// passwords, with new ones.
+func inheritTemplateBinding(instance, binding *v1.ServiceBrokerTemplateList) *v1.ServiceBrokerTemplateList {
+	templates := binding.DeepCopy()
+	templates.Annotations = inheritRegistryValues(instance.Annotations, binding.Annotations)
+
+	return templates
+}
+
+// inheritRegistryValues prepends inherited values to the defined ones, omitting
+// any that are overridden.
+func inheritRegistryValues(inherited, defined []v1.RegistryValue) []v1.RegistryValue {
+	overridden := map[string]interface{}{}
+
+	for _, value := range defined {
+		overridden[value.Name] = nil
+	}
+
+	var values []v1.RegistryValue
+
+	for _, value := range inherited {
+		if _, ok := overridden[value.Name]; ok {
+			continue
+		}
+
+		values = append(values, *value.DeepCopy())
+	}
+
+	for _, value := range defined {
+		values = append(values, *value.DeepCopy())
+	}
+
+	return values
+}
+
 // getTemplate returns the template corresponding to a template name.
 func getTemplate(name string) (*v1.ConfigurationTemplate, error) {
 	for index, template := range config.Config().Spec.Templates {
@@ -63,9 +152,295 @@ func getTemplate(name string) (*v1.ConfigurationTemplate, error) {
 	return nil, errors.NewConfigurationError("unable to locate template for %s", name)
 }
 
+// getLookup returns the lookup table associated with a name.
+func getLookup(name string) (*v1.LookupTable, error) {
+	for index, lookup := range config.Config().Spec.Lookups {
+		if lookup.Name == name {
+			return &config.Config().Spec.Lookups[index], nil
+		}
+	}
+
+	return nil, errors.NewConfigurationError("unable to locate lookup for %s", name)
+}
+
+// selectTemplates returns the names of templates to create, in order, including any
+// conditional templates whose condition is true.
+func selectTemplates(templates *v1.ServiceBrokerTemplateList, entry *registry.Entry) ([]string, error) {
+	names := append([]string{}, templates.Templates...)
+
+	for _, conditional := range templates.ConditionalTemplates {
+		value, err := renderTemplateString(conditional.Condition, entry, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := value.(type) {
+		case nil:
+		case bool:
+			if t {
+				names = append(names, conditional.Templates...)
+			}
+		default:
+			return nil, errors.NewParameterError("template condition %s must be a boolean, got %v", conditional.Condition, value)
+		}
+	}
+
+	return names, nil
+}
+
+// renderAnnotations renders the annotations that are added to every resource created
+// for a service instance or binding.  Annotations that render to nil are omitted.
+func renderAnnotations(templates *v1.ServiceBrokerTemplateList, entry *registry.Entry) (map[string]string, error) {
+	annotations := map[string]string{}
+
+	for _, annotation := range templates.Annotations {
+		value, err := renderTemplateString(annotation.Value, entry, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if value == nil {
+			continue
+		}
+
+		str, ok := value.(string)
+		if !ok {
+			return nil, errors.NewConfigurationError("annotation %s must be a string", annotation.Name)
+		}
+
+		annotations[annotation.Name] = str
+	}
+
+	return annotations, nil
+}
+
+// annotateTemplate adds annotations to the resource of a rendered template.  Annotations
+// defined by the template take precedence.  Singleton resources are shared between
+// service instances, so are not annotated.
+func annotateTemplate(template *v1.ConfigurationTemplate, annotations map[string]string) error {
+	if len(annotations) == 0 || template.Singleton {
+		return nil
+	}
+
+	object := map[string]interface{}{}
+	if err := json.Unmarshal(template.Template.Raw, &object); err != nil {
+		return err
+	}
+
+	existing, _, err := unstructured.NestedStringMap(object, "metadata", "annotations")
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		existing = map[string]string{}
+	}
+
+	for name, value := range annotations {
+		if _, ok := existing[name]; !ok {
+			existing[name] = value
+		}
+	}
+
+	if err := unstructured.SetNestedStringMap(object, existing, "metadata", "annotations"); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	template.Template.Raw = raw
+
+	return nil
+}
+
+// maxManifestsSize is the maximum size in bytes of the manifests recorded in the
+// registry, this leaves room for other registry values within the 1MiB limit.
+const maxManifestsSize = 512 << 10
+
+// setManifests records the rendered templates applied to a service instance or binding.
+// They are bounded in size so that the registry entry remains within the Kubernetes
+// secret size limit.
+func setManifests(entry *registry.Entry, manifests []v1.ConfigurationTemplate) error {
+	raw, err := json.Marshal(manifests)
+	if err != nil {
+		return err
+	}
+
+	if len(raw) > maxManifestsSize {
+		return errors.NewConfigurationError("rendered manifests of %d bytes exceed the maximum of %d", len(raw), maxManifestsSize)
+	}
+
+	return entry.Set(registry.Manifests, manifests)
+}
+
 // renderTemplate accepts a template defined in the configuration and applies any
 // request or metadata parameters to it.
 func renderTemplate(template *v1.ConfigurationTemplate, entry *registry.Entry, data interface{}) (*v1.ConfigurationTemplate, error) {
+	t, err := renderTemplateWithIncludes(template, entry, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := renderTemplateNamespace(t, entry, data); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// renderTemplateNamespace sets the namespace of a rendered template, if the template
+// defines one.  The namespace is recorded in the resource, so it is deleted from the
+// same namespace it was created in.
+func renderTemplateNamespace(template *v1.ConfigurationTemplate, entry *registry.Entry, data interface{}) error {
+	if template.Namespace == "" {
+		return nil
+	}
+
+	value, err := renderTemplateString(template.Namespace, entry, data)
+	if err != nil {
+		return err
+	}
+
+	namespace, ok := value.(string)
+	if !ok {
+		return errors.NewConfigurationError("template %s namespace must be a string, got %v", template.Name, value)
+	}
+
+	if errs := validation.IsDNS1123Label(namespace); len(errs) != 0 {
+		return errors.NewConfigurationError("template %s namespace '%s' is invalid: %s", template.Name, namespace, strings.Join(errs, ", "))
+	}
+
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(template.Template.Raw, object); err != nil {
+		return err
+	}
+
+	object.SetNamespace(namespace)
+
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	template.Template.Raw = raw
+
+	return nil
+}
+
+// renderTemplates renders a template, once per element if the template is ranged.
+func renderTemplates(template *v1.ConfigurationTemplate, entry *registry.Entry) ([]*v1.ConfigurationTemplate, error) {
+	if template.Range == nil {
+		t, err := renderTemplate(template, entry, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*v1.ConfigurationTemplate{t}, nil
+	}
+
+	elements, err := rangeElements(template, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]*v1.ConfigurationTemplate, len(elements))
+
+	for index, element := range elements {
+		data := map[string]interface{}{
+			"index":   index,
+			"element": element,
+		}
+
+		t, err := renderTemplate(template, entry, data)
+		if err != nil {
+			return nil, err
+		}
+
+		templates[index] = t
+	}
+
+	return templates, nil
+}
+
+// rangeElements resolves the list a ranged template is instantiated over.  A count
+// yields a list of indices.
+func rangeElements(template *v1.ConfigurationTemplate, entry *registry.Entry) ([]interface{}, error) {
+	value, err := renderTemplateString(template.Range.Over, entry, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var elements []interface{}
+
+	switch t := value.(type) {
+	case nil:
+	case []interface{}:
+		elements = t
+	case float64:
+		if t < 0 || t != math.Trunc(t) {
+			return nil, errors.NewParameterError("template %s range count %v must be a non-negative integer", template.Name, t)
+		}
+
+		elements = make([]interface{}, int(t))
+
+		for i := range elements {
+			elements[i] = i
+		}
+	default:
+		return nil, errors.NewParameterError("template %s range must be a list or count, got %v", template.Name, value)
+	}
+
+	if template.Range.MaxItems != nil && len(elements) > *template.Range.MaxItems {
+		return nil, errors.NewParameterError("template %s range of %d items exceeds the maximum of %d", template.Name, len(elements), *template.Range.MaxItems)
+	}
+
+	maxItems, err := planMaxRangeItems(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxItems != nil && len(elements) > *maxItems {
+		return nil, errors.NewParameterError("template %s range of %d items exceeds the service plan maximum of %d", template.Name, len(elements), *maxItems)
+	}
+
+	return elements, nil
+}
+
+// planMaxRangeItems returns the limit the service plan places on all ranges, if any.
+func planMaxRangeItems(entry *registry.Entry) (*int, error) {
+	serviceID, ok, err := entry.GetString(registry.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: unable to lookup service ID", ErrResourceReferenceMissing)
+	}
+
+	planID, ok, err := entry.GetString(registry.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: unable to lookup plan ID", ErrResourceReferenceMissing)
+	}
+
+	plan, err := config.Config().GetServicePlan(serviceID, planID)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan.MaxRangeItems, nil
+}
+
+// renderTemplateWithIncludes renders a template and any templates it includes.  The
+// includers are the templates that are already being rendered, and are used to detect
+// include cycles and limit the include depth.
+func renderTemplateWithIncludes(template *v1.ConfigurationTemplate, entry *registry.Entry, data interface{}, includers []string) (*v1.ConfigurationTemplate, error) {
 	glog.Infof("rendering template %s", template.Name)
 
 	if template.Template == nil || template.Template.Raw == nil {
@@ -88,6 +463,14 @@ func renderTemplate(template *v1.ConfigurationTemplate, entry *registry.Entry, d
 		return nil, err
 	}
 
+	includers = append(includers, template.Name)
+
+	for _, include := range template.Includes {
+		if object, err = renderInclude(object, include, entry, includers); err != nil {
+			return nil, err
+		}
+	}
+
 	raw, err := json.Marshal(object)
 	if err != nil {
 		return nil, err
@@ -99,3 +482,141 @@ func renderTemplate(template *v1.ConfigurationTemplate, entry *registry.Entry, d
 
 	return t, nil
 }
+
+// renderInclude renders an included template and splices it into the parent object.
+func renderInclude(object interface{}, include v1.ConfigurationTemplateInclude, entry *registry.Entry, includers []string) (interface{}, error) {
+	for _, includer := range includers {
+		if includer == include.Name {
+			return nil, errors.NewConfigurationError("template include cycle %s -> %s", strings.Join(includers, " -> "), include.Name)
+		}
+	}
+
+	maxIncludeDepth := config.GetOptions().MaxIncludeDepth
+
+	if len(includers) > maxIncludeDepth {
+		return nil, errors.NewConfigurationError("template include depth exceeds maximum of %d %s -> %s", maxIncludeDepth, strings.Join(includers, " -> "), include.Name)
+	}
+
+	template, err := getTemplate(include.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var parameters interface{}
+
+	if include.Parameters != nil && include.Parameters.Raw != nil {
+		if err := json.Unmarshal(include.Parameters.Raw, &parameters); err != nil {
+			return nil, errors.NewConfigurationError("template include %s parameters not JSON formatted: %v", include.Name, err)
+		}
+	}
+
+	rendered, err := renderTemplateWithIncludes(template, entry, parameters, includers)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+
+	if err := json.Unmarshal(rendered.Template.Raw, &value); err != nil {
+		return nil, errors.NewConfigurationError("template not JSON formatted: %v", err)
+	}
+
+	if include.Overrides != nil && include.Overrides.Raw != nil {
+		var overrides interface{}
+
+		if err := json.Unmarshal(include.Overrides.Raw, &overrides); err != nil {
+			return nil, errors.NewConfigurationError("template include %s overrides not JSON formatted: %v", include.Name, err)
+		}
+
+		if overrides, err = recurseRenderTemplate(overrides, entry, parameters); err != nil {
+			return nil, err
+		}
+
+		value = override(value, overrides)
+	}
+
+	pointer, err := jsonpointer.New(include.Path)
+	if err != nil {
+		return nil, errors.NewConfigurationError("template include %s path %s malformed: %v", include.Name, include.Path, err)
+	}
+
+	return splice(object, pointer.DecodedTokens(), value)
+}
+
+// override recursively merges overrides into an object.  Where both are objects
+// their fields are merged, otherwise the override replaces the original value.
+func override(object, overrides interface{}) interface{} {
+	existing, ok := object.(map[string]interface{})
+	if !ok {
+		return overrides
+	}
+
+	fields, ok := overrides.(map[string]interface{})
+	if !ok {
+		return overrides
+	}
+
+	for k, v := range fields {
+		existing[k] = override(existing[k], v)
+	}
+
+	return existing
+}
+
+// splice places a value in an object at the location described by the JSON pointer
+// tokens.  Missing objects are created along the way, and objects that already exist
+// at the location are merged with the value.
+func splice(object interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		existing, ok := object.(map[string]interface{})
+		if !ok {
+			return value, nil
+		}
+
+		included, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.NewConfigurationError("template include cannot merge %v into an object", value)
+		}
+
+		for k, v := range included {
+			existing[k] = v
+		}
+
+		return existing, nil
+	}
+
+	switch t := object.(type) {
+	case nil:
+		child, err := splice(nil, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{tokens[0]: child}, nil
+	case map[string]interface{}:
+		child, err := splice(t[tokens[0]], tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+
+		t[tokens[0]] = child
+
+		return t, nil
+	case []interface{}:
+		index, err := strconv.Atoi(tokens[0])
+		if err != nil || index < 0 || index >= len(t) {
+			return nil, errors.NewConfigurationError("template include array index %s invalid", tokens[0])
+		}
+
+		child, err := splice(t[index], tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+
+		t[index] = child
+
+		return t, nil
+	default:
+		return nil, errors.NewConfigurationError("template include path traverses %v", object)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/service-broker/pkg/api"
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/errors"
+	"github.com/couchbase/service-broker/pkg/version"
+
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// isBackupSecret returns whether a secret should be included in a backup.
+func isBackupSecret(secret *corev1.Secret) bool {
+	return secret.Name == directoryName || strings.HasPrefix(secret.Name, "registry-")
+}
+
+// isRegistryEntryName returns whether a secret name is that of a service instance or
+// service binding registry entry.
+func isRegistryEntryName(name string) bool {
+	return strings.HasPrefix(name, Name(ServiceInstance, "")) || strings.HasPrefix(name, Name(ServiceBinding, ""))
+}
+
+// backupNamespaces returns all namespaces that may contain registry entries.  This is
+// the broker namespace, where the directory lives, and any namespace recorded in the
+// directory.
+func backupNamespaces(namespace string) ([]string, error) {
+	namespaces := map[string]interface{}{
+		namespace: nil,
+	}
+
+	directory, err := NewDirectory(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, data := range directory.secret.Data {
+		dirent := &DirectoryEntry{}
+		if err := json.Unmarshal(data, dirent); err != nil {
+			return nil, err
+		}
+
+		namespaces[dirent.Namespace] = nil
+	}
+
+	result := make([]string, 0, len(namespaces))
+
+	for ns := range namespaces {
+		result = append(result, ns)
+	}
+
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// Export returns a backup of the registry directory and all registry entries.
+func Export(namespace string) (*api.RegistryBackup, error) {
+	namespaces, err := backupNamespaces(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{
+		"app": version.Application,
+	})
+
+	backup := &api.RegistryBackup{
+		Entries: []api.RegistryBackupEntry{},
+	}
+
+	for _, ns := range namespaces {
+		secrets, err := config.Clients().Kubernetes().CoreV1().Secrets(ns).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, err
+		}
+
+		for index := range secrets.Items {
+			secret := &secrets.Items[index]
+
+			if !isBackupSecret(secret) {
+				continue
+			}
+
+			backup.Entries = append(backup.Entries, api.RegistryBackupEntry{
+				Namespace: secret.Namespace,
+				Name:      secret.Name,
+				Data:      secret.Data,
+			})
+		}
+	}
+
+	return backup, nil
+}
+
+// importNamespaces returns the namespaces a backup may be imported into.  This is the
+// broker namespace, and any namespace recorded in either the existing directory or the
+// directory contained in the backup.
+func importNamespaces(namespace string, backup *api.RegistryBackup) (map[string]bool, error) {
+	existing, err := backupNamespaces(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := map[string]bool{}
+
+	for _, ns := range existing {
+		namespaces[ns] = true
+	}
+
+	for _, entry := range backup.Entries {
+		if entry.Namespace != namespace || entry.Name != directoryName {
+			continue
+		}
+
+		for _, data := range entry.Data {
+			dirent := &DirectoryEntry{}
+			if err := json.Unmarshal(data, dirent); err != nil {
+				return nil, errors.NewParameterError("backup directory entry is invalid: %v", err)
+			}
+
+			namespaces[dirent.Namespace] = true
+		}
+	}
+
+	return namespaces, nil
+}
+
+// checkImportEntry checks that a backup entry may be imported.  The directory must be
+// in the broker namespace, and other entries must be service instance or binding registry
+// entries in a namespace known to the directory.  Existing secrets must have been created
+// by the broker.
+func checkImportEntry(namespace string, namespaces map[string]bool, entry *api.RegistryBackupEntry) error {
+	if !namespaces[entry.Namespace] {
+		return errors.NewParameterError("backup entry %s/%s is not in a service instance namespace", entry.Namespace, entry.Name)
+	}
+
+	if entry.Name == directoryName && entry.Namespace != namespace {
+		return errors.NewParameterError("backup entry %s/%s is not in the broker namespace", entry.Namespace, entry.Name)
+	}
+
+	if entry.Name != directoryName && !isRegistryEntryName(entry.Name) {
+		return errors.NewParameterError("backup entry %s/%s is not a registry entry", entry.Namespace, entry.Name)
+	}
+
+	existing, err := config.Clients().Kubernetes().CoreV1().Secrets(entry.Namespace).Get(context.TODO(), entry.Name, metav1.GetOptions{})
+	if err != nil {
+		if k8s_errors.IsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if application, ok := existing.Labels["app"]; !ok || application != version.Application {
+		return errors.NewParameterError("backup entry %s/%s would overwrite a secret not created by the broker", entry.Namespace, entry.Name)
+	}
+
+	return nil
+}
+
+// Import restores the registry directory and registry entries from a backup.  Any
+// existing entries are overwritten.  All entries are checked before any are imported.
+func Import(namespace string, backup *api.RegistryBackup) error {
+	namespaces, err := importNamespaces(namespace, backup)
+	if err != nil {
+		return err
+	}
+
+	for index := range backup.Entries {
+		if err := checkImportEntry(namespace, namespaces, &backup.Entries[index]); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range backup.Entries {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      entry.Name,
+				Namespace: entry.Namespace,
+				Labels: map[string]string{
+					"app": version.Application,
+				},
+				Annotations: map[string]string{
+					v1.VersionAnnotaiton: version.Version,
+				},
+			},
+			Data: entry.Data,
+		}
+
+		existing, err := config.Clients().Kubernetes().CoreV1().Secrets(entry.Namespace).Get(context.TODO(), entry.Name, metav1.GetOptions{})
+		if err != nil {
+			if !k8s_errors.IsNotFound(err) {
+				return err
+			}
+
+			if _, err := config.Clients().Kubernetes().CoreV1().Secrets(entry.Namespace).Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		existing.Data = entry.Data
+
+		if _, err := config.Clients().Kubernetes().CoreV1().Secrets(entry.Namespace).Update(context.TODO(), existing, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -17,6 +17,7 @@ package registry
 import (
 	"context"
 	"encoding/json"
+	"sort"
 
 	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
 	"github.com/couchbase/service-broker/pkg/config"
@@ -164,3 +165,16 @@ func (d *Directory) Remove(instanceID string) error {
 
 	return d.commit()
 }
+
+// InstanceIDs returns the IDs of all service instances in the directory.
+func (d *Directory) InstanceIDs() []string {
+	instanceIDs := make([]string, 0, len(d.secret.Data))
+
+	for instanceID := range d.secret.Data {
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+
+	sort.Strings(instanceIDs)
+
+	return instanceIDs
+}
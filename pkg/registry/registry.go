@@ -16,10 +16,12 @@
 package registry
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	goerrors "errors"
 	"fmt"
+	"strings"
 
 	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
 	"github.com/couchbase/service-broker/pkg/config"
@@ -31,6 +33,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // Key is an indentifier of a value in the registry entry's KV map.
@@ -46,6 +49,10 @@ const (
 	// BindingID is the name of the binding.
 	BindingID Key = "binding-id"
 
+	// PredecessorBindingID is the name of the binding that a binding replaces when
+	// credentials are rotated.
+	PredecessorBindingID Key = "predecessor-binding-id"
+
 	// ServiceID is the service ID related to the instance or binding.
 	ServiceID Key = "service-id"
 
@@ -58,6 +65,13 @@ const (
 	// Parameters are the parameters used to create or update the instance or binding.
 	Parameters Key = "parameters"
 
+	// PreviousParameters are the parameters that were in effect before the last
+	// update of the instance.
+	PreviousParameters Key = "previous-parameters"
+
+	// Query is the set of allowed query parameters used to create the instance or binding.
+	Query Key = "query"
+
 	// Operation records there is an asynchronous operation in progress for the instance or binding.
 	// This is the analogue to an operation.Type.
 	Operation Key = "operation"
@@ -68,16 +82,107 @@ const (
 	// OperationStatus is the error string returned by an aysynchronous operation.
 	OperationStatus Key = "operation-status"
 
+	// OperationRequestIdentity is the X-Broker-API-Request-Identity of the request that
+	// started an asynchronous operation, used to correlate it with platform logs.
+	OperationRequestIdentity Key = "operation-request-identity"
+
+	// OperationAudit is the audit record of the request that started an asynchronous
+	// operation, written again with the outcome once the operation completes.
+	OperationAudit Key = "operation-audit"
+
+	// OperationDiagnostics are recent diagnostic messages recorded by the operation, to
+	// help explain why it failed.
+	OperationDiagnostics Key = "operation-diagnostics"
+
+	// OperationLastPolled is when a client last polled for the operation, or when it
+	// started if it has not been polled.
+	OperationLastPolled Key = "operation-last-polled"
+
+	// OperationProgress is a human readable checkpoint recorded by an asynchronous operation
+	// while it is in progress.
+	OperationProgress Key = "operation-progress"
+
+	// OperationResultID is the unique ID of the last completed asynchronous operation,
+	// retained so that it can be polled more than once.
+	OperationResultID Key = "operation-result-id"
+
+	// OperationResultStatus is the error string returned by the last completed
+	// asynchronous operation.
+	OperationResultStatus Key = "operation-result-status"
+
+	// OperationResultExpiry is the time after which the last completed asynchronous
+	// operation result is pruned.
+	OperationResultExpiry Key = "operation-result-expiry"
+
+	// OperationLastStatus is the error string returned by the last asynchronous
+	// operation to end, empty if it succeeded.  Unlike the retained result, this
+	// is kept until the next operation ends.
+	OperationLastStatus Key = "operation-last-status"
+
 	// DashboardURL is the dashboard URL associated with a service instance.
 	DashboardURL Key = "dashboard-url"
 
 	// Credentials is the set of credentials that may be generated for a service binding.
 	Credentials Key = "credentials"
+
+	// SyslogDrainURL is where a service binding's logs are streamed from, returned
+	// when the platform supports the syslog_drain requirement.
+	SyslogDrainURL Key = "syslog-drain-url"
+
+	// RouteServiceURL is where requests are proxied to for a service binding, returned
+	// when the platform supports the route_forwarding requirement.
+	RouteServiceURL Key = "route-service-url"
+
+	// VolumeMounts is the list of volumes that a service binding provides, returned
+	// when the platform supports the volume_mount requirement.
+	VolumeMounts Key = "volume-mounts"
+
+	// BindingExpiresAt is the time after which a service binding's credentials
+	// are no longer valid.
+	BindingExpiresAt Key = "binding-expires-at"
+
+	// ClientCertificateSubject is the subject of the verified client certificate that
+	// made the request, when using mutual TLS authentication.
+	ClientCertificateSubject Key = "client-certificate-subject"
+
+	// ClientCertificateFingerprint is the hex encoded SHA-256 fingerprint of the verified
+	// client certificate that made the request, when using mutual TLS authentication.
+	ClientCertificateFingerprint Key = "client-certificate-fingerprint"
+
+	// DeletionReport is the per-resource outcome of a failed deprovision operation.
+	DeletionReport Key = "deletion-report"
+
+	// RollbackReport is the per-resource outcome of rolling back a cancelled operation.
+	RollbackReport Key = "rollback-report"
+
+	// Manifests is the set of rendered templates that were last applied for an instance.
+	Manifests Key = "manifests"
+
+	// CompletionWebhookError records why the last completion webhook could not be delivered.
+	CompletionWebhookError Key = "completion-webhook-error"
+
+	// ReadinessDeadline is the time after which unready readiness checks cause an
+	// asynchronous operation to fail.
+	ReadinessDeadline Key = "readiness-deadline"
+
+	// DeletionDeadline is the time after which a soft-deleted service instance is
+	// deleted, until then it may be undeleted.
+	DeletionDeadline Key = "deletion-deadline"
+
+	// Endpoint is the value of the service instance endpoint selected by a service binding.
+	Endpoint Key = "endpoint"
+
+	// ClampedParameters records parameter values that were clamped to their allowed
+	// range, rather than being rejected.
+	ClampedParameters Key = "clamped-parameters"
 )
 
 // ErrPermsission is raised when you don't have permission to read/write a registry key.
 var ErrPermsission = goerrors.New("permission error")
 
+// ErrCorrupt is raised when registry data is not what was written.
+var ErrCorrupt = goerrors.New("registry corrupt")
+
 // keyPolicy defines managed keys and how they can be accessed by users.
 type keyPolicy struct {
 	// name is the name of the key.
@@ -103,6 +208,16 @@ var (
 			read:  true,
 			write: false,
 		},
+		{
+			name:  BindingID,
+			read:  true,
+			write: false,
+		},
+		{
+			name:  PredecessorBindingID,
+			read:  true,
+			write: false,
+		},
 		{
 			name:  ServiceID,
 			read:  true,
@@ -123,6 +238,16 @@ var (
 			read:  false,
 			write: false,
 		},
+		{
+			name:  PreviousParameters,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  Query,
+			read:  false,
+			write: false,
+		},
 		{
 			name:  Operation,
 			read:  false,
@@ -138,6 +263,51 @@ var (
 			read:  false,
 			write: false,
 		},
+		{
+			name:  OperationRequestIdentity,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  OperationAudit,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  OperationDiagnostics,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  OperationLastPolled,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  OperationProgress,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  OperationResultID,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  OperationResultStatus,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  OperationResultExpiry,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  OperationLastStatus,
+			read:  false,
+			write: false,
+		},
 		{
 			name:  DashboardURL,
 			read:  true,
@@ -148,6 +318,61 @@ var (
 			read:  true,
 			write: true,
 		},
+		{
+			name:  BindingExpiresAt,
+			read:  true,
+			write: false,
+		},
+		{
+			name:  Endpoint,
+			read:  true,
+			write: false,
+		},
+		{
+			name:  ClientCertificateSubject,
+			read:  true,
+			write: false,
+		},
+		{
+			name:  ClientCertificateFingerprint,
+			read:  true,
+			write: false,
+		},
+		{
+			name:  DeletionReport,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  RollbackReport,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  Manifests,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  CompletionWebhookError,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  ReadinessDeadline,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  DeletionDeadline,
+			read:  false,
+			write: false,
+		},
+		{
+			name:  ClampedParameters,
+			read:  true,
+			write: false,
+		},
 	}
 )
 
@@ -182,6 +407,64 @@ func isKeyWritable(name string) bool {
 	return policy.write
 }
 
+// isKeyScoped checks to see whether a key selects an inherited, or service binding
+// generated, value.
+func isKeyScoped(name string) bool {
+	return strings.HasPrefix(name, InstanceKeyPrefix) || strings.HasPrefix(name, BindingKeyPrefix)
+}
+
+// sensitiveKeyWords identify user defined registry keys whose values are redacted.
+var sensitiveKeyWords = []string{
+	"password",
+	"secret",
+	"token",
+	"key",
+	"credential",
+}
+
+// IsKeySensitive returns whether a key's value must be redacted from diagnostics
+// and logs.  These are credentials, and user defined keys that look like they hold
+// secrets.
+func IsKeySensitive(name string) bool {
+	if Key(name) == Credentials {
+		return true
+	}
+
+	if findKeyPolicy(name) != nil {
+		return false
+	}
+
+	name = strings.ToLower(name)
+
+	for _, word := range sensitiveKeyWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactValue replaces all occurrences of a value, or any strings it contains, in a string.
+func redactValue(s string, value interface{}) string {
+	switch t := value.(type) {
+	case string:
+		if t != "" {
+			s = strings.ReplaceAll(s, t, "[REDACTED]")
+		}
+	case []interface{}:
+		for _, v := range t {
+			s = redactValue(s, v)
+		}
+	case map[string]interface{}:
+		for _, v := range t {
+			s = redactValue(s, v)
+		}
+	}
+
+	return s
+}
+
 // Type defines the registry type.
 type Type string
 
@@ -191,6 +474,9 @@ const (
 
 	// ServiceBinding is used for service instance registries.
 	ServiceBinding Type = "service-binding"
+
+	// selfTest is used for the canary entry written by SelfTest.
+	selfTest Type = "self-test"
 )
 
 // Entry is a KV store associated with each instance or binding.
@@ -205,6 +491,41 @@ type Entry struct {
 	// Once set it cannot be unset.  Read only instances cannot be deleted or
 	// updated.
 	readOnly bool
+
+	// base is the data as last read from, or committed to, Kubernetes.  It is
+	// used to determine what has been modified when retrying a conflicting commit.
+	base map[string][]byte
+
+	// inherited is the data inherited from a service binding's service instance.
+	inherited map[string][]byte
+
+	// bound records the keys written by a service binding after inheritance.
+	bound map[string]bool
+}
+
+const (
+	// InstanceKeyPrefix, when prepended to a key read by a service binding, selects
+	// the value inherited from the service instance.
+	InstanceKeyPrefix = "instance."
+
+	// BindingKeyPrefix, when prepended to a key read by a service binding, selects
+	// the value generated by the service binding, ignoring any inherited value.
+	BindingKeyPrefix = "binding."
+)
+
+// commitAttempts is the maximum number of times a commit is attempted when it
+// conflicts with a concurrent modification.
+const commitAttempts = 5
+
+// copyData returns a shallow copy of secret data.
+func copyData(data map[string][]byte) map[string][]byte {
+	out := make(map[string][]byte, len(data))
+
+	for key, value := range data {
+		out[key] = value
+	}
+
+	return out
 }
 
 // Name returns the name of the registry secret.
@@ -214,7 +535,18 @@ func Name(t Type, name string) string {
 
 // New creates a registry entry, or retrives an existing one.
 func New(t Type, namespace, name string, readOnly bool) (*Entry, error) {
-	resourceName := Name(t, name)
+	return newEntry(namespace, Name(t, name), readOnly)
+}
+
+// NewFromReference retrieves the registry entry a reference, as returned by
+// GetObjectReference, refers to.  This allows an entry to be read and modified
+// independently of the one the reference was taken from, e.g. by a background task.
+func NewFromReference(reference corev1.ObjectReference, readOnly bool) (*Entry, error) {
+	return newEntry(reference.Namespace, reference.Name, readOnly)
+}
+
+// newEntry creates a registry entry, or retrieves an existing one, by resource name.
+func newEntry(namespace, resourceName string, readOnly bool) (*Entry, error) {
 	exists := true
 
 	// Look up an existing config map.
@@ -247,24 +579,108 @@ func New(t Type, namespace, name string, readOnly bool) (*Entry, error) {
 		secret:   secret,
 		exists:   exists,
 		readOnly: readOnly,
+		base:     copyData(secret.Data),
 	}
 
 	return entry, nil
 }
 
+// List returns all existing registry entries of the given type in a namespace.  The
+// entries are read only.
+func List(t Type, namespace string) ([]*Entry, error) {
+	selector := labels.SelectorFromSet(labels.Set{
+		"app": version.Application,
+	})
+
+	secrets, err := config.Clients().Kubernetes().CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := Name(t, "")
+
+	entries := []*Entry{}
+
+	for index := range secrets.Items {
+		secret := &secrets.Items[index]
+
+		if !strings.HasPrefix(secret.Name, prefix) {
+			continue
+		}
+
+		entries = append(entries, &Entry{
+			secret:   secret,
+			exists:   true,
+			readOnly: true,
+		})
+	}
+
+	return entries, nil
+}
+
+// SelfTest checks the registry is usable by writing, reading back and deleting a
+// canary entry.  This detects registries that have silently stopped working, for
+// example because permissions have been revoked.  The canary is named after the
+// caller, so concurrent self tests by different broker replicas do not interfere.
+func SelfTest(namespace, name string) error {
+	const (
+		key   Key    = "canary"
+		value string = "ok"
+	)
+
+	entry, err := New(selfTest, namespace, name, false)
+	if err != nil {
+		return fmt.Errorf("registry read failed: %w", err)
+	}
+
+	if err := entry.Set(key, value); err != nil {
+		return err
+	}
+
+	if err := entry.Commit(); err != nil {
+		return fmt.Errorf("registry write failed: %w", err)
+	}
+
+	readback, err := New(selfTest, namespace, name, false)
+	if err != nil {
+		return fmt.Errorf("registry read failed: %w", err)
+	}
+
+	actual, ok, err := readback.GetString(key)
+	if err != nil {
+		return err
+	}
+
+	if !ok || actual != value {
+		return fmt.Errorf("%w: registry read back unexpected canary value", ErrCorrupt)
+	}
+
+	// The canary may have been cleaned up by someone else, which is fine.
+	if err := readback.Delete(); err != nil && !k8s_errors.IsNotFound(err) {
+		return fmt.Errorf("registry delete failed: %w", err)
+	}
+
+	return nil
+}
+
 // Clone duplicates a registry entry, the clone is read only to allow concurrency
 // while the master copy retains its read/write status.
 func (e *Entry) Clone() *Entry {
 	return &Entry{
-		secret:   e.secret.DeepCopy(),
-		exists:   e.exists,
-		readOnly: true,
+		secret:    e.secret.DeepCopy(),
+		exists:    e.exists,
+		readOnly:  true,
+		inherited: e.inherited,
+		bound:     e.bound,
 	}
 }
 
 // Inherit is used when creating a service binding registry entry.  It gets a copy
 // of all data cached in the service instance.
 func (e *Entry) Inherit(o *Entry) {
+	e.inherited = copyData(o.secret.Data)
+	e.bound = map[string]bool{}
+
 	if o.secret.Data == nil {
 		return
 	}
@@ -283,30 +699,74 @@ func (e *Entry) Exists() bool {
 	return e.exists
 }
 
-// Commit persists the entry transaction to Kubernetes.
+// Commit persists the entry transaction to Kubernetes.  If the entry has been
+// modified concurrently, it is read again and the modifications made since it was
+// last read or committed are reapplied before retrying.
 func (e *Entry) Commit() error {
 	if e.readOnly {
 		return fmt.Errorf("%w: registry entry is read only", ErrPermsission)
 	}
 
-	if e.exists {
-		secret, err := config.Clients().Kubernetes().CoreV1().Secrets(e.secret.Namespace).Update(context.TODO(), e.secret, metav1.UpdateOptions{})
+	if !e.exists {
+		secret, err := config.Clients().Kubernetes().CoreV1().Secrets(e.secret.Namespace).Create(context.TODO(), e.secret, metav1.CreateOptions{})
 		if err != nil {
 			return err
 		}
 
 		e.secret = secret
+		e.exists = true
+		e.base = copyData(secret.Data)
 
 		return nil
 	}
 
-	secret, err := config.Clients().Kubernetes().CoreV1().Secrets(e.secret.Namespace).Create(context.TODO(), e.secret, metav1.CreateOptions{})
+	for attempt := 1; ; attempt++ {
+		secret, err := config.Clients().Kubernetes().CoreV1().Secrets(e.secret.Namespace).Update(context.TODO(), e.secret, metav1.UpdateOptions{})
+		if err == nil {
+			e.secret = secret
+			e.base = copyData(secret.Data)
+
+			return nil
+		}
+
+		if !k8s_errors.IsConflict(err) || attempt == commitAttempts {
+			return err
+		}
+
+		glog.Infof("registry entry %s modified concurrently, retrying commit", e.secret.Name)
+
+		if err := e.rebase(); err != nil {
+			return err
+		}
+	}
+}
+
+// rebase reads the entry from Kubernetes again, and reapplies any modifications
+// made since it was last read or committed.
+func (e *Entry) rebase() error {
+	secret, err := config.Clients().Kubernetes().CoreV1().Secrets(e.secret.Namespace).Get(context.TODO(), e.secret.Name, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
 
+	data := copyData(secret.Data)
+
+	for key, value := range e.secret.Data {
+		if base, ok := e.base[key]; !ok || !bytes.Equal(base, value) {
+			data[key] = value
+		}
+	}
+
+	for key := range e.base {
+		if _, ok := e.secret.Data[key]; !ok {
+			delete(data, key)
+		}
+	}
+
+	e.base = copyData(secret.Data)
+
+	secret.Data = data
 	e.secret = secret
-	e.exists = true
 
 	return nil
 }
@@ -371,11 +831,66 @@ func (e *Entry) Set(key Key, value interface{}) error {
 
 	e.secret.Data[string(key)] = data
 
+	e.markBound(string(key))
+
 	return nil
 }
 
+// markBound records that a key was written by a service binding after inheritance.
+func (e *Entry) markBound(key string) {
+	if e.bound != nil {
+		e.bound[key] = true
+	}
+}
+
+// getScoped gets an inherited, or service binding generated, item.  The scope is
+// selected by the key prefix.
+func (e *Entry) getScoped(key string) (interface{}, bool, error) {
+	if e.inherited == nil {
+		return nil, false, errors.NewConfigurationError("registry key %s may only be read by service bindings", key)
+	}
+
+	var (
+		name string
+		data []byte
+		ok   bool
+	)
+
+	switch {
+	case strings.HasPrefix(key, InstanceKeyPrefix):
+		name = strings.TrimPrefix(key, InstanceKeyPrefix)
+		data, ok = e.inherited[name]
+	case strings.HasPrefix(key, BindingKeyPrefix):
+		name = strings.TrimPrefix(key, BindingKeyPrefix)
+
+		if _, inherited := e.inherited[name]; !inherited || e.bound[name] {
+			data, ok = e.secret.Data[name]
+		}
+	}
+
+	if !isKeyReadable(name) {
+		return nil, false, errors.NewConfigurationError("registry key %s cannot be read", key)
+	}
+
+	if !ok {
+		return nil, false, nil
+	}
+
+	var value interface{}
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, true, err
+	}
+
+	return value, true, nil
+}
+
 // GetUser gets and decodes a JSON object from the registry.
 func (e *Entry) GetUser(key string) (interface{}, bool, error) {
+	if isKeyScoped(key) {
+		return e.getScoped(key)
+	}
+
 	if !isKeyReadable(key) {
 		return "", false, errors.NewConfigurationError("registry key %s cannot be read", key)
 	}
@@ -394,18 +909,79 @@ func (e *Entry) GetUser(key string) (interface{}, bool, error) {
 func (e *Entry) SetUser(key string, value interface{}) error {
 	glog.Infof("setting registry entry %s to %s", key, value)
 
-	if !isKeyWritable(key) {
+	if !isKeyWritable(key) || isKeyScoped(key) {
 		return errors.NewConfigurationError("registry key %s cannot be written", key)
 	}
 
 	return e.Set(Key(key), value)
 }
 
+// SetUsers encodes a JSON object and sets multiple entry items to it.  Either all
+// items are set, or on error none are.
+func (e *Entry) SetUsers(keys []string, value interface{}) error {
+	glog.Infof("setting registry entries %v to %s", keys, value)
+
+	for _, key := range keys {
+		if !isKeyWritable(key) || isKeyScoped(key) {
+			return errors.NewConfigurationError("registry key %s cannot be written", key)
+		}
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	if e.secret.Data == nil {
+		e.secret.Data = map[string][]byte{}
+	}
+
+	for _, key := range keys {
+		e.secret.Data[key] = data
+
+		e.markBound(key)
+	}
+
+	return nil
+}
+
 // Unset removes an item from the entry item.
 func (e *Entry) Unset(key Key) {
 	delete(e.secret.Data, string(key))
 }
 
+// Redact replaces any sensitive values held by the entry that occur in a string, so
+// that it can be safely reported to clients.
+func (e *Entry) Redact(s string) string {
+	for key, data := range e.secret.Data {
+		if !IsKeySensitive(key) {
+			continue
+		}
+
+		var value interface{}
+
+		if err := json.Unmarshal(data, &value); err != nil {
+			continue
+		}
+
+		s = redactValue(s, value)
+	}
+
+	return s
+}
+
+// GetObjectReference returns a reference to the registry entry resource, used to
+// attach events to the service instance or binding.
+func (e *Entry) GetObjectReference() corev1.ObjectReference {
+	return corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Namespace:  e.secret.Namespace,
+		Name:       e.secret.Name,
+		UID:        e.secret.UID,
+	}
+}
+
 // GetOwnerReference returns the owner reference to attach to all resources created
 // referenced by the template binding.
 func (e *Entry) GetOwnerReference() metav1.OwnerReference {
@@ -0,0 +1,319 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-openapi/spec"
+)
+
+// ErrUnsupportedDraft is raised when a schema declares a draft we cannot validate.
+var ErrUnsupportedDraft = errors.New("unsupported JSON schema draft")
+
+// ErrUnsupportedKeyword is raised when a schema uses a keyword we cannot validate.
+var ErrUnsupportedKeyword = errors.New("unsupported JSON schema keyword")
+
+// Draft is a JSON schema draft version.
+type Draft string
+
+const (
+	// Draft04 is JSON schema draft-04, and the default if no $schema is specified.
+	Draft04 Draft = "draft-04"
+
+	// Draft06 is JSON schema draft-06.
+	Draft06 Draft = "draft-06"
+
+	// Draft07 is JSON schema draft-07.
+	Draft07 Draft = "draft-07"
+)
+
+// drafts maps from normalized $schema URIs to draft versions.
+var drafts = map[string]Draft{
+	"json-schema.org/draft-04/schema": Draft04,
+	"json-schema.org/draft-06/schema": Draft06,
+	"json-schema.org/draft-07/schema": Draft07,
+}
+
+// GetDraft returns the draft version declared by a schema's $schema keyword.
+func GetDraft(schema map[string]interface{}) (Draft, error) {
+	value, ok := schema["$schema"]
+	if !ok {
+		return Draft04, nil
+	}
+
+	uri, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: $schema must be a string", ErrUnsupportedDraft)
+	}
+
+	normalized := strings.TrimSuffix(uri, "#")
+	normalized = strings.TrimPrefix(normalized, "http://")
+	normalized = strings.TrimPrefix(normalized, "https://")
+
+	draft, ok := drafts[normalized]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedDraft, uri)
+	}
+
+	return draft, nil
+}
+
+// Parse parses a raw JSON schema.  The underlying validation library only understands
+// draft-04, so later drafts are rewritten into semantically equivalent draft-04 schemas.
+func Parse(raw []byte) (*spec.Schema, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+
+	draft, err := GetDraft(object)
+	if err != nil {
+		return nil, err
+	}
+
+	if draft != Draft04 {
+		translated, err := translate(draft, object)
+		if err != nil {
+			return nil, err
+		}
+
+		object, _ = translated.(map[string]interface{})
+		object["$schema"] = "http://json-schema.org/draft-04/schema#"
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &spec.Schema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+// translateSchemas translates each schema in a list.
+func translateSchemas(draft Draft, list []interface{}) ([]interface{}, error) {
+	result := make([]interface{}, len(list))
+
+	for i, item := range list {
+		translated, err := translate(draft, item)
+		if err != nil {
+			return nil, err
+		}
+
+		result[i] = translated
+	}
+
+	return result, nil
+}
+
+// translateSchemaMap translates each schema in a map.  Values that are not schemas
+// e.g. property dependencies, are left as is.
+func translateSchemaMap(draft Draft, schemas map[string]interface{}) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+
+	for name, item := range schemas {
+		if _, ok := item.([]interface{}); ok {
+			result[name] = item
+			continue
+		}
+
+		translated, err := translate(draft, item)
+		if err != nil {
+			return nil, err
+		}
+
+		result[name] = translated
+	}
+
+	return result, nil
+}
+
+// translate recursively rewrites a draft-06 or draft-07 schema into draft-04.
+func translate(draft Draft, node interface{}) (interface{}, error) {
+	// Boolean schemas match anything, or nothing.
+	if value, ok := node.(bool); ok {
+		if value {
+			return map[string]interface{}{}, nil
+		}
+
+		return map[string]interface{}{"not": map[string]interface{}{}}, nil
+	}
+
+	object, ok := node.(map[string]interface{})
+	if !ok {
+		return node, nil
+	}
+
+	schema := map[string]interface{}{}
+
+	for keyword, value := range object {
+		schema[keyword] = value
+	}
+
+	if _, ok := schema["propertyNames"]; ok {
+		return nil, fmt.Errorf("%w: propertyNames", ErrUnsupportedKeyword)
+	}
+
+	// Translate any sub-schemas.
+	for _, keyword := range []string{"additionalItems", "additionalProperties", "contains", "else", "if", "not", "then"} {
+		if value, ok := schema[keyword]; ok {
+			translated, err := translate(draft, value)
+			if err != nil {
+				return nil, err
+			}
+
+			schema[keyword] = translated
+		}
+	}
+
+	if value, ok := schema["items"]; ok {
+		var err error
+
+		if list, ok := value.([]interface{}); ok {
+			schema["items"], err = translateSchemas(draft, list)
+		} else {
+			schema["items"], err = translate(draft, value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		if value, ok := schema[keyword].([]interface{}); ok {
+			translated, err := translateSchemas(draft, value)
+			if err != nil {
+				return nil, err
+			}
+
+			schema[keyword] = translated
+		}
+	}
+
+	for _, keyword := range []string{"definitions", "dependencies", "patternProperties", "properties"} {
+		if value, ok := schema[keyword].(map[string]interface{}); ok {
+			translated, err := translateSchemaMap(draft, value)
+			if err != nil {
+				return nil, err
+			}
+
+			schema[keyword] = translated
+		}
+	}
+
+	// Any keywords that need rewriting are added as additional constraints.
+	var constraints []interface{}
+
+	if value, ok := schema["const"]; ok {
+		delete(schema, "const")
+
+		constraints = append(constraints, map[string]interface{}{"enum": []interface{}{value}})
+	}
+
+	// Exclusive bounds are numeric, rather than boolean modifiers.
+	for exclusive, inclusive := range map[string]string{"exclusiveMinimum": "minimum", "exclusiveMaximum": "maximum"} {
+		if value, ok := schema[exclusive]; ok {
+			if _, ok := value.(bool); ok {
+				continue
+			}
+
+			delete(schema, exclusive)
+
+			constraints = append(constraints, map[string]interface{}{inclusive: value, exclusive: true})
+		}
+	}
+
+	// The instance must contain at least one item that matches, this only applies to arrays.
+	if value, ok := schema["contains"]; ok {
+		delete(schema, "contains")
+
+		constraints = append(constraints, map[string]interface{}{
+			"anyOf": []interface{}{
+				map[string]interface{}{"not": map[string]interface{}{"type": "array"}},
+				map[string]interface{}{"not": map[string]interface{}{"items": map[string]interface{}{"not": value}}},
+			},
+		})
+	}
+
+	// Conditionals are only defined for draft-07, and are equivalent to
+	// (if AND then) OR (NOT if AND else).
+	if draft == Draft07 {
+		condition, hasIf := schema["if"]
+
+		consequent, ok := schema["then"]
+		if !ok {
+			consequent = map[string]interface{}{}
+		}
+
+		alternative, ok := schema["else"]
+		if !ok {
+			alternative = map[string]interface{}{}
+		}
+
+		delete(schema, "if")
+		delete(schema, "then")
+		delete(schema, "else")
+
+		if hasIf {
+			constraints = append(constraints, map[string]interface{}{
+				"anyOf": []interface{}{
+					map[string]interface{}{"allOf": []interface{}{condition, consequent}},
+					map[string]interface{}{"allOf": []interface{}{map[string]interface{}{"not": condition}, alternative}},
+				},
+			})
+		}
+	}
+
+	if len(constraints) > 0 {
+		allOf, _ := schema["allOf"].([]interface{})
+		schema["allOf"] = append(allOf, constraints...)
+	}
+
+	return schema, nil
+}
+
+// Default fills in any properties of an object that are missing, but have a default
+// defined by the schema.  Properties that are present are recursively defaulted.
+func Default(schema *spec.Schema, value interface{}) interface{} {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+
+	for name := range schema.Properties {
+		property := schema.Properties[name]
+
+		if v, ok := object[name]; ok {
+			object[name] = Default(&property, v)
+
+			continue
+		}
+
+		if property.Default != nil {
+			object[name] = property.Default
+		}
+	}
+
+	return object
+}
@@ -0,0 +1,78 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock abstracts the passage of time, so timeouts and delays can be controlled
+// deterministically by tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the current time once the duration
+	// has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock uses the system time.
+type realClock struct{}
+
+// Now returns the current system time.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for the duration to elapse in system time.
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+var (
+	// SystemClock uses the system time.
+	SystemClock Clock = realClock{}
+
+	// defaultClock is the clock used for operation timeouts and delays.
+	defaultClock = SystemClock
+
+	// defaultClockLock guards the default clock, as it may be replaced while
+	// operations are running.
+	defaultClockLock sync.RWMutex
+)
+
+// DefaultClock returns the clock used for operation timeouts and delays.
+func DefaultClock() Clock {
+	defaultClockLock.RLock()
+	defer defaultClockLock.RUnlock()
+
+	return defaultClock
+}
+
+// SetDefaultClock replaces the clock used for operation timeouts and delays, for
+// example by a test framework.
+func SetDefaultClock(clock Clock) {
+	defaultClockLock.Lock()
+	defer defaultClockLock.Unlock()
+
+	defaultClock = clock
+}
+
+// Sleep pauses the current goroutine for the duration on the default clock.
+func Sleep(d time.Duration) {
+	<-DefaultClock().After(d)
+}
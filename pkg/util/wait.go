@@ -35,8 +35,20 @@ type WaitFunc func() error
 
 // WaitFor waits until a condition is nil.
 func WaitFor(f WaitFunc, timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	return WaitForContext(context.Background(), f, timeout)
+}
+
+// WaitForContext waits until a condition is nil, returning early if the parent
+// context is cancelled.
+func WaitForContext(parent context.Context, f WaitFunc, timeout time.Duration) error {
+	return WaitForClock(parent, SystemClock, f, timeout)
+}
+
+// WaitForClock waits until a condition is nil, returning early if the parent
+// context is cancelled.  The timeout is measured by the supplied clock, while
+// the condition is polled in system time.
+func WaitForClock(parent context.Context, clock Clock, f WaitFunc, timeout time.Duration) error {
+	deadline := clock.After(timeout)
 
 	tick := time.NewTicker(retryPeriod)
 	defer tick.Stop()
@@ -44,7 +56,9 @@ func WaitFor(f WaitFunc, timeout time.Duration) error {
 	for err := f(); err != nil; err = f() {
 		select {
 		case <-tick.C:
-		case <-ctx.Done():
+		case <-parent.Done():
+			return parent.Err()
+		case <-deadline:
 			return fmt.Errorf("%w: failed to wait for condition: %v", ErrTimeout, err)
 		}
 	}
@@ -53,7 +67,7 @@ func WaitFor(f WaitFunc, timeout time.Duration) error {
 }
 
 // MustWaitFor waits until a condition is nil.
-func MustWaitFor(t *testing.T, f WaitFunc, timeout time.Duration) {
+func MustWaitFor(t testing.TB, f WaitFunc, timeout time.Duration) {
 	if err := WaitFor(f, timeout); err != nil {
 		t.Fatal(err)
 	}
@@ -29,6 +29,8 @@ import (
 	goerrors "errors"
 	"fmt"
 	"math/big"
+	"net"
+	"net/url"
 	"strings"
 	"time"
 
@@ -41,6 +43,9 @@ var ErrInvalidPublicKey = goerrors.New("invalid public key")
 // ErrInvalidSubjectAltName is raised when an unsupported SAN is specified.
 var ErrInvalidSubjectAltName = goerrors.New("invalid subject alt name")
 
+// ErrInvalidNameConstraint is raised when an unsupported name constraint is specified.
+var ErrInvalidNameConstraint = goerrors.New("invalid name constraint")
+
 const (
 	// pemTypeRSAPrivateKey is used with PKCS#1 RSA keys.
 	pemTypeRSAPrivateKey = "RSA PRIVATE KEY"
@@ -53,6 +58,9 @@ const (
 
 	// pemTypeCertificate is used with all certificates.
 	pemTypeCertificate = "CERTIFICATE"
+
+	// pemTypePublicKey is used with PKIX public keys.
+	pemTypePublicKey = "PUBLIC KEY"
 )
 
 // KeyType is a private key type.
@@ -292,8 +300,190 @@ func DecodeCertificate(certPEM []byte) (*x509.Certificate, error) {
 	return cert, err
 }
 
-// GenerateCertificate generates and signs an X.509 certificate.
+// DecodeCertificates accepts and parses a PEM formatted certificate chain.
+func DecodeCertificates(certsPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for rest := certsPEM; len(strings.TrimSpace(string(rest))) != 0; {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.NewConfigurationError("unexpected content in PEM file")
+		}
+
+		if block.Type != pemTypeCertificate {
+			return nil, errors.NewConfigurationError("certificate format %s unsupported", block.Type)
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.NewConfigurationError("unable to decode certificate PEM file")
+	}
+
+	return certs, nil
+}
+
+// EncodeCertificates returns a PEM formatted certificate chain.
+func EncodeCertificates(certs []*x509.Certificate) []byte {
+	var data []byte
+
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: pemTypeCertificate, Bytes: cert.Raw})...)
+	}
+
+	return data
+}
+
+// PublicKey accepts a PEM formatted certificate or private key, and returns its PEM
+// formatted public key.
+func PublicKey(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.NewConfigurationError("unable to decode PEM file")
+	}
+
+	var pub interface{}
+
+	if block.Type == pemTypeCertificate {
+		cert, err := DecodeCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+
+		pub = cert.PublicKey
+	} else {
+		key, err := DecodePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%w: private key type %T unsupported", ErrInvalidPublicKey, key)
+		}
+
+		pub = signer.Public()
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypePublicKey, Bytes: der}), nil
+}
+
+// GenerateCertificate generates and signs an X.509 certificate.  If signed by a CA
+// with name constraints, SANs that the constraints do not permit are rejected.
 func GenerateCertificate(keyPEM []byte, cn string, lifetime time.Duration, usage CertificateUsage, sans []string, caKeyPEM, caCertPEM []byte) ([]byte, error) {
+	return generateCertificate(keyPEM, cn, lifetime, usage, sans, nil, caKeyPEM, caCertPEM)
+}
+
+// GenerateCACertificate generates a self-signed X.509 CA certificate that only
+// permits certificates it signs to have SANs within the name constraints.
+// Constraints are defined as "type:name" where type is DNS, for a domain, or IP,
+// for a CIDR.
+func GenerateCACertificate(keyPEM []byte, cn string, lifetime time.Duration, constraints []string) ([]byte, error) {
+	return generateCertificate(keyPEM, cn, lifetime, CA, nil, constraints, nil, nil)
+}
+
+// setNameConstraints adds permitted name constraints to a CA certificate.
+func setNameConstraints(certificate *x509.Certificate, constraints []string) error {
+	for _, constraint := range constraints {
+		requiredFields := 2
+
+		fields := strings.SplitN(constraint, ":", requiredFields)
+		if len(fields) != requiredFields {
+			return fmt.Errorf("%w: malformed name constraint %s", ErrInvalidNameConstraint, constraint)
+		}
+
+		switch fields[0] {
+		case "DNS":
+			certificate.PermittedDNSDomains = append(certificate.PermittedDNSDomains, fields[1])
+		case "IP":
+			_, network, err := net.ParseCIDR(fields[1])
+			if err != nil {
+				return fmt.Errorf("%w: malformed IP name constraint %s", ErrInvalidNameConstraint, constraint)
+			}
+
+			certificate.PermittedIPRanges = append(certificate.PermittedIPRanges, network)
+		default:
+			return fmt.Errorf("%w: unsupported name constraint type %s", ErrInvalidNameConstraint, fields[0])
+		}
+	}
+
+	if len(constraints) != 0 {
+		certificate.PermittedDNSDomainsCritical = true
+	}
+
+	return nil
+}
+
+// dnsNamePermitted checks a DNS name against a permitted DNS domain constraint.  As
+// with X.509 verification, a leading period only matches subdomains, otherwise the
+// domain itself also matches.
+func dnsNamePermitted(name, constraint string) bool {
+	name = strings.ToLower(name)
+	constraint = strings.ToLower(constraint)
+
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+// checkNameConstraints rejects certificate SANs that are not permitted by the name
+// constraints of the signing CA.  Name types the CA does not constrain are permitted.
+func checkNameConstraints(certificate, ca *x509.Certificate) error {
+	if len(ca.PermittedDNSDomains) != 0 {
+		for _, name := range certificate.DNSNames {
+			permitted := false
+
+			for _, constraint := range ca.PermittedDNSDomains {
+				if dnsNamePermitted(name, constraint) {
+					permitted = true
+					break
+				}
+			}
+
+			if !permitted {
+				return errors.NewConfigurationError("DNS SAN %s not permitted by CA name constraints", name)
+			}
+		}
+	}
+
+	if len(ca.PermittedIPRanges) != 0 {
+		for _, ip := range certificate.IPAddresses {
+			permitted := false
+
+			for _, network := range ca.PermittedIPRanges {
+				if network.Contains(ip) {
+					permitted = true
+					break
+				}
+			}
+
+			if !permitted {
+				return errors.NewConfigurationError("IP SAN %s not permitted by CA name constraints", ip)
+			}
+		}
+	}
+
+	return nil
+}
+
+// generateCertificate generates and signs an X.509 certificate, CA certificates
+// may be name constrained.
+func generateCertificate(keyPEM []byte, cn string, lifetime time.Duration, usage CertificateUsage, sans, constraints []string, caKeyPEM, caCertPEM []byte) ([]byte, error) {
 	key, err := DecodePrivateKey(keyPEM)
 	if err != nil {
 		return nil, err
@@ -330,7 +520,7 @@ func GenerateCertificate(keyPEM []byte, cn string, lifetime time.Duration, usage
 		return nil, err
 	}
 
-	notBefore := time.Now()
+	notBefore := DefaultClock().Now()
 	notAfter := notBefore.Add(lifetime)
 
 	certificate := &x509.Certificate{
@@ -343,10 +533,10 @@ func GenerateCertificate(keyPEM []byte, cn string, lifetime time.Duration, usage
 	}
 
 	for _, san := range sans {
-		// A type and a name.
+		// A type and a name.  URIs may contain further colons so only split on the first.
 		requiredFields := 2
 
-		fields := strings.Split(san, ":")
+		fields := strings.SplitN(san, ":", requiredFields)
 		if len(fields) != requiredFields {
 			return nil, fmt.Errorf("%w: malformed SAN %s", ErrInvalidSubjectAltName, san)
 		}
@@ -356,6 +546,20 @@ func GenerateCertificate(keyPEM []byte, cn string, lifetime time.Duration, usage
 			certificate.DNSNames = append(certificate.DNSNames, fields[1])
 		case "EMAIL":
 			certificate.EmailAddresses = append(certificate.EmailAddresses, fields[1])
+		case "IP":
+			ip := net.ParseIP(fields[1])
+			if ip == nil {
+				return nil, fmt.Errorf("%w: malformed IP SAN %s", ErrInvalidSubjectAltName, san)
+			}
+
+			certificate.IPAddresses = append(certificate.IPAddresses, ip)
+		case "URI":
+			uri, err := url.Parse(fields[1])
+			if err != nil || uri.Scheme == "" {
+				return nil, fmt.Errorf("%w: malformed URI SAN %s", ErrInvalidSubjectAltName, san)
+			}
+
+			certificate.URIs = append(certificate.URIs, uri)
 		default:
 			return nil, fmt.Errorf("%w unsupported SAN type %s", ErrInvalidSubjectAltName, fields[0])
 		}
@@ -365,6 +569,10 @@ func GenerateCertificate(keyPEM []byte, cn string, lifetime time.Duration, usage
 	case CA:
 		certificate.IsCA = true
 		certificate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+		if err := setNameConstraints(certificate, constraints); err != nil {
+			return nil, err
+		}
 	case Server:
 		certificate.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
 		certificate.ExtKeyUsage = []x509.ExtKeyUsage{
@@ -393,6 +601,10 @@ func GenerateCertificate(keyPEM []byte, cn string, lifetime time.Duration, usage
 		if err != nil {
 			return nil, err
 		}
+
+		if err := checkNameConstraints(certificate, caCert); err != nil {
+			return nil, err
+		}
 	}
 
 	cert, err := x509.CreateCertificate(rand.Reader, certificate, caCert, req.PublicKey, caKey)
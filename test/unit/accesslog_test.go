@@ -0,0 +1,206 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/accesslog"
+	"github.com/couchbase/service-broker/pkg/api"
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/test/unit/fixtures"
+	"github.com/couchbase/service-broker/test/unit/util"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// mustSetAccessLog directs access log records to a temporary file, returning its path
+// and a function to restore the default configuration.
+func mustSetAccessLog(t *testing.T, rates map[string]float64) (string, func()) {
+	file, err := ioutil.TempFile("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	restore := util.SetOptions(func(o *config.Options) {
+		o.AccessLog = file.Name()
+		o.AccessLogSampleRates = rates
+	})
+
+	return file.Name(), func() {
+		restore()
+
+		os.Remove(file.Name())
+	}
+}
+
+// mustReadAccessLog reads all the records from an access log.
+func mustReadAccessLog(t *testing.T, path string) []accesslog.Record {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	records := []accesslog.Record{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := accesslog.Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+// countAccessLogRoute returns the number of access log records for a route.
+func countAccessLogRoute(records []accesslog.Record, route accesslog.Route) int {
+	count := 0
+
+	for _, record := range records {
+		if record.Route == route {
+			count++
+		}
+	}
+
+	return count
+}
+
+// TestAccessLogSampling tests that mutating requests are always logged, while poll
+// requests are not logged when their sample rate is zero.
+func TestAccessLogSampling(t *testing.T) {
+	defer mustReset(t)
+
+	path, cleanup := mustSetAccessLog(t, map[string]float64{
+		string(accesslog.RoutePoll): 0,
+	})
+	defer cleanup()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+	util.MustDeleteServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	records := mustReadAccessLog(t, path)
+
+	util.Assert(t, countAccessLogRoute(records, accesslog.RoutePoll) == 0)
+	util.Assert(t, countAccessLogRoute(records, accesslog.RouteMutating) == 2)
+
+	for _, record := range records {
+		if record.Route != accesslog.RouteMutating {
+			continue
+		}
+
+		if record.Method != http.MethodPut && record.Method != http.MethodDelete {
+			t.Fatalf("unexpected mutating request %s", record.Method)
+		}
+
+		if record.Status != http.StatusAccepted || !strings.HasPrefix(record.URI, "/v2/service_instances/"+fixtures.ServiceInstanceName) {
+			t.Fatalf("unexpected access log record %v", record)
+		}
+	}
+}
+
+// TestAccessLogSamplingRate tests that poll requests are logged at roughly the
+// configured sample rate.
+func TestAccessLogSamplingRate(t *testing.T) {
+	defer mustReset(t)
+
+	// Retain the operation so it can be polled repeatedly.
+	defer util.SetOptions(func(o *config.Options) {
+		o.OperationRetention = time.Minute
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+
+	path, cleanup := mustSetAccessLog(t, map[string]float64{
+		string(accesslog.RoutePoll): 0.25,
+	})
+	defer cleanup()
+
+	polls := 200
+
+	for i := 0; i < polls; i++ {
+		util.MustGet(t, util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, nil)
+	}
+
+	// The expected count is 50, allow plenty of room for randomness.
+	count := countAccessLogRoute(mustReadAccessLog(t, path), accesslog.RoutePoll)
+	if count < 20 || count > 80 {
+		t.Fatalf("expected around 50 of %d polls to be logged, got %d", polls, count)
+	}
+}
+
+// TestAccessLogBodies tests that request bodies are logged with sensitive values
+// redacted.
+func TestAccessLogBodies(t *testing.T) {
+	defer mustReset(t)
+
+	path, cleanup := mustSetAccessLog(t, nil)
+	defer cleanup()
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.AccessLogBodies = true
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"size":3,"adminPassword":"hunter2"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	for _, record := range mustReadAccessLog(t, path) {
+		if record.Method != http.MethodPut {
+			continue
+		}
+
+		body := &api.CreateServiceInstanceRequest{}
+		if err := json.Unmarshal(record.Body, body); err != nil {
+			t.Fatal(err)
+		}
+
+		util.Assert(t, body.ServiceID == req.ServiceID)
+		util.Assert(t, string(body.Parameters.Raw) == `{"adminPassword":"<redacted>","size":3}`)
+
+		return
+	}
+
+	t.Fatal("create request not logged")
+}
@@ -16,10 +16,45 @@ package unit_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
-
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/api"
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/broker"
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/pkg/version"
+	"github.com/couchbase/service-broker/test/unit/fixtures"
 	"github.com/couchbase/service-broker/test/unit/util"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// requestIdentity is a platform supplied request identity.
+	requestIdentity = "2ba0b3b4-6c7e-4b4a-9b1c-9d7c7a5e6f10"
+
+	// certificateExpiryWindow is how long before expiry a certificate is considered
+	// not ready.
+	certificateExpiryWindow = 24 * time.Hour
 )
 
 // TestReadiness tests a TLS readiness probe succeeds with no other headers.
@@ -52,6 +87,641 @@ func TestReadinessUnconfigured(t *testing.T) {
 	util.MustCreateServiceBrokerConfig(t, clients, util.DefaultBrokerConfig)
 }
 
+// TestReadinessCertificateExpiring tests readiness fails when the TLS certificate
+// expires within the configured window.
+func TestReadinessCertificateExpiring(t *testing.T) {
+	defer mustReset(t)
+
+	// Readiness also depends on the broker being configured.
+	util.MustWaitFor(t, util.ServerRunning, time.Minute)
+
+	token := util.Token
+
+	configuration := &broker.ServerConfiguration{
+		Namespace:               util.Namespace,
+		Token:                   &token,
+		Certificate:             util.MustGenerateServerCertificate(t, time.Hour),
+		CertificateExpiryWindow: certificateExpiryWindow,
+	}
+
+	request := util.MustBasicRequest(t, http.MethodGet, "/readyz")
+
+	response := httptest.NewRecorder()
+	broker.NewOpenServiceBrokerHandler(configuration).ServeHTTP(response, request)
+
+	util.Assert(t, response.Code == http.StatusServiceUnavailable)
+
+	// Outside of the window, the certificate is fine.
+	configuration.CertificateExpiryWindow = time.Minute
+
+	response = httptest.NewRecorder()
+	broker.NewOpenServiceBrokerHandler(configuration).ServeHTTP(response, request)
+
+	util.Assert(t, response.Code == http.StatusOK)
+}
+
+// TestReadinessRegistrySelfTest tests readiness fails, with a descriptive reason,
+// when the registry self test fails.
+func TestReadinessRegistrySelfTest(t *testing.T) {
+	defer mustReset(t)
+
+	// Readiness also depends on the broker being configured.
+	util.MustWaitFor(t, util.ServerRunning, time.Minute)
+
+	token := util.Token
+
+	configuration := &broker.ServerConfiguration{
+		Namespace:   util.Namespace,
+		Token:       &token,
+		Certificate: util.MustGenerateServerCertificate(t, time.Hour),
+	}
+
+	if err := broker.SelfTestRegistry(configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	request := util.MustBasicRequest(t, http.MethodGet, "/readyz")
+
+	response := httptest.NewRecorder()
+	broker.NewOpenServiceBrokerHandler(configuration).ServeHTTP(response, request)
+
+	util.Assert(t, response.Code == http.StatusOK)
+
+	util.MustFailSecretCreate(t, clients)
+
+	if err := broker.SelfTestRegistry(configuration); err == nil {
+		t.Fatal("expected registry self test to fail")
+	}
+
+	response = httptest.NewRecorder()
+	broker.NewOpenServiceBrokerHandler(configuration).ServeHTTP(response, request)
+
+	util.Assert(t, response.Code == http.StatusServiceUnavailable)
+
+	body := response.Body.String()
+
+	util.Assert(t, strings.Contains(body, "[+]certificate ok"))
+	util.Assert(t, strings.Contains(body, "[-]registry failed: registry write failed"))
+}
+
+// TestReadinessRegistrySelfTestPerReplica tests that the registry self test canary is
+// named after the broker replica, so it does not interfere with another replica's
+// self test that is in flight.
+func TestReadinessRegistrySelfTestPerReplica(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.LockIdentity = "replica-a"
+	})()
+
+	// Simulate another replica's canary, written but not yet read back.
+	canary := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "registry-self-test-replica-b",
+		},
+	}
+
+	if _, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Create(context.TODO(), canary, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = clients.Kubernetes().CoreV1().Secrets(util.Namespace).Delete(context.TODO(), canary.Name, metav1.DeleteOptions{})
+	}()
+
+	token := util.Token
+
+	configuration := &broker.ServerConfiguration{
+		Namespace: util.Namespace,
+		Token:     &token,
+	}
+
+	if err := broker.SelfTestRegistry(configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Get(context.TODO(), canary.Name, metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Get(context.TODO(), "registry-self-test-replica-a", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Fatalf("expected canary to be deleted, got %v", err)
+	}
+}
+
+// TestResponseCompression tests that large responses are gzip compressed when the
+// client accepts it, and decompress to the uncompressed response.
+func TestResponseCompression(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	client := util.MustDefaultClient(t)
+
+	request := util.MustDefaultRequest(t, http.MethodGet, "/v2/catalog")
+	request.Header.Set("Accept-Encoding", "identity")
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusOK)
+	util.Assert(t, response.Header.Get("Content-Encoding") == "")
+
+	expected, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, len(expected) >= util.ResponseCompressionThreshold)
+
+	request = util.MustDefaultRequest(t, http.MethodGet, "/v2/catalog")
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	response = util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusOK)
+	util.Assert(t, response.Header.Get("Content-Encoding") == "gzip")
+
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, bytes.Equal(actual, expected))
+
+	catalog := &api.ServiceCatalog{}
+	if err := json.Unmarshal(actual, catalog); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, len(catalog.Services) != 0)
+}
+
+// TestResponseCompressionSmall tests that small responses are not compressed.
+func TestResponseCompressionSmall(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	request := util.MustDefaultRequest(t, http.MethodGet, "/v2/unknown")
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	client := util.MustDefaultClient(t)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusNotFound)
+	util.Assert(t, response.Header.Get("Content-Encoding") == "")
+
+	apiError := &api.Error{}
+	if err := json.NewDecoder(response.Body).Decode(apiError); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustGetCatalogBody reads the raw catalog response body, checking that the content
+// type and length are correct.
+func mustGetCatalogBody(t *testing.T) []byte {
+	request := util.MustDefaultRequest(t, http.MethodGet, "/v2/catalog")
+	request.Header.Set("Accept-Encoding", "identity")
+
+	client := util.MustDefaultClient(t)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusOK)
+	util.Assert(t, response.Header.Get("Content-Type") == "application/json")
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, response.ContentLength == int64(len(body)))
+
+	return body
+}
+
+// TestPrettyJSON tests that responses are compact by default, and indented when
+// pretty printing is enabled, without changing their content.
+func TestPrettyJSON(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	compact := mustGetCatalogBody(t)
+	util.Assert(t, !bytes.Contains(compact, []byte("\n")))
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.PrettyJSON = true
+	})()
+
+	pretty := mustGetCatalogBody(t)
+	util.Assert(t, bytes.Contains(pretty, []byte("\n  \"services\": [")))
+
+	indented := &bytes.Buffer{}
+	if err := json.Indent(indented, compact, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, bytes.Equal(indented.Bytes(), pretty))
+}
+
+// TestUnknownRoute tests that requests for unknown paths are reported as an API
+// error.
+func TestUnknownRoute(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	request := util.MustDefaultRequest(t, http.MethodGet, "/v2/unknown")
+	client := util.MustDefaultClient(t)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusNotFound)
+
+	apiError := &api.Error{}
+	if err := json.NewDecoder(response.Body).Decode(apiError); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, apiError.Error == api.ErrorResourceNotFound)
+}
+
+// TestUnsupportedMethod tests that requests for known paths with an unsupported
+// method are reported as an API error, and the supported methods are advertised.
+func TestUnsupportedMethod(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	request := util.MustDefaultRequest(t, http.MethodPost, "/v2/catalog")
+	client := util.MustDefaultClient(t)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusMethodNotAllowed)
+
+	allow := response.Header.Get("Allow")
+	util.Assert(t, strings.Contains(allow, http.MethodGet))
+	util.Assert(t, !strings.Contains(allow, http.MethodPost))
+
+	apiError := &api.Error{}
+	if err := json.NewDecoder(response.Body).Decode(apiError); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, apiError.Error == api.ErrorMethodNotAllowed)
+}
+
+// mustWriteCertificate writes a PEM encoded certificate and key to disk, returning
+// the DER encoded leaf certificate.
+func mustWriteCertificate(t *testing.T, certificatePath, privateKeyPath string) []byte {
+	cert, key := util.MustGenerateServerCertificatePEM(t, time.Hour)
+
+	if err := ioutil.WriteFile(certificatePath, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(privateKeyPath, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate.Certificate[0]
+}
+
+// mustGetPeerCertificate connects to a TLS server and returns the DER encoded leaf
+// certificate that it presents.
+func mustGetPeerCertificate(t *testing.T, address string) []byte {
+	// We are only interested in what is presented, not whether it's trusted.
+	config := &tls.Config{
+		InsecureSkipVerify: true, // nolint:gosec
+	}
+
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].Raw
+}
+
+// TestTLSCertificateReload tests a certificate loaded from disk is reloaded when
+// rotated, without restarting the server.
+func TestTLSCertificateReload(t *testing.T) {
+	defer mustReset(t)
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	certificatePath := filepath.Join(dir, "tls-certificate")
+	privateKeyPath := filepath.Join(dir, "tls-private-key")
+
+	initial := mustWriteCertificate(t, certificatePath, privateKeyPath)
+
+	token := util.Token
+
+	configuration := &broker.ServerConfiguration{
+		Namespace:       util.Namespace,
+		Token:           &token,
+		CertificatePath: certificatePath,
+		PrivateKeyPath:  privateKeyPath,
+	}
+
+	tlsConfig, err := broker.NewTLSConfig(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{
+		Handler: broker.NewOpenServiceBrokerHandler(configuration),
+	}
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	defer server.Close()
+
+	util.Assert(t, bytes.Equal(mustGetPeerCertificate(t, listener.Addr().String()), initial))
+
+	rotated := mustWriteCertificate(t, certificatePath, privateKeyPath)
+
+	util.Assert(t, bytes.Equal(mustGetPeerCertificate(t, listener.Addr().String()), rotated))
+}
+
+// TestMutualTLS tests clients are authenticated by certificate, and that the verified
+// client certificate is available to templates during provisioning.
+func TestMutualTLS(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].SynchronousTimeout = &metav1.Duration{Duration: time.Minute}
+	configuration.Bindings[0].ServiceInstance.Annotations = []v1.RegistryValue{
+		{
+			Name:  "example.com/provisioned-by",
+			Value: `{{` + string(fixtures.NewPipeline(fixtures.Registry(string(registry.ClientCertificateSubject)))) + `}}`,
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	pool, clientCertificate := util.MustGenerateClientCertificate(t, "platform")
+
+	certificate, err := tls.X509KeyPair([]byte(util.Cert), []byte(util.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfiguration := &broker.ServerConfiguration{
+		Namespace:   util.Namespace,
+		ClientCAs:   pool,
+		Certificate: certificate,
+	}
+
+	tlsConfig, err := broker.NewTLSConfig(serverConfiguration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "localhost:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{
+		Handler: broker.NewOpenServiceBrokerHandler(serverConfiguration),
+	}
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(fixtures.BasicServiceInstanceCreateRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRequest := func() *http.Request {
+		request, err := http.NewRequest(http.MethodPut, "https://localhost:"+port+util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request.Header.Set("X-Broker-API-Version", "2.13")
+		request.Header.Set("Content-Type", "application/json")
+
+		return request
+	}
+
+	// Clients without a certificate are rejected.
+	util.MustNotDoRequest(t, util.MustDefaultClient(t), newRequest())
+
+	client := util.MustDefaultClient(t)
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{
+		clientCertificate,
+	}
+
+	response := util.MustDoRequest(t, client, newRequest())
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusCreated)
+
+	leaf, err := x509.ParseCertificate(clientCertificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixtures.AssertFixtureFieldSet(t, clients, leaf.Subject.String(), "metadata", "annotations", "example.com/provisioned-by")
+}
+
+// openAPIDocument is the subset of an OpenAPI document we verify.
+type openAPIDocument struct {
+	OpenAPI    string                            `json:"openapi"`
+	Paths      map[string]map[string]interface{} `json:"paths"`
+	Components struct {
+		Schemas map[string]json.RawMessage `json:"schemas"`
+	} `json:"components"`
+}
+
+// TestOpenAPI tests the OpenAPI document is served without authentication, and
+// describes the API.
+func TestOpenAPI(t *testing.T) {
+	defer mustReset(t)
+
+	request := util.MustBasicRequest(t, http.MethodGet, "/openapi.json")
+	client := util.MustDefaultClient(t)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusOK)
+
+	document := &openAPIDocument{}
+	if err := json.NewDecoder(response.Body).Decode(document); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, strings.HasPrefix(document.OpenAPI, "3."))
+
+	expected := map[string][]string{
+		"/v2/catalog":                                                       {"get"},
+		"/v2/service_instances/{instance_id}":                               {"put", "get", "patch", "delete"},
+		"/v2/service_instances/{instance_id}/last_operation":                {"get"},
+		"/v2/service_instances/{instance_id}/service_bindings/{binding_id}": {"put", "get", "delete"},
+		"/v2/registry": {"get", "put"},
+	}
+
+	for path, methods := range expected {
+		for _, method := range methods {
+			if _, ok := document.Paths[path][method]; !ok {
+				t.Fatalf("expected %s %s to be documented", method, path)
+			}
+		}
+	}
+
+	for _, name := range []string{"ServiceCatalog", "CreateServiceInstanceRequest", "CreateServiceBindingRequest", "Error"} {
+		if _, ok := document.Components.Schemas[name]; !ok {
+			t.Fatalf("expected schema %s to be documented", name)
+		}
+	}
+}
+
+// TestOpenAPIRoutes tests every route served by the broker, with all optional
+// routes enabled, is described by the OpenAPI document.
+func TestOpenAPIRoutes(t *testing.T) {
+	defer mustReset(t)
+
+	token := util.Token
+
+	configuration := &broker.ServerConfiguration{
+		Namespace:      util.Namespace,
+		Token:          &token,
+		RegistryBackup: true,
+		Version:        true,
+	}
+
+	request := util.MustBasicRequest(t, http.MethodGet, "/openapi.json")
+
+	response := httptest.NewRecorder()
+	broker.NewOpenServiceBrokerHandler(configuration).ServeHTTP(response, request)
+
+	util.Assert(t, response.Code == http.StatusOK)
+
+	document := &openAPIDocument{}
+	if err := json.Unmarshal(response.Body.Bytes(), document); err != nil {
+		t.Fatal(err)
+	}
+
+	// Path parameters are ":name" to the router, and "{name}" to OpenAPI.
+	parameter := regexp.MustCompile(`:([^/]+)`)
+
+	for _, route := range broker.Routes(configuration) {
+		path := parameter.ReplaceAllString(route.Path, "{$1}")
+
+		if _, ok := document.Paths[path][strings.ToLower(route.Method)]; !ok {
+			t.Fatalf("expected %s %s to be documented", route.Method, path)
+		}
+	}
+}
+
+// TestOpenAPIRegistryBackupDisabled tests registry endpoints are not documented
+// when they are not enabled.
+func TestOpenAPIRegistryBackupDisabled(t *testing.T) {
+	defer mustReset(t)
+
+	token := util.Token
+
+	configuration := &broker.ServerConfiguration{
+		Namespace: util.Namespace,
+		Token:     &token,
+	}
+
+	request := util.MustBasicRequest(t, http.MethodGet, "/openapi.json")
+
+	response := httptest.NewRecorder()
+	broker.NewOpenServiceBrokerHandler(configuration).ServeHTTP(response, request)
+
+	util.Assert(t, response.Code == http.StatusOK)
+
+	document := &openAPIDocument{}
+	if err := json.Unmarshal(response.Body.Bytes(), document); err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok := document.Paths["/v2/registry"]
+	util.Assert(t, !ok)
+}
+
+// TestVersion tests the version endpoint reports the service broker version, build
+// information and a hash of the configuration.
+func TestVersion(t *testing.T) {
+	defer mustReset(t)
+
+	application, release, commit := version.Application, version.Version, version.GitCommit
+
+	defer func() {
+		version.Application, version.Version, version.GitCommit = application, release, commit
+	}()
+
+	version.Application = "service-broker"
+	version.Version = "1.2.3"
+	version.GitCommit = "0123456789abcdef"
+
+	rsp := &api.Version{}
+	util.MustGet(t, "/version", http.StatusOK, rsp)
+	util.Assert(t, rsp.Application == "service-broker")
+	util.Assert(t, rsp.Version == "1.2.3")
+	util.Assert(t, rsp.GitCommit == "0123456789abcdef")
+	util.Assert(t, len(rsp.ConfigurationHash) == 64)
+
+	if _, err := time.ParseDuration(rsp.Uptime); err != nil {
+		t.Fatal(err)
+	}
+
+	// The configuration hash changes with the configuration.
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Description = "a modified test offering"
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	modified := &api.Version{}
+	util.MustGet(t, "/version", http.StatusOK, modified)
+	util.Assert(t, modified.ConfigurationHash != rsp.ConfigurationHash)
+}
+
 // TestConnect tests basic connection to the service broker.
 func TestConnect(t *testing.T) {
 	defer mustReset(t)
@@ -78,6 +748,56 @@ func TestConnectNoTLS(t *testing.T) {
 	util.MustNotDoRequest(t, client, request)
 }
 
+// TestConnectInsecureHTTP tests that the server responds over plain HTTP when TLS
+// is disabled.
+func TestConnectInsecureHTTP(t *testing.T) {
+	defer mustReset(t)
+
+	token := util.Token
+
+	configuration := &broker.ServerConfiguration{
+		Namespace:    util.Namespace,
+		Token:        &token,
+		InsecureHTTP: true,
+	}
+
+	// Listen on an ephemeral port, closing the listener stops the server.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+
+	go func() {
+		_ = broker.Serve(configuration, listener)
+
+		close(stopped)
+	}()
+
+	defer func() {
+		listener.Close()
+		<-stopped
+	}()
+
+	address := listener.Addr().String()
+
+	util.MustWaitFor(t, util.InsecureServerRunning(address), time.Minute)
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+address+"/v2/catalog", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request.Header.Set("X-Broker-API-Version", "2.13")
+	request.Header.Set("Authorization", "Bearer "+util.Token)
+
+	response := util.MustDoRequest(t, http.DefaultClient, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusOK)
+}
+
 // TestConnectNoAPIVersion tests that the X-Broker-API-Version header is required
 // by the broker.
 // https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#api-version-header
@@ -301,3 +1021,205 @@ func TestConnectInvalidContentType(t *testing.T) {
 
 	util.MustVerifyStatusCode(t, response, http.StatusBadRequest)
 }
+
+// TestConnectRequestIdentity tests that the request identity header is echoed back
+// to the client.
+func TestConnectRequestIdentity(t *testing.T) {
+	defer mustReset(t)
+
+	request := util.MustDefaultRequest(t, http.MethodGet, "/v2/catalog")
+	request.Header.Set("X-Broker-API-Request-Identity", requestIdentity)
+
+	client := util.MustDefaultClient(t)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusOK)
+	util.Assert(t, response.Header.Get("X-Broker-API-Request-Identity") == requestIdentity)
+}
+
+// TestConnectRequestIdentityGenerated tests that a request identity is generated
+// when the client does not supply one.
+func TestConnectRequestIdentityGenerated(t *testing.T) {
+	defer mustReset(t)
+
+	request := util.MustDefaultRequest(t, http.MethodGet, "/v2/catalog")
+	client := util.MustDefaultClient(t)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusOK)
+	util.Assert(t, response.Header.Get("X-Broker-API-Request-Identity") != "")
+}
+
+// TestAuthorizationReadOnly tests that a read only principal may read resources, but
+// is forbidden from modifying them.
+func TestAuthorizationReadOnly(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	client := util.MustDefaultClient(t)
+
+	request := util.MustDefaultRequest(t, http.MethodGet, "/v2/catalog")
+	request.Header.Set("Authorization", "Bearer "+util.ReadOnlyToken)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusOK)
+
+	body, err := json.Marshal(fixtures.BasicServiceInstanceCreateRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request = util.MustDefaultRequestWithBody(t, http.MethodPut, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), bytes.NewBuffer(body))
+	request.Header.Set("Authorization", "Bearer "+util.ReadOnlyToken)
+
+	response = util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusForbidden)
+
+	apiError := &api.Error{}
+	if err := json.NewDecoder(response.Body).Decode(apiError); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, apiError.Error == api.ErrorForbidden)
+	util.Assert(t, apiError.Description != "")
+
+	// Once created by an authorized principal, the service instance can be read.
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	request = util.MustDefaultRequest(t, http.MethodGet, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil))
+	request.Header.Set("Authorization", "Bearer "+util.ReadOnlyToken)
+
+	response = util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusOK)
+}
+
+// TestAuthorizationRegistryPrivileged tests that a wildcard policy rule does not allow
+// access to the registry, it must be named explicitly.
+func TestAuthorizationRegistryPrivileged(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	client := util.MustDefaultClient(t)
+
+	request := util.MustDefaultRequest(t, http.MethodGet, util.RegistryURI())
+	request.Header.Set("Authorization", "Bearer "+util.ReadOnlyToken)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusForbidden)
+}
+
+// TestAuthorizationPolicy tests that the first matching policy rule decides whether
+// a request is allowed, and that requests matching no rules are denied.
+func TestAuthorizationPolicy(t *testing.T) {
+	policy := &broker.AuthorizationPolicy{
+		Rules: []broker.AuthorizationRule{
+			{
+				Principals: []string{"auditor"},
+				Actions:    []string{"*"},
+				Resources:  []string{string(broker.AuthorizationResourceRegistry)},
+				Allow:      false,
+			},
+			{
+				Principals: []string{"auditor"},
+				Actions:    []string{string(broker.AuthorizationActionRead)},
+				Resources:  []string{"*"},
+				Allow:      true,
+			},
+		},
+	}
+
+	cases := []struct {
+		request *broker.AuthorizationRequest
+		allowed bool
+	}{
+		{
+			request: &broker.AuthorizationRequest{Principal: "auditor", Action: broker.AuthorizationActionRead, Resource: broker.AuthorizationResourceServiceInstance},
+			allowed: true,
+		},
+		{
+			request: &broker.AuthorizationRequest{Principal: "auditor", Action: broker.AuthorizationActionRead, Resource: broker.AuthorizationResourceRegistry},
+			allowed: false,
+		},
+		{
+			request: &broker.AuthorizationRequest{Principal: "auditor", Action: broker.AuthorizationActionCreate, Resource: broker.AuthorizationResourceServiceInstance},
+			allowed: false,
+		},
+		{
+			request: &broker.AuthorizationRequest{Principal: "stranger", Action: broker.AuthorizationActionRead, Resource: broker.AuthorizationResourceCatalog},
+			allowed: false,
+		},
+	}
+
+	for _, c := range cases {
+		allowed, err := policy.Authorize(c.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if allowed != c.allowed {
+			t.Fatalf("expected %v for %v, got %v", c.allowed, c.request, allowed)
+		}
+	}
+}
+
+// TestRegistration tests that the service broker registers itself with the service
+// catalog, and that registration updates an existing registration.
+func TestRegistration(t *testing.T) {
+	defer mustReset(t)
+
+	token := util.Token
+
+	configuration := &broker.ServerConfiguration{
+		Namespace: util.Namespace,
+		Token:     &token,
+		Registration: &broker.Registration{
+			Name:       "test-broker",
+			URL:        "https://test-broker.default.svc",
+			CABundle:   []byte(util.CA),
+			SecretName: "test-broker-credentials",
+		},
+	}
+
+	if err := broker.Register(clients, configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	// Registration is idempotent, updating the existing registration.
+	configuration.Registration.URL = "https://test-broker.other.svc"
+
+	if err := broker.Register(clients, configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := clients.Dynamic().Resource(broker.ClusterServiceBrokerResource).Get(context.TODO(), "test-broker", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url, _, _ := unstructured.NestedString(object.Object, "spec", "url")
+	util.Assert(t, url == "https://test-broker.other.svc")
+
+	caBundle, _, _ := unstructured.NestedString(object.Object, "spec", "caBundle")
+	util.Assert(t, caBundle == base64.StdEncoding.EncodeToString([]byte(util.CA)))
+
+	secretName, _, _ := unstructured.NestedString(object.Object, "spec", "authInfo", "bearer", "secretRef", "name")
+	util.Assert(t, secretName == "test-broker-credentials")
+
+	secretNamespace, _, _ := unstructured.NestedString(object.Object, "spec", "authInfo", "bearer", "secretRef", "namespace")
+	util.Assert(t, secretNamespace == util.Namespace)
+}
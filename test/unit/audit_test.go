@@ -0,0 +1,327 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unit_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/api"
+	"github.com/couchbase/service-broker/pkg/audit"
+	"github.com/couchbase/service-broker/pkg/broker"
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/test/unit/fixtures"
+	"github.com/couchbase/service-broker/test/unit/util"
+)
+
+// mustSetAuditLog directs audit records to a temporary file, returning its path and
+// a function to restore the default configuration.
+func mustSetAuditLog(t *testing.T) (string, func()) {
+	file, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	restore := util.SetOptions(func(o *config.Options) {
+		o.AuditLog = file.Name()
+	})
+
+	return file.Name(), func() {
+		restore()
+
+		os.Remove(file.Name())
+	}
+}
+
+// mustReadAuditLog reads all the records from an audit log.
+func mustReadAuditLog(t *testing.T, path string) []audit.Record {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	records := []audit.Record{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := audit.Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+// mustWaitForAuditLog waits for an audit log to contain the expected number of records,
+// as the completion of an asynchronous operation is audited after it can be polled.
+func mustWaitForAuditLog(t *testing.T, path string, count int) []audit.Record {
+	var records []audit.Record
+
+	util.MustWaitFor(t, func() error {
+		records = mustReadAuditLog(t, path)
+		if len(records) != count {
+			return fmt.Errorf("expected %d audit records, got %d", count, len(records))
+		}
+
+		return nil
+	}, time.Minute)
+
+	return records
+}
+
+// TestAuditLog tests that each mutating API call produces exactly one audit record
+// with the expected fields, that read only calls are not audited, and that asynchronous
+// operations are audited again with their outcome once they complete.
+func TestAuditLog(t *testing.T) {
+	defer mustReset(t)
+
+	path, cleanup := mustSetAuditLog(t)
+	defer cleanup()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+	util.MustUpdateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, fixtures.BasicServiceInstanceUpdateRequest())
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
+	util.MustDeleteServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
+	util.MustDeleteServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	expected := []audit.Record{
+		{
+			Action:  audit.ActionCreateServiceInstance,
+			Outcome: audit.OutcomeAccepted,
+		},
+		{
+			Action:  audit.ActionUpdateServiceInstance,
+			Outcome: audit.OutcomeAccepted,
+		},
+		{
+			Action:    audit.ActionCreateServiceBinding,
+			BindingID: fixtures.ServiceBindingName,
+			Outcome:   audit.OutcomeSucceeded,
+		},
+		{
+			Action:    audit.ActionDeleteServiceBinding,
+			BindingID: fixtures.ServiceBindingName,
+			Outcome:   audit.OutcomeSucceeded,
+		},
+		{
+			Action:  audit.ActionDeleteServiceInstance,
+			Outcome: audit.OutcomeAccepted,
+		},
+	}
+
+	// Each asynchronous operation is audited again when it completes.
+	completed := map[audit.Action]bool{
+		audit.ActionCreateServiceInstance: true,
+		audit.ActionUpdateServiceInstance: true,
+		audit.ActionDeleteServiceInstance: true,
+	}
+
+	records := mustWaitForAuditLog(t, path, len(expected)+len(completed))
+
+	requests := []audit.Record{}
+	operations := map[audit.Action]string{}
+
+	for _, record := range records {
+		util.Assert(t, record.InstanceID == fixtures.ServiceInstanceName)
+		util.Assert(t, record.ServiceID == fixtures.BasicConfigurationOfferingID)
+		util.Assert(t, record.PlanID == fixtures.BasicConfigurationPlanID)
+		util.Assert(t, record.Principal == util.TokenPrincipal)
+		util.Assert(t, !record.Timestamp.IsZero())
+
+		if record.Status == 0 {
+			util.Assert(t, completed[record.Action])
+			util.Assert(t, record.Outcome == audit.OutcomeSucceeded)
+			util.Assert(t, record.OperationID != "")
+
+			operations[record.Action] = record.OperationID
+
+			continue
+		}
+
+		requests = append(requests, record)
+	}
+
+	if len(requests) != len(expected) {
+		t.Fatalf("expected %d request audit records, got %d: %v", len(expected), len(requests), requests)
+	}
+
+	for i, record := range requests {
+		util.Assert(t, record.Action == expected[i].Action)
+		util.Assert(t, record.Outcome == expected[i].Outcome)
+		util.Assert(t, record.BindingID == expected[i].BindingID)
+
+		// Accepted requests are correlated with the completion of the operation.
+		if completed[record.Action] {
+			util.Assert(t, record.OperationID == operations[record.Action])
+		}
+	}
+}
+
+// TestAuditLogRequestIdentity tests that the request identity is recorded in audit
+// records and completion webhooks, so platform and broker logs can be correlated.
+func TestAuditLogRequestIdentity(t *testing.T) {
+	defer mustReset(t)
+
+	path, cleanup := mustSetAuditLog(t)
+	defer cleanup()
+
+	receiver := &completionWebhook{}
+
+	defer mustSetCompletionWebhook(receiver, 1)()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	body, err := json.Marshal(fixtures.BasicServiceInstanceCreateRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := util.MustDefaultRequestWithBody(t, http.MethodPut, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), bytes.NewBuffer(body))
+	request.Header.Set("X-Broker-API-Request-Identity", requestIdentity)
+
+	client := util.MustDefaultClient(t)
+
+	response := util.MustDoRequest(t, client, request)
+	defer response.Body.Close()
+
+	util.MustVerifyStatusCode(t, response, http.StatusAccepted)
+	util.Assert(t, response.Header.Get("X-Broker-API-Request-Identity") == requestIdentity)
+
+	rsp := &api.CreateServiceInstanceResponse{}
+	if err := json.NewDecoder(response.Body).Decode(rsp); err != nil {
+		t.Fatal(err)
+	}
+
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+
+	records := mustWaitForAuditLog(t, path, 2)
+
+	util.Assert(t, records[0].RequestIdentity == requestIdentity)
+	util.Assert(t, records[1].RequestIdentity == requestIdentity)
+
+	receiver.mustWaitForAttempts(t, 1)
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+
+	if len(receiver.completions) != 1 {
+		t.Fatalf("expected 1 completion, got %d", len(receiver.completions))
+	}
+
+	util.Assert(t, receiver.completions[0].RequestIdentity == requestIdentity)
+}
+
+// TestAuditLogReconcile tests that service instance reconciliation requests are audited.
+func TestAuditLogReconcile(t *testing.T) {
+	defer mustReset(t)
+
+	path, cleanup := mustSetAuditLog(t)
+	defer cleanup()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	util.MustPost(t, util.ServiceInstanceReconcileURI(fixtures.ServiceInstanceName), http.StatusOK, nil, &api.ReconcileServiceInstanceResponse{})
+
+	// Creation is audited when accepted and when completed.
+	reconciled := 0
+
+	for _, record := range mustWaitForAuditLog(t, path, 3) {
+		if record.Action != audit.ActionReconcileServiceInstance {
+			continue
+		}
+
+		util.Assert(t, record.InstanceID == fixtures.ServiceInstanceName)
+		util.Assert(t, record.Outcome == audit.OutcomeSucceeded)
+
+		reconciled++
+	}
+
+	util.Assert(t, reconciled == 1)
+}
+
+// TestAuditLogClientIP tests that the client IP address is taken from forwarding
+// headers when the peer is a trusted proxy, and ignored otherwise.
+func TestAuditLogClientIP(t *testing.T) {
+	defer mustReset(t)
+
+	path, cleanup := mustSetAuditLog(t)
+	defer cleanup()
+
+	token := util.Token
+
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configuration := &broker.ServerConfiguration{
+		Namespace:      util.Namespace,
+		Token:          &token,
+		TrustedProxies: []*net.IPNet{proxies},
+	}
+
+	handler := broker.NewOpenServiceBrokerHandler(configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	uri := util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.DeleteServiceInstanceQuery(req))
+
+	// The first request is from a trusted proxy, the second is from an untrusted
+	// client attempting to spoof its address.
+	peers := []string{"10.0.0.1:443", "192.168.0.1:443"}
+
+	for _, peer := range peers {
+		request := util.MustDefaultRequest(t, http.MethodDelete, uri)
+		request.RemoteAddr = peer
+		request.Header.Set("X-Forwarded-For", "172.16.0.1, 10.0.0.2")
+
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	records := mustReadAuditLog(t, path)
+	if len(records) != len(peers) {
+		t.Fatalf("expected %d audit records, got %d: %v", len(peers), len(records), records)
+	}
+
+	util.Assert(t, records[0].ClientIP == "172.16.0.1")
+	util.Assert(t, records[1].ClientIP == "192.168.0.1")
+}
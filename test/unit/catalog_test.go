@@ -22,7 +22,11 @@ import (
 
 	"github.com/couchbase/service-broker/pkg/api"
 	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/broker"
+	"github.com/couchbase/service-broker/test/unit/fixtures"
 	"github.com/couchbase/service-broker/test/unit/util"
+
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 var (
@@ -60,3 +64,286 @@ func TestCatalogUpdate(t *testing.T) {
 	}
 	util.MustWaitFor(t, validator, time.Minute)
 }
+
+// TestCatalogOverlay tests that a catalog overlay patches the catalog served by the
+// broker, and that provisioning is unaffected.
+func TestCatalogOverlay(t *testing.T) {
+	defer mustReset(t)
+
+	catalogOverlay.Services = []broker.CatalogOverlayService{
+		{
+			ID:   fixtures.BasicConfigurationOfferingID,
+			Tags: []string{"overlay"},
+			Plans: []broker.CatalogOverlayPlan{
+				{
+					ID: fixtures.BasicConfigurationPlanID,
+					Metadata: map[string]interface{}{
+						"displayName": "Renamed Plan",
+					},
+				},
+			},
+		},
+	}
+
+	defer func() {
+		catalogOverlay.Services = nil
+	}()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	catalog := &api.ServiceCatalog{}
+	util.MustGet(t, "/v2/catalog", http.StatusOK, catalog)
+
+	service := catalog.Services[0]
+	util.Assert(t, len(service.Tags) == 1 && service.Tags[0] == "overlay")
+
+	metadata, ok := service.Plans[0].Metadata.(map[string]interface{})
+	util.Assert(t, ok && metadata["displayName"] == "Renamed Plan")
+	util.Assert(t, service.Plans[1].Metadata == nil)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+}
+
+// fragmentConfiguration returns a configuration fragment that contributes a service
+// offering, with the requested ID, to the service broker configuration.
+func fragmentConfiguration(offeringID string) *v1.ServiceBrokerConfigSpec {
+	return &v1.ServiceBrokerConfigSpec{
+		Catalog: v1.ServiceCatalog{
+			Services: []v1.ServiceOffering{
+				{
+					Name:        "fragment-offering",
+					ID:          offeringID,
+					Description: "a fragment offering",
+					Plans: []v1.ServicePlan{
+						{
+							Name:        "fragment-plan",
+							ID:          "e2b1a5b6-6c61-4d4b-8d8b-3a4cf5b1c0de",
+							Description: "a fragment plan",
+						},
+					},
+				},
+			},
+		},
+		Bindings: []v1.ConfigurationBinding{
+			{
+				Name:    "fragment-binding",
+				Service: "fragment-offering",
+				Plan:    "fragment-plan",
+				ServiceInstance: v1.ServiceBrokerTemplateList{
+					Registry: []v1.RegistryValue{
+						{
+							Name:  "fragment",
+							Value: "true",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// TestCatalogFragments tests that configuration fragments contribute service offerings
+// to the catalog, and that a fragment that conflicts with the service broker configuration
+// is rejected without affecting it.
+func TestCatalogFragments(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	util.MustCreateBrokerConfigFragment(t, clients, "fragment", fragmentConfiguration("5c2e3b1a-8f0d-4c7e-9a8b-6d4f2e1c0b9a"), v1.ConditionTrue)
+
+	defer util.MustDeleteBrokerConfigFragment(t, clients, "fragment")
+
+	catalog := &api.ServiceCatalog{}
+	util.MustGet(t, "/v2/catalog", http.StatusOK, catalog)
+	util.Assert(t, len(catalog.Services) == 2)
+	util.Assert(t, catalog.Services[0].Name == "test-offering")
+	util.Assert(t, catalog.Services[1].Name == "fragment-offering")
+
+	// A second fragment with a duplicate service offering ID must be rejected.
+	util.MustCreateBrokerConfigFragment(t, clients, "fragment-conflict", fragmentConfiguration(fixtures.BasicConfigurationOfferingID), v1.ConditionFalse)
+
+	defer util.MustDeleteBrokerConfigFragment(t, clients, "fragment-conflict")
+
+	catalog = &api.ServiceCatalog{}
+	util.MustGet(t, "/v2/catalog", http.StatusOK, catalog)
+	util.Assert(t, len(catalog.Services) == 2)
+}
+
+// TestCatalogPlanCosts tests that the free flag and structured cost metadata are
+// reported in the catalog.
+func TestCatalogPlanCosts(t *testing.T) {
+	defer mustReset(t)
+
+	free := false
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Free = &free
+	configuration.Catalog.Services[0].Plans[0].Metadata = &runtime.RawExtension{
+		Raw: []byte(`{"displayName":"Test Plan"}`),
+	}
+	configuration.Catalog.Services[0].Plans[0].CostMetadata = []v1.ServicePlanCost{
+		{
+			Amount: map[string]string{
+				"usd": "9.99",
+			},
+			Unit: "MONTHLY",
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	catalog := &api.ServiceCatalog{}
+	util.MustGet(t, "/v2/catalog", http.StatusOK, catalog)
+
+	plan := catalog.Services[0].Plans[0]
+	util.Assert(t, plan.Free != nil && !*plan.Free)
+
+	metadata, ok := plan.Metadata.(map[string]interface{})
+	util.Assert(t, ok)
+	util.Assert(t, metadata["displayName"] == "Test Plan")
+
+	costs, ok := metadata["costs"].([]interface{})
+	util.Assert(t, ok)
+	util.Assert(t, len(costs) == 1)
+
+	cost, ok := costs[0].(map[string]interface{})
+	util.Assert(t, ok)
+	util.Assert(t, cost["unit"] == "MONTHLY")
+
+	amount, ok := cost["amount"].(map[string]interface{})
+	util.Assert(t, ok)
+	util.Assert(t, amount["usd"] == 9.99)
+}
+
+// TestCatalogPlanCostsInvalid tests that malformed cost metadata is rejected.
+func TestCatalogPlanCostsInvalid(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].CostMetadata = []v1.ServicePlanCost{
+		{
+			Amount: map[string]string{
+				"usd": "lots",
+			},
+			Unit: "MONTHLY",
+		},
+	}
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
+}
+
+// TestCatalogDashboardClient tests that a dashboard client is reported in the catalog,
+// with its secret read from a Kubernetes secret.
+func TestCatalogDashboardClient(t *testing.T) {
+	defer mustReset(t)
+
+	mustCreateSecret(t, util.Namespace, sourceResourceName, key, value)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].DashboardClient = &v1.DashboardClient{
+		ID: "dashboard",
+		SecretRef: &v1.DashboardClientSecretRef{
+			Name: sourceResourceName,
+			Key:  key,
+		},
+		RedirectedURI: "https://dashboard.example.com/callback",
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	catalog := map[string]interface{}{}
+	util.MustGet(t, "/v2/catalog", http.StatusOK, &catalog)
+
+	services, ok := catalog["services"].([]interface{})
+	util.Assert(t, ok && len(services) > 0)
+
+	service, ok := services[0].(map[string]interface{})
+	util.Assert(t, ok)
+
+	client, ok := service["dashboard_client"].(map[string]interface{})
+	util.Assert(t, ok)
+	util.Assert(t, client["id"] == "dashboard")
+	util.Assert(t, client["secret"] == value)
+	util.Assert(t, client["redirect_uri"] == "https://dashboard.example.com/callback")
+}
+
+// TestCatalogDashboardClientInvalidRedirectURI tests that a dashboard client with a
+// relative redirect URI is rejected.
+func TestCatalogDashboardClientInvalidRedirectURI(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].DashboardClient = &v1.DashboardClient{
+		ID:            "dashboard",
+		Secret:        value,
+		RedirectedURI: "/callback",
+	}
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
+}
+
+// TestCatalogPlanBindableOverride tests that the catalog reports the effective bindable
+// value for each plan, with a plan override taking precedence over the offering.
+func TestCatalogPlanBindableOverride(t *testing.T) {
+	defer mustReset(t)
+
+	bindable := false
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Bindable = &bindable
+	configuration.Bindings[0].ServiceBinding = nil
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	catalog := &api.ServiceCatalog{}
+	util.MustGet(t, "/v2/catalog", http.StatusOK, catalog)
+
+	util.Assert(t, catalog.Services[0].Bindable)
+	util.Assert(t, catalog.Services[0].Plans[0].Bindable != nil && !*catalog.Services[0].Plans[0].Bindable)
+	util.Assert(t, catalog.Services[0].Plans[1].Bindable != nil && *catalog.Services[0].Plans[1].Bindable)
+}
+
+// TestCatalogFilterTag tests that the catalog can be filtered by service offering tag.
+func TestCatalogFilterTag(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Tags = []string{"database", "nosql"}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	catalog := &api.ServiceCatalog{}
+	util.MustGet(t, "/v2/catalog?tag=database&tag=nosql", http.StatusOK, catalog)
+	util.Assert(t, len(catalog.Services) == 1)
+	util.Assert(t, len(catalog.Services[0].Plans) == 2)
+
+	catalog = &api.ServiceCatalog{}
+	util.MustGet(t, "/v2/catalog?tag=database&tag=cache", http.StatusOK, catalog)
+	util.Assert(t, len(catalog.Services) == 0)
+}
+
+// TestCatalogFilterBindable tests that the catalog can be filtered by the effective
+// plan bindable flag, omitting plans that do not match.
+func TestCatalogFilterBindable(t *testing.T) {
+	defer mustReset(t)
+
+	bindable := false
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Bindable = &bindable
+	configuration.Bindings[0].ServiceBinding = nil
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	catalog := &api.ServiceCatalog{}
+	util.MustGet(t, "/v2/catalog?bindable=true", http.StatusOK, catalog)
+	util.Assert(t, len(catalog.Services) == 1)
+	util.Assert(t, len(catalog.Services[0].Plans) == 1)
+	util.Assert(t, catalog.Services[0].Plans[0].ID == fixtures.BasicConfigurationPlanID2)
+
+	catalog = &api.ServiceCatalog{}
+	util.MustGet(t, "/v2/catalog?bindable=false&service_name=test-offering", http.StatusOK, catalog)
+	util.Assert(t, len(catalog.Services) == 1)
+	util.Assert(t, len(catalog.Services[0].Plans) == 1)
+	util.Assert(t, catalog.Services[0].Plans[0].ID == fixtures.BasicConfigurationPlanID)
+}
+
+// TestCatalogFilterIllegal tests that malformed catalog filters are rejected.
+func TestCatalogFilterIllegal(t *testing.T) {
+	util.MustGetAndError(t, "/v2/catalog?bindable=maybe", http.StatusBadRequest, api.ErrorQueryError)
+}
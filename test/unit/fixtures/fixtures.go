@@ -62,6 +62,14 @@ const (
 	// BasicSchemaParametersRequired is a simple schema for use in parameter validation.
 	BasicSchemaParametersRequired = `{"$schema":"http://json-schema.org/draft-04/schema#","type":"object","required":["test"],"properties":{"test":{"type":"number","minimum":1}}}`
 
+	// Draft07SchemaParameters is a schema that uses conditional and constant keywords
+	// that are ignored by draft-04.  Premium tiers require at least 3 replicas, other
+	// tiers allow at most 1.
+	Draft07SchemaParameters = `{"$schema":"http://json-schema.org/draft-07/schema#","type":"object","properties":{"tier":{"enum":["basic","premium"]},"replicas":{"type":"integer"},"version":{"const":"7.0"}},"if":{"properties":{"tier":{"const":"premium"}},"required":["tier"]},"then":{"required":["replicas"],"properties":{"replicas":{"minimum":3}}},"else":{"properties":{"replicas":{"maximum":1}}}}`
+
+	// UnsupportedDraftSchemaParameters is a schema using a draft that is not supported.
+	UnsupportedDraftSchemaParameters = `{"$schema":"https://json-schema.org/draft/2020-12/schema","type":"object"}`
+
 	// DashboardURL is the expected dashboard URL to be generated.
 	DashboardURL = "http://instance-" + ServiceInstanceName + "." + util.Namespace + ".svc"
 
@@ -326,6 +334,23 @@ func BasicConfigurationWithReadiness() *v1.ServiceBrokerConfigSpec {
 	return configuration
 }
 
+// BasicConfigurationWithBindingReadiness returns the standard configuration with a readiness
+// check added to service binding creation for the resource that is templated by the service
+// instance.
+func BasicConfigurationWithBindingReadiness() *v1.ServiceBrokerConfigSpec {
+	configuration := BasicConfiguration()
+
+	checks := []v1.ConfigurationReadinessCheck{}
+
+	for _, check := range basicReadinessChecks {
+		checks = append(checks, *check.DeepCopy())
+	}
+
+	configuration.Bindings[0].ServiceBinding.ReadinessChecks = checks
+
+	return configuration
+}
+
 // BasicSchema is schema for service instance create validation with optional parameters.
 func BasicSchema() *v1.Schemas {
 	return basicSchema.DeepCopy()
@@ -341,6 +366,20 @@ func BasicSchemaBindingRequired() *v1.Schemas {
 	return basicSchemaBindingRequired.DeepCopy()
 }
 
+// ServiceInstanceCreateSchema returns a schema for service instance create validation
+// with the provided raw schema.
+func ServiceInstanceCreateSchema(schema string) *v1.Schemas {
+	return &v1.Schemas{
+		ServiceInstance: &v1.ServiceInstanceSchema{
+			Create: &v1.InputParamtersSchema{
+				Parameters: &runtime.RawExtension{
+					Raw: []byte(schema),
+				},
+			},
+		},
+	}
+}
+
 // BasicServiceInstanceCreateRequest is the absolute minimum valid service instance create
 // request to use against the basicConfiguration.
 func BasicServiceInstanceCreateRequest() *api.CreateServiceInstanceRequest {
@@ -432,7 +471,13 @@ var (
 
 // MustSetFixtureField sets the named field in the fixture Kubernetes resource.
 func MustSetFixtureField(t *testing.T, clients client.Clients, value interface{}, path ...string) {
-	object, err := clients.Dynamic().Resource(fixtureGVR).Namespace(util.Namespace).Get(context.TODO(), "instance-"+ServiceInstanceName, metav1.GetOptions{})
+	MustSetInstanceFixtureField(t, clients, ServiceInstanceName, value, path...)
+}
+
+// MustSetInstanceFixtureField sets the named field in the fixture Kubernetes resource
+// created by the named service instance.
+func MustSetInstanceFixtureField(t *testing.T, clients client.Clients, instance string, value interface{}, path ...string) {
+	object, err := clients.Dynamic().Resource(fixtureGVR).Namespace(util.Namespace).Get(context.TODO(), "instance-"+instance, metav1.GetOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -446,10 +491,57 @@ func MustSetFixtureField(t *testing.T, clients client.Clients, value interface{}
 	}
 }
 
+// MustCreateForeignFixture creates the fixture Kubernetes resource, owned by another
+// service instance, before the service instance is provisioned.
+func MustCreateForeignFixture(t *testing.T, clients client.Clients, owner string) {
+	MustCreateOwnedFixture(t, clients, metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Name:       registry.Name(registry.ServiceInstance, owner),
+	})
+}
+
+// MustCreateOwnedFixture creates the fixture Kubernetes resource, with the given owner,
+// before the service instance is provisioned.
+func MustCreateOwnedFixture(t *testing.T, clients client.Clients, owner metav1.OwnerReference) {
+	object := &unstructured.Unstructured{}
+	object.SetAPIVersion("v1")
+	object.SetKind("Pod")
+	object.SetName("instance-" + ServiceInstanceName)
+	object.SetOwnerReferences([]metav1.OwnerReference{
+		owner,
+	})
+
+	if _, err := clients.Dynamic().Resource(fixtureGVR).Namespace(util.Namespace).Create(context.TODO(), object, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// MustGetFixtureField returns the named field in the Kubernetes resource.
+func MustGetFixtureField(t *testing.T, clients client.Clients, path ...string) interface{} {
+	object, err := clients.Dynamic().Resource(fixtureGVR).Namespace(util.Namespace).Get(context.TODO(), "instance-"+ServiceInstanceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, ok, _ := unstructured.NestedFieldCopy(object.Object, path...)
+	if !ok {
+		t.Fatal("path not found in fixture")
+	}
+
+	return value
+}
+
 // AssertFixtureFieldSet asserts that the named field in the Kubernetes resource is
 // set as expected.
 func AssertFixtureFieldSet(t *testing.T, clients client.Clients, value interface{}, path ...string) {
-	object, err := clients.Dynamic().Resource(fixtureGVR).Namespace(util.Namespace).Get(context.TODO(), "instance-"+ServiceInstanceName, metav1.GetOptions{})
+	AssertNamedFixtureFieldSet(t, clients, "instance-"+ServiceInstanceName, value, path...)
+}
+
+// AssertNamedFixtureFieldSet asserts that the named field in the named Kubernetes
+// resource is set as expected.
+func AssertNamedFixtureFieldSet(t *testing.T, clients client.Clients, name string, value interface{}, path ...string) {
+	object, err := clients.Dynamic().Resource(fixtureGVR).Namespace(util.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -476,3 +568,10 @@ func AssertFixtureFieldNotSet(t *testing.T, clients client.Clients, path ...stri
 		t.Fatal("path found in fixture")
 	}
 }
+
+// AssertFixtureDeleted asserts that the fixture Kubernetes resource does not exist.
+func AssertFixtureDeleted(t *testing.T, clients client.Clients) {
+	if _, err := clients.Dynamic().Resource(fixtureGVR).Namespace(util.Namespace).Get(context.TODO(), "instance-"+ServiceInstanceName, metav1.GetOptions{}); err == nil {
+		t.Fatal("fixture exists")
+	}
+}
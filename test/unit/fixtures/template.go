@@ -63,12 +63,36 @@ func NewParameterPipeline(arg interface{}) Pipeline {
 	return NewPipeline(Parameter(arg))
 }
 
+// NewQueryParameterPipeline creates a pipeline initialized with a query parameter
+// lookup function.
+func NewQueryParameterPipeline(name interface{}) Pipeline {
+	return NewPipeline(QueryParameter(name))
+}
+
+// NewSecretPipeline creates a pipeline initialized with a secret lookup
+// function.
+func NewSecretPipeline(name, key, namespace interface{}) Pipeline {
+	return NewPipeline(Secret(name, key, namespace))
+}
+
+// NewConfigMapPipeline creates a pipeline initialized with a config map lookup
+// function.
+func NewConfigMapPipeline(name, key, namespace interface{}) Pipeline {
+	return NewPipeline(ConfigMap(name, key, namespace))
+}
+
 // NewGeneratePasswordPipeline creates a pipeline initialized with a generate
 // password function.
 func NewGeneratePasswordPipeline(length, dictionary interface{}) Pipeline {
 	return NewPipeline(GeneratePassword(length, dictionary))
 }
 
+// NewGenerateTokenPipeline creates a pipeline initialized with a generate token
+// function.
+func NewGenerateTokenPipeline(length interface{}) Pipeline {
+	return NewPipeline(GenerateToken(length))
+}
+
 // NewGeneratePrivateKeyPipeline creates a pipeline initialized with a generate
 // private key function.
 func NewGeneratePrivateKeyPipeline(typ, encoding, bits interface{}) Pipeline {
@@ -81,6 +105,17 @@ func NewGenerateCertificatePipeline(key, cn, lifetime, usage, sans, caKey, caCer
 	return NewPipeline(GenerateCertificate(key, cn, lifetime, usage, sans, caKey, caCert))
 }
 
+// NewGenerateCACertificatePipeline creates a pipeline initialized with a generate
+// CA certificate function.
+func NewGenerateCACertificatePipeline(key, cn, lifetime, constraints interface{}) Pipeline {
+	return NewPipeline(GenerateCACertificate(key, cn, lifetime, constraints))
+}
+
+// NewNowPipeline creates a pipeline initialized with a current time function.
+func NewNowPipeline(layout, offset interface{}) Pipeline {
+	return NewPipeline(Now(layout, offset))
+}
+
 // With appends a function to a pipeline.
 func (p Pipeline) With(fn Function) Pipeline {
 	if p == "" {
@@ -101,6 +136,12 @@ func (p Pipeline) Required() Pipeline {
 	return p.With(Required())
 }
 
+// RequiredIf appends a function to a pipeline that raises an error if the
+// condition holds and the input is nil.
+func (p Pipeline) RequiredIf(condition interface{}) Pipeline {
+	return p.With(RequiredIf(condition))
+}
+
 // Function represents a named function that accepts an arbitrary number
 // of arguments.
 // https://golang.org/pkg/text/template/#hdr-Functions
@@ -134,11 +175,67 @@ func Parameter(arg interface{}) Function {
 	return NewFunction("parameter", arg)
 }
 
+// PreviousParameter returns a function that looks up a parameter from before the
+// last update.
+func PreviousParameter(arg interface{}) Function {
+	return NewFunction("previousParameter", arg)
+}
+
+// QueryParameter returns a function that looks up a request query parameter.
+func QueryParameter(name interface{}) Function {
+	return NewFunction("queryParameter", name)
+}
+
+// Broker returns a function that looks up a broker environment value.
+func Broker(name interface{}) Function {
+	return NewFunction("broker", name)
+}
+
+// Lookup returns a function that maps its input with a lookup table.
+func Lookup(name interface{}) Function {
+	return NewFunction("lookup", name)
+}
+
+// Secret returns a function that looks up a secret key.
+func Secret(name, key, namespace interface{}) Function {
+	return NewFunction("secret", name, key, namespace)
+}
+
+// ConfigMap returns a function that looks up a config map key.
+func ConfigMap(name, key, namespace interface{}) Function {
+	return NewFunction("configMap", name, key, namespace)
+}
+
 // GeneratePassword returns a function that generates a random password string.
 func GeneratePassword(length, dictionary interface{}) Function {
 	return NewFunction("generatePassword", length, dictionary)
 }
 
+// GenerateToken returns a function that generates a random bearer token.
+func GenerateToken(length interface{}) Function {
+	return NewFunction("generateToken", length)
+}
+
+// SHA256 returns a function that generates a SHA-256 digest of its input.
+func SHA256() Function {
+	return NewFunction("sha256")
+}
+
+// Fingerprint returns a function that generates the SHA-256 fingerprint of a certificate.
+func Fingerprint() Function {
+	return NewFunction("fingerprint")
+}
+
+// NotAfter returns a function that returns the expiry time of a certificate.
+func NotAfter() Function {
+	return NewFunction("notAfter")
+}
+
+// PublicKey returns a function that returns the public key of a certificate or private key.
+func PublicKey() Function {
+	return NewFunction("publicKey")
+}
+
 // GeneratePrivateKey returns a function that generates a private key.
 func GeneratePrivateKey(typ, encoding, bits interface{}) Function {
 	return NewFunction("generatePrivateKey", typ, encoding, bits)
@@ -149,12 +246,49 @@ func GenerateCertificate(key, cn, lifetime, usage, sans, caKey, caCert interface
 	return NewFunction("generateCertificate", key, cn, lifetime, usage, sans, caKey, caCert)
 }
 
+// GenerateCACertificate generates a function that creates a name constrained CA
+// certificate.
+func GenerateCACertificate(key, cn, lifetime, constraints interface{}) Function {
+	return NewFunction("generateCACertificate", key, cn, lifetime, constraints)
+}
+
+// Now generates a function that returns the current time.
+func Now(layout, offset interface{}) Function {
+	return NewFunction("now", layout, offset)
+}
+
 // Default generates a function that returns a default if the input it nil.
 func Default(arg interface{}) Function {
 	return NewFunction("default", arg)
 }
 
+// Clamp returns a function that constrains a numeric input to a range.
+func Clamp(min, max interface{}) Function {
+	return NewFunction("clamp", min, max)
+}
+
 // Required returns a function that raises an error if the input is nil.
 func Required() Function {
 	return NewFunction(`required`)
 }
+
+// RequiredIf returns a function that raises an error if the condition holds and
+// the input is nil.
+func RequiredIf(condition interface{}) Function {
+	return NewFunction("requiredIf", condition)
+}
+
+// Eq returns a function that compares its arguments for equality.
+func Eq(a, b interface{}) Function {
+	return NewFunction("eq", a, b)
+}
+
+// Join returns a function that joins a list of strings with a separator.
+func Join(separator interface{}) Function {
+	return NewFunction("join", separator)
+}
+
+// Split returns a function that splits a string into a list with a separator.
+func Split(separator interface{}) Function {
+	return NewFunction("split", separator)
+}
@@ -0,0 +1,374 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/api"
+	"github.com/couchbase/service-broker/pkg/broker"
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/lock"
+	"github.com/couchbase/service-broker/pkg/registry"
+	"github.com/couchbase/service-broker/test/unit/fixtures"
+	"github.com/couchbase/service-broker/test/unit/util"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// replicaA is the identity of the first simulated broker replica.
+	replicaA = "replica-a"
+
+	// replicaB is the identity of the second simulated broker replica.
+	replicaB = "replica-b"
+)
+
+// enableLocking enables service instance locking, returning a function to
+// restore the default configuration.
+func enableLocking() func() {
+	return util.SetOptions(func(o *config.Options) {
+		o.LockLeaseDuration = time.Second
+	})
+}
+
+// mustCreateLease creates a service instance lease held by another broker replica.
+func mustCreateLease(t *testing.T, instanceID, holder string, renewTime time.Time) {
+	duration := int32(1)
+	renew := metav1.NewMicroTime(renewTime)
+
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: lock.LeaseName(instanceID),
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &renew,
+			RenewTime:            &renew,
+		},
+	}
+
+	if _, err := clients.Kubernetes().CoordinationV1().Leases(util.Namespace).Create(context.TODO(), lease, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustDeleteLease deletes a service instance lease.
+func mustDeleteLease(t *testing.T, instanceID string) {
+	if err := clients.Kubernetes().CoordinationV1().Leases(util.Namespace).Delete(context.TODO(), lock.LeaseName(instanceID), metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+		t.Fatal(err)
+	}
+}
+
+// mustTakeOverLease simulates another broker replica taking over a service instance lease.
+func mustTakeOverLease(t *testing.T, instanceID, holder string) {
+	leases := clients.Kubernetes().CoordinationV1().Leases(util.Namespace)
+
+	lease, err := leases.Get(context.TODO(), lock.LeaseName(instanceID), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease.Spec.HolderIdentity = &holder
+
+	if _, err := leases.Update(context.TODO(), lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// leaseDeleted returns a function that checks whether a service instance lease
+// has been released.
+func leaseDeleted(instanceID string) func() error {
+	return func() error {
+		if _, err := clients.Kubernetes().CoordinationV1().Leases(util.Namespace).Get(context.TODO(), lock.LeaseName(instanceID), metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+			return errors.New("lease still held")
+		}
+
+		return nil
+	}
+}
+
+// TestLockContention tests that two broker replicas contending for the same service
+// instance are mutually excluded.
+func TestLockContention(t *testing.T) {
+	defer mustReset(t)
+	defer enableLocking()()
+	defer mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	var holders int
+
+	var holdersMutex sync.Mutex
+
+	var wg sync.WaitGroup
+
+	contend := func(holder string) {
+		defer wg.Done()
+
+		for i := 0; i < 10; i++ {
+			l, err := lock.Acquire(util.Namespace, fixtures.ServiceInstanceName, holder)
+			for errors.Is(err, lock.ErrLockHeld) {
+				time.Sleep(time.Millisecond)
+
+				l, err = lock.Acquire(util.Namespace, fixtures.ServiceInstanceName, holder)
+			}
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			holdersMutex.Lock()
+			holders++
+			exclusive := holders == 1
+			holdersMutex.Unlock()
+
+			if !exclusive {
+				t.Error("lock held by multiple replicas")
+			}
+
+			time.Sleep(time.Millisecond)
+
+			holdersMutex.Lock()
+			holders--
+			holdersMutex.Unlock()
+
+			l.Release()
+		}
+	}
+
+	wg.Add(2)
+
+	go contend(replicaA)
+	go contend(replicaB)
+
+	wg.Wait()
+}
+
+// TestLockRenewal tests that a lock held for longer than the lease duration is
+// renewed, so is not taken over by another broker replica.
+func TestLockRenewal(t *testing.T) {
+	defer mustReset(t)
+	defer enableLocking()()
+	defer mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	l, err := lock.Acquire(util.Namespace, fixtures.ServiceInstanceName, replicaA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * config.GetOptions().LockLeaseDuration)
+
+	if _, err := lock.Acquire(util.Namespace, fixtures.ServiceInstanceName, replicaB); !errors.Is(err, lock.ErrLockHeld) {
+		t.Fatalf("expected lock to be held, got %v", err)
+	}
+
+	l.Release()
+
+	util.MustWaitFor(t, leaseDeleted(fixtures.ServiceInstanceName), time.Minute)
+}
+
+// TestLockTakeover tests that a lease that has not been renewed, e.g. because the
+// broker replica holding it crashed, is taken over.
+func TestLockTakeover(t *testing.T) {
+	defer mustReset(t)
+	defer enableLocking()()
+	defer mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	mustCreateLease(t, fixtures.ServiceInstanceName, replicaA, time.Now().Add(-time.Hour))
+
+	l, err := lock.Acquire(util.Namespace, fixtures.ServiceInstanceName, replicaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err := clients.Kubernetes().CoordinationV1().Leases(util.Namespace).Get(context.TODO(), lock.LeaseName(fixtures.ServiceInstanceName), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == replicaB)
+
+	l.Release()
+}
+
+// TestLockServiceInstance tests that a service instance cannot be modified while
+// another broker replica holds its lock, and that the lock is released once an
+// asynchronous operation completes.
+func TestLockServiceInstance(t *testing.T) {
+	defer mustReset(t)
+	defer enableLocking()()
+	defer mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.LockIdentity = replicaA
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	mustCreateLease(t, fixtures.ServiceInstanceName, replicaB, time.Now())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusUnprocessableEntity, req, api.ErrorConcurrencyError)
+
+	mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+	util.MustWaitFor(t, leaseDeleted(fixtures.ServiceInstanceName), time.Minute)
+}
+
+// TestLockTakeoverClock tests that lease expiry is measured by the service broker's
+// clock.
+func TestLockTakeoverClock(t *testing.T) {
+	defer mustReset(t)
+	defer enableLocking()()
+	defer mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	clock, restore := util.UseFakeClock()
+	defer restore()
+
+	mustCreateLease(t, fixtures.ServiceInstanceName, replicaA, clock.Now())
+
+	if _, err := lock.Acquire(util.Namespace, fixtures.ServiceInstanceName, replicaB); !errors.Is(err, lock.ErrLockHeld) {
+		t.Fatalf("expected lock to be held, got %v", err)
+	}
+
+	clock.Advance(2 * config.GetOptions().LockLeaseDuration)
+
+	l, err := lock.Acquire(util.Namespace, fixtures.ServiceInstanceName, replicaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Release()
+}
+
+// TestLockLost tests that a lock whose lease is taken over by another broker replica
+// reports that it has been lost.
+func TestLockLost(t *testing.T) {
+	defer mustReset(t)
+	defer enableLocking()()
+	defer mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	l, err := lock.Acquire(util.Namespace, fixtures.ServiceInstanceName, replicaA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Release()
+
+	mustTakeOverLease(t, fixtures.ServiceInstanceName, replicaB)
+
+	select {
+	case <-l.Lost():
+	case <-time.After(time.Minute):
+		t.Fatal("lock not lost")
+	}
+}
+
+// TestLockServiceInstanceLost tests that an asynchronous operation is aborted when
+// its service instance lock is taken over by another broker replica.  Aborting does
+// not roll back, or record a status, as the service instance now belongs to the other
+// replica, and polling does not modify it either.
+func TestLockServiceInstanceLost(t *testing.T) {
+	defer mustReset(t)
+	defer enableLocking()()
+	defer mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.LockIdentity = replicaA
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	mustTakeOverLease(t, fixtures.ServiceInstanceName, replicaB)
+
+	// Once aborted, the lock is released, so the lease can no longer be acquired.
+	callback := func() error {
+		l, err := lock.Acquire(util.Namespace, fixtures.ServiceInstanceName, replicaA)
+		if err == nil {
+			l.Release()
+
+			return errors.New("lock still held")
+		}
+
+		if !errors.Is(err, lock.ErrLockHeld) {
+			return err
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	fixtures.MustGetFixtureField(t, clients, "metadata", "name")
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	if _, ok := entry.Data[string(registry.OperationStatus)]; ok {
+		t.Fatal("aborted operation status recorded")
+	}
+
+	poll := &api.PollServiceInstanceResponse{}
+	util.MustGet(t, util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll)
+	util.Assert(t, poll.State == api.PollStateInProgress)
+}
+
+// TestLockReconcileServiceInstances tests that periodic reconciliation takes the
+// service instance lock, skipping service instances locked by another broker replica
+// until a later sweep.
+func TestLockReconcileServiceInstances(t *testing.T) {
+	defer mustReset(t)
+	defer enableLocking()()
+	defer mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.LockIdentity = replicaA
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	if err := clients.Dynamic().Resource(gvr).Namespace(util.Namespace).Delete(context.TODO(), "instance-"+fixtures.ServiceInstanceName, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	configuration := &broker.ServerConfiguration{
+		Namespace: util.Namespace,
+	}
+
+	mustCreateLease(t, fixtures.ServiceInstanceName, replicaB, time.Now().Add(time.Hour))
+
+	broker.ReconcileServiceInstances(configuration)
+	fixtures.AssertFixtureDeleted(t, clients)
+
+	mustDeleteLease(t, fixtures.ServiceInstanceName)
+
+	broker.ReconcileServiceInstances(configuration)
+	fixtures.MustGetFixtureField(t, clients, "metadata", "name")
+}
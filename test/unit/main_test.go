@@ -24,6 +24,7 @@ import (
 
 	"github.com/couchbase/service-broker/pkg/broker"
 	"github.com/couchbase/service-broker/pkg/client"
+	"github.com/couchbase/service-broker/pkg/config"
 	"github.com/couchbase/service-broker/test/unit/util"
 )
 
@@ -38,6 +39,10 @@ var (
 	// written to to trigger behviours, witness consequences and
 	// verify actions.  They should be reset after each test.
 	clients client.Clients
+
+	// catalogOverlay patches the catalog served by the broker.  Tests may add
+	// patches, and must remove them when done.
+	catalogOverlay = &broker.CatalogOverlay{}
 )
 
 // reset cleans the client of any resources that we may have registered and
@@ -48,7 +53,7 @@ func reset() error {
 
 // mustResetcleans the client of any resources that we may have registered and
 // clears out any broker persistent state.
-func mustReset(t *testing.T) {
+func mustReset(t testing.TB) {
 	if err := reset(); err != nil {
 		t.Fatal(err)
 	}
@@ -68,10 +73,48 @@ func TestMain(m *testing.M) {
 
 	token := util.Token
 
+	options := config.NewOptions()
+
+	// Allow templates to read from an additional namespace.
+	options.SourceNamespaces = []string{util.SourceNamespace}
+
+	// Allow templates to read a request query parameter.
+	options.QueryParameters = []string{util.QueryParameter}
+
+	// The default token may do anything, including registry backup which must be
+	// allowed explicitly, and the read only principal may only read.
+	authorizer := &broker.AuthorizationPolicy{
+		Rules: []broker.AuthorizationRule{
+			{
+				Principals: []string{util.TokenPrincipal},
+				Actions:    []string{"*"},
+				Resources:  []string{"*", string(broker.AuthorizationResourceRegistry)},
+				Allow:      true,
+			},
+			{
+				Principals: []string{util.ReadOnlyPrincipal},
+				Actions:    []string{string(broker.AuthorizationActionRead)},
+				Resources:  []string{"*"},
+				Allow:      true,
+			},
+		},
+	}
+
 	configuration := &broker.ServerConfiguration{
-		Namespace:   util.Namespace,
-		Token:       &token,
-		Certificate: cert,
+		Namespace:      util.Namespace,
+		Token:          &token,
+		TokenPrincipal: util.TokenPrincipal,
+		Tokens: map[string]string{
+			util.ReadOnlyPrincipal: util.ReadOnlyToken,
+		},
+		Certificate:                  cert,
+		RegistryBackup:               true,
+		Version:                      true,
+		ResponseCompressionThreshold: util.ResponseCompressionThreshold,
+		Authorizer:                   authorizer,
+		CatalogOverlay:               catalogOverlay,
+		PlanRolloutSource:            util.PlanRolloutSource,
+		Options:                      options,
 	}
 
 	// Create fake clients we can use to mock Kubernetes and have complete
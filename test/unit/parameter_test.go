@@ -15,15 +15,30 @@
 package unit_test
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/couchbase/service-broker/pkg/api"
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/config"
 	"github.com/couchbase/service-broker/pkg/registry"
 	"github.com/couchbase/service-broker/test/unit/fixtures"
 	"github.com/couchbase/service-broker/test/unit/util"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -41,11 +56,30 @@ const (
 	// Pick a random prime as that's unlikely to be a default ever!
 	defaultPasswordLength = 23
 
+	// longPasswordLength is used to test password generation where we want a
+	// statistically significant sample of characters.
+	longPasswordLength = 256
+
 	// defaultPasswordDictionary is the service broker default for password generation.
 	defaultPasswordDictionary = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
+	// defaultTokenLength is used to test token generation.
+	defaultTokenLength = 37
+
 	// defaultCN is the common name for a certificate.
 	defaultCN = "test common name"
+
+	// expiryDuration is how far into the future a time will be generated.
+	expiryDuration = 24 * time.Hour
+
+	// sourceResourceName is the name of a secret or config map to read from.
+	sourceResourceName = "castle-grayskull"
+
+	// lookupEndpoint is the value a lookup table maps a known region to.
+	lookupEndpoint = "https://eu-west-1.example.com"
+
+	// lookupDefaultEndpoint is the value a lookup table maps an unknown region to.
+	lookupDefaultEndpoint = "https://global.example.com"
 )
 
 var (
@@ -68,6 +102,16 @@ var (
 
 	// customPasswordDictionary is a bucnh of stuff that isn't default.
 	customPasswordDictionary = "!@#$%^&*()_+"
+
+	// passwordDictionaryPresets maps named dictionary presets to the characters
+	// they are expected to generate.
+	passwordDictionaryPresets = map[string]string{
+		"alphanumeric":         defaultPasswordDictionary,
+		"alphanumeric-symbols": defaultPasswordDictionary + "!#$%&()*+,-.:;<=>?@[]^_{|}~",
+		"hex":                  "0123456789abcdef",
+		"base58":               "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz",
+		"no-ambiguous":         "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789",
+	}
 )
 
 // TestParameters tests parameter items are correctly populated by service instance
@@ -118,6 +162,203 @@ func TestParametersMissingRequiredPath(t *testing.T) {
 	util.MustPutAndError(t, "/v2/service_instances/pinkiepie?accepts_incomplete=true", http.StatusBadRequest, req, api.ErrorConfigurationError)
 }
 
+// requiredIfConfiguration returns a configuration where the size parameter is only
+// required for premium tier service instances, and is otherwise defaulted.
+func requiredIfConfiguration() *v1.ServiceBrokerConfigSpec {
+	condition := fixtures.Eq(fixtures.NewParameterPipeline("/tier"), "premium")
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewParameterPipeline("/size").RequiredIf(condition).WithDefault(defaultValue))
+
+	return configuration
+}
+
+// TestParametersRequiredIf tests a conditionally required parameter must be specified
+// when the condition holds.
+func TestParametersRequiredIf(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, requiredIfConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"tier":"premium"}`),
+	}
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorConfigurationError)
+
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"tier":"premium","size":"` + value + `"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), value)
+}
+
+// TestParametersRequiredIfNotRequired tests a conditionally required parameter falls
+// back to its default when the condition does not hold.
+func TestParametersRequiredIfNotRequired(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, requiredIfConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"tier":"basic"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), defaultValue)
+}
+
+// TestParametersClamp tests numeric parameters outside of the allowed range are
+// clamped to the nearest bound, and those within it are unmodified.
+func TestParametersClamp(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, "over", fixtures.NewParameterPipeline("/over").With(fixtures.Clamp(1, 10)))
+	fixtures.AddRegistry(configuration, "under", fixtures.NewParameterPipeline("/under").With(fixtures.Clamp(1, 10)))
+	fixtures.AddRegistry(configuration, "within", fixtures.NewParameterPipeline("/within").With(fixtures.Clamp(1, 10)))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"over":50,"under":-3,"within":7}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	expected := map[string]string{
+		"over":   "10",
+		"under":  "1",
+		"within": "7",
+	}
+
+	for name, value := range expected {
+		if data := string(entry.Data[name]); data != value {
+			t.Fatalf("registry entry %s is %s, expected %s", name, data, value)
+		}
+	}
+
+	clamped := []string{}
+	if err := json.Unmarshal(entry.Data[string(registry.ClampedParameters)], &clamped); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, reflect.DeepEqual(clamped, []string{"value 50 clamped to 10", "value -3 clamped to 1"}))
+}
+
+// TestParametersClampNotNumeric tests that a non-numeric parameter cannot be clamped
+// and is rejected.
+func TestParametersClampNotNumeric(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, "over", fixtures.NewParameterPipeline("/over").With(fixtures.Clamp(1, 10)))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"over":"lots"}`),
+	}
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
+// TestParametersBrokerClusterDomain tests a service URL built from the broker
+// environment uses the configured cluster domain.
+func TestParametersBrokerClusterDomain(t *testing.T) {
+	defer mustReset(t)
+
+	clusterDomain := "example.internal"
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.ClusterDomain = clusterDomain
+	})()
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewFunction("printf", "https://my-service.%s.svc.%s", fixtures.Registry("namespace"), fixtures.Broker("cluster-domain")))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), "https://my-service."+util.Namespace+".svc."+clusterDomain)
+}
+
+// lookupConfiguration returns a configuration that maps the region parameter to
+// an endpoint with a lookup table.
+func lookupConfiguration() *v1.ServiceBrokerConfigSpec {
+	defaultEndpoint := lookupDefaultEndpoint
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Lookups = []v1.LookupTable{
+		{
+			Name: "endpoints",
+			Entries: &runtime.RawExtension{
+				Raw: []byte(`{"eu-west-1":"` + lookupEndpoint + `"}`),
+			},
+			Default: &defaultEndpoint,
+		},
+	}
+	fixtures.SetRegistry(configuration, key, fixtures.NewParameterPipeline("/region").With(fixtures.Lookup("endpoints")))
+
+	return configuration
+}
+
+// TestParametersLookup tests a parameter can be mapped to another value with a
+// lookup table.
+func TestParametersLookup(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, lookupConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"region":"eu-west-1"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), lookupEndpoint)
+}
+
+// TestParametersLookupDefault tests a lookup table yields its default when the
+// parameter is not in the table.
+func TestParametersLookupDefault(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, lookupConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"region":"us-east-1"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), lookupDefaultEndpoint)
+}
+
+// TestParametersLookupInvalid tests a lookup table with non-string values is rejected.
+func TestParametersLookupInvalid(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Lookups = []v1.LookupTable{
+		{
+			Name: "endpoints",
+			Entries: &runtime.RawExtension{
+				Raw: []byte(`{"eu-west-1":{"host":"example.com"}}`),
+			},
+		},
+	}
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
+}
+
 // TestParametersDefault tests a parameter with a default work when not specified.
 func TestParametersDefault(t *testing.T) {
 	defer mustReset(t)
@@ -151,6 +392,79 @@ func TestParametersDefaultOverride(t *testing.T) {
 	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), value)
 }
 
+// TestParametersSchemaDefault tests a parameter omitted from the request is populated
+// from the JSON schema default.
+func TestParametersSchemaDefault(t *testing.T) {
+	defer mustReset(t)
+
+	schema := `{"$schema":"http://json-schema.org/draft-04/schema#","type":"object","properties":{"` + key + `":{"type":"string","default":"` + defaultValue + `"}}}`
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Schemas = fixtures.ServiceInstanceCreateSchema(schema)
+	fixtures.SetRegistry(configuration, key, fixtures.NewParameterPipeline("/animal"))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), defaultValue)
+}
+
+// sanitizedSchema returns a schema that requires the parameter to be a valid label,
+// and sanitizes the parameter so that it is.
+func sanitizedSchema() *v1.Schemas {
+	schema := `{"$schema":"http://json-schema.org/draft-04/schema#","type":"object","properties":{"` + key + `":{"type":"string","pattern":"^[a-z0-9]([-a-z0-9]*[a-z0-9])?$"}}}`
+
+	schemas := fixtures.ServiceInstanceCreateSchema(schema)
+	schemas.ServiceInstance.Create.Sanitizers = []v1.ParameterSanitizer{
+		{
+			Path:      "/" + key,
+			Trim:      true,
+			Lowercase: true,
+			DNSLabel:  true,
+		},
+	}
+
+	return schemas
+}
+
+// TestParametersSanitized tests a messy parameter is sanitized into a valid Kubernetes
+// label before it is validated and used.
+func TestParametersSanitized(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Schemas = sanitizedSchema()
+	fixtures.SetRegistry(configuration, key, fixtures.NewParameterPipeline("/animal"))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"` + key + `":"  --Sea_Pony (Rarity)  "}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), "sea-pony-rarity")
+}
+
+// TestParametersSanitizedInvalid tests a parameter that cannot be sanitized into a
+// valid Kubernetes label is rejected.
+func TestParametersSanitizedInvalid(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Schemas = sanitizedSchema()
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"` + key + `":" !!! "}`),
+	}
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
 // TestParameterGenerateKeyRSAPKCS1 tests we can generate PKCS#1 formatted RSA keys.
 func TestParameterGenerateKeyRSAPKCS1(t *testing.T) {
 	defer mustReset(t)
@@ -520,6 +834,64 @@ func TestParameterGenerateServerCertificateRSAPKCS8WithSANs(t *testing.T) {
 	util.MustHaveRegistryEntriesTLSAndVerify(t, entry, registry.Key(caCertificateKey), registry.Key(childKeyKey), registry.Key(childCertificateKey), x509.ExtKeyUsageServerAuth)
 }
 
+// nameConstrainedConfiguration returns a configuration that generates a name
+// constrained CA, and a server certificate signed by it with the provided SANs.
+func nameConstrainedConfiguration(sans ...interface{}) *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+	fixtures.AddRegistry(configuration, caKeyKey, fixtures.NewGeneratePrivateKeyPipeline("EllipticP256", "PKCS#8", nil))
+	fixtures.AddRegistry(configuration, caCertificateKey, fixtures.NewGenerateCACertificatePipeline(fixtures.Registry(caKeyKey), defaultCN, "24h", fixtures.NewFunction("list", "DNS:looneytunes.com", "IP:10.0.0.0/8")))
+	fixtures.AddRegistry(configuration, childKeyKey, fixtures.NewGeneratePrivateKeyPipeline("EllipticP256", "PKCS#8", nil))
+	fixtures.AddRegistry(configuration, childCertificateKey, fixtures.NewGenerateCertificatePipeline(fixtures.Registry(childKeyKey), defaultCN, "24h", "Server", fixtures.NewFunction("list", sans...), fixtures.Registry(caKeyKey), fixtures.Registry(caCertificateKey)))
+
+	return configuration
+}
+
+// TestParameterGenerateCertificateNameConstraints tests that a CA embeds its name
+// constraints, and signs certificates with SANs it permits.
+func TestParameterGenerateCertificateNameConstraints(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, nameConstrainedConfiguration("DNS:bugs.looneytunes.com", "IP:10.1.2.3"))
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntriesTLSAndVerify(t, entry, registry.Key(caCertificateKey), registry.Key(childKeyKey), registry.Key(childCertificateKey), x509.ExtKeyUsageServerAuth)
+
+	block, _ := pem.Decode([]byte(mustGetRegistryEntryString(t, entry, caCertificateKey)))
+	if block == nil {
+		t.Fatal("unable to decode certificate")
+	}
+
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, ca.PermittedDNSDomainsCritical)
+	util.Assert(t, len(ca.PermittedDNSDomains) == 1 && ca.PermittedDNSDomains[0] == "looneytunes.com")
+	util.Assert(t, len(ca.PermittedIPRanges) == 1 && ca.PermittedIPRanges[0].String() == "10.0.0.0/8")
+}
+
+// TestParameterGenerateCertificateNameConstraintsViolated tests that certificates with
+// SANs not permitted by the CA name constraints are rejected.
+func TestParameterGenerateCertificateNameConstraintsViolated(t *testing.T) {
+	defer mustReset(t)
+
+	sans := [][]interface{}{
+		{"DNS:daffy.acme.com"},
+		{"DNS:bugs.looneytunes.com", "IP:192.168.0.1"},
+	}
+
+	for _, s := range sans {
+		util.MustReplaceBrokerConfig(t, clients, nameConstrainedConfiguration(s...))
+
+		req := fixtures.BasicServiceInstanceCreateRequest()
+		util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorConfigurationError)
+	}
+}
+
 // TestParameterGenerateClientCertificateRSAPKCS1 tests that we can create a client certificate with an
 // RSA private key.
 func TestParameterGenerateClientCertificateRSAPKCS1(t *testing.T) {
@@ -596,32 +968,735 @@ func TestParameterGenerateClientCertificateRSAPKCS8WithSANs(t *testing.T) {
 	util.MustHaveRegistryEntriesTLSAndVerify(t, entry, registry.Key(caCertificateKey), registry.Key(childKeyKey), registry.Key(childCertificateKey), x509.ExtKeyUsageClientAuth)
 }
 
-// TestParameterGeneratePassword tests that password generation works.
-func TestParameterGeneratePassword(t *testing.T) {
+// mustCreateSecret creates a secret containing a single key.
+func mustCreateSecret(t *testing.T, namespace, name, key, value string) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Data: map[string][]byte{
+			key: []byte(value),
+		},
+	}
+
+	if _, err := clients.Kubernetes().CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustCreateConfigMap creates a config map containing a single key.
+func mustCreateConfigMap(t *testing.T, namespace, name, key, value string) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Data: map[string]string{
+			key: value,
+		},
+	}
+
+	if _, err := clients.Kubernetes().CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestParameterSecret tests secrets can be read from the service instance namespace.
+func TestParameterSecret(t *testing.T) {
 	defer mustReset(t)
 
+	mustCreateSecret(t, util.Namespace, sourceResourceName, key, value)
+
 	configuration := fixtures.BasicConfiguration()
-	fixtures.SetRegistry(configuration, key, fixtures.NewGeneratePasswordPipeline(defaultPasswordLength, nil))
+	fixtures.SetRegistry(configuration, key, fixtures.NewSecretPipeline(sourceResourceName, key, nil))
 	util.MustReplaceBrokerConfig(t, clients, configuration)
 
 	req := fixtures.BasicServiceInstanceCreateRequest()
 	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
 
 	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
-	util.MustHaveRegistryEntryPassword(t, entry, key, defaultPasswordLength, defaultPasswordDictionary)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), value)
 }
 
-// TestParameterGeneratePasswordWithCustomDictionary tests that password generation works.
-func TestParameterGeneratePasswordWithCustomDictionary(t *testing.T) {
+// TestParameterSecretSourceNamespace tests secrets can be read from an allowed namespace.
+func TestParameterSecretSourceNamespace(t *testing.T) {
 	defer mustReset(t)
 
+	mustCreateSecret(t, util.SourceNamespace, sourceResourceName, key, value)
+
 	configuration := fixtures.BasicConfiguration()
-	fixtures.SetRegistry(configuration, key, fixtures.NewGeneratePasswordPipeline(defaultPasswordLength, customPasswordDictionary))
+	fixtures.SetRegistry(configuration, key, fixtures.NewSecretPipeline(sourceResourceName, key, util.SourceNamespace))
 	util.MustReplaceBrokerConfig(t, clients, configuration)
 
 	req := fixtures.BasicServiceInstanceCreateRequest()
 	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
 
 	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
-	util.MustHaveRegistryEntryPassword(t, entry, key, defaultPasswordLength, customPasswordDictionary)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), value)
+}
+
+// TestParameterSecretIllegalSourceNamespace tests secrets cannot be read from a
+// namespace that is not allowed.
+func TestParameterSecretIllegalSourceNamespace(t *testing.T) {
+	defer mustReset(t)
+
+	mustCreateSecret(t, util.IllegalSourceNamespace, sourceResourceName, key, value)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewSecretPipeline(sourceResourceName, key, util.IllegalSourceNamespace))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorConfigurationError)
+}
+
+// TestParameterQueryParameter tests allowed request query parameters can be read.
+func TestParameterQueryParameter(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewQueryParameterPipeline(util.QueryParameter))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	query := util.CreateServiceInstanceQuery()
+	query.Set(util.QueryParameter, value)
+	query.Set(util.IllegalQueryParameter, value)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := &api.CreateServiceInstanceResponse{}
+	util.MustPut(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, query), http.StatusAccepted, req, rsp)
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), value)
+}
+
+// TestParameterQueryParameterNotSpecified tests allowed request query parameters that
+// are not specified can be defaulted.
+func TestParameterQueryParameterNotSpecified(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewQueryParameterPipeline(util.QueryParameter).WithDefault(defaultValue))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), defaultValue)
+}
+
+// TestParameterQueryParameterIllegal tests request query parameters that are not
+// allowed cannot be read.
+func TestParameterQueryParameterIllegal(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewQueryParameterPipeline(util.IllegalQueryParameter))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	query := util.CreateServiceInstanceQuery()
+	query.Set(util.IllegalQueryParameter, value)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, query), http.StatusBadRequest, req, api.ErrorConfigurationError)
+}
+
+// TestParameterConfigMapSourceNamespace tests config maps can be read from an allowed namespace.
+func TestParameterConfigMapSourceNamespace(t *testing.T) {
+	defer mustReset(t)
+
+	mustCreateConfigMap(t, util.SourceNamespace, sourceResourceName, key, value)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewConfigMapPipeline(sourceResourceName, key, util.SourceNamespace))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), value)
+}
+
+// TestParameterConfigMapIllegalSourceNamespace tests config maps cannot be read from a
+// namespace that is not allowed.
+func TestParameterConfigMapIllegalSourceNamespace(t *testing.T) {
+	defer mustReset(t)
+
+	mustCreateConfigMap(t, util.IllegalSourceNamespace, sourceResourceName, key, value)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewConfigMapPipeline(sourceResourceName, key, util.IllegalSourceNamespace))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorConfigurationError)
+}
+
+// TestParameterGeneratePassword tests that password generation works.
+func TestParameterGeneratePassword(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewGeneratePasswordPipeline(defaultPasswordLength, nil))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryPassword(t, entry, key, defaultPasswordLength, defaultPasswordDictionary)
+}
+
+// TestParameterGeneratePasswordWithCustomDictionary tests that password generation works.
+func TestParameterGeneratePasswordWithCustomDictionary(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewGeneratePasswordPipeline(defaultPasswordLength, customPasswordDictionary))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryPassword(t, entry, key, defaultPasswordLength, customPasswordDictionary)
+}
+
+// TestParameterGeneratePasswordWithPresetDictionary tests that password generation
+// with a named dictionary preset only generates characters from that preset.
+func TestParameterGeneratePasswordWithPresetDictionary(t *testing.T) {
+	for preset, dictionary := range passwordDictionaryPresets {
+		func() {
+			defer mustReset(t)
+
+			configuration := fixtures.BasicConfiguration()
+			fixtures.SetRegistry(configuration, key, fixtures.NewGeneratePasswordPipeline(defaultPasswordLength, preset))
+			util.MustReplaceBrokerConfig(t, clients, configuration)
+
+			req := fixtures.BasicServiceInstanceCreateRequest()
+			util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+			entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+			util.MustHaveRegistryEntryPassword(t, entry, key, defaultPasswordLength, dictionary)
+		}()
+	}
+}
+
+// TestParameterGeneratePasswordNoAmbiguous tests that the no-ambiguous preset excludes
+// characters that are easily confused with one another.
+func TestParameterGeneratePasswordNoAmbiguous(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewGeneratePasswordPipeline(longPasswordLength, "no-ambiguous"))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustNotHaveRegistryEntryCharacters(t, entry, key, "0O1l")
+}
+
+// mustGetRegistryEntryString returns a string value from a registry entry.
+func mustGetRegistryEntryString(t *testing.T, entry *corev1.Secret, key string) string {
+	data, ok := entry.Data[key]
+	if !ok {
+		t.Fatalf("registry missing key %s", key)
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+// TestParameterGenerateToken tests that tokens are generated with the requested
+// number of random bytes, are unique, and can be stored as a hash.
+func TestParameterGenerateToken(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, "token", fixtures.NewGenerateTokenPipeline(defaultTokenLength))
+	fixtures.AddRegistry(configuration, "other-token", fixtures.NewGenerateTokenPipeline(defaultTokenLength))
+	fixtures.AddRegistry(configuration, "token-hash", fixtures.NewRegistryPipeline("token").With(fixtures.SHA256()))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	token := mustGetRegistryEntryString(t, entry, "token")
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, len(data) == defaultTokenLength)
+	util.Assert(t, token != mustGetRegistryEntryString(t, entry, "other-token"))
+
+	digest := sha256.Sum256([]byte(token))
+	util.Assert(t, mustGetRegistryEntryString(t, entry, "token-hash") == hex.EncodeToString(digest[:]))
+}
+
+// TestParameterCertificateMetadata tests that metadata can be derived from a generated
+// certificate and private key.
+func TestParameterCertificateMetadata(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.AddRegistry(configuration, caKeyKey, fixtures.NewGeneratePrivateKeyPipeline("EllipticP256", "PKCS#8", nil))
+	fixtures.AddRegistry(configuration, caCertificateKey, fixtures.NewGenerateCertificatePipeline(fixtures.Registry(caKeyKey), defaultCN, "24h", "CA", nil, nil, nil))
+	fixtures.AddRegistry(configuration, "not-after", fixtures.NewRegistryPipeline(caCertificateKey).With(fixtures.NotAfter()))
+	fixtures.AddRegistry(configuration, "certificate-public-key", fixtures.NewRegistryPipeline(caCertificateKey).With(fixtures.PublicKey()))
+	fixtures.AddRegistry(configuration, "key-public-key", fixtures.NewRegistryPipeline(caKeyKey).With(fixtures.PublicKey()))
+
+	for index := range configuration.Templates {
+		template := &configuration.Templates[index]
+
+		if template.Name == "test-template" {
+			template.Template.Raw = []byte(strings.Replace(string(template.Template.Raw), `"metadata":{`, `"metadata":{"annotations":{"fingerprint":"{{ registry \"`+caCertificateKey+`\" | fingerprint }}"},`, 1))
+		}
+	}
+
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	block, _ := pem.Decode([]byte(mustGetRegistryEntryString(t, entry, caCertificateKey)))
+	if block == nil {
+		t.Fatal("unable to decode certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(cert.Raw)
+	util.Assert(t, fixtures.MustGetFixtureField(t, clients, "metadata", "annotations", "fingerprint") == hex.EncodeToString(digest[:]))
+
+	util.Assert(t, mustGetRegistryEntryString(t, entry, "not-after") == cert.NotAfter.UTC().Format(time.RFC3339))
+
+	der, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	util.Assert(t, mustGetRegistryEntryString(t, entry, "certificate-public-key") == publicKey)
+	util.Assert(t, mustGetRegistryEntryString(t, entry, "key-public-key") == publicKey)
+}
+
+// mustParseTimeAnnotation reads an RFC3339 annotation from the fixture resource.
+func mustParseTimeAnnotation(t *testing.T, name string) time.Time {
+	value, ok := fixtures.MustGetFixtureField(t, clients, "metadata", "annotations", name).(string)
+	if !ok {
+		t.Fatal("annotation not a string")
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+// TestParameterNow tests that timestamps are generated, and offsets are applied.
+func TestParameterNow(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+
+	for index := range configuration.Templates {
+		template := &configuration.Templates[index]
+
+		if template.Name == "test-template" {
+			template.Template.Raw = []byte(strings.Replace(string(template.Template.Raw), `"metadata":{`, `"metadata":{"annotations":{"created-at":"{{ now nil nil }}","expires-at":"{{ now nil \"24h\" }}"},`, 1))
+		}
+	}
+
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	start := time.Now().Truncate(time.Second)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	createdAt := mustParseTimeAnnotation(t, "created-at")
+	expiresAt := mustParseTimeAnnotation(t, "expires-at")
+
+	util.Assert(t, !createdAt.Before(start))
+	util.Assert(t, !expiresAt.Before(createdAt.Add(expiryDuration)))
+}
+
+// TestParameterNowClock tests that timestamps are generated by the service broker's
+// clock.
+func TestParameterNowClock(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.AddRegistry(configuration, key, fixtures.NewNowPipeline("epoch", "1h"))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	clock, restore := util.UseFakeClock()
+	defer restore()
+
+	clock.Advance(48 * time.Hour)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	var epoch string
+	if err := json.Unmarshal(entry.Data[key], &epoch); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, epoch == strconv.FormatInt(clock.Now().Add(time.Hour).Unix(), 10))
+}
+
+// TestParameterNowEpoch tests that timestamps can be generated as seconds since the epoch.
+func TestParameterNowEpoch(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.AddRegistry(configuration, key, fixtures.NewNowPipeline("epoch", "1h"))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	start := time.Now().Add(time.Hour).Unix()
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	var epoch string
+	if err := json.Unmarshal(entry.Data[key], &epoch); err != nil {
+		t.Fatal(err)
+	}
+
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, seconds >= start)
+}
+
+// TestParameterNowIllegalOffset tests that an invalid time offset is rejected.
+func TestParameterNowIllegalOffset(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.AddRegistry(configuration, key, fixtures.NewNowPipeline(nil, "tomorrow"))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorConfigurationError)
+}
+
+// TestParameterFeature tests that feature flags toggle template behavior, with plan
+// flags taking precedence over service offering flags.
+func TestParameterFeature(t *testing.T) {
+	defer mustReset(t)
+
+	feature := "enableMonitoring"
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Features = map[string]bool{
+		feature: false,
+	}
+	configuration.Catalog.Services[0].Plans[0].Features = map[string]bool{
+		feature: true,
+	}
+	configuration.Templates = append(configuration.Templates,
+		v1.ConfigurationTemplate{
+			Name: "main-container",
+			Template: &runtime.RawExtension{
+				Raw: []byte(`{"name":"image","image":"name/image:tag"}`),
+			},
+		},
+		v1.ConfigurationTemplate{
+			Name: "monitoring-container",
+			Template: &runtime.RawExtension{
+				Raw: []byte(`{"name":"monitoring","image":"name/monitoring:tag"}`),
+			},
+		},
+	)
+
+	for index := range configuration.Templates {
+		template := &configuration.Templates[index]
+
+		if template.Name == "test-template" {
+			template.Template.Raw = []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"{{ registry \"instance-name\" }}"},"spec":{"containers":"{{ if (feature \"` + feature + `\") }}{{ list (snippet \"main-container\") (snippet \"monitoring-container\") }}{{ else }}{{ list (snippet \"main-container\") }}{{ end }}"}}`)
+		}
+	}
+
+	// Use the same template for the second plan, which inherits the disabled flag
+	// from the service offering.
+	configuration.Bindings[1].ServiceInstance = *configuration.Bindings[0].ServiceInstance.DeepCopy()
+
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	containers, ok := fixtures.MustGetFixtureField(t, clients, "spec", "containers").([]interface{})
+	util.Assert(t, ok)
+	util.Assert(t, len(containers) == 2)
+
+	util.MustDeleteServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	req.PlanID = fixtures.BasicConfigurationPlanID2
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	containers, ok = fixtures.MustGetFixtureField(t, clients, "spec", "containers").([]interface{})
+	util.Assert(t, ok)
+	util.Assert(t, len(containers) == 1)
+}
+
+// TestParameterJoin tests that a list parameter can be joined into a single string.
+func TestParameterJoin(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewParameterPipeline("/searches").With(fixtures.Join(",")))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"searches":["cluster.local","svc.cluster.local"]}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), "cluster.local,svc.cluster.local")
+}
+
+// TestParameterJoinIllegal tests that joining something other than a list of strings
+// is rejected.
+func TestParameterJoinIllegal(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewParameterPipeline("/searches").With(fixtures.Join(",")))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"searches":"cluster.local"}`),
+	}
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
+// TestParameterSplit tests that a string parameter can be split into a list.
+func TestParameterSplit(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+
+	for index := range configuration.Templates {
+		template := &configuration.Templates[index]
+
+		if template.Name == "test-template" {
+			template.Template.Raw = []byte(strings.Replace(string(template.Template.Raw), `"spec":{`, `"spec":{"hostAliases":[{"ip":"127.0.0.1","hostnames":"{{ parameter \"/aliases\" | split \",\" }}"}],`, 1))
+		}
+	}
+
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"aliases":"foo.local,bar.local"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	expected := []interface{}{
+		map[string]interface{}{
+			"ip":        "127.0.0.1",
+			"hostnames": []interface{}{"foo.local", "bar.local"},
+		},
+	}
+
+	fixtures.AssertFixtureFieldSet(t, clients, expected, "spec", "hostAliases")
+}
+
+// TestParameterSplitIllegal tests that splitting something other than a string is
+// rejected.
+func TestParameterSplitIllegal(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewParameterPipeline("/aliases").With(fixtures.Split(",")))
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"aliases":["foo.local"]}`),
+	}
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
+// environmentConfiguration returns a configuration where the container image is
+// prefixed with an environment variable reference.
+func environmentConfiguration(reference string) *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+
+	for index := range configuration.Templates {
+		template := &configuration.Templates[index]
+
+		if template.Name == "test-template" {
+			template.Template.Raw = []byte(strings.Replace(string(template.Template.Raw), `"image":"name/image:tag"`, `"image":"`+reference+`name/image:tag"`, 1))
+		}
+	}
+
+	return configuration
+}
+
+// mustGetFixtureImage returns the container image from the fixture resource.
+func mustGetFixtureImage(t *testing.T) string {
+	containers, ok := fixtures.MustGetFixtureField(t, clients, "spec", "containers").([]interface{})
+	util.Assert(t, ok)
+	util.Assert(t, len(containers) == 1)
+
+	container, ok := containers[0].(map[string]interface{})
+	util.Assert(t, ok)
+
+	image, ok := container["image"].(string)
+	util.Assert(t, ok)
+
+	return image
+}
+
+// TestParameterEnvironment tests that environment variables are substituted into
+// configuration, without modifying the configuration resource.
+func TestParameterEnvironment(t *testing.T) {
+	defer mustReset(t)
+
+	os.Setenv("IMAGE_REGISTRY", "registry.example.com/")
+	defer os.Unsetenv("IMAGE_REGISTRY")
+
+	util.MustReplaceBrokerConfigExpanded(t, clients, environmentConfiguration("${ENV:IMAGE_REGISTRY}"), environmentConfiguration("registry.example.com/"))
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	util.Assert(t, mustGetFixtureImage(t) == "registry.example.com/name/image:tag")
+
+	configuration, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(util.Namespace).Get(context.TODO(), config.GetOptions().ConfigurationName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := json.Marshal(configuration.Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, strings.Contains(string(raw), "${ENV:IMAGE_REGISTRY}"))
+}
+
+// TestParameterEnvironmentDefault tests that a default is used when an environment
+// variable is not set.
+func TestParameterEnvironmentDefault(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfigExpanded(t, clients, environmentConfiguration("${ENV:IMAGE_REGISTRY:-docker.io/}"), environmentConfiguration("docker.io/"))
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	util.Assert(t, mustGetFixtureImage(t) == "docker.io/name/image:tag")
+}
+
+// TestParameterEnvironmentRequired tests that configuration is rejected when a required
+// environment variable is not set.
+func TestParameterEnvironmentRequired(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, environmentConfiguration("${ENV:IMAGE_REGISTRY}"))
+}
+
+// TestParameterDependencyOrder tests that registry values declared before the values
+// they reference are rendered after them.
+func TestParameterDependencyOrder(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.Registry = append([]v1.RegistryValue{
+		{
+			Name:  "greeting",
+			Value: `{{ printf "hello %s" (registry "dashboard-url") }}`,
+		},
+		{
+			Name:  "dashboard-url",
+			Value: `{{ printf "http://%v.%v.svc" (registry "instance-name") (registry "namespace") }}`,
+		},
+	}, configuration.Bindings[0].ServiceInstance.Registry[0])
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key("greeting"), "hello http://instance-"+fixtures.ServiceInstanceName+"."+util.Namespace+".svc")
+}
+
+// TestParameterDependencyCycle tests that registry values that depend on one another
+// are rejected.
+func TestParameterDependencyCycle(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.Registry[0].Value = `{{ registry "dashboard-url" }}`
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
+}
+
+// TestParameterDependencyOrderSnippet tests that registry values that reference other
+// values via a snippet are rendered after them.
+func TestParameterDependencyOrderSnippet(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name: "greeting-snippet",
+		Template: &runtime.RawExtension{
+			Raw: []byte(`"{{ printf \"hello %s\" (registry \"dashboard-url\") }}"`),
+		},
+	})
+	configuration.Bindings[0].ServiceInstance.Registry = append([]v1.RegistryValue{
+		{
+			Name:  "greeting",
+			Value: `{{ snippet "greeting-snippet" }}`,
+		},
+	}, configuration.Bindings[0].ServiceInstance.Registry...)
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key("greeting"), "hello http://instance-"+fixtures.ServiceInstanceName+"."+util.Namespace+".svc")
+}
+
+// TestParameterDependencyComputed tests that registry values that reference registry
+// keys by a computed name are rejected, as their dependencies are unknown.
+func TestParameterDependencyComputed(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.Registry[0].Value = `{{ registry (printf "%s-url" "dashboard") }}`
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
 }
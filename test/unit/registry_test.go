@@ -15,14 +15,18 @@
 package unit_test
 
 import (
+	"context"
 	"net/http"
 	"testing"
 
 	"github.com/couchbase/service-broker/pkg/api"
+	"github.com/couchbase/service-broker/pkg/config"
 	"github.com/couchbase/service-broker/pkg/registry"
 	"github.com/couchbase/service-broker/test/unit/fixtures"
 	"github.com/couchbase/service-broker/test/unit/util"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -58,6 +62,72 @@ func TestRegistryIllegalWrite(t *testing.T) {
 	util.MustPutAndError(t, "/v2/service_instances/pinkiepie?accepts_incomplete=true", http.StatusBadRequest, req, api.ErrorConfigurationError)
 }
 
+// TestRegistryMultipleNames tests a single generated value is written to all
+// requested registry keys.
+func TestRegistryMultipleNames(t *testing.T) {
+	defer mustReset(t)
+
+	names := []string{"admin-password", "exporter-password"}
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewGeneratePasswordPipeline(defaultPasswordLength, nil))
+	configuration.Bindings[0].ServiceInstance.Registry[0].Names = names
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryPassword(t, entry, key, defaultPasswordLength, defaultPasswordDictionary)
+
+	for _, name := range names {
+		util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(name), mustGetRegistryEntryString(t, entry, key))
+	}
+}
+
+// TestRegistryMultipleNamesIllegalWrite tests that if any registry key cannot be
+// written then none are.
+func TestRegistryMultipleNamesIllegalWrite(t *testing.T) {
+	defer mustReset(t)
+
+	entry, err := registry.New(registry.ServiceInstance, util.Namespace, fixtures.ServiceInstanceName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := entry.SetUser(key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := entry.SetUsers([]string{key, "other", string(registry.ServiceID)}, "illegal"); err == nil {
+		t.Fatal("expected illegal write to fail")
+	}
+
+	current, ok, err := entry.GetUser(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, ok && current == value)
+
+	_, ok, err = entry.GetUser("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, !ok)
+
+	// And the same is true when configured as a registry value.
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, key, fixtures.NewGeneratePasswordPipeline(defaultPasswordLength, nil))
+	configuration.Bindings[0].ServiceInstance.Registry[0].Names = []string{string(registry.ServiceID)}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorConfigurationError)
+	util.MustNotHaveRegistry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+}
+
 // TestRegistryIllegalRead tests that some system registry items are not readable.
 func TestRegistryIllegalRead(t *testing.T) {
 	defer mustReset(t)
@@ -107,8 +177,9 @@ func TestRegistryMissingRequiredKey(t *testing.T) {
 func TestRegistryExplicitNamespace(t *testing.T) {
 	defer mustReset(t)
 
-	namespace := "BattleCat"
+	namespace := "battlecat"
 
+	util.MustCreateNamespace(t, clients, namespace)
 	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
 
 	req := fixtures.BasicServiceInstanceCreateRequest()
@@ -135,6 +206,59 @@ func TestRegistryExplicitIllegaNamespace(t *testing.T) {
 	util.MustPutAndError(t, "/v2/service_instances/pinkiepie?accepts_incomplete=true", http.StatusBadRequest, req, api.ErrorParameterError)
 }
 
+// TestRegistryExplicitNamespaceInvalid tests that a context namespace that is not
+// a valid DNS label raises a parameter error.
+func TestRegistryExplicitNamespaceInvalid(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Context = &runtime.RawExtension{
+		Raw: []byte(`{"namespace":"Battle_Cat"}`),
+	}
+	util.MustPutAndError(t, "/v2/service_instances/pinkiepie?accepts_incomplete=true", http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
+// TestRegistryExplicitNamespaceMissing tests that a context namespace that does
+// not exist raises a parameter error.
+func TestRegistryExplicitNamespaceMissing(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Context = &runtime.RawExtension{
+		Raw: []byte(`{"namespace":"battlecat"}`),
+	}
+	util.MustPutAndError(t, "/v2/service_instances/pinkiepie?accepts_incomplete=true", http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
+// TestRegistryExplicitNamespaceCreate tests that a context namespace that does
+// not exist is created when configured to do so.
+func TestRegistryExplicitNamespaceCreate(t *testing.T) {
+	defer mustReset(t)
+
+	namespace := "battlecat"
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.CreateNamespaces = true
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Context = &runtime.RawExtension{
+		Raw: []byte(`{"namespace":"` + namespace + `"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	util.MustHaveNamespace(t, clients, namespace)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Namespace, namespace)
+}
+
 // TestRegistryDefault tests that missing registry entries can be defaulted.
 func TestRegistryDefault(t *testing.T) {
 	defer mustReset(t)
@@ -152,3 +276,139 @@ func TestRegistryDefault(t *testing.T) {
 	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
 	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key(key), defaultValue)
 }
+
+// TestRegistryExportImport tests that the registry can be exported, and imported
+// into an empty broker, leaving service instances and bindings operable.
+func TestRegistryExportImport(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	bindingReq := fixtures.BasicServiceBindingCreateRequest()
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, bindingReq)
+
+	backup := &api.RegistryBackup{}
+	util.MustGet(t, util.RegistryURI(), http.StatusOK, backup)
+
+	names := map[string]bool{}
+	for _, entry := range backup.Entries {
+		names[entry.Name] = true
+	}
+
+	util.Assert(t, names[registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName)])
+	util.Assert(t, names[registry.Name(registry.ServiceBinding, fixtures.ServiceBindingName)])
+
+	// Simulate disaster, all state is lost.
+	mustReset(t)
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+	util.MustNotHaveRegistry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	util.MustPut(t, util.RegistryURI(), http.StatusOK, backup, nil)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.InstanceID, fixtures.ServiceInstanceName)
+
+	util.MustGet(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.ReadServiceInstanceQuery(req)), http.StatusOK, nil)
+	util.MustDeleteServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, bindingReq)
+	util.MustDeleteServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+}
+
+// TestRegistryImportIllegalEntry tests that only registry entries can be imported.
+func TestRegistryImportIllegalEntry(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	backup := &api.RegistryBackup{
+		Entries: []api.RegistryBackupEntry{
+			{
+				Namespace: util.Namespace,
+				Name:      "kube-root-ca.crt",
+			},
+		},
+	}
+
+	util.MustPutAndError(t, util.RegistryURI(), http.StatusBadRequest, backup, api.ErrorParameterError)
+}
+
+// TestRegistryImportIllegalNamespace tests that registry entries can only be imported
+// into namespaces known to the directory.
+func TestRegistryImportIllegalNamespace(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	backup := &api.RegistryBackup{
+		Entries: []api.RegistryBackupEntry{
+			{
+				Namespace: "kube-system",
+				Name:      registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName),
+			},
+		},
+	}
+
+	util.MustPutAndError(t, util.RegistryURI(), http.StatusBadRequest, backup, api.ErrorParameterError)
+	util.MustNotHaveRegistry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+}
+
+// TestRegistryImportUnownedSecret tests that secrets not created by the broker are not
+// overwritten by an import, even if named like a registry entry.
+func TestRegistryImportUnownedSecret(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName),
+			Namespace: util.Namespace,
+		},
+		Data: map[string][]byte{
+			"owner": []byte("someone-else"),
+		},
+	}
+
+	if _, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := &api.RegistryBackup{
+		Entries: []api.RegistryBackupEntry{
+			{
+				Namespace: util.Namespace,
+				Name:      secret.Name,
+			},
+		},
+	}
+
+	util.MustPutAndError(t, util.RegistryURI(), http.StatusBadRequest, backup, api.ErrorParameterError)
+
+	existing, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Get(context.TODO(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, string(existing.Data["owner"]) == "someone-else")
+}
+
+// TestRegistryCommitConflict tests that a registry commit that conflicts with a
+// concurrent modification is retried, retaining both modifications.
+func TestRegistryCommitConflict(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	util.MustConflictSecretUpdate(t, clients, registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName), "concurrent")
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key("concurrent"), "concurrent")
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.InstanceID, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.Key("instance-name"), "instance-"+fixtures.ServiceInstanceName)
+}
@@ -15,13 +15,24 @@
 package unit_test
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"net/http"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/couchbase/service-broker/pkg/api"
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/registry"
 	"github.com/couchbase/service-broker/test/unit/fixtures"
 	"github.com/couchbase/service-broker/test/unit/util"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -38,6 +49,137 @@ func TestServiceBindingCreate(t *testing.T) {
 	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
 }
 
+// TestServiceBindingCreateInherit tests that a service binding can inherit registry
+// values from the service instance, and reuse a service instance partial with a field
+// overridden.
+func TestServiceBindingCreateInherit(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	fixtures.AddRegistry(configuration, "app", "wolverine")
+	configuration.Templates = append(configuration.Templates,
+		v1.ConfigurationTemplate{
+			Name:     "labels-partial",
+			Template: &runtime.RawExtension{Raw: []byte(`{"app":"{{ registry \"app\" }}","tier":"instance"}`)},
+		},
+		v1.ConfigurationTemplate{
+			Name:     "binding-template",
+			Template: &runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"{{ printf \"binding-%s\" (registry \"binding-id\") }}"}}`)},
+			Includes: []v1.ConfigurationTemplateInclude{
+				{
+					Name:      "labels-partial",
+					Path:      "/metadata/labels",
+					Overrides: &runtime.RawExtension{Raw: []byte(`{"tier":"binding"}`)},
+				},
+			},
+		},
+	)
+	configuration.Bindings[0].ServiceBinding.Inherit = true
+	configuration.Bindings[0].ServiceBinding.Templates = []string{"binding-template"}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
+
+	name := "binding-" + fixtures.ServiceBindingName
+
+	fixtures.AssertNamedFixtureFieldSet(t, clients, name, "wolverine", "metadata", "labels", "app")
+	fixtures.AssertNamedFixtureFieldSet(t, clients, name, "binding", "metadata", "labels", "tier")
+}
+
+// TestServiceBindingCreateInheritGenerated tests that a service binding that inherits
+// from the service instance sees the generated values of the service instance, rather
+// than generating new ones.
+func TestServiceBindingCreateInheritGenerated(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.Registry = append(configuration.Bindings[0].ServiceInstance.Registry, v1.RegistryValue{
+		Name:  "password",
+		Value: `{{ generatePassword 32 nil }}`,
+	})
+	configuration.Bindings[0].ServiceBinding.Inherit = true
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
+
+	instanceEntry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	bindingEntry := util.MustGetRegistryEntry(t, clients, registry.ServiceBinding, fixtures.ServiceBindingName)
+
+	util.Assert(t, len(instanceEntry.Data["password"]) != 0)
+	util.Assert(t, string(bindingEntry.Data["password"]) == string(instanceEntry.Data["password"]))
+}
+
+// TestServiceBindingCreateIDIllegal tests that the service broker rejects service
+// binding IDs that cannot be used to name Kubernetes resources.
+func TestServiceBindingCreateIDIllegal(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, "spike!", nil), http.StatusBadRequest, binding, api.ErrorParameterError)
+}
+
+// TestServiceBindingCreateInstanceInProgress tests that binding to a service instance is
+// rejected until it has been successfully provisioned.
+func TestServiceBindingCreateInstanceInProgress(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusBadRequest, binding, api.ErrorParameterError)
+
+	fixtures.MustSetFixtureField(t, clients, fixtures.BasicResourceStatus(t), "status")
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
+}
+
+// TestServiceBindingCreateInstanceFailed tests that binding to a service instance whose
+// provisioning failed is rejected.
+func TestServiceBindingCreateInstanceFailed(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.Templates = append(configuration.Bindings[0].ServiceInstance.Templates, fixtures.IllegalTemplateName)
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if poll.State != api.PollStateFailed {
+			return fmt.Errorf("poll state %s, expected %s", poll.State, api.PollStateFailed)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusBadRequest, binding, api.ErrorParameterError)
+}
+
 // TestServiceBindingCreateIllegalBody tests graceful handing of an illegal body.
 func TestServiceBindingCreateIllegalBody(t *testing.T) {
 	defer mustReset(t)
@@ -226,6 +368,135 @@ func TestServiceBindingIllegalResource(t *testing.T) {
 	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusBadRequest, binding, api.ErrorConfigurationError)
 }
 
+// TestServiceBindingCreateReadinessTimeout tests service binding creation reports a timeout
+// when a readiness check does not pass in time.
+func TestServiceBindingCreateReadinessTimeout(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfigurationWithBindingReadiness()
+	configuration.Bindings[0].ServiceBinding.ReadinessChecks[0].Timeout = &metav1.Duration{Duration: 100 * time.Millisecond}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusGatewayTimeout, binding, api.ErrorOperationTimeout)
+}
+
+// TestServiceBindingCreateReadinessTimeoutFakeClock tests service binding creation reports
+// a timeout when the clock is advanced past the readiness check timeout, without waiting
+// for it in real time.
+func TestServiceBindingCreateReadinessTimeoutFakeClock(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfigurationWithBindingReadiness()
+	configuration.Bindings[0].ServiceBinding.ReadinessChecks[0].Timeout = &metav1.Duration{Duration: time.Hour}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	clock, restore := util.UseFakeClock()
+	defer restore()
+
+	advanced := make(chan error, 1)
+
+	go func() {
+		advanced <- clock.AdvanceWhenWaiting(time.Hour)
+	}()
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusGatewayTimeout, binding, api.ErrorOperationTimeout)
+
+	if err := <-advanced; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServiceBindingRead tests a service binding cannot be read while it is being
+// created, and can be read, including its credentials, once created.
+func TestServiceBindingRead(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithBindingReadiness())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	created := &api.GetServiceBindingResponse{}
+
+	result := make(chan error)
+
+	go func() {
+		result <- util.Put(util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusCreated, binding, created)
+	}()
+
+	callback := func() error {
+		entry, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Get(context.TODO(), registry.Name(registry.ServiceBinding, fixtures.ServiceBindingName), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		progress := string(entry.Data[string(registry.OperationProgress)])
+		if !strings.Contains(progress, "waiting for readiness") {
+			return fmt.Errorf("operation progress %s, expected readiness wait", progress)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	util.MustGetAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusNotFound, api.ErrorResourceNotFound)
+
+	fixtures.MustSetFixtureField(t, clients, fixtures.BasicResourceStatus(t), "status")
+
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+
+	response := &api.GetServiceBindingResponse{}
+	util.MustGet(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusOK, response)
+
+	util.Assert(t, response.Credentials != nil && created.Credentials != nil)
+	util.Assert(t, len(response.Credentials.Raw) != 0)
+	util.Assert(t, string(response.Credentials.Raw) == string(created.Credentials.Raw))
+}
+
+// TestServiceBindingReadNotFound tests a service binding that does not exist cannot
+// be read.
+func TestServiceBindingReadNotFound(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	util.MustGetAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusNotFound, api.ErrorResourceNotFound)
+}
+
+// TestServiceBindingReadNotRetrievable tests that service bindings cannot be read
+// when the service offering does not support it.
+func TestServiceBindingReadNotRetrievable(t *testing.T) {
+	defer mustReset(t)
+
+	retrievable := false
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].BindingsRetrievable = &retrievable
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
+
+	util.MustGetAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusNotFound, api.ErrorResourceNotFound)
+}
+
 // TestServiceBindingRereateAfterCreation tests service binding recreation executes successfully when
 // a service binding already exists.
 func TestServiceBindingRecreateAfterCreation(t *testing.T) {
@@ -466,3 +737,606 @@ func TestServiceBindingDeleteDeleteAndRecreate(t *testing.T) {
 	util.MustDeleteServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
 	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
 }
+
+// volumeMountConfiguration returns a configuration whose service offering requires
+// volume mounts, and whose service bindings return one.
+func volumeMountConfiguration() *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Requires = []string{"volume_mount"}
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name:     "volume-mount",
+		Template: &runtime.RawExtension{Raw: []byte(`{"driver":"nfs","container_dir":"/data","mode":"rw","device_type":"shared","device":{"volume_id":"{{ registry \"instance-name\" }}"}}`)},
+	})
+	configuration.Bindings[0].ServiceBinding.Registry = append(configuration.Bindings[0].ServiceBinding.Registry, v1.RegistryValue{
+		Name:  "volume-mounts",
+		Value: `{{ list (snippet "volume-mount") }}`,
+	})
+
+	return configuration
+}
+
+// TestServiceBindingCreateRequiresVolumeMount tests that a service binding returns
+// volume mounts when the platform supports them.
+func TestServiceBindingCreateRequiresVolumeMount(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, volumeMountConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	binding.Context = &runtime.RawExtension{
+		Raw: []byte(`{"capabilities":["volume_mount"]}`),
+	}
+
+	rsp := &api.GetServiceBindingResponse{}
+	util.MustPut(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusCreated, binding, rsp)
+
+	util.Assert(t, len(rsp.VolumeMounts) == 1)
+	util.Assert(t, rsp.VolumeMounts[0].Driver == "nfs")
+	util.Assert(t, rsp.VolumeMounts[0].Device.VolumeID == "instance-"+fixtures.ServiceInstanceName)
+}
+
+// TestServiceBindingCreateRequiresVolumeMountUnsupported tests that a service binding
+// is rejected when the platform does not support volume mounts.
+func TestServiceBindingCreateRequiresVolumeMountUnsupported(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, volumeMountConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusBadRequest, binding, api.ErrorParameterError)
+}
+
+// credentialFormats are the credential representations returned by a service binding.
+type credentialFormats struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	URI      string `json:"uri"`
+	JDBCURL  string `json:"jdbcUrl"`
+}
+
+// TestServiceBindingCreateCredentialFormats tests that a service binding returns all
+// credential formats, and that they are derived from the same values.
+func TestServiceBindingCreateCredentialFormats(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceBinding.Registry = append(configuration.Bindings[0].ServiceBinding.Registry,
+		v1.RegistryValue{
+			Name:  "username",
+			Value: `{{ registry "instance-name" }}`,
+		},
+		v1.RegistryValue{
+			Name:  "password",
+			Value: `{{ generatePassword 16 nil }}`,
+		},
+	)
+	configuration.Bindings[0].ServiceBinding.CredentialFormats = []v1.RegistryValue{
+		{
+			Name:  "username",
+			Value: `{{ registry "username" }}`,
+		},
+		{
+			Name:  "password",
+			Value: `{{ registry "password" }}`,
+		},
+		{
+			Name:  "uri",
+			Value: `{{ printf "couchbase://%s:%s@%s" (registry "username") (registry "password") (registry "dashboard-url") }}`,
+		},
+		{
+			Name:  "jdbcUrl",
+			Value: `{{ printf "jdbc:couchbase://%s?user=%s&password=%s" (registry "dashboard-url") (registry "username") (registry "password") }}`,
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	rsp := &api.GetServiceBindingResponse{}
+	util.MustPut(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusCreated, binding, rsp)
+
+	util.Assert(t, rsp.Credentials != nil)
+
+	credentials := &credentialFormats{}
+	if err := json.Unmarshal(rsp.Credentials.Raw, credentials); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, credentials.Username != "")
+	util.Assert(t, credentials.Password != "")
+	util.Assert(t, credentials.URI == fmt.Sprintf("couchbase://%s:%s@%s", credentials.Username, credentials.Password, fixtures.DashboardURL))
+	util.Assert(t, credentials.JDBCURL == fmt.Sprintf("jdbc:couchbase://%s?user=%s&password=%s", fixtures.DashboardURL, credentials.Username, credentials.Password))
+
+	// The credentials are persisted in the registry, and returned unmodified when the
+	// service binding is read.
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceBinding, fixtures.ServiceBindingName)
+
+	stored := &credentialFormats{}
+	if err := json.Unmarshal(entry.Data[string(registry.Credentials)], stored); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, reflect.DeepEqual(stored, credentials))
+
+	read := &api.GetServiceBindingResponse{}
+	util.MustGet(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusOK, read)
+
+	util.Assert(t, read.Credentials != nil)
+	util.Assert(t, string(read.Credentials.Raw) == string(rsp.Credentials.Raw))
+}
+
+// TestServiceBindingCreateCredentialFormatsIllegalCredentials tests that credential
+// formats cannot be added to credentials that are not an object.
+func TestServiceBindingCreateCredentialFormatsIllegalCredentials(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceBinding.Registry = []v1.RegistryValue{
+		{
+			Name:  "credentials",
+			Value: `{{ "password" }}`,
+		},
+	}
+	configuration.Bindings[0].ServiceBinding.CredentialFormats = []v1.RegistryValue{
+		{
+			Name:  "uri",
+			Value: `{{ "couchbase://localhost" }}`,
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusBadRequest, binding, api.ErrorConfigurationError)
+}
+
+// clientCertificateConfiguration returns a configuration where the service instance
+// generates a CA, and each service binding a client certificate signed by it, whose
+// identity is derived from the service binding ID.
+func clientCertificateConfiguration() *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, caKeyKey, fixtures.NewGeneratePrivateKeyPipeline("RSA", "PKCS#8", defaultKeyLength))
+	fixtures.AddRegistry(configuration, caCertificateKey, fixtures.NewGenerateCertificatePipeline(fixtures.Registry(caKeyKey), defaultCN, "24h", "CA", nil, nil, nil))
+
+	sans := fixtures.NewFunction("list", fixtures.NewFunction("printf", "URI:urn:service-binding:%s", fixtures.Registry("binding-id")))
+
+	configuration.Bindings[0].ServiceBinding.Registry = append(configuration.Bindings[0].ServiceBinding.Registry,
+		v1.RegistryValue{
+			Name:  childKeyKey,
+			Value: `{{` + string(fixtures.NewGeneratePrivateKeyPipeline("RSA", "PKCS#8", defaultKeyLength)) + `}}`,
+		},
+		v1.RegistryValue{
+			Name:  childCertificateKey,
+			Value: `{{` + string(fixtures.NewGenerateCertificatePipeline(fixtures.Registry(childKeyKey), fixtures.Registry("binding-id"), "24h", "Client", sans, fixtures.Registry(caKeyKey), fixtures.Registry(caCertificateKey))) + `}}`,
+		},
+	)
+
+	return configuration
+}
+
+// TestServiceBindingCreateClientCertificate tests that each service binding can be
+// issued with a unique client certificate signed by the service instance CA.
+func TestServiceBindingCreateClientCertificate(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, clientCertificateConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	bindingNames := []string{
+		fixtures.ServiceBindingName,
+		fixtures.ServiceBindingName + "-2",
+	}
+
+	subjects := map[string]bool{}
+
+	for _, name := range bindingNames {
+		binding := fixtures.BasicServiceBindingCreateRequest()
+		util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, name, binding)
+
+		entry := util.MustGetRegistryEntry(t, clients, registry.ServiceBinding, name)
+		certificate := util.MustHaveRegistryEntriesTLSAndVerify(t, entry, registry.Key(caCertificateKey), registry.Key(childKeyKey), registry.Key(childCertificateKey), x509.ExtKeyUsageClientAuth)
+
+		util.Assert(t, certificate.Subject.CommonName == name)
+		util.Assert(t, len(certificate.URIs) == 1)
+		util.Assert(t, certificate.URIs[0].String() == "urn:service-binding:"+name)
+
+		subjects[certificate.Subject.String()] = true
+	}
+
+	util.Assert(t, len(subjects) == len(bindingNames))
+}
+
+// TestServiceBindingCreateRotation tests that a service binding can replace an existing
+// one, and is issued with a new client certificate.
+func TestServiceBindingCreateRotation(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, clientCertificateConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName, binding)
+
+	rotatedName := fixtures.ServiceBindingName + "-rotated"
+
+	rotated := fixtures.BasicServiceBindingCreateRequest()
+	rotated.PredecessorBindingID = fixtures.ServiceBindingName
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, rotatedName, rotated)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceBinding, rotatedName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.PredecessorBindingID, fixtures.ServiceBindingName)
+
+	certificate := util.MustHaveRegistryEntriesTLSAndVerify(t, entry, registry.Key(caCertificateKey), registry.Key(childKeyKey), registry.Key(childCertificateKey), x509.ExtKeyUsageClientAuth)
+	util.Assert(t, certificate.Subject.CommonName == rotatedName)
+}
+
+// TestServiceBindingCreateRotationInvalidPredecessor tests that a service binding
+// cannot replace one that does not exist.
+func TestServiceBindingCreateRotationInvalidPredecessor(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	binding.PredecessorBindingID = fixtures.ServiceBindingName + "-missing"
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusBadRequest, binding, api.ErrorParameterError)
+}
+
+const (
+	// intermediateKeyKey is the key name used for intermediate CA private keys.
+	intermediateKeyKey = "intermediate.key"
+
+	// intermediateCertificateKey is the key name used for intermediate CA certificates.
+	intermediateCertificateKey = "intermediate.pem"
+
+	// caChainKey is the key name used for CA certificate chains.
+	caChainKey = "chain.pem"
+)
+
+// caCertificateConfiguration returns a configuration where the service instance
+// generates a root and intermediate CA, and a server certificate signed by the
+// intermediate CA.  Service bindings return the CA chain in their credentials.
+func caCertificateConfiguration() *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+	fixtures.SetRegistry(configuration, caKeyKey, fixtures.NewGeneratePrivateKeyPipeline("RSA", "PKCS#8", defaultKeyLength))
+	fixtures.AddRegistry(configuration, caCertificateKey, fixtures.NewGenerateCertificatePipeline(fixtures.Registry(caKeyKey), defaultCN, "24h", "CA", nil, nil, nil))
+	fixtures.AddRegistry(configuration, intermediateKeyKey, fixtures.NewGeneratePrivateKeyPipeline("RSA", "PKCS#8", defaultKeyLength))
+	fixtures.AddRegistry(configuration, intermediateCertificateKey, fixtures.NewGenerateCertificatePipeline(fixtures.Registry(intermediateKeyKey), defaultCN, "24h", "CA", nil, fixtures.Registry(caKeyKey), fixtures.Registry(caCertificateKey)))
+	fixtures.AddRegistry(configuration, caChainKey, fixtures.NewFunction("printf", "%s%s", fixtures.Registry(intermediateCertificateKey), fixtures.Registry(caCertificateKey)))
+	fixtures.AddRegistry(configuration, childKeyKey, fixtures.NewGeneratePrivateKeyPipeline("RSA", "PKCS#8", defaultKeyLength))
+	fixtures.AddRegistry(configuration, childCertificateKey, fixtures.NewGenerateCertificatePipeline(fixtures.Registry(childKeyKey), defaultCN, "24h", "Server", fixtures.NewFunction("list", "DNS:localhost"), fixtures.Registry(intermediateKeyKey), fixtures.Registry(intermediateCertificateKey)))
+
+	configuration.Bindings[0].ServiceBinding.CACertificate = registry.InstanceKeyPrefix + caChainKey
+
+	return configuration
+}
+
+// TestServiceBindingCreateCACertificate tests that a service binding returns the
+// service instance's CA chain in its credentials, and that it verifies the service
+// instance's server certificate.
+func TestServiceBindingCreateCACertificate(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, caCertificateConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	rsp := &api.GetServiceBindingResponse{}
+	util.MustPut(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusCreated, binding, rsp)
+
+	util.Assert(t, rsp.Credentials != nil)
+
+	credentials := map[string]interface{}{}
+	if err := json.Unmarshal(rsp.Credentials.Raw, &credentials); err != nil {
+		t.Fatal(err)
+	}
+
+	caPEM, ok := credentials["ca.crt"].(string)
+	if !ok {
+		t.Fatal("credentials missing ca.crt")
+	}
+
+	// Both the intermediate and root CA are returned.
+	util.Assert(t, strings.Count(caPEM, "-----BEGIN CERTIFICATE-----") == 2)
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM([]byte(caPEM)); !ok {
+		t.Fatal("unable to add CA certificate to pool")
+	}
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	block, _ := pem.Decode([]byte(mustGetRegistryEntryString(t, entry, childCertificateKey)))
+	if block == nil {
+		t.Fatal("unable to decode certificate")
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := x509.VerifyOptions{
+		DNSName: "localhost",
+		Roots:   pool,
+		KeyUsages: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+		},
+	}
+
+	if _, err := certificate.Verify(options); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServiceBindingCreateCACertificateIllegal tests that a service binding cannot
+// return a certificate that is not a CA as its CA certificate.
+func TestServiceBindingCreateCACertificateIllegal(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := caCertificateConfiguration()
+	configuration.Bindings[0].ServiceBinding.CACertificate = registry.InstanceKeyPrefix + childCertificateKey
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusBadRequest, binding, api.ErrorConfigurationError)
+}
+
+// TestServiceBindingCreateTTL tests that service binding credentials report their
+// expiry, and that an identical request for an expired binding returns the existing
+// binding and its expiry rather than recreating it.
+func TestServiceBindingCreateTTL(t *testing.T) {
+	defer mustReset(t)
+
+	ttl := time.Hour
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].BindingTTL = &metav1.Duration{Duration: ttl}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	clock, restore := util.UseFakeClock()
+	defer restore()
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+
+	rsp := &api.GetServiceBindingResponse{}
+	util.MustPut(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusCreated, binding, rsp)
+	util.Assert(t, rsp.Metadata != nil)
+
+	expiry, err := time.Parse(time.RFC3339, rsp.Metadata.ExpiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, expiry.After(clock.Now()))
+	util.Assert(t, expiry.Before(clock.Now().Add(ttl+time.Second)))
+
+	// Before and after expiry, the existing binding is returned unmodified.
+	for _, advance := range []time.Duration{0, ttl + time.Second} {
+		clock.Advance(advance)
+
+		rsp = &api.GetServiceBindingResponse{}
+		util.MustPut(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusOK, binding, rsp)
+		util.Assert(t, rsp.Metadata != nil)
+
+		existing, err := time.Parse(time.RFC3339, rsp.Metadata.ExpiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		util.Assert(t, existing.Equal(expiry))
+	}
+
+	util.Assert(t, expiry.Before(clock.Now()))
+
+	// Expired credentials cannot be read.
+	util.MustGetAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusGone, api.ErrorResourceGone)
+}
+
+// TestServiceBindingCreateLimit tests that a service plan can limit the number of
+// service bindings per service instance, and that deleting a binding frees a slot.
+func TestServiceBindingCreateLimit(t *testing.T) {
+	defer mustReset(t)
+
+	limit := 2
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].MaxBindingsPerInstance = &limit
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName+"-1", binding)
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName+"-2", binding)
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName+"-3", nil), http.StatusTooManyRequests, binding, api.ErrorQuotaExceeded)
+
+	// Existing bindings are still returned.
+	util.MustPut(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName+"-1", nil), http.StatusOK, binding, nil)
+
+	util.MustDeleteServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName+"-1", binding)
+	util.MustCreateServiceBinding(t, fixtures.ServiceInstanceName, fixtures.ServiceBindingName+"-3", binding)
+}
+
+// endpointsConfiguration returns a configuration where service instances record
+// read-write and read-only endpoints, and service bindings select one.
+func endpointsConfiguration() *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].BindingEndpoints = &v1.ServicePlanBindingEndpoints{
+		Registry: "endpoints",
+		Default:  "readwrite",
+	}
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name: "endpoints-snippet",
+		Template: &runtime.RawExtension{
+			Raw: []byte(`{"readwrite":"{{ printf \"rw.%s\" (registry \"dashboard-url\") }}","readonly":"{{ printf \"ro.%s\" (registry \"dashboard-url\") }}"}`),
+		},
+	})
+	configuration.Bindings[0].ServiceInstance.Registry = append(configuration.Bindings[0].ServiceInstance.Registry, v1.RegistryValue{
+		Name:  "endpoints",
+		Value: `{{ snippet "endpoints-snippet" }}`,
+	})
+	configuration.Bindings[0].ServiceBinding.CredentialFormats = []v1.RegistryValue{
+		{
+			Name:  "host",
+			Value: `{{ registry "endpoint" }}`,
+		},
+	}
+
+	return configuration
+}
+
+// TestServiceBindingCreateEndpoint tests that a service binding can select one of the
+// endpoints recorded by its service instance with a parameter.
+func TestServiceBindingCreateEndpoint(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, endpointsConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	binding.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"endpoint":"readonly"}`),
+	}
+
+	rsp := &api.GetServiceBindingResponse{}
+	util.MustPut(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusCreated, binding, rsp)
+	util.Assert(t, rsp.Credentials != nil)
+
+	credentials := map[string]interface{}{}
+	if err := json.Unmarshal(rsp.Credentials.Raw, &credentials); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, credentials["host"] == "ro."+fixtures.DashboardURL)
+}
+
+// TestServiceBindingCreateEndpointDefault tests that a service binding gets the default
+// endpoint when it does not select one.
+func TestServiceBindingCreateEndpointDefault(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, endpointsConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+
+	rsp := &api.GetServiceBindingResponse{}
+	util.MustPut(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusCreated, binding, rsp)
+	util.Assert(t, rsp.Credentials != nil)
+
+	credentials := map[string]interface{}{}
+	if err := json.Unmarshal(rsp.Credentials.Raw, &credentials); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, credentials["host"] == "rw."+fixtures.DashboardURL)
+}
+
+// TestServiceBindingCreateEndpointInvalid tests that a service binding cannot select an
+// endpoint its service instance does not expose.
+func TestServiceBindingCreateEndpointInvalid(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, endpointsConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+	binding.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"endpoint":"writeonly"}`),
+	}
+	util.MustPutAndError(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusBadRequest, binding, api.ErrorParameterError)
+}
+
+// TestServiceBindingCreateScopedRegistry tests that service binding credentials can
+// be composed from values inherited from the service instance, and values generated by
+// the service binding, even when they share the same name.
+func TestServiceBindingCreateScopedRegistry(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.Registry = append(configuration.Bindings[0].ServiceInstance.Registry,
+		v1.RegistryValue{
+			Name:  "ca",
+			Value: "instance-ca",
+		},
+		v1.RegistryValue{
+			Name:  "username",
+			Value: "instance-username",
+		},
+	)
+	configuration.Bindings[0].ServiceBinding.Registry = append(configuration.Bindings[0].ServiceBinding.Registry, v1.RegistryValue{
+		Name:  "username",
+		Value: "binding-username",
+	})
+	configuration.Bindings[0].ServiceBinding.CredentialFormats = []v1.RegistryValue{
+		{
+			Name:  "ca",
+			Value: `{{ registry "instance.ca" }}`,
+		},
+		{
+			Name:  "username",
+			Value: `{{ registry "binding.username" }}`,
+		},
+		{
+			Name:  "adminUsername",
+			Value: `{{ registry "instance.username" }}`,
+		},
+		{
+			Name:  "bindingCA",
+			Value: `{{ default "none" (registry "binding.ca") }}`,
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	binding := fixtures.BasicServiceBindingCreateRequest()
+
+	rsp := &api.GetServiceBindingResponse{}
+	util.MustPut(t, util.ServiceBindingURI(fixtures.ServiceInstanceName, fixtures.ServiceBindingName, nil), http.StatusCreated, binding, rsp)
+	util.Assert(t, rsp.Credentials != nil)
+
+	credentials := map[string]interface{}{}
+	if err := json.Unmarshal(rsp.Credentials.Raw, &credentials); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, credentials["ca"] == "instance-ca")
+	util.Assert(t, credentials["username"] == "binding-username")
+	util.Assert(t, credentials["adminUsername"] == "instance-username")
+	util.Assert(t, credentials["bindingCA"] == "none")
+}
@@ -15,15 +15,46 @@
 package unit_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/couchbase/service-broker/pkg/api"
+	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
+	"github.com/couchbase/service-broker/pkg/broker"
+	"github.com/couchbase/service-broker/pkg/config"
+	"github.com/couchbase/service-broker/pkg/operation"
+	"github.com/couchbase/service-broker/pkg/registry"
 	"github.com/couchbase/service-broker/test/unit/fixtures"
 	"github.com/couchbase/service-broker/test/unit/util"
 
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// rolloutSeed makes weighted plan selection deterministic.
+	rolloutSeed = 42
+
+	// rolloutWeight is the weight of the default plan, relative to a weight of 1
+	// for the alternative.
+	rolloutWeight = 4
+
+	// rolloutInstances is the number of service instances to create.
+	rolloutInstances = 30
 )
 
 // TestServiceInstanceCreate tests that the service broker accepts a minimal
@@ -37,6 +68,51 @@ func TestServiceInstanceCreate(t *testing.T) {
 	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
 }
 
+// TestServiceInstanceCreateEvents tests that Kubernetes events are raised against
+// the service instance during provisioning.
+func TestServiceInstanceCreateEvents(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.Events = true
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	events, err := clients.Kubernetes().CoreV1().Events(util.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reasons := []string{}
+
+	for _, event := range events.Items {
+		if event.InvolvedObject.Kind != "Secret" || event.InvolvedObject.Name != registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName) {
+			t.Fatalf("event %s raised against unexpected object %v", event.Reason, event.InvolvedObject)
+		}
+
+		reasons = append(reasons, event.Reason)
+	}
+
+	for _, reason := range []string{operation.EventReasonStarted, operation.EventReasonResourceApplied, operation.EventReasonReady} {
+		found := false
+
+		for _, r := range reasons {
+			if r == reason {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Fatalf("expected %s event, got %v", reason, reasons)
+		}
+	}
+}
+
 // TestServiceInstanceCreateSingleton tests that the service broker accepts a
 // minimal service instance creation and allows multiple instances sharing  a
 // singleton resource.
@@ -61,6 +137,151 @@ func TestServiceInstanceCreateNotAynchronous(t *testing.T) {
 	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusUnprocessableEntity, nil, api.ErrorAsyncRequired)
 }
 
+// TestServiceInstanceCreateSynchronous tests that a client that does not support
+// asynchronous operations can create a service instance when the service plan allows
+// synchronous provisioning.
+func TestServiceInstanceCreateSynchronous(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].SynchronousTimeout = &metav1.Duration{Duration: time.Minute}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := &api.CreateServiceInstanceResponse{}
+	util.MustPut(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusCreated, req, rsp)
+	util.Assert(t, rsp.Operation == "")
+
+	fixtures.AssertFixtureFieldSet(t, clients, "instance-"+fixtures.ServiceInstanceName, "metadata", "name")
+}
+
+// TestServiceInstanceCreateAnnotations tests that static and parameter derived
+// annotations are added to created resources.
+func TestServiceInstanceCreateAnnotations(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.Annotations = []v1.RegistryValue{
+		{
+			Name:  "example.com/team",
+			Value: "platform",
+		},
+		{
+			Name:  "example.com/cost-center",
+			Value: `{{` + string(fixtures.NewParameterPipeline("/costCenter")) + `}}`,
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"costCenter":"R&D"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	fixtures.AssertFixtureFieldSet(t, clients, "platform", "metadata", "annotations", "example.com/team")
+	fixtures.AssertFixtureFieldSet(t, clients, "R&D", "metadata", "annotations", "example.com/cost-center")
+}
+
+// TestServiceInstanceCreateSynchronousTooSlow tests that synchronous provisioning that
+// does not complete in time is rolled back and the client told asynchronous operation
+// is required.
+func TestServiceInstanceCreateSynchronousTooSlow(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfigurationWithReadiness()
+	configuration.Catalog.Services[0].Plans[0].SynchronousTimeout = &metav1.Duration{Duration: time.Second}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusUnprocessableEntity, req, api.ErrorAsyncRequired)
+	fixtures.AssertFixtureDeleted(t, clients)
+
+	// The abandoned service instance is forgotten so can be created asynchronously.
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	fixtures.MustSetFixtureField(t, clients, fixtures.BasicResourceStatus(t), "status")
+
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+}
+
+// TestServiceInstanceCreateRollbackRetry tests that resources created by an abandoned
+// synchronous service instance creation are deleted even when deletion transiently fails.
+func TestServiceInstanceCreateRollbackRetry(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.RollbackBackoff = time.Millisecond
+	})()
+
+	configuration := fixtures.BasicConfigurationWithReadiness()
+	configuration.Catalog.Services[0].Plans[0].SynchronousTimeout = &metav1.Duration{Duration: time.Second}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	util.MustFailDynamicDeleteOnce(t, clients, "pods", "instance-"+fixtures.ServiceInstanceName)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusUnprocessableEntity, req, api.ErrorAsyncRequired)
+	fixtures.AssertFixtureDeleted(t, clients)
+}
+
+// TestServiceInstanceCreateFailedRollbackRetry tests that resources created by a failed
+// service instance creation are deleted even when deletion transiently fails.
+func TestServiceInstanceCreateFailedRollbackRetry(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.RollbackBackoff = time.Millisecond
+	})()
+
+	// The pod is created first, then the namespace fails to create.
+	util.MustReplaceBrokerConfig(t, clients, concurrentDeleteConfiguration(1))
+
+	util.MustFailDynamicCreate(t, clients, "namespaces", fmt.Sprintf("instance-%s-0", fixtures.ServiceInstanceName), "exceeded quota: namespaces")
+	util.MustFailDynamicDeleteOnce(t, clients, "pods", "instance-"+fixtures.ServiceInstanceName)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if poll.State != api.PollStateFailed {
+			return fmt.Errorf("poll state %s, expected %s", poll.State, api.PollStateFailed)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	fixtures.AssertFixtureDeleted(t, clients)
+}
+
+// TestServiceInstanceCreateIDTooLong tests that the service broker rejects service
+// instance IDs that exceed the maximum length.
+func TestServiceInstanceCreateIDTooLong(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(strings.Repeat("a", config.GetOptions().MaxIDLength+1), util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
+// TestServiceInstanceCreateIDIllegal tests that the service broker rejects service
+// instance IDs that cannot be used to name Kubernetes resources.
+func TestServiceInstanceCreateIDIllegal(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI("Pinkie_Pie", util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
 // TestServiceInstanceCreateIllegalBody tests that the service broker rejects service
 // instance creation when the body isn't JSON.
 func TestServiceInstanceCreateIllegalBody(t *testing.T) {
@@ -71,6 +292,23 @@ func TestServiceInstanceCreateIllegalBody(t *testing.T) {
 	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, `illegal`, api.ErrorParameterError)
 }
 
+// TestServiceInstanceCreateBodyTooLarge tests that the service broker rejects service
+// instance creation when the body exceeds the maximum size, but accepts a normal one.
+func TestServiceInstanceCreateBodyTooLarge(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"padding":"` + strings.Repeat("x", broker.DefaultMaxRequestBodySize) + `"}`),
+	}
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusRequestEntityTooLarge, req, api.ErrorParameterError)
+
+	req = fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+}
+
 // TestServiceInstanceCreateIllegalConfiguration tests that the service broker handles
 // misconfiguration of the service catalog gracefully.  On this occasion the default
 // doesn't have any configuration bindings defined.
@@ -116,6 +354,215 @@ func TestServiceInstanceCreateInvalidPlan(t *testing.T) {
 	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
 }
 
+// TestServiceInstanceCreateNamespaceConflict tests that the service broker rejects
+// a service instance whose resources would collide with another service instance's.
+func TestServiceInstanceCreateNamespaceConflict(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	fixtures.MustCreateForeignFixture(t, clients, fixtures.AlternateServiceInstanceName)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusUnprocessableEntity, req, api.ErrorNamespaceConflict)
+	util.MustNotHaveRegistry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+}
+
+// collidingConfiguration returns the basic configuration with instance names that
+// are shortened, so long instance IDs that only differ at the end collide.
+func collidingConfiguration() *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.Registry[0].Value = `{{ printf "instance-%s" (registry "instance-id") | resourceName }}`
+
+	return configuration
+}
+
+// collidingInstanceIDs are service instance IDs whose instance names only differ
+// beyond the maximum resource name length.
+var collidingInstanceIDs = []string{
+	strings.Repeat("a", 63) + "-1",
+	strings.Repeat("a", 63) + "-2",
+}
+
+// TestServiceInstanceCreateNameCollisionHash tests that service instance names that
+// collide when shortened are made unique with a hash suffix.
+func TestServiceInstanceCreateNameCollisionHash(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, collidingConfiguration())
+
+	names := map[string]interface{}{}
+
+	for _, id := range collidingInstanceIDs {
+		req := fixtures.BasicServiceInstanceCreateRequest()
+		util.MustCreateServiceInstanceSuccessfully(t, id, req)
+
+		entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, id)
+
+		var name string
+		if err := json.Unmarshal(entry.Data["instance-name"], &name); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(name) > 63 {
+			t.Fatalf("instance name %s too long", name)
+		}
+
+		names[name] = nil
+	}
+
+	if len(names) != len(collidingInstanceIDs) {
+		t.Fatal("instance names collide", names)
+	}
+}
+
+// TestServiceInstanceCreateNameCollisionTruncate tests that service instance names
+// that collide when truncated are rejected when provisioning.
+func TestServiceInstanceCreateNameCollisionTruncate(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.NameCollisionStrategy = config.NameCollisionStrategyTruncate
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, collidingConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, collidingInstanceIDs[0], req)
+	util.MustPutAndError(t, util.ServiceInstanceURI(collidingInstanceIDs[1], util.CreateServiceInstanceQuery()), http.StatusUnprocessableEntity, req, api.ErrorNamespaceConflict)
+}
+
+// TestServiceInstanceCreateDefaultPlanRollout tests that service instances created
+// without a service plan are distributed across plans by weight, and that the
+// selected plan is stable.
+func TestServiceInstanceCreateDefaultPlanRollout(t *testing.T) {
+	defer mustReset(t)
+
+	util.PlanRolloutSource.Seed(rolloutSeed)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].DefaultPlanRollout = []v1.ServicePlanWeight{
+		{
+			Plan:   "test-plan",
+			Weight: rolloutWeight,
+		},
+		{
+			Plan:   "test-plan-2",
+			Weight: 1,
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	plans := map[string]int{}
+
+	for i := 0; i < rolloutInstances; i++ {
+		name := fmt.Sprintf("%s-%d", fixtures.ServiceInstanceName, i)
+
+		req := fixtures.BasicServiceInstanceCreateRequest()
+		req.PlanID = ""
+		util.MustCreateServiceInstanceSuccessfully(t, name, req)
+
+		query := &url.Values{}
+		query.Add(util.QueryServiceID, req.ServiceID)
+
+		read := &api.GetServiceInstanceResponse{}
+		util.MustGet(t, util.ServiceInstanceURI(name, query), http.StatusOK, read)
+
+		plans[read.PlanID]++
+
+		// Retrying the request must select the same plan, rather than conflict.
+		util.MustPut(t, util.ServiceInstanceURI(name, util.CreateServiceInstanceQuery()), http.StatusOK, req, nil)
+
+		reread := &api.GetServiceInstanceResponse{}
+		util.MustGet(t, util.ServiceInstanceURI(name, query), http.StatusOK, reread)
+		util.Assert(t, reread.PlanID == read.PlanID)
+	}
+
+	util.Assert(t, plans[fixtures.BasicConfigurationPlanID]+plans[fixtures.BasicConfigurationPlanID2] == rolloutInstances)
+	util.Assert(t, plans[fixtures.BasicConfigurationPlanID2] > 0)
+	util.Assert(t, plans[fixtures.BasicConfigurationPlanID] > rolloutWeight/2*plans[fixtures.BasicConfigurationPlanID2])
+}
+
+// TestServiceInstanceCreateNoPlan tests that a service instance cannot be created
+// without a service plan when there is no default plan rollout.
+func TestServiceInstanceCreateNoPlan(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.PlanID = ""
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+
+	// The service plan may not be omitted when retrying the request for an existing
+	// service instance either.
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, fixtures.BasicServiceInstanceCreateRequest())
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
+// TestServiceInstanceCreateDefaultPlanRolloutIllegalPlan tests that a default plan
+// rollout must reference service plans that exist.
+func TestServiceInstanceCreateDefaultPlanRolloutIllegalPlan(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].DefaultPlanRollout = []v1.ServicePlanWeight{
+		{
+			Plan:   "missing-plan",
+			Weight: 1,
+		},
+	}
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
+}
+
+// TestServiceInstanceCreateDefaultPlanRolloutIllegalWeight tests that a default plan
+// rollout must have positive weights.
+func TestServiceInstanceCreateDefaultPlanRolloutIllegalWeight(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].DefaultPlanRollout = []v1.ServicePlanWeight{
+		{
+			Plan:   "test-plan",
+			Weight: 0,
+		},
+	}
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
+}
+
+// TestServiceInstanceCreateNamespaceConflictOwner tests that a resource is only
+// considered owned by the service instance when all of its owner reference matches.
+func TestServiceInstanceCreateNamespaceConflictOwner(t *testing.T) {
+	owners := []metav1.OwnerReference{
+		// A different API group.
+		{
+			APIVersion: "example.com/v1",
+			Kind:       "Secret",
+			Name:       registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName),
+		},
+		// A previous incarnation of the service instance.
+		{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Name:       registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName),
+			UID:        "deleted",
+		},
+	}
+
+	for _, owner := range owners {
+		func() {
+			defer mustReset(t)
+
+			util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+			fixtures.MustCreateOwnedFixture(t, clients, owner)
+
+			req := fixtures.BasicServiceInstanceCreateRequest()
+			util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusUnprocessableEntity, req, api.ErrorNamespaceConflict)
+		}()
+	}
+}
+
 // TestServiceInstanceCreateWithSchema tests that the service broker accepts a
 // minimal service instance creation with schema validation.
 func TestServiceInstanceCreateWithSchema(t *testing.T) {
@@ -161,48 +608,1264 @@ func TestServiceInstanceCreateWithSchemaInvalid(t *testing.T) {
 	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorValidationError)
 }
 
+// TestServiceInstanceCreateWithSchemaInvalidFailures tests that schema validation
+// failures report which parameter failed, and the constraint that it violated.
+func TestServiceInstanceCreateWithSchemaInvalidFailures(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Schemas = fixtures.BasicSchema()
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"test":0}`),
+	}
+
+	e := &api.Error{}
+	util.MustPut(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, e)
+	util.Assert(t, e.Error == api.ErrorValidationError)
+	util.Assert(t, len(e.ValidationFailures) == 1)
+	util.Assert(t, e.ValidationFailures[0].Path == "/test")
+	util.Assert(t, e.ValidationFailures[0].Constraint == "minimum")
+	util.Assert(t, strings.Contains(e.ValidationFailures[0].Message, "greater than or equal to 1"))
+}
+
+// TestServiceInstanceCreateWithSchemaInvalidMultipleFailures tests that all schema
+// validation failures are reported together, rather than just the first.
+func TestServiceInstanceCreateWithSchemaInvalidMultipleFailures(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Schemas = &v1.Schemas{
+		ServiceInstance: &v1.ServiceInstanceSchema{
+			Create: &v1.InputParamtersSchema{
+				Parameters: &runtime.RawExtension{
+					Raw: []byte(`{"$schema":"http://json-schema.org/draft-04/schema#","type":"object","properties":{"test":{"type":"number","minimum":1},"name":{"type":"string","maxLength":3}}}`),
+				},
+			},
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"test":0,"name":"toolong"}`),
+	}
+
+	e := &api.Error{}
+	util.MustPut(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, e)
+	util.Assert(t, e.Error == api.ErrorValidationError)
+
+	constraints := map[string]string{}
+
+	for _, failure := range e.ValidationFailures {
+		constraints[failure.Path] = failure.Constraint
+	}
+
+	util.Assert(t, len(e.ValidationFailures) == 2)
+	util.Assert(t, constraints["/test"] == "minimum")
+	util.Assert(t, constraints["/name"] == "maxLength")
+}
+
 // TestServiceInstanceCreateWithRequiredSchemaNoParameters tests that the service broker
 // rejects a minimal service instance creation with required schema validation and no
 // parameters.
 func TestServiceInstanceCreateWithRequiredSchemaNoParameters(t *testing.T) {
 	defer mustReset(t)
 
-	configuration := fixtures.BasicConfiguration()
-	configuration.Catalog.Services[0].Plans[0].Schemas = fixtures.BasicSchemaRequired()
-	util.MustReplaceBrokerConfig(t, clients, configuration)
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Schemas = fixtures.BasicSchemaRequired()
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorValidationError)
+}
+
+// TestServiceInstanceCreateWithDraft07Schema tests that the service broker accepts
+// parameters that satisfy draft-07 conditional and constant keywords.
+func TestServiceInstanceCreateWithDraft07Schema(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Schemas = fixtures.ServiceInstanceCreateSchema(fixtures.Draft07SchemaParameters)
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"tier":"premium","replicas":3,"version":"7.0"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+}
+
+// TestServiceInstanceCreateWithDraft07SchemaInvalid tests that the service broker
+// rejects parameters that violate draft-07 keywords that draft-04 would ignore.
+func TestServiceInstanceCreateWithDraft07SchemaInvalid(t *testing.T) {
+	parameters := []string{
+		// The then clause requires replicas.
+		`{"tier":"premium"}`,
+		// The then clause requires at least 3 replicas.
+		`{"tier":"premium","replicas":2}`,
+		// The else clause allows at most 1 replica.
+		`{"tier":"basic","replicas":2}`,
+		// The version must be constant.
+		`{"version":"6.5"}`,
+	}
+
+	for _, parameter := range parameters {
+		func() {
+			defer mustReset(t)
+
+			configuration := fixtures.BasicConfiguration()
+			configuration.Catalog.Services[0].Plans[0].Schemas = fixtures.ServiceInstanceCreateSchema(fixtures.Draft07SchemaParameters)
+			util.MustReplaceBrokerConfig(t, clients, configuration)
+
+			req := fixtures.BasicServiceInstanceCreateRequest()
+			req.Parameters = &runtime.RawExtension{
+				Raw: []byte(parameter),
+			}
+			util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorValidationError)
+		}()
+	}
+}
+
+// TestServiceInstanceCreateWithUnsupportedSchemaDraft tests that a schema with an
+// unsupported draft is rejected by configuration validation.
+func TestServiceInstanceCreateWithUnsupportedSchemaDraft(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].Schemas = fixtures.ServiceInstanceCreateSchema(fixtures.UnsupportedDraftSchemaParameters)
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
+}
+
+// TestServiceInstanceCreateWithIncludes tests that a resource can be composed from
+// reusable partial templates.
+func TestServiceInstanceCreateWithIncludes(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates = append(configuration.Templates,
+		v1.ConfigurationTemplate{
+			Name:     "labels-partial",
+			Template: &runtime.RawExtension{Raw: []byte(`{"app":"{{ .app }}","instance":"{{ registry \"instance-id\" }}"}`)},
+		},
+		v1.ConfigurationTemplate{
+			Name:     "node-selector-partial",
+			Template: &runtime.RawExtension{Raw: []byte(`{"disktype":"ssd"}`)},
+		},
+	)
+	// Include the partials in the templated resource, test-template.
+	configuration.Templates[3].Includes = []v1.ConfigurationTemplateInclude{
+		{
+			Name:       "labels-partial",
+			Path:       "/metadata/labels",
+			Parameters: &runtime.RawExtension{Raw: []byte(`{"app":"wolverine"}`)},
+		},
+		{
+			Name: "node-selector-partial",
+			Path: "/spec/nodeSelector",
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	fixtures.AssertFixtureFieldSet(t, clients, "wolverine", "metadata", "labels", "app")
+	fixtures.AssertFixtureFieldSet(t, clients, fixtures.ServiceInstanceName, "metadata", "labels", "instance")
+	fixtures.AssertFixtureFieldSet(t, clients, "ssd", "spec", "nodeSelector", "disktype")
+}
+
+// TestServiceInstanceCreateWithIncludeCycle tests that templates that include each
+// other are rejected by configuration validation.
+func TestServiceInstanceCreateWithIncludeCycle(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates[0].Includes = []v1.ConfigurationTemplateInclude{
+		{
+			Name: configuration.Templates[1].Name,
+			Path: "/cycle",
+		},
+	}
+	configuration.Templates[1].Includes = []v1.ConfigurationTemplateInclude{
+		{
+			Name: configuration.Templates[0].Name,
+			Path: "/cycle",
+		},
+	}
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
+	util.MustHaveBrokerConfigInvalidMessage(t, clients, "template include cycle "+configuration.Templates[0].Name+" -> "+configuration.Templates[1].Name+" -> "+configuration.Templates[0].Name)
+}
+
+// includeChainConfiguration returns the basic configuration where the templated
+// resource includes a chain of partials nested to the requested depth.
+func includeChainConfiguration(depth int) *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates[3].Includes = []v1.ConfigurationTemplateInclude{
+		{
+			Name: "chain-partial-1",
+			Path: "/spec/chain",
+		},
+	}
+
+	for i := 1; i <= depth; i++ {
+		partial := v1.ConfigurationTemplate{
+			Name:     fmt.Sprintf("chain-partial-%d", i),
+			Template: &runtime.RawExtension{Raw: []byte(`{}`)},
+		}
+
+		if i == depth {
+			partial.Template.Raw = []byte(`{"depth":"bottom"}`)
+		} else {
+			partial.Includes = []v1.ConfigurationTemplateInclude{
+				{
+					Name: fmt.Sprintf("chain-partial-%d", i+1),
+					Path: "/next",
+				},
+			}
+		}
+
+		configuration.Templates = append(configuration.Templates, partial)
+	}
+
+	return configuration
+}
+
+// TestServiceInstanceCreateWithIncludeMaxDepth tests that includes nested to the
+// maximum depth are rendered.
+func TestServiceInstanceCreateWithIncludeMaxDepth(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, includeChainConfiguration(config.GetOptions().MaxIncludeDepth))
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	path := []string{"spec", "chain"}
+	for i := 1; i < config.GetOptions().MaxIncludeDepth; i++ {
+		path = append(path, "next")
+	}
+
+	fixtures.AssertFixtureFieldSet(t, clients, "bottom", append(path, "depth")...)
+}
+
+// TestServiceInstanceCreateWithIncludeTooDeep tests that includes nested beyond the
+// maximum depth are rejected by configuration validation.
+func TestServiceInstanceCreateWithIncludeTooDeep(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, includeChainConfiguration(config.GetOptions().MaxIncludeDepth+1))
+	util.MustHaveBrokerConfigInvalidMessage(t, clients, fmt.Sprintf("template include depth exceeds maximum of %d", config.GetOptions().MaxIncludeDepth))
+}
+
+// rangedConfiguration returns the basic configuration with an additional pod that
+// is instantiated once per element of the "nodes" parameter.
+func rangedConfiguration() *v1.ServiceBrokerConfigSpec {
+	maxItems := 3
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name:     "ranged-template",
+		Template: &runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"{{ printf \"%s-%d\" (registry \"instance-name\") .index }}","labels":{"node":"{{ .element }}"}}}`)},
+		Range: &v1.ConfigurationTemplateRange{
+			Over:     `{{ parameter "/nodes" }}`,
+			MaxItems: &maxItems,
+		},
+	})
+	configuration.Bindings[0].ServiceInstance.Templates = append(configuration.Bindings[0].ServiceInstance.Templates, "ranged-template")
+
+	return configuration
+}
+
+// TestServiceInstanceCreateWithRange tests that a ranged template creates a resource
+// per element of a list parameter.
+func TestServiceInstanceCreateWithRange(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, rangedConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"nodes":["data","index","query"]}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	for index, node := range []string{"data", "index", "query"} {
+		fixtures.AssertNamedFixtureFieldSet(t, clients, fmt.Sprintf("instance-%s-%d", fixtures.ServiceInstanceName, index), node, "metadata", "labels", "node")
+	}
+}
+
+// mustUpdateRangedServiceInstance creates a service instance with one ranged pod per
+// node, then updates it with a different list of nodes.
+func mustUpdateRangedServiceInstance(t *testing.T, nodes, updatedNodes string) {
+	util.MustReplaceBrokerConfig(t, clients, rangedConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"nodes":` + nodes + `}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	update := fixtures.BasicServiceInstanceUpdateRequest()
+	update.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"nodes":` + updatedNodes + `}`),
+	}
+	util.MustUpdateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, update)
+}
+
+// TestServiceInstanceUpdateWithRangeGrow tests that growing a range updates existing
+// resources and creates new ones.
+func TestServiceInstanceUpdateWithRangeGrow(t *testing.T) {
+	defer mustReset(t)
+
+	mustUpdateRangedServiceInstance(t, `["data","index"]`, `["query","index","data"]`)
+
+	for index, node := range []string{"query", "index", "data"} {
+		fixtures.AssertNamedFixtureFieldSet(t, clients, fmt.Sprintf("instance-%s-%d", fixtures.ServiceInstanceName, index), node, "metadata", "labels", "node")
+	}
+}
+
+// TestServiceInstanceUpdateWithRangeShrink tests that shrinking a range updates the
+// remaining resources and deletes the removed ones.
+func TestServiceInstanceUpdateWithRangeShrink(t *testing.T) {
+	defer mustReset(t)
+
+	mustUpdateRangedServiceInstance(t, `["data","index","query"]`, `["query"]`)
+
+	fixtures.AssertNamedFixtureFieldSet(t, clients, fmt.Sprintf("instance-%s-0", fixtures.ServiceInstanceName), "query", "metadata", "labels", "node")
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	for index := 1; index < 3; index++ {
+		name := fmt.Sprintf("instance-%s-%d", fixtures.ServiceInstanceName, index)
+		if _, err := clients.Dynamic().Resource(gvr).Namespace(util.Namespace).Get(context.TODO(), name, metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+			t.Fatalf("expected pod %s to be deleted: %v", name, err)
+		}
+	}
+
+	// The removed elements are no longer recorded, so deletion of the service
+	// instance does not try to delete them again.
+	util.MustDeleteServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, fixtures.BasicServiceInstanceCreateRequest())
+}
+
+// TestServiceInstanceCreateWithRangePlanLimit tests that a service plan limit on ranges
+// rejects a list that the template alone would allow.
+func TestServiceInstanceCreateWithRangePlanLimit(t *testing.T) {
+	defer mustReset(t)
+
+	maxRangeItems := 2
+
+	configuration := rangedConfiguration()
+	configuration.Catalog.Services[0].Plans[0].MaxRangeItems = &maxRangeItems
+
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"nodes":["data","index","query"]}`),
+	}
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
+// conditionalConfiguration returns a configuration that creates a replica only when
+// the "ha" parameter is true.
+func conditionalConfiguration() *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name:     "replica-template",
+		Template: &runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"{{ printf \"%s-replica\" (registry \"instance-name\") }}"}}`)},
+	})
+	configuration.Bindings[0].ServiceInstance.ConditionalTemplates = []v1.ServiceBrokerConditionalTemplates{
+		{
+			Condition: `{{ parameter "/ha" }}`,
+			Templates: []string{"replica-template"},
+		},
+	}
+
+	return configuration
+}
+
+// mustCreateConditionalServiceInstance creates a service instance with the "ha" parameter
+// and returns whether the replica was created.
+func mustCreateConditionalServiceInstance(t *testing.T, ha bool) bool {
+	util.MustReplaceBrokerConfig(t, clients, conditionalConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(fmt.Sprintf(`{"ha":%v}`, ha)),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	_, err := clients.Dynamic().Resource(gvr).Namespace(util.Namespace).Get(context.TODO(), "instance-"+fixtures.ServiceInstanceName+"-replica", metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		t.Fatal(err)
+	}
+
+	return err == nil
+}
+
+// TestServiceInstanceCreateConditionalTemplates tests that conditional templates are
+// created when their condition is true.
+func TestServiceInstanceCreateConditionalTemplates(t *testing.T) {
+	defer mustReset(t)
+
+	util.Assert(t, mustCreateConditionalServiceInstance(t, true))
+}
+
+// TestServiceInstanceCreateConditionalTemplatesOmitted tests that conditional templates
+// are not created when their condition is false.
+func TestServiceInstanceCreateConditionalTemplatesOmitted(t *testing.T) {
+	defer mustReset(t)
+
+	util.Assert(t, !mustCreateConditionalServiceInstance(t, false))
+}
+
+// TestServiceInstanceConditionalTemplatesMissing tests that conditional templates must
+// exist.
+func TestServiceInstanceConditionalTemplatesMissing(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := conditionalConfiguration()
+	configuration.Bindings[0].ServiceInstance.ConditionalTemplates[0].Templates = []string{"missing-template"}
+	util.MustReplaceBrokerConfigWithInvalidCondition(t, clients, configuration)
+}
+
+// TestServiceInstanceCreateWithRangeTooLong tests that a ranged template rejects a
+// list that exceeds the maximum number of items.
+func TestServiceInstanceCreateWithRangeTooLong(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, rangedConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"nodes":["data","data","data","data"]}`),
+	}
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorParameterError)
+}
+
+// TestServiceInstanceDeleteWithPreDelete tests that a pre-delete action must complete
+// before the resource it is attached to is deleted.
+func TestServiceInstanceDeleteWithPreDelete(t *testing.T) {
+	defer mustReset(t)
+
+	jobName := "instance-" + fixtures.ServiceInstanceName + "-snapshot"
+	jobGVR := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name:     "snapshot-job",
+		Template: &runtime.RawExtension{Raw: []byte(`{"apiVersion":"batch/v1","kind":"Job","metadata":{"name":"{{ printf \"%s-snapshot\" (registry \"instance-name\") }}"}}`)},
+	})
+	// Snapshot the templated resource, test-template, before deletion.
+	configuration.Templates[3].PreDelete = []v1.ConfigurationTemplatePreDelete{
+		{
+			Template: "snapshot-job",
+			ReadinessChecks: []v1.ConfigurationReadinessCheck{
+				{
+					Name: "snapshot-complete",
+					Condition: &v1.ConfigurationReadinessCheckCondition{
+						APIVersion: "batch/v1",
+						Kind:       "Job",
+						Namespace:  `{{ registry "namespace" }}`,
+						Name:       `{{ printf "%s-snapshot" (registry "instance-name") }}`,
+						Type:       "Complete",
+						Status:     "True",
+					},
+				},
+			},
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	rsp := util.MustDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		_, err := clients.Dynamic().Resource(jobGVR).Namespace(util.Namespace).Get(context.TODO(), jobName, metav1.GetOptions{})
+		return err
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	// The resource must not be deleted until the job has completed.
+	mustWaitForPollDescription(t, fixtures.ServiceInstanceName, rsp, "running pre-delete action snapshot-job")
+	fixtures.MustGetFixtureField(t, clients, "metadata", "name")
+
+	job, err := clients.Dynamic().Resource(jobGVR).Namespace(util.Namespace).Get(context.TODO(), jobName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conditions := []interface{}{
+		map[string]interface{}{
+			"type":   "Complete",
+			"status": "True",
+		},
+	}
+
+	if err := unstructured.SetNestedSlice(job.Object, conditions, "status", "conditions"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clients.Dynamic().Resource(jobGVR).Namespace(util.Namespace).Update(context.TODO(), job, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	util.MustPollServiceInstanceForDeletion(t, fixtures.ServiceInstanceName, rsp)
+	fixtures.AssertFixtureDeleted(t, clients)
+}
+
+// TestServiceInstanceDeleteResourcesGone tests that deprovisioning succeeds when the
+// resources created for the service instance have already been deleted, without running
+// pre-delete actions for them.
+func TestServiceInstanceDeleteResourcesGone(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name:     "snapshot-job",
+		Template: &runtime.RawExtension{Raw: []byte(`{"apiVersion":"batch/v1","kind":"Job","metadata":{"name":"{{ printf \"%s-snapshot\" (registry \"instance-name\") }}"}}`)},
+	})
+	// The snapshot never completes, so would fail deletion if it were run.
+	configuration.Templates[3].PreDelete = []v1.ConfigurationTemplatePreDelete{
+		{
+			Template: "snapshot-job",
+			ReadinessChecks: []v1.ConfigurationReadinessCheck{
+				{
+					Name: "snapshot-complete",
+					Condition: &v1.ConfigurationReadinessCheckCondition{
+						APIVersion: "batch/v1",
+						Kind:       "Job",
+						Namespace:  `{{ registry "namespace" }}`,
+						Name:       `{{ printf "%s-snapshot" (registry "instance-name") }}`,
+						Type:       "Complete",
+						Status:     "True",
+					},
+				},
+			},
+			Timeout: &metav1.Duration{Duration: time.Second},
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	if err := clients.Dynamic().Resource(gvr).Namespace(util.Namespace).Delete(context.TODO(), "instance-"+fixtures.ServiceInstanceName, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	util.MustDeleteServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+	util.MustNotHaveRegistry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	jobGVR := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+
+	if _, err := clients.Dynamic().Resource(jobGVR).Namespace(util.Namespace).Get(context.TODO(), "instance-"+fixtures.ServiceInstanceName+"-snapshot", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Fatalf("pre-delete action run for deleted resource: %v", err)
+	}
+}
+
+// namespaceConfiguration returns a configuration that creates a namespace per service
+// instance, and waits for it to be removed when the service instance is deleted.
+func namespaceConfiguration(timeout time.Duration) *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name:     "instance-namespace",
+		Template: &runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"{{ printf \"%s-namespace\" (registry \"instance-name\") }}"}}`)},
+		WaitForDeletion: &v1.ConfigurationTemplateWaitForDeletion{
+			Timeout: &metav1.Duration{Duration: timeout},
+		},
+	})
+	configuration.Bindings[0].ServiceInstance.Templates = append(configuration.Bindings[0].ServiceInstance.Templates, "instance-namespace")
+
+	return configuration
+}
+
+// TestServiceInstanceDeleteWaitForNamespace tests that deprovisioning waits for a
+// namespace to finish terminating before reporting success.
+func TestServiceInstanceDeleteWaitForNamespace(t *testing.T) {
+	defer mustReset(t)
+
+	namespace := "instance-" + fixtures.ServiceInstanceName + "-namespace"
+
+	util.MustReplaceBrokerConfig(t, clients, namespaceConfiguration(time.Minute))
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	util.MustDelayDynamicDelete(t, clients, "namespaces", namespace, time.Second)
+
+	rsp := util.MustDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+	mustWaitForPollDescription(t, fixtures.ServiceInstanceName, rsp, "waiting for v1/Namespace "+namespace+" to be removed")
+	util.MustPollServiceInstanceForDeletion(t, fixtures.ServiceInstanceName, rsp)
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	if _, err := clients.Dynamic().Resource(gvr).Get(context.TODO(), namespace, metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Fatalf("expected namespace to be removed, got %v", err)
+	}
+}
+
+// concurrentDeleteConfiguration returns a configuration that creates a number of
+// independent namespaces per service instance, each of which is removed slowly.
+func concurrentDeleteConfiguration(count int) *v1.ServiceBrokerConfigSpec {
+	configuration := fixtures.BasicConfiguration()
+
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("instance-namespace-%d", i)
+
+		configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+			Name:     name,
+			Template: &runtime.RawExtension{Raw: []byte(fmt.Sprintf(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"{{ printf \"%%s-%d\" (registry \"instance-name\") }}"}}`, i))},
+			WaitForDeletion: &v1.ConfigurationTemplateWaitForDeletion{
+				Timeout: &metav1.Duration{Duration: time.Minute},
+			},
+		})
+		configuration.Bindings[0].ServiceInstance.Templates = append(configuration.Bindings[0].ServiceInstance.Templates, name)
+	}
+
+	return configuration
+}
+
+// mustCreateForConcurrentDelete creates a service instance with a number of slowly
+// removed resources.
+func mustCreateForConcurrentDelete(t testing.TB, count int, delay time.Duration) *api.CreateServiceInstanceRequest {
+	util.MustReplaceBrokerConfig(t, clients, concurrentDeleteConfiguration(count))
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	for i := 0; i < count; i++ {
+		util.MustDelayDynamicDelete(t, clients, "namespaces", fmt.Sprintf("instance-%s-%d", fixtures.ServiceInstanceName, i), delay)
+	}
+
+	return req
+}
+
+// TestServiceInstanceDeleteConcurrent tests that independent resources deleted
+// concurrently are all removed.
+func TestServiceInstanceDeleteConcurrent(t *testing.T) {
+	defer mustReset(t)
+
+	count := 4
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.DeleteConcurrency = count
+	})()
+
+	req := mustCreateForConcurrentDelete(t, count, 100*time.Millisecond)
+
+	rsp := util.MustDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+	util.MustPollServiceInstanceForDeletion(t, fixtures.ServiceInstanceName, rsp)
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	for i := 0; i < count; i++ {
+		if _, err := clients.Dynamic().Resource(gvr).Get(context.TODO(), fmt.Sprintf("instance-%s-%d", fixtures.ServiceInstanceName, i), metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+			t.Fatalf("expected namespace to be removed, got %v", err)
+		}
+	}
+}
+
+// BenchmarkDeleteServiceInstance measures how long a service instance with a number
+// of slowly removed resources takes to delete, serially and concurrently.  Deleting
+// concurrently should take about as long as the slowest resource, rather than the
+// sum of them all.
+func BenchmarkDeleteServiceInstance(b *testing.B) {
+	count := 4
+	delay := 100 * time.Millisecond
+
+	for _, concurrency := range []int{1, count} {
+		concurrency := concurrency
+
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			defer util.SetOptions(func(o *config.Options) {
+				o.DeleteConcurrency = concurrency
+			})()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+
+				req := mustCreateForConcurrentDelete(b, count, delay)
+
+				b.StartTimer()
+
+				rsp := util.MustDeleteServiceInstance(b, fixtures.ServiceInstanceName, req)
+				util.MustPollServiceInstanceForDeletion(b, fixtures.ServiceInstanceName, rsp)
+
+				b.StopTimer()
+
+				mustReset(b)
+			}
+		})
+	}
+}
+
+// TestServiceInstanceDeleteWaitForNamespaceTimeout tests that deprovisioning fails
+// if a namespace is stuck terminating.
+func TestServiceInstanceDeleteWaitForNamespaceTimeout(t *testing.T) {
+	defer mustReset(t)
+
+	namespace := "instance-" + fixtures.ServiceInstanceName + "-namespace"
+
+	util.MustReplaceBrokerConfig(t, clients, namespaceConfiguration(time.Second))
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	util.MustDelayDynamicDelete(t, clients, "namespaces", namespace, time.Hour)
+
+	rsp := util.MustDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if poll.State != api.PollStateFailed {
+			return fmt.Errorf("poll state %v", poll.State)
+		}
+
+		util.Assert(t, strings.Contains(poll.Description, "v1/Namespace "+namespace+" is stuck terminating"))
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+}
+
+// TestServiceInstancePoll tests polling a completed service instance creation
+// is ok.
+func TestServiceInstancePoll(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+}
+
+// TestServiceInstancePollWithReadiness tests that a configuration with readiness checks
+// responds correctly.
+func TestServiceInstancePollWithReadiness(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	poll := &api.PollServiceInstanceResponse{}
+	util.MustGet(t, util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll)
+	util.Assert(t, poll.State == api.PollStateInProgress)
+
+	fixtures.MustSetFixtureField(t, clients, fixtures.BasicResourceStatus(t), "status")
+
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+}
+
+// TestServiceInstancePollWithFieldReadiness tests that provisioning does not complete
+// until a numeric resource field reaches the requested threshold.
+func TestServiceInstancePollWithFieldReadiness(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.ReadinessChecks = []v1.ConfigurationReadinessCheck{
+		{
+			Name: "replicas-ready",
+			Field: &v1.ConfigurationReadinessCheckField{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Namespace:  `{{ registry "namespace" }}`,
+				Name:       `{{ registry "instance-name" }}`,
+				Path:       "/status/readyReplicas",
+				Operator:   v1.ReadinessOperatorGreaterThanOrEqual,
+				Value:      `{{ parameter "/replicas" }}`,
+			},
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"replicas":3}`),
+	}
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	mustWaitForPollDescription(t, fixtures.ServiceInstanceName, rsp, "waiting for readiness")
+
+	fixtures.MustSetFixtureField(t, clients, int64(2), "status", "readyReplicas")
+
+	poll := &api.PollServiceInstanceResponse{}
+	util.MustGet(t, util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll)
+	util.Assert(t, poll.State == api.PollStateInProgress)
+
+	fixtures.MustSetFixtureField(t, clients, int64(3), "status", "readyReplicas")
+
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+}
+
+// TestServiceInstancePollWithResourceReadiness tests that provisioning does not
+// complete until a resource created by something other than the service broker
+// exists.
+func TestServiceInstancePollWithResourceReadiness(t *testing.T) {
+	defer mustReset(t)
+
+	serviceName := "instance-" + fixtures.ServiceInstanceName + "-external"
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.ReadinessChecks = []v1.ConfigurationReadinessCheck{
+		{
+			Name: "external-service",
+			Resource: &v1.ConfigurationReadinessCheckResource{
+				APIVersion: "v1",
+				Kind:       "Service",
+				Namespace:  `{{ registry "namespace" }}`,
+				Name:       `{{ printf "%s-external" (registry "instance-name") }}`,
+			},
+		},
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	mustWaitForPollDescription(t, fixtures.ServiceInstanceName, rsp, "waiting for readiness")
+
+	service := &unstructured.Unstructured{}
+	service.SetAPIVersion("v1")
+	service.SetKind("Service")
+	service.SetName(serviceName)
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	if _, err := clients.Dynamic().Resource(gvr).Namespace(util.Namespace).Create(context.TODO(), service, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+}
+
+// TestServiceInstancePollWithProgress tests that provisioning checkpoints are
+// reported by polling before the operation completes.
+func TestServiceInstancePollWithProgress(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		util.Assert(t, poll.State == api.PollStateInProgress)
+
+		expected := "asynchronous provisioning in progress: 2/2 resources created, step default (1/1) waiting for readiness"
+		if poll.Description != expected {
+			return fmt.Errorf("poll description %s, expected %s", poll.Description, expected)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	fixtures.MustSetFixtureField(t, clients, fixtures.BasicResourceStatus(t), "status")
+
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+}
+
+// TestServiceInstancePollRetention tests that the result of a completed operation can
+// be polled for again until the retention period expires, after which it is pruned.
+func TestServiceInstancePollRetention(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.OperationRetention = time.Second
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+
+	uri := util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp))
+
+	poll := &api.PollServiceInstanceResponse{}
+	util.MustGet(t, uri, http.StatusOK, poll)
+	util.Assert(t, poll.State == api.PollStateSucceeded)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.OperationResultID, rsp.Operation)
+
+	time.Sleep(config.GetOptions().OperationRetention)
+
+	util.MustGetAndError(t, uri, http.StatusBadRequest, api.ErrorQueryError)
+
+	entry = util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustNotHaveRegistryEntry(t, entry, registry.OperationResultID)
+}
+
+// TestServiceInstanceRetentionPruned tests that expired operation results are pruned
+// by the periodic sweep, even if the client never polls again.
+func TestServiceInstanceRetentionPruned(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.OperationRetention = time.Minute
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	clock, restore := util.UseFakeClock()
+	defer restore()
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+
+	configuration := &broker.ServerConfiguration{
+		Namespace: util.Namespace,
+	}
+
+	// Unexpired results are retained.
+	broker.PruneOperationResults(configuration)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustHaveRegistryEntryWithValue(t, entry, registry.OperationResultID, rsp.Operation)
+
+	clock.Advance(2 * time.Minute)
+
+	broker.PruneOperationResults(configuration)
+
+	entry = util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustNotHaveRegistryEntry(t, entry, registry.OperationResultID)
+}
+
+// TestServiceInstancePollReadinessDeadline tests that readiness checks that never
+// pass fail the operation once the readiness deadline expires, rather than waiting
+// for the longer readiness check timeout.
+func TestServiceInstancePollReadinessDeadline(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfigurationWithReadiness()
+	configuration.Bindings[0].ServiceInstance.ReadinessDeadline = &metav1.Duration{Duration: time.Second}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if poll.State != api.PollStateFailed {
+			return fmt.Errorf("poll state %s, expected %s", poll.State, api.PollStateFailed)
+		}
+
+		if !strings.Contains(poll.Description, "readiness deadline") || !strings.Contains(poll.Description, "contains no status conditions") {
+			return fmt.Errorf("poll description %s, expected readiness deadline failure", poll.Description)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, 10*time.Second)
+}
+
+// probeConfiguration returns a configuration that probes the given URL once the service
+// instance has been provisioned.
+func probeConfiguration(url string) *v1.ServiceBrokerConfigSpec {
+	attempts := 2
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Bindings[0].ServiceInstance.PostProvisionProbes = []v1.ConfigurationProbe{
+		{
+			Name: "http",
+			HTTP: &v1.ConfigurationProbeHTTP{
+				URL: url,
+			},
+			Attempts: &attempts,
+			Period:   &metav1.Duration{Duration: 10 * time.Millisecond},
+		},
+	}
+
+	return configuration
+}
+
+// TestServiceInstanceCreatePostProvisionProbe tests that provisioning succeeds once
+// post-provision probes pass.
+func TestServiceInstanceCreatePostProvisionProbe(t *testing.T) {
+	defer mustReset(t)
+
+	var probes int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+	}))
+	defer server.Close()
+
+	util.MustReplaceBrokerConfig(t, clients, probeConfiguration(server.URL))
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+	util.Assert(t, atomic.LoadInt32(&probes) == 1)
+}
+
+// TestServiceInstanceCreatePostProvisionProbeFailed tests that provisioning fails with
+// the probe error when post-provision probes do not pass.
+func TestServiceInstanceCreatePostProvisionProbeFailed(t *testing.T) {
+	defer mustReset(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	util.MustReplaceBrokerConfig(t, clients, probeConfiguration(server.URL))
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if poll.State != api.PollStateFailed {
+			return fmt.Errorf("poll state %s, expected %s", poll.State, api.PollStateFailed)
+		}
+
+		if !strings.Contains(poll.Description, "probe http failed after 2 attempts") || !strings.Contains(poll.Description, "returned 503") {
+			return fmt.Errorf("poll description %s, expected probe failure", poll.Description)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+}
+
+// TestServiceInstanceDeleteCancelsProvisioning tests that deprovisioning a service
+// instance while provisioning is in progress cancels provisioning and rolls back any
+// resources created so far.
+func TestServiceInstanceDeleteCancelsProvisioning(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if !strings.HasSuffix(poll.Description, "waiting for readiness") {
+			return fmt.Errorf("poll description %s, expected readiness wait", poll.Description)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	// Cancellation is synchronous, so resources are rolled back by the time the
+	// deprovision is accepted.
+	deleteRsp := util.MustDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+	util.Assert(t, deleteRsp.Operation != rsp.Operation)
+	fixtures.AssertFixtureDeleted(t, clients)
+
+	util.MustPollServiceInstanceForDeletion(t, fixtures.ServiceInstanceName, deleteRsp)
+}
+
+// TestServiceInstanceCreateSynchronousCancelledByDelete tests that deprovisioning a
+// service instance while it is being provisioned synchronously cancels provisioning,
+// and the client is told so.
+func TestServiceInstanceCreateSynchronousCancelledByDelete(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfigurationWithReadiness()
+	configuration.Catalog.Services[0].Plans[0].SynchronousTimeout = &metav1.Duration{Duration: time.Minute}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+
+	result := make(chan error)
+
+	go func() {
+		result <- util.PutAndError(util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusUnprocessableEntity, req, api.ErrorOperationCancelled)
+	}()
+
+	callback := func() error {
+		entry, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Get(context.TODO(), registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		progress := string(entry.Data[string(registry.OperationProgress)])
+		if !strings.Contains(progress, "waiting for readiness") {
+			return fmt.Errorf("operation progress %s, expected readiness wait", progress)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	deleteRsp := util.MustDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+
+	fixtures.AssertFixtureDeleted(t, clients)
+
+	util.MustPollServiceInstanceForDeletion(t, fixtures.ServiceInstanceName, deleteRsp)
+}
+
+// mustWaitForPollDescription waits until an in progress service instance operation
+// reports the expected progress.
+func mustWaitForPollDescription(t *testing.T, name string, rsp *api.CreateServiceInstanceResponse, progress string) {
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(name, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if poll.State != api.PollStateInProgress || !strings.Contains(poll.Description, progress) {
+			return fmt.Errorf("poll state %s, description %s, expected %s", poll.State, poll.Description, progress)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+}
+
+// TestServiceInstanceCreateOperationLimitQueued tests that provisioning beyond the
+// concurrent operation limit is queued until a slot is available.
+func TestServiceInstanceCreateOperationLimitQueued(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.MaxConcurrentOperations = 1
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
 
 	req := fixtures.BasicServiceInstanceCreateRequest()
-	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorValidationError)
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+	mustWaitForPollDescription(t, fixtures.ServiceInstanceName, rsp, "waiting for readiness")
+
+	// The second service instance must not start until the first has completed.
+	alternateRsp := util.MustCreateServiceInstance(t, fixtures.AlternateServiceInstanceName, req)
+	mustWaitForPollDescription(t, fixtures.AlternateServiceInstanceName, alternateRsp, "queued")
+
+	fixtures.MustSetFixtureField(t, clients, fixtures.BasicResourceStatus(t), "status")
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+
+	mustWaitForPollDescription(t, fixtures.AlternateServiceInstanceName, alternateRsp, "waiting for readiness")
+	fixtures.MustSetInstanceFixtureField(t, clients, fixtures.AlternateServiceInstanceName, fixtures.BasicResourceStatus(t), "status")
+	util.MustPollServiceInstanceForCompletion(t, fixtures.AlternateServiceInstanceName, alternateRsp)
 }
 
-// TestServiceInstancePoll tests polling a completed service instance creation
-// is ok.
-func TestServiceInstancePoll(t *testing.T) {
+// TestServiceInstanceCreateOperationLimitRejected tests that provisioning beyond the
+// concurrent operation limit is rejected when configured.
+func TestServiceInstanceCreateOperationLimitRejected(t *testing.T) {
 	defer mustReset(t)
 
-	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+	defer util.SetOptions(func(o *config.Options) {
+		o.MaxConcurrentOperations = 1
+		o.RejectExcessOperations = true
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
 
 	req := fixtures.BasicServiceInstanceCreateRequest()
-	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+	mustWaitForPollDescription(t, fixtures.ServiceInstanceName, rsp, "waiting for readiness")
+
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.AlternateServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusTooManyRequests, req, api.ErrorQuotaExceeded)
+	util.MustNotHaveRegistry(t, clients, registry.ServiceInstance, fixtures.AlternateServiceInstanceName)
+
+	fixtures.MustSetFixtureField(t, clients, fixtures.BasicResourceStatus(t), "status")
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
 }
 
-// TestServiceInstancePollWithReadiness tests that a configuration with readiness checks
-// responds correctly.
-func TestServiceInstancePollWithReadiness(t *testing.T) {
+// TestServiceInstanceCreateServiceProvisionLimit tests that provisioning beyond a service
+// offering's concurrent provisioning limit is queued, while other service offerings are
+// provisioned immediately.
+func TestServiceInstanceCreateServiceProvisionLimit(t *testing.T) {
 	defer mustReset(t)
 
-	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
+	serviceID := "b1f4a0c6-7c56-4f1c-9d3b-4f6e0d7a2e51"
+	planID := "6a0d3c8e-2b7f-4e4a-8f1d-5c9b7e3a1d42"
+	otherInstanceName := "other-instance"
+
+	configuration := fixtures.BasicConfigurationWithReadiness()
+	configuration.Catalog.Services[0].MaxConcurrentProvisions = 1
+	configuration.Catalog.Services = append(configuration.Catalog.Services, v1.ServiceOffering{
+		Name:                    "test-offering-2",
+		ID:                      serviceID,
+		Description:             "another test offering",
+		MaxConcurrentProvisions: 1,
+		Plans: []v1.ServicePlan{
+			{
+				Name:        "test-plan",
+				ID:          planID,
+				Description: "a test plan",
+			},
+		},
+	})
+	configuration.Bindings = append(configuration.Bindings, v1.ConfigurationBinding{
+		Name:    "test-binding-3",
+		Service: "test-offering-2",
+		Plan:    "test-plan",
+		ServiceInstance: v1.ServiceBrokerTemplateList{
+			Registry: []v1.RegistryValue{
+				{
+					Name:  "instance-name",
+					Value: `{{ printf "instance-%s" (registry "instance-id") }}`,
+				},
+			},
+			Templates: []string{
+				"test-template",
+			},
+		},
+	})
+	util.MustReplaceBrokerConfig(t, clients, configuration)
 
 	req := fixtures.BasicServiceInstanceCreateRequest()
 	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+	mustWaitForPollDescription(t, fixtures.ServiceInstanceName, rsp, "waiting for readiness")
 
-	poll := &api.PollServiceInstanceResponse{}
-	util.MustGet(t, util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll)
-	util.Assert(t, poll.State == api.PollStateInProgress)
+	// The second service instance must not start until the first has completed.
+	alternateRsp := util.MustCreateServiceInstance(t, fixtures.AlternateServiceInstanceName, req)
+	mustWaitForPollDescription(t, fixtures.AlternateServiceInstanceName, alternateRsp, "queued")
 
-	fixtures.MustSetFixtureField(t, clients, fixtures.BasicResourceStatus(t), "status")
+	// Other service offerings are unaffected.
+	otherReq := &api.CreateServiceInstanceRequest{
+		ServiceID: serviceID,
+		PlanID:    planID,
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, otherInstanceName, otherReq)
 
+	fixtures.MustSetFixtureField(t, clients, fixtures.BasicResourceStatus(t), "status")
 	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+
+	mustWaitForPollDescription(t, fixtures.AlternateServiceInstanceName, alternateRsp, "waiting for readiness")
+	fixtures.MustSetInstanceFixtureField(t, clients, fixtures.AlternateServiceInstanceName, fixtures.BasicResourceStatus(t), "status")
+	util.MustPollServiceInstanceForCompletion(t, fixtures.AlternateServiceInstanceName, alternateRsp)
 }
 
 // TestServiceInstancePollServiceIDOptional tests that the service ID supplied to a service
@@ -393,45 +2056,508 @@ func TestServiceInstanceRecreateAfterCompletionMismatchedNoParameters(t *testing
 	req.Parameters = &runtime.RawExtension{
 		Raw: []byte(`{"test":1}`),
 	}
-	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusConflict, req, api.ErrorResourceConflict)
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusConflict, req, api.ErrorResourceConflict)
+}
+
+// TestServiceInstanceRecreateAfterCompletionMismatchedWithParameters tests recreation of a service
+// instance where the first was created with parameters, and the second wasn't.
+func TestServiceInstanceRecreateAfterCompletionMismatchedWithParameters(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"test":1}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	req.Parameters = nil
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusConflict, req, api.ErrorResourceConflict)
+}
+
+// TestServiceInstanceDelete tests that service instance deletion works.
+func TestServiceInstanceDelete(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+	util.MustDeleteServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+}
+
+// mustSoftDeleteServiceInstance deprovisions a service instance that is retained for
+// the soft-delete grace period, this completes synchronously even though the client
+// accepts asynchronous operations.
+func mustSoftDeleteServiceInstance(t *testing.T, name string, req *api.CreateServiceInstanceRequest) {
+	response := map[string]interface{}{}
+	util.MustDelete(t, util.ServiceInstanceURI(name, util.DeleteServiceInstanceQuery(req)), http.StatusOK, &response)
+
+	util.Assert(t, len(response) == 0)
+}
+
+// TestServiceInstanceSoftDelete tests that a soft-deleted service instance appears
+// deleted, may be undeleted within the grace period, and is deleted once the grace
+// period has elapsed.
+func TestServiceInstanceSoftDelete(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.SoftDeleteGracePeriod = time.Hour
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	clock, restore := util.UseFakeClock()
+	defer restore()
+
+	// Deprovisioning appears to succeed, but the service instance is retained.
+	mustSoftDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+	util.MustGetAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusNotFound, api.ErrorResourceNotFound)
+	util.MustDeleteAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.DeleteServiceInstanceQuery(req)), http.StatusGone, api.ErrorResourceGone)
+	util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	// Undeleting within the grace period restores the service instance, and it is
+	// not deleted when the grace period elapses.
+	util.MustPost(t, util.ServiceInstanceUndeleteURI(fixtures.ServiceInstanceName), http.StatusOK, nil, nil)
+	util.MustGet(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusOK, &api.GetServiceInstanceResponse{})
+
+	if err := clock.AdvanceWhenWaiting(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	util.MustGet(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusOK, &api.GetServiceInstanceResponse{})
+
+	// Once the grace period elapses, the service instance is deleted.
+	mustSoftDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	if err := clock.AdvanceWhenWaiting(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	callback := func() error {
+		if _, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Get(context.TODO(), registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName), metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("service instance registry entry not deleted: %v", err)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	util.MustPostAndError(t, util.ServiceInstanceUndeleteURI(fixtures.ServiceInstanceName), http.StatusNotFound, nil, api.ErrorResourceNotFound)
+}
+
+// TestServiceInstanceSoftDeleteFailed tests that a soft-deleted service instance that
+// fails to delete once the grace period has elapsed is kept in the directory, so it
+// is not orphaned, and deletion is retried.
+func TestServiceInstanceSoftDeleteFailed(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.SoftDeleteGracePeriod = time.Hour
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	clock, restore := util.UseFakeClock()
+	defer restore()
+
+	util.MustFailDynamicDeleteOnce(t, clients, "pods", "instance-"+fixtures.ServiceInstanceName)
+
+	mustSoftDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	if err := clock.AdvanceWhenWaiting(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the failed deletion to be scheduled for a retry.
+	callback := func() error {
+		if clock.Waiters() == 0 {
+			return fmt.Errorf("deletion not retried")
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	directory, err := registry.NewDirectory(util.Namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := directory.Lookup(fixtures.ServiceInstanceName); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry succeeds, and the service instance is removed from the directory.
+	if err := clock.AdvanceWhenWaiting(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	callback = func() error {
+		directory, err := registry.NewDirectory(util.Namespace)
+		if err != nil {
+			return err
+		}
+
+		if _, err := directory.Lookup(fixtures.ServiceInstanceName); err == nil {
+			return fmt.Errorf("service instance directory entry not deleted")
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	util.MustNotHaveRegistry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+}
+
+// TestServiceInstanceCreateAbandoned tests that an asynchronous create that is never
+// polled, and does not become ready, is reaped once the timeout elapses.
+func TestServiceInstanceCreateAbandoned(t *testing.T) {
+	defer mustReset(t)
+
+	clock, restore := util.UseFakeClock()
+	defer restore()
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.AbandonedCreateTimeout = time.Hour
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	if err := clock.AdvanceWhenWaiting(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	callback := func() error {
+		if _, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Get(context.TODO(), registry.Name(registry.ServiceInstance, fixtures.ServiceInstanceName), metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("service instance registry entry not deleted: %v", err)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	util.MustGetAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusNotFound, api.ErrorResourceNotFound)
+}
+
+// TestServiceInstanceCreateAbandonedDeleteFailed tests that when an abandoned create
+// cannot be deleted, the service instance is retained, and the deprovision operation
+// ended, so the client can still find and delete it.
+func TestServiceInstanceCreateAbandonedDeleteFailed(t *testing.T) {
+	defer mustReset(t)
+
+	clock, restore := util.UseFakeClock()
+	defer restore()
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.AbandonedCreateTimeout = time.Hour
+		o.RollbackAttempts = 1
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfigurationWithReadiness())
+
+	util.MustFailDynamicDelete(t, clients, "pods", "instance-"+fixtures.ServiceInstanceName)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	if err := clock.AdvanceWhenWaiting(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed deprovision records its status, and ends the operation.
+	callback := func() error {
+		entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+		if _, ok := entry.Data[string(registry.Operation)]; ok {
+			return fmt.Errorf("operation not ended")
+		}
+
+		if status := string(entry.Data[string(registry.OperationLastStatus)]); !strings.Contains(status, "resource deletion failed") {
+			return fmt.Errorf("unexpected operation status %s", status)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+
+	util.MustGet(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.ReadServiceInstanceQuery(req)), http.StatusOK, nil)
+}
+
+// TestServiceInstanceCreateFailureDiagnostics tests that when provisioning fails, the
+// underlying Kubernetes error is reported by polling.
+func TestServiceInstanceCreateFailureDiagnostics(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	util.MustFailDynamicCreate(t, clients, "pods", "instance-"+fixtures.ServiceInstanceName, "exceeded quota: compute-resources")
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if poll.State != api.PollStateFailed {
+			return fmt.Errorf("poll state %s, expected %s", poll.State, api.PollStateFailed)
+		}
+
+		if !strings.Contains(poll.Description, "diagnostics") || !strings.Contains(poll.Description, "exceeded quota: compute-resources (reason Forbidden, code 403)") {
+			return fmt.Errorf("poll description %s, expected diagnostics", poll.Description)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+}
+
+// TestServiceInstanceCreateApplyTimeout tests that a resource create that hangs
+// fails the operation once the apply timeout expires.
+func TestServiceInstanceCreateApplyTimeout(t *testing.T) {
+	defer mustReset(t)
+
+	defer util.SetOptions(func(o *config.Options) {
+		o.ApplyTimeout = 100 * time.Millisecond
+	})()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	util.MustDelayDynamicCreate(t, clients, "pods", "instance-"+fixtures.ServiceInstanceName, time.Second)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if poll.State != api.PollStateFailed {
+			return fmt.Errorf("poll state %s, expected %s", poll.State, api.PollStateFailed)
+		}
+
+		if !strings.Contains(poll.Description, "timed out") {
+			return fmt.Errorf("poll description %s, expected timeout", poll.Description)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, 10*time.Second)
+
+	// The create completes after timing out, it must not be orphaned.
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	deleted := func() error {
+		if _, err := clients.Dynamic().Resource(gvr).Namespace(util.Namespace).Get(context.TODO(), "instance-"+fixtures.ServiceInstanceName, metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("expected late created pod to be deleted: %v", err)
+		}
+
+		return nil
+	}
+	util.MustWaitFor(t, deleted, 10*time.Second)
+}
+
+// TestServiceInstanceDeletePartialFailure tests that when some resources fail to be
+// deleted, the outcome for every resource is reported by polling.
+func TestServiceInstanceDeletePartialFailure(t *testing.T) {
+	defer mustReset(t)
+
+	// Make all resources owned by the instance so they are explicitly deleted.
+	configuration := fixtures.BasicConfiguration()
+	for index := range configuration.Templates {
+		configuration.Templates[index].Singleton = false
+	}
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	util.MustFailDynamicDelete(t, clients, "pods", "singleton")
+
+	rsp := util.MustDeleteServiceInstance(t, fixtures.ServiceInstanceName, req)
+
+	callback := func() error {
+		poll := &api.PollServiceInstanceResponse{}
+		if err := util.Get(util.ServiceInstancePollURI(fixtures.ServiceInstanceName, util.PollServiceInstanceQuery(nil, rsp)), http.StatusOK, poll); err != nil {
+			return err
+		}
+
+		if poll.State != api.PollStateFailed {
+			return fmt.Errorf("poll state %v", poll.State)
+		}
+
+		util.Assert(t, strings.Contains(poll.Description, `{"resource":"v1/Pod instance-`+fixtures.ServiceInstanceName+`","result":"deleted"}`))
+		util.Assert(t, strings.Contains(poll.Description, `{"resource":"v1/Pod singleton","result":"failed"`))
+
+		return nil
+	}
+	util.MustWaitFor(t, callback, time.Minute)
+}
+
+// TestServiceInstanceDeleteNotAsynchronous tests that a service instance delete must
+// be an aysnchronous operation.
+func TestServiceInstanceDeleteNotAsynchronous(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	util.MustDeleteAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusUnprocessableEntity, api.ErrorAsyncRequired)
+}
+
+// TestServiceInstanceDeleteSynchronous tests that service instances of a service plan
+// that allows synchronous deletion are deleted immediately, even if the client does not
+// support asynchronous operations, while other service plans remain asynchronous.
+func TestServiceInstanceDeleteSynchronous(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].SynchronousDelete = true
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	query := util.DeleteServiceInstanceQuery(req)
+	query.Del("accepts_incomplete")
+	util.MustDelete(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, query), http.StatusOK, nil)
+	util.MustNotHaveRegistry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	// Other service plans still require asynchronous deletion.
+	const asyncInstanceName = "fluttershy"
+
+	asyncReq := fixtures.BasicServiceInstanceCreateRequest()
+	asyncReq.PlanID = fixtures.BasicConfigurationPlanID2
+	util.MustCreateServiceInstanceSuccessfully(t, asyncInstanceName, asyncReq)
+
+	query = util.DeleteServiceInstanceQuery(asyncReq)
+	query.Del("accepts_incomplete")
+	util.MustDeleteAndError(t, util.ServiceInstanceURI(asyncInstanceName, query), http.StatusUnprocessableEntity, api.ErrorAsyncRequired)
+	util.MustDeleteServiceInstanceSuccessfully(t, asyncInstanceName, asyncReq)
+}
+
+// TestServiceInstanceDeleteSynchronousOperationInProgress tests that synchronous deletion
+// is rejected while another operation is in progress, rather than racing with it.
+func TestServiceInstanceDeleteSynchronousOperationInProgress(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].Plans[0].SynchronousDelete = true
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	// Simulate an update in progress.
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	entry.Data[string(registry.Operation)] = []byte(`"update"`)
+
+	if _, err := clients.Kubernetes().CoreV1().Secrets(util.Namespace).Update(context.TODO(), entry, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	query := util.DeleteServiceInstanceQuery(req)
+	query.Del("accepts_incomplete")
+	util.MustDeleteAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, query), http.StatusUnprocessableEntity, api.ErrorConcurrencyError)
+	util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+}
+
+// mustServeAsyncOptional makes a request, without accepts_incomplete, to a broker that
+// treats asynchronous operation as optional for the requested operations.
+func mustServeAsyncOptional(t *testing.T, ops []operation.Type, method, path string, body interface{}, status int) *api.CreateServiceInstanceResponse {
+	token := util.Token
+
+	configuration := &broker.ServerConfiguration{
+		Namespace:     util.Namespace,
+		Token:         &token,
+		AsyncOptional: map[operation.Type]bool{},
+	}
+
+	for _, op := range ops {
+		configuration.AsyncOptional[op] = true
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := util.MustDefaultRequestWithBody(t, method, path, bytes.NewBuffer(data))
+
+	response := httptest.NewRecorder()
+	broker.NewOpenServiceBrokerHandler(configuration).ServeHTTP(response, request)
+
+	if response.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, response.Code, response.Body.String())
+	}
+
+	rsp := &api.CreateServiceInstanceResponse{}
+	if err := json.Unmarshal(response.Body.Bytes(), rsp); err != nil {
+		t.Fatal(err)
+	}
+
+	return rsp
 }
 
-// TestServiceInstanceRecreateAfterCompletionMismatchedWithParameters tests recreation of a service
-// instance where the first was created with parameters, and the second wasn't.
-func TestServiceInstanceRecreateAfterCompletionMismatchedWithParameters(t *testing.T) {
+// TestServiceInstanceAsyncOptional tests that when asynchronous operation is optional,
+// requests without accepts_incomplete are accepted and run to completion synchronously,
+// as the client cannot poll for an operation.
+func TestServiceInstanceAsyncOptional(t *testing.T) {
 	defer mustReset(t)
 
 	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
 
+	ops := []operation.Type{operation.TypeProvision, operation.TypeUpdate, operation.TypeDeprovision}
+
 	req := fixtures.BasicServiceInstanceCreateRequest()
-	req.Parameters = &runtime.RawExtension{
-		Raw: []byte(`{"test":1}`),
-	}
-	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+	query := util.ReadServiceInstanceQuery(req)
 
-	req.Parameters = nil
-	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusConflict, req, api.ErrorResourceConflict)
+	rsp := mustServeAsyncOptional(t, ops, http.MethodPut, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), req, http.StatusCreated)
+	util.Assert(t, rsp.Operation == "")
+	util.MustGet(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, query), http.StatusOK, nil)
+
+	rsp = mustServeAsyncOptional(t, ops, http.MethodPatch, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), fixtures.BasicServiceInstanceUpdateRequest(), http.StatusOK)
+	util.Assert(t, rsp.Operation == "")
+	util.MustGet(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, query), http.StatusOK, nil)
+
+	rsp = mustServeAsyncOptional(t, ops, http.MethodDelete, util.ServiceInstanceURI(fixtures.ServiceInstanceName, query), nil, http.StatusOK)
+	util.Assert(t, rsp.Operation == "")
+	util.MustGetAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, query), http.StatusNotFound, api.ErrorResourceNotFound)
 }
 
-// TestServiceInstanceDelete tests that service instance deletion works.
-func TestServiceInstanceDelete(t *testing.T) {
+// TestServiceInstanceAsyncOptionalPerOperation tests that asynchronous operation is only
+// optional for the configured operations.
+func TestServiceInstanceAsyncOptionalPerOperation(t *testing.T) {
 	defer mustReset(t)
 
 	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
 
+	ops := []operation.Type{operation.TypeUpdate}
+
 	req := fixtures.BasicServiceInstanceCreateRequest()
+	mustServeAsyncOptional(t, ops, http.MethodPut, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), req, http.StatusUnprocessableEntity)
 	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
-	util.MustDeleteServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
-}
-
-// TestServiceInstanceDeleteNotAsynchronous tests that a service instance delete must
-// be an aysnchronous operation.
-func TestServiceInstanceDeleteNotAsynchronous(t *testing.T) {
-	defer mustReset(t)
 
-	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+	mustServeAsyncOptional(t, ops, http.MethodPatch, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), fixtures.BasicServiceInstanceUpdateRequest(), http.StatusOK)
 
-	util.MustDeleteAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, nil), http.StatusUnprocessableEntity, api.ErrorAsyncRequired)
+	query := util.ReadServiceInstanceQuery(req)
+	mustServeAsyncOptional(t, ops, http.MethodDelete, util.ServiceInstanceURI(fixtures.ServiceInstanceName, query), nil, http.StatusUnprocessableEntity)
 }
 
 // TestServiceInstanceDeleteIllegalInstance tests  service instance deletion when there
@@ -547,6 +2673,24 @@ func TestServiceInstanceRead(t *testing.T) {
 	util.Assert(t, read.PlanID == req.PlanID)
 }
 
+// TestServiceInstanceReadNotRetrievable tests that service instances cannot be read
+// when the service offering does not support it, but can still be polled.
+func TestServiceInstanceReadNotRetrievable(t *testing.T) {
+	defer mustReset(t)
+
+	retrievable := false
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Catalog.Services[0].InstancesRetrievable = &retrievable
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	rsp := util.MustCreateServiceInstance(t, fixtures.ServiceInstanceName, req)
+	util.MustPollServiceInstanceForCompletion(t, fixtures.ServiceInstanceName, rsp)
+
+	util.MustGetAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.ReadServiceInstanceQuery(req)), http.StatusNotFound, api.ErrorResourceNotFound)
+}
+
 // TestServiceInstanceReadWithParameters tests that parameters are preserved and
 // reported with a get call.
 func TestServiceInstanceReadWithParameters(t *testing.T) {
@@ -653,6 +2797,164 @@ func TestServiceInstanceReadIllegalInstance(t *testing.T) {
 	util.MustGetAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.ReadServiceInstanceQuery(req)), http.StatusNotFound, api.ErrorResourceNotFound)
 }
 
+// TestServiceInstanceReadManifests tests that the rendered manifests of a service instance
+// can be read after creation.
+func TestServiceInstanceReadManifests(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	read := &api.GetServiceInstanceManifestsResponse{}
+	util.MustGet(t, util.ServiceInstanceManifestsURI(fixtures.ServiceInstanceName, nil), http.StatusOK, read)
+
+	util.Assert(t, len(read.Manifests) == 2)
+	util.Assert(t, read.Manifests[0].Name == "test-template")
+
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(read.Manifests[0].Resource.Raw, object); err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, object.GetKind() == "Pod")
+	util.Assert(t, object.GetName() == "instance-"+fixtures.ServiceInstanceName)
+}
+
+// TestServiceInstanceReadManifestsIllegalInstance tests that reading manifests for a
+// service instance that doesn't exist is rejected.
+func TestServiceInstanceReadManifestsIllegalInstance(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	util.MustGetAndError(t, util.ServiceInstanceManifestsURI(fixtures.ServiceInstanceName, nil), http.StatusNotFound, api.ErrorResourceNotFound)
+}
+
+// TestServiceInstanceReadManifestsRedacted tests that credentials are redacted from the
+// rendered manifests of a service instance.
+func TestServiceInstanceReadManifestsRedacted(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name: "credentials-secret",
+		Template: &runtime.RawExtension{
+			Raw: []byte(`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"credentials","annotations":{"example.com/password":"{{ registry \"password\" }}"}},"stringData":{"password":"{{ registry \"password\" }}"}}`),
+		},
+	})
+	configuration.Bindings[0].ServiceInstance.Registry = append(configuration.Bindings[0].ServiceInstance.Registry, v1.RegistryValue{
+		Name:  "password",
+		Value: `{{ generatePassword 32 nil }}`,
+	})
+	configuration.Bindings[0].ServiceInstance.Templates = append(configuration.Bindings[0].ServiceInstance.Templates, "credentials-secret")
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+
+	var password string
+	if err := json.Unmarshal(entry.Data["password"], &password); err != nil {
+		t.Fatal(err)
+	}
+
+	read := &api.GetServiceInstanceManifestsResponse{}
+	util.MustGet(t, util.ServiceInstanceManifestsURI(fixtures.ServiceInstanceName, nil), http.StatusOK, read)
+
+	util.Assert(t, len(read.Manifests) == 3)
+	util.Assert(t, read.Manifests[2].Name == "credentials-secret")
+	util.Assert(t, !strings.Contains(string(read.Manifests[2].Resource.Raw), password))
+
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(read.Manifests[2].Resource.Raw, object); err != nil {
+		t.Fatal(err)
+	}
+
+	value, _, err := unstructured.NestedString(object.Object, "stringData", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, value == "[REDACTED]")
+}
+
+// TestServiceInstanceReadManifestsUpdated tests that the rendered manifests of a service
+// instance reflect the last update.
+func TestServiceInstanceReadManifestsUpdated(t *testing.T) {
+	defer mustReset(t)
+
+	optionalParameterValue := "piglet"
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	update := fixtures.BasicServiceInstanceUpdateRequest()
+	update.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"` + fixtures.OptionalParameter + `":"` + optionalParameterValue + `"}`),
+	}
+	util.MustUpdateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, update)
+
+	read := &api.GetServiceInstanceManifestsResponse{}
+	util.MustGet(t, util.ServiceInstanceManifestsURI(fixtures.ServiceInstanceName, nil), http.StatusOK, read)
+
+	util.Assert(t, len(read.Manifests) == 2)
+
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(read.Manifests[0].Resource.Raw, object); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname, _, err := unstructured.NestedString(object.Object, "spec", "hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Assert(t, hostname == optionalParameterValue)
+}
+
+// TestServiceInstanceReconcile tests that resources deleted out from under a service
+// instance are recreated by reconciliation.
+func TestServiceInstanceReconcile(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	name := "instance-" + fixtures.ServiceInstanceName
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	if err := clients.Dynamic().Resource(gvr).Namespace(util.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rsp := &api.ReconcileServiceInstanceResponse{}
+	util.MustPost(t, util.ServiceInstanceReconcileURI(fixtures.ServiceInstanceName), http.StatusOK, nil, rsp)
+	util.Assert(t, reflect.DeepEqual(rsp.Recreated, []string{"v1/Pod " + name}))
+	fixtures.AssertFixtureFieldSet(t, clients, name, "metadata", "name")
+
+	// Once reconciled, there is nothing more to do.
+	rsp = &api.ReconcileServiceInstanceResponse{}
+	util.MustPost(t, util.ServiceInstanceReconcileURI(fixtures.ServiceInstanceName), http.StatusOK, nil, rsp)
+	util.Assert(t, len(rsp.Recreated) == 0)
+}
+
+// TestServiceInstanceReconcileIllegalInstance tests that reconciling a service instance
+// that doesn't exist is rejected.
+func TestServiceInstanceReconcileIllegalInstance(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	util.MustPostAndError(t, util.ServiceInstanceReconcileURI(fixtures.ServiceInstanceName), http.StatusNotFound, nil, api.ErrorResourceNotFound)
+}
+
 // TestServiceInstanceUpdate tests a service instance can be updated.
 func TestServiceInstanceUpdate(t *testing.T) {
 	defer mustReset(t)
@@ -758,6 +3060,29 @@ func TestServiceInstanceUpdateIllegalInstance(t *testing.T) {
 	util.MustPatchAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusNotFound, update, api.ErrorResourceNotFound)
 }
 
+// TestServiceInstanceUpdateNamespaceChange tests that an update whose context would
+// move the service instance to another namespace is rejected with a parameter error.
+func TestServiceInstanceUpdateNamespaceChange(t *testing.T) {
+	defer mustReset(t)
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	update := fixtures.BasicServiceInstanceUpdateRequest()
+	update.Context = &runtime.RawExtension{
+		Raw: []byte(`{"namespace":"battlecat"}`),
+	}
+	util.MustPatchAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, update, api.ErrorParameterError)
+
+	// The same namespace is not a change.
+	update.Context = &runtime.RawExtension{
+		Raw: []byte(`{"namespace":"` + util.Namespace + `"}`),
+	}
+	util.MustUpdateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, update)
+}
+
 // TestServiceInstanceUpdateWithSchema tests that schema validation works.
 func TestServiceInstanceUpdateWithSchema(t *testing.T) {
 	defer mustReset(t)
@@ -834,6 +3159,56 @@ func TestServiceInstanceUpdateUpdatedParameters(t *testing.T) {
 	fixtures.AssertFixtureFieldSet(t, clients, optionalParameterValue, "spec", "hostname")
 }
 
+// TestServiceInstanceUpdatePreviousParameters tests that parameters in effect before
+// an update can be used to derive new values when the update omits them, and that
+// they are retained across successive updates that omit them.
+func TestServiceInstanceUpdatePreviousParameters(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+
+	for index := range configuration.Templates {
+		template := &configuration.Templates[index]
+
+		if template.Name == "test-template" {
+			template.Template.Raw = []byte(strings.Replace(string(template.Template.Raw), `"metadata":{`, `"metadata":{"annotations":{"replicas":"{{ parameter \"/replicas\" | default (previousParameter \"/replicas\") | default \"1\" }}"},`, 1))
+		}
+	}
+
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	req.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"replicas":"3"}`),
+	}
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	fixtures.AssertFixtureFieldSet(t, clients, "3", "metadata", "annotations", "replicas")
+
+	// Omitting the replica count retains the previous one.
+	update := fixtures.BasicServiceInstanceUpdateRequest()
+	update.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"` + fixtures.OptionalParameter + `":"lion"}`),
+	}
+	util.MustUpdateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, update)
+
+	fixtures.AssertFixtureFieldSet(t, clients, "3", "metadata", "annotations", "replicas")
+
+	update.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"` + fixtures.OptionalParameter + `":"tiger"}`),
+	}
+	util.MustUpdateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, update)
+
+	fixtures.AssertFixtureFieldSet(t, clients, "3", "metadata", "annotations", "replicas")
+
+	update.Parameters = &runtime.RawExtension{
+		Raw: []byte(`{"replicas":"5"}`),
+	}
+	util.MustUpdateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, update)
+
+	fixtures.AssertFixtureFieldSet(t, clients, "5", "metadata", "annotations", "replicas")
+}
+
 // TestServiceInstanceUpdatePreserveExternalMutations tests that mutations made by
 // Kubernetes are preserved e.g. ports changing could be a problem for someone, it
 // shouldn't be, but it will be.
@@ -880,3 +3255,202 @@ func TestServiceInstanceUpdateUpdatedParametersWithExternalMutations(t *testing.
 	fixtures.AssertFixtureFieldSet(t, clients, optionalParameterValue, "spec", "hostname")
 	fixtures.AssertFixtureFieldSet(t, clients, muatatedValue, "spec", "subdomain")
 }
+
+// completionWebhook is a webhook receiver that fails a number of deliveries before
+// accepting them.
+type completionWebhook struct {
+	failures    int
+	completions []api.OperationCompletion
+	lock        sync.Mutex
+}
+
+// ServeHTTP records the completion and fails while failures remain.
+func (c *completionWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	completion := api.OperationCompletion{}
+	if err := json.NewDecoder(r.Body).Decode(&completion); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.completions = append(c.completions, completion)
+
+	if len(c.completions) <= c.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// mustWaitForAttempts waits for the expected number of delivery attempts, which are
+// made in the background once an operation completes.
+func (c *completionWebhook) mustWaitForAttempts(t *testing.T, attempts int) {
+	callback := func() error {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if len(c.completions) < attempts {
+			return fmt.Errorf("expected %d delivery attempts, got %d", attempts, len(c.completions))
+		}
+
+		return nil
+	}
+
+	util.MustWaitFor(t, callback, time.Minute)
+}
+
+// mustSetCompletionWebhook directs completion webhooks to the receiver.  The returned
+// function restores the defaults.
+func mustSetCompletionWebhook(receiver *completionWebhook, attempts int) func() {
+	server := httptest.NewServer(receiver)
+
+	restore := util.SetOptions(func(o *config.Options) {
+		o.CompletionWebhook = server.URL
+		o.CompletionWebhookAttempts = attempts
+		o.CompletionWebhookBackoff = 10 * time.Millisecond
+	})
+
+	return func() {
+		server.Close()
+
+		restore()
+	}
+}
+
+// TestServiceInstanceCreateCompletionWebhook tests that the completion webhook is retried
+// until it is delivered, with the same idempotency token each time.
+func TestServiceInstanceCreateCompletionWebhook(t *testing.T) {
+	defer mustReset(t)
+
+	receiver := &completionWebhook{
+		failures: 2,
+	}
+
+	defer mustSetCompletionWebhook(receiver, 5)()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	receiver.mustWaitForAttempts(t, 3)
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+
+	if len(receiver.completions) != 3 {
+		t.Fatalf("expected 3 delivery attempts, got %d", len(receiver.completions))
+	}
+
+	for _, completion := range receiver.completions {
+		if completion.IdempotencyToken == "" || completion.IdempotencyToken != receiver.completions[0].IdempotencyToken {
+			t.Fatalf("idempotency token not stable across retries: %v", receiver.completions)
+		}
+
+		if completion.InstanceID != fixtures.ServiceInstanceName || completion.State != api.PollStateSucceeded {
+			t.Fatalf("unexpected completion: %v", completion)
+		}
+	}
+
+	entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+	util.MustNotHaveRegistryEntry(t, entry, registry.CompletionWebhookError)
+}
+
+// TestServiceInstanceCreateCompletionWebhookAbandoned tests that the completion webhook
+// gives up after the maximum number of attempts and records the failure.
+func TestServiceInstanceCreateCompletionWebhookAbandoned(t *testing.T) {
+	defer mustReset(t)
+
+	receiver := &completionWebhook{
+		failures: 5,
+	}
+
+	defer mustSetCompletionWebhook(receiver, 3)()
+
+	util.MustReplaceBrokerConfig(t, clients, fixtures.BasicConfiguration())
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	receiver.mustWaitForAttempts(t, 3)
+
+	// The failure is recorded after the last attempt.
+	callback := func() error {
+		entry := util.MustGetRegistryEntry(t, clients, registry.ServiceInstance, fixtures.ServiceInstanceName)
+		if _, ok := entry.Data[string(registry.CompletionWebhookError)]; !ok {
+			return fmt.Errorf("completion webhook failure not recorded")
+		}
+
+		return nil
+	}
+
+	util.MustWaitFor(t, callback, time.Minute)
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+
+	if len(receiver.completions) != 3 {
+		t.Fatalf("expected 3 delivery attempts, got %d", len(receiver.completions))
+	}
+}
+
+// TestServiceInstanceTemplateNamespace tests that templates may create their resources
+// in a different namespace to the service instance, and that they are deleted from that
+// namespace on deprovision.
+func TestServiceInstanceTemplateNamespace(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates = append(configuration.Templates, v1.ConfigurationTemplate{
+		Name:      "test-monitor",
+		Template:  &runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"{{ printf \"monitor-%s\" (registry \"instance-id\") }}"}}`)},
+		Namespace: `{{ default "monitoring" (parameter "/monitoring-namespace") }}`,
+	})
+	configuration.Bindings[0].ServiceInstance.Templates = append(configuration.Bindings[0].ServiceInstance.Templates, "test-monitor")
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustCreateServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	resources := map[string]string{
+		"instance-" + fixtures.ServiceInstanceName: util.Namespace,
+		"monitor-" + fixtures.ServiceInstanceName:  "monitoring",
+	}
+
+	// Owner references cannot cross namespaces, so only resources in the same
+	// namespace as the registry are owned by it.
+	for name, namespace := range resources {
+		object, err := clients.Dynamic().Resource(gvr).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		util.Assert(t, (len(object.GetOwnerReferences()) != 0) == (namespace == util.Namespace))
+	}
+
+	util.MustDeleteServiceInstanceSuccessfully(t, fixtures.ServiceInstanceName, req)
+
+	for name, namespace := range resources {
+		if _, err := clients.Dynamic().Resource(gvr).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+			t.Fatalf("resource %s/%s not deleted: %v", namespace, name, err)
+		}
+	}
+}
+
+// TestServiceInstanceTemplateNamespaceInvalid tests that templates reject namespaces
+// that are not valid DNS labels.
+func TestServiceInstanceTemplateNamespaceInvalid(t *testing.T) {
+	defer mustReset(t)
+
+	configuration := fixtures.BasicConfiguration()
+	configuration.Templates[3].Namespace = "Not_Valid"
+	util.MustReplaceBrokerConfig(t, clients, configuration)
+
+	req := fixtures.BasicServiceInstanceCreateRequest()
+	util.MustPutAndError(t, util.ServiceInstanceURI(fixtures.ServiceInstanceName, util.CreateServiceInstanceQuery()), http.StatusBadRequest, req, api.ErrorConfigurationError)
+}
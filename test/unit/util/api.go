@@ -50,7 +50,7 @@ const (
 // MustBasicRequest creates a HTTP request object for the requested method
 // on a path.
 // It applies no additional headers.
-func MustBasicRequest(t *testing.T, method, path string) *http.Request {
+func MustBasicRequest(t testing.TB, method, path string) *http.Request {
 	request, err := http.NewRequest(method, "https://localhost:8443"+path, nil)
 	if err != nil {
 		t.Fatal(err)
@@ -79,7 +79,7 @@ func DefaultRequest(method, path string) (*http.Request, error) {
 // on a path.
 // It applies known good configuration to provide connectivity with the broker
 // for the common case.
-func MustDefaultRequest(t *testing.T, method, path string) *http.Request {
+func MustDefaultRequest(t testing.TB, method, path string) *http.Request {
 	request, err := DefaultRequest(method, path)
 	if err != nil {
 		t.Fatal(err)
@@ -109,7 +109,7 @@ func DefaultRequestWithBody(method, path string, body io.Reader) (*http.Request,
 // on a path.
 // It applies known good configuration to provide connectivity with the broker
 // for the common case.
-func MustDefaultRequestWithBody(t *testing.T, method, path string, body io.Reader) *http.Request {
+func MustDefaultRequestWithBody(t testing.TB, method, path string, body io.Reader) *http.Request {
 	request, err := DefaultRequestWithBody(method, path, body)
 	if err != nil {
 		t.Fatal(err)
@@ -145,7 +145,7 @@ func DefaultClient() (*http.Client, error) {
 // MustDefaultClient creates a HTTP client for use against the service broker.
 // It applies known good configuration to provide connectivity with the broker
 // for the common case.
-func MustDefaultClient(t *testing.T) *http.Client {
+func MustDefaultClient(t testing.TB) *http.Client {
 	client, err := DefaultClient()
 	if err != nil {
 		t.Fatal(err)
@@ -167,7 +167,7 @@ func DoRequest(client *http.Client, request *http.Request) (*http.Response, erro
 
 // MustDoRequest performs a requests against the broker API with the provided client.
 // This call will cause test failure if the network transport fails.
-func MustDoRequest(t *testing.T, client *http.Client, request *http.Request) *http.Response {
+func MustDoRequest(t testing.TB, client *http.Client, request *http.Request) *http.Response {
 	response, err := DoRequest(client, request)
 	if err != nil {
 		t.Fatal(err)
@@ -178,7 +178,7 @@ func MustDoRequest(t *testing.T, client *http.Client, request *http.Request) *ht
 
 // MustNotDoRequest performs a requests against the broker API with the provided client.
 // This call will cause test failure if the network transport succeeds.
-func MustNotDoRequest(t *testing.T, client *http.Client, request *http.Request) {
+func MustNotDoRequest(t testing.TB, client *http.Client, request *http.Request) {
 	response, err := DoRequest(client, request)
 	if err == nil {
 		defer response.Body.Close()
@@ -198,7 +198,7 @@ func VerifyStatusCode(response *http.Response, statusCode int) error {
 
 // MustVerifyStatusCode verifies the HTTP status code is as expected.
 // This call will cause test failure if the HTTP status code does not match.
-func MustVerifyStatusCode(t *testing.T, response *http.Response, statusCode int) {
+func MustVerifyStatusCode(t testing.TB, response *http.Response, statusCode int) {
 	if err := VerifyStatusCode(response, statusCode); err != nil {
 		t.Fatal(fmt.Errorf("unexpected status code %d, expected %d", response.StatusCode, statusCode))
 	}
@@ -303,7 +303,7 @@ func Get(path string, statusCode int, response interface{}) error {
 }
 
 // MustGet does a GET API call and expects a certain response.
-func MustGet(t *testing.T, path string, statusCode int, response interface{}) {
+func MustGet(t testing.TB, path string, statusCode int, response interface{}) {
 	if err := Get(path, statusCode, response); err != nil {
 		t.Fatal(err)
 	}
@@ -319,7 +319,7 @@ func GetAndError(path string, statusCode int, apiError api.ErrorType) error {
 }
 
 // MustGetAndError does a GET API call and expects a certain response with a valid JSON error.
-func MustGetAndError(t *testing.T, path string, statusCode int, apiError api.ErrorType) {
+func MustGetAndError(t testing.TB, path string, statusCode int, apiError api.ErrorType) {
 	if err := GetAndError(path, statusCode, apiError); err != nil {
 		t.Fatal(err)
 	}
@@ -335,7 +335,7 @@ func Put(path string, statusCode int, request, response interface{}) error {
 }
 
 // MustPut does a PUT API call and expects a certain response.
-func MustPut(t *testing.T, path string, statusCode int, request, response interface{}) {
+func MustPut(t testing.TB, path string, statusCode int, request, response interface{}) {
 	if err := Put(path, statusCode, request, response); err != nil {
 		t.Fatal(err)
 	}
@@ -351,7 +351,7 @@ func PutAndError(path string, statusCode int, request interface{}, apiError api.
 }
 
 // MustPutAndError does a PUT API call and expects a certain response with a valid JSON error.
-func MustPutAndError(t *testing.T, path string, statusCode int, request interface{}, apiError api.ErrorType) {
+func MustPutAndError(t testing.TB, path string, statusCode int, request interface{}, apiError api.ErrorType) {
 	if err := PutAndError(path, statusCode, request, apiError); err != nil {
 		t.Fatal(err)
 	}
@@ -367,7 +367,7 @@ func Delete(path string, statusCode int, response interface{}) error {
 }
 
 // MustDelete does a DELETE API call and expects a certain response.
-func MustDelete(t *testing.T, path string, statusCode int, response interface{}) {
+func MustDelete(t testing.TB, path string, statusCode int, response interface{}) {
 	if err := Delete(path, statusCode, response); err != nil {
 		t.Fatal(err)
 	}
@@ -383,7 +383,7 @@ func DeleteAndError(path string, statusCode int, apiError api.ErrorType) error {
 }
 
 // MustDeleteAndError does a DELETE API call and expects a certain response with a valid JSON error.
-func MustDeleteAndError(t *testing.T, path string, statusCode int, apiError api.ErrorType) {
+func MustDeleteAndError(t testing.TB, path string, statusCode int, apiError api.ErrorType) {
 	if err := DeleteAndError(path, statusCode, apiError); err != nil {
 		t.Fatal(err)
 	}
@@ -399,7 +399,7 @@ func Patch(path string, statusCode int, request, response interface{}) error {
 }
 
 // MustPatch does a PATCH API call and expects a certain response.
-func MustPatch(t *testing.T, path string, statusCode int, request, response interface{}) {
+func MustPatch(t testing.TB, path string, statusCode int, request, response interface{}) {
 	if err := Patch(path, statusCode, request, response); err != nil {
 		t.Fatal(err)
 	}
@@ -415,12 +415,44 @@ func PatchAndError(path string, statusCode int, request interface{}, apiError ap
 }
 
 // MustPatchAndError does a PATCH API call and expects a certain response with a valid JSON error.
-func MustPatchAndError(t *testing.T, path string, statusCode int, request interface{}, apiError api.ErrorType) {
+func MustPatchAndError(t testing.TB, path string, statusCode int, request interface{}, apiError api.ErrorType) {
 	if err := PatchAndError(path, statusCode, request, apiError); err != nil {
 		t.Fatal(err)
 	}
 }
 
+// Post does a POST API call and expects a certain response.
+func Post(path string, statusCode int, request, response interface{}) error {
+	if err := basicOperation(http.MethodPost, path, statusCode, request, response); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MustPost does a POST API call and expects a certain response.
+func MustPost(t testing.TB, path string, statusCode int, request, response interface{}) {
+	if err := Post(path, statusCode, request, response); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// PostAndError does a POST API call and expects a certain response with a valid JSON error.
+func PostAndError(path string, statusCode int, request interface{}, apiError api.ErrorType) error {
+	if err := basicOperationAndError(http.MethodPost, path, statusCode, request, apiError); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MustPostAndError does a POST API call and expects a certain response with a valid JSON error.
+func MustPostAndError(t testing.TB, path string, statusCode int, request interface{}, apiError api.ErrorType) {
+	if err := PostAndError(path, statusCode, request, apiError); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // ServiceInstanceURI generates a URI (path + query) to operate on a service instance.
 func ServiceInstanceURI(instance string, query *url.Values) string {
 	uri := "/v2/service_instances/" + instance
@@ -443,6 +475,32 @@ func ServiceInstancePollURI(instance string, query *url.Values) string {
 	return uri
 }
 
+// ServiceInstanceManifestsURI generates a URI (path + query) to read a service instance's manifests.
+func ServiceInstanceManifestsURI(instance string, query *url.Values) string {
+	uri := "/v2/service_instances/" + instance + "/manifests"
+
+	if query != nil {
+		uri = uri + "?" + query.Encode()
+	}
+
+	return uri
+}
+
+// ServiceInstanceReconcileURI generates a URI to reconcile a service instance.
+func ServiceInstanceReconcileURI(instance string) string {
+	return "/v2/service_instances/" + instance + "/reconcile"
+}
+
+// ServiceInstanceUndeleteURI generates a URI to undelete a service instance.
+func ServiceInstanceUndeleteURI(instance string) string {
+	return "/v2/service_instances/" + instance + "/undelete"
+}
+
+// RegistryURI generates a URI to export and import the registry.
+func RegistryURI() string {
+	return "/v2/registry"
+}
+
 // ServiceBindingURI generates a URI (path + query) to operate on a service binding.
 func ServiceBindingURI(instance, binding string, query *url.Values) string {
 	uri := "/v2/service_instances/" + instance + "/service_bindings/" + binding
@@ -523,7 +581,7 @@ func DeleteServiceBindingQuery(req *api.CreateServiceBindingRequest) *url.Values
 }
 
 // MustCreateServiceInstance wraps up service instance creation.
-func MustCreateServiceInstance(t *testing.T, name string, req *api.CreateServiceInstanceRequest) *api.CreateServiceInstanceResponse {
+func MustCreateServiceInstance(t testing.TB, name string, req *api.CreateServiceInstanceRequest) *api.CreateServiceInstanceResponse {
 	rsp := &api.CreateServiceInstanceResponse{}
 	MustPut(t, ServiceInstanceURI(name, CreateServiceInstanceQuery()), http.StatusAccepted, req, rsp)
 
@@ -534,7 +592,7 @@ func MustCreateServiceInstance(t *testing.T, name string, req *api.CreateService
 }
 
 // MustPollServiceInstanceForCompletion wraps up service instance poll.
-func MustPollServiceInstanceForCompletion(t *testing.T, name string, rsp *api.CreateServiceInstanceResponse) {
+func MustPollServiceInstanceForCompletion(t testing.TB, name string, rsp *api.CreateServiceInstanceResponse) {
 	callback := func() error {
 		// Polling will usually always return OK with the status embedded in the response.
 		poll := &api.PollServiceInstanceResponse{}
@@ -554,7 +612,7 @@ func MustPollServiceInstanceForCompletion(t *testing.T, name string, rsp *api.Cr
 }
 
 // MustDeleteServiceInstance wraps up service instance deletion.
-func MustDeleteServiceInstance(t *testing.T, name string, req *api.CreateServiceInstanceRequest) *api.CreateServiceInstanceResponse {
+func MustDeleteServiceInstance(t testing.TB, name string, req *api.CreateServiceInstanceRequest) *api.CreateServiceInstanceResponse {
 	rsp := &api.CreateServiceInstanceResponse{}
 	MustDelete(t, ServiceInstanceURI(name, DeleteServiceInstanceQuery(req)), http.StatusAccepted, rsp)
 
@@ -565,7 +623,7 @@ func MustDeleteServiceInstance(t *testing.T, name string, req *api.CreateService
 }
 
 // MustPollServiceInstanceForDeletion wraps up polling for an aysnc deletion.
-func MustPollServiceInstanceForDeletion(t *testing.T, name string, rsp *api.CreateServiceInstanceResponse) {
+func MustPollServiceInstanceForDeletion(t testing.TB, name string, rsp *api.CreateServiceInstanceResponse) {
 	callback := func() error {
 		// When polling for deletion, it will start as OK (as per MustPollServiceInstanceForCompletion)
 		// however will finally respond with Gone.  When it does, assert the response is an empty object.
@@ -583,19 +641,19 @@ func MustPollServiceInstanceForDeletion(t *testing.T, name string, rsp *api.Crea
 }
 
 // MustCreateServiceInstanceSuccessfully wraps up service instance creation and polling.
-func MustCreateServiceInstanceSuccessfully(t *testing.T, name string, req *api.CreateServiceInstanceRequest) {
+func MustCreateServiceInstanceSuccessfully(t testing.TB, name string, req *api.CreateServiceInstanceRequest) {
 	rsp := MustCreateServiceInstance(t, name, req)
 	MustPollServiceInstanceForCompletion(t, name, rsp)
 }
 
 // MustDeleteServiceInstanceSuccessfully wraps up service instance deletion and polling.
-func MustDeleteServiceInstanceSuccessfully(t *testing.T, name string, req *api.CreateServiceInstanceRequest) {
+func MustDeleteServiceInstanceSuccessfully(t testing.TB, name string, req *api.CreateServiceInstanceRequest) {
 	rsp := MustDeleteServiceInstance(t, name, req)
 	MustPollServiceInstanceForDeletion(t, name, rsp)
 }
 
 // MustUpdateServiceInstance wraps up service instance creation.
-func MustUpdateServiceInstance(t *testing.T, name string, req *api.UpdateServiceInstanceRequest) *api.CreateServiceInstanceResponse {
+func MustUpdateServiceInstance(t testing.TB, name string, req *api.UpdateServiceInstanceRequest) *api.CreateServiceInstanceResponse {
 	rsp := &api.CreateServiceInstanceResponse{}
 	MustPatch(t, ServiceInstanceURI(name, UpdateServiceInstanceQuery()), http.StatusAccepted, req, rsp)
 
@@ -606,17 +664,17 @@ func MustUpdateServiceInstance(t *testing.T, name string, req *api.UpdateService
 }
 
 // MustUpdateServiceInstanceSuccessfully wraps up service instance update and polling.
-func MustUpdateServiceInstanceSuccessfully(t *testing.T, name string, req *api.UpdateServiceInstanceRequest) {
+func MustUpdateServiceInstanceSuccessfully(t testing.TB, name string, req *api.UpdateServiceInstanceRequest) {
 	rsp := MustUpdateServiceInstance(t, name, req)
 	MustPollServiceInstanceForCompletion(t, name, rsp)
 }
 
 // MustCreateServiceBinding wraps up service binding creation.
-func MustCreateServiceBinding(t *testing.T, instance, binding string, req *api.CreateServiceBindingRequest) {
+func MustCreateServiceBinding(t testing.TB, instance, binding string, req *api.CreateServiceBindingRequest) {
 	MustPut(t, ServiceBindingURI(instance, binding, nil), http.StatusCreated, req, nil)
 }
 
 // MustDeleteServiceBinding wraps up service binding deletion.
-func MustDeleteServiceBinding(t *testing.T, instance, binding string, req *api.CreateServiceBindingRequest) {
+func MustDeleteServiceBinding(t testing.TB, instance, binding string, req *api.CreateServiceBindingRequest) {
 	MustDelete(t, ServiceBindingURI(instance, binding, DeleteServiceBindingQuery(req)), http.StatusOK, nil)
 }
@@ -20,8 +20,10 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,6 +34,7 @@ import (
 	"github.com/couchbase/service-broker/pkg/util"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -42,22 +45,22 @@ const (
 )
 
 // MustDeleteServiceBrokerConfig deletes the service broker configuration file.
-func MustDeleteServiceBrokerConfig(t *testing.T, clients client.Clients) {
-	if err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Delete(context.TODO(), config.ConfigurationName, metav1.DeleteOptions{}); err != nil {
+func MustDeleteServiceBrokerConfig(t testing.TB, clients client.Clients) {
+	if err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Delete(context.TODO(), config.GetOptions().ConfigurationName, metav1.DeleteOptions{}); err != nil {
 		t.Fatal(err)
 	}
 }
 
 // MustCreateServiceBrokerConfig creates the service broker configuration file with a user specified one.
-func MustCreateServiceBrokerConfig(t *testing.T, clients client.Clients, config *v1.ServiceBrokerConfig) {
+func MustCreateServiceBrokerConfig(t testing.TB, clients client.Clients, config *v1.ServiceBrokerConfig) {
 	if _, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Create(context.TODO(), config, metav1.CreateOptions{}); err != nil {
 		t.Fatal(err)
 	}
 }
 
 // MustUpdateBrokerConfig updates the service broker configuration with a typesafe callback.
-func MustUpdateBrokerConfig(t *testing.T, clients client.Clients, callback func(*v1.ServiceBrokerConfig)) {
-	config, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Get(context.TODO(), config.ConfigurationName, metav1.GetOptions{})
+func MustUpdateBrokerConfig(t testing.TB, clients client.Clients, callback func(*v1.ServiceBrokerConfig)) {
+	config, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Get(context.TODO(), config.GetOptions().ConfigurationName, metav1.GetOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -90,14 +93,21 @@ func configurationValidCondition(config *v1.ServiceBrokerConfig, status v1.Condi
 // MustReplaceBrokerConfig updates the service broker configuration and waits
 // for the broker to acquire the write lock and update the configuration to
 // make it live.
-func MustReplaceBrokerConfig(t *testing.T, clients client.Clients, spec *v1.ServiceBrokerConfigSpec) {
-	if err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Delete(context.TODO(), config.ConfigurationName, metav1.DeleteOptions{}); err != nil {
+func MustReplaceBrokerConfig(t testing.TB, clients client.Clients, spec *v1.ServiceBrokerConfigSpec) {
+	MustReplaceBrokerConfigExpanded(t, clients, spec, spec)
+}
+
+// MustReplaceBrokerConfigExpanded updates the service broker configuration and waits
+// for the broker to make it live, once environment variable references have been
+// expanded to the expected specification.
+func MustReplaceBrokerConfigExpanded(t testing.TB, clients client.Clients, spec, expanded *v1.ServiceBrokerConfigSpec) {
+	if err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Delete(context.TODO(), config.GetOptions().ConfigurationName, metav1.DeleteOptions{}); err != nil {
 		t.Fatal(err)
 	}
 
 	configuration := &v1.ServiceBrokerConfig{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: config.ConfigurationName,
+			Name: config.GetOptions().ConfigurationName,
 		},
 		Spec: *spec,
 	}
@@ -108,7 +118,7 @@ func MustReplaceBrokerConfig(t *testing.T, clients client.Clients, spec *v1.Serv
 
 	callback := func() error {
 		// Service broker will first check validity and update the resource.
-		configuration, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Get(context.TODO(), config.ConfigurationName, metav1.GetOptions{})
+		configuration, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Get(context.TODO(), config.GetOptions().ConfigurationName, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
@@ -126,7 +136,7 @@ func MustReplaceBrokerConfig(t *testing.T, clients client.Clients, spec *v1.Serv
 			return fmt.Errorf("no config available")
 		}
 
-		if !reflect.DeepEqual(&c.Spec, spec) {
+		if !reflect.DeepEqual(&c.Spec, expanded) {
 			return fmt.Errorf("specification do not match")
 		}
 
@@ -144,14 +154,14 @@ func MustReplaceBrokerConfig(t *testing.T, clients client.Clients, spec *v1.Serv
 
 // MustReplaceBrokerConfigWithInvalidCondition will updata the configuration and
 // then ensure that the broker has registered it is invalid.
-func MustReplaceBrokerConfigWithInvalidCondition(t *testing.T, clients client.Clients, spec *v1.ServiceBrokerConfigSpec) {
-	if err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Delete(context.TODO(), config.ConfigurationName, metav1.DeleteOptions{}); err != nil {
+func MustReplaceBrokerConfigWithInvalidCondition(t testing.TB, clients client.Clients, spec *v1.ServiceBrokerConfigSpec) {
+	if err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Delete(context.TODO(), config.GetOptions().ConfigurationName, metav1.DeleteOptions{}); err != nil {
 		t.Fatal(err)
 	}
 
 	configuration := &v1.ServiceBrokerConfig{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: config.ConfigurationName,
+			Name: config.GetOptions().ConfigurationName,
 		},
 		Spec: *spec,
 	}
@@ -162,7 +172,7 @@ func MustReplaceBrokerConfigWithInvalidCondition(t *testing.T, clients client.Cl
 
 	callback := func() error {
 		// Service broker will first check validity and update the resource.
-		configuration, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Get(context.TODO(), config.ConfigurationName, metav1.GetOptions{})
+		configuration, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Get(context.TODO(), config.GetOptions().ConfigurationName, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
@@ -179,8 +189,70 @@ func MustReplaceBrokerConfigWithInvalidCondition(t *testing.T, clients client.Cl
 	}
 }
 
+// MustHaveBrokerConfigInvalidMessage checks the service broker configuration has been
+// reported as invalid, with a message containing the expected text.
+func MustHaveBrokerConfigInvalidMessage(t testing.TB, clients client.Clients, message string) {
+	configuration, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Get(context.TODO(), config.GetOptions().ConfigurationName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, condition := range configuration.Status.Conditions {
+		if condition.Type != v1.ConfigurationValid {
+			continue
+		}
+
+		if condition.Status != v1.ConditionFalse || !strings.Contains(condition.Message, message) {
+			t.Fatalf("configuration valid condition %v: %s, expected message containing %s", condition.Status, condition.Message, message)
+		}
+
+		return
+	}
+
+	t.Fatal("configuration valid condition not present")
+}
+
+// MustCreateBrokerConfigFragment creates a configuration fragment that contributes
+// to the service broker configuration, and waits for the broker to report the
+// validity condition with the requested status.
+func MustCreateBrokerConfigFragment(t testing.TB, clients client.Clients, name string, spec *v1.ServiceBrokerConfigSpec, status v1.ConditionStatus) {
+	fragment := &v1.ServiceBrokerConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				v1.ConfigurationLabel: config.GetOptions().ConfigurationName,
+			},
+		},
+		Spec: *spec,
+	}
+
+	if _, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Create(context.TODO(), fragment, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	callback := func() error {
+		fragment, err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		return configurationValidCondition(fragment, status)
+	}
+
+	if err := util.WaitFor(callback, configUpdateTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// MustDeleteBrokerConfigFragment deletes a configuration fragment.
+func MustDeleteBrokerConfigFragment(t testing.TB, clients client.Clients, name string) {
+	if err := clients.Broker().ServicebrokerV1alpha1().ServiceBrokerConfigs(Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // MustGetRegistryEntry returns the registry entry for a service instance.
-func MustGetRegistryEntry(t *testing.T, clients client.Clients, rt registry.Type, name string) *corev1.Secret {
+func MustGetRegistryEntry(t testing.TB, clients client.Clients, rt registry.Type, name string) *corev1.Secret {
 	entry, err := clients.Kubernetes().CoreV1().Secrets(Namespace).Get(context.TODO(), registry.Name(rt, name), metav1.GetOptions{})
 	if err != nil {
 		t.Fatal(err)
@@ -189,8 +261,20 @@ func MustGetRegistryEntry(t *testing.T, clients client.Clients, rt registry.Type
 	return entry
 }
 
+// MustNotHaveRegistry checks a registry does not exist.
+func MustNotHaveRegistry(t testing.TB, clients client.Clients, rt registry.Type, name string) {
+	_, err := clients.Kubernetes().CoreV1().Secrets(Namespace).Get(context.TODO(), registry.Name(rt, name), metav1.GetOptions{})
+	if err == nil {
+		t.Fatalf("registry %s unexpectedly exists", name)
+	}
+
+	if !errors.IsNotFound(err) {
+		t.Fatal(err)
+	}
+}
+
 // MustHaveRegistryEntryWithValue checks a registry entry exists.
-func MustHaveRegistryEntryWithValue(t *testing.T, entry *corev1.Secret, key registry.Key, value string) {
+func MustHaveRegistryEntryWithValue(t testing.TB, entry *corev1.Secret, key registry.Key, value string) {
 	data, ok := entry.Data[string(key)]
 	if !ok {
 		t.Fatalf("registry missing key %s", key)
@@ -213,7 +297,7 @@ func byteInDictionary(c byte, dictionary string) bool {
 }
 
 // MustHaveRegistryEntryPassword checks a registry entry exists and is valid for a password.
-func MustHaveRegistryEntryPassword(t *testing.T, entry *corev1.Secret, key registry.Key, length int, dictionary string) {
+func MustHaveRegistryEntryPassword(t testing.TB, entry *corev1.Secret, key registry.Key, length int, dictionary string) {
 	data, ok := entry.Data[string(key)]
 	if !ok {
 		t.Fatalf("registry missing key %s", key)
@@ -236,6 +320,27 @@ func MustHaveRegistryEntryPassword(t *testing.T, entry *corev1.Secret, key regis
 	}
 }
 
+// MustNotHaveRegistryEntryCharacters checks a registry entry string contains none of
+// the specified characters.
+func MustNotHaveRegistryEntryCharacters(t testing.TB, entry *corev1.Secret, key registry.Key, characters string) {
+	data, ok := entry.Data[string(key)]
+	if !ok {
+		t.Fatalf("registry missing key %s", key)
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatal(err)
+	}
+
+	for index := 0; index < len(value); index++ {
+		c := value[index]
+		if byteInDictionary(c, characters) {
+			t.Fatalf("character %v at index %d in excluded set %s", rune(c), index, characters)
+		}
+	}
+}
+
 // haveRegistryEntriesTLS check the key/cert pair exist and are valid, returning the certificate.
 func haveRegistryEntriesTLS(entry *corev1.Secret, key, cert registry.Key) (*x509.Certificate, error) {
 	keyData, ok := entry.Data[string(key)]
@@ -273,15 +378,15 @@ func haveRegistryEntriesTLS(entry *corev1.Secret, key, cert registry.Key) (*x509
 
 // MustHaveRegistryEntriesTLS checks that the requested entries corresponding to a certificate
 // and key pair exist and they are valid.
-func MustHaveRegistryEntriesTLS(t *testing.T, entry *corev1.Secret, key, cert registry.Key) {
+func MustHaveRegistryEntriesTLS(t testing.TB, entry *corev1.Secret, key, cert registry.Key) {
 	if _, err := haveRegistryEntriesTLS(entry, key, cert); err != nil {
 		t.Fatal(err)
 	}
 }
 
 // MustHaveRegistryEntriesTLSAndVerify checks that the requested entries corresponding to a certificate
-// and key pair exist and they are valid against a CA.
-func MustHaveRegistryEntriesTLSAndVerify(t *testing.T, entry *corev1.Secret, caCert, key, cert registry.Key, usage x509.ExtKeyUsage) {
+// and key pair exist and they are valid against a CA, returning the certificate.
+func MustHaveRegistryEntriesTLSAndVerify(t testing.TB, entry *corev1.Secret, caCert, key, cert registry.Key, usage x509.ExtKeyUsage) *x509.Certificate {
 	caCertData, ok := entry.Data[string(caCert)]
 	if !ok {
 		t.Fatalf("registry missing ca certificate key %s", key)
@@ -312,10 +417,12 @@ func MustHaveRegistryEntriesTLSAndVerify(t *testing.T, entry *corev1.Secret, caC
 	if _, err := certificate.Verify(options); err != nil {
 		t.Fatal(err)
 	}
+
+	return certificate
 }
 
 // MustNotHaveRegistryEntry checks a registry entry doesn't exist.
-func MustNotHaveRegistryEntry(t *testing.T, entry *corev1.Secret, key registry.Key) {
+func MustNotHaveRegistryEntry(t testing.TB, entry *corev1.Secret, key registry.Key) {
 	if _, ok := entry.Data[string(key)]; ok {
 		t.Fatalf("registry has key %s", key)
 	}
@@ -334,7 +441,7 @@ func keyInSlice(key string, slice []string) bool {
 
 // mustValidateObject validates an API object.  The required attributes must exist, the optional
 // ones may exist, anything not in these slices is illegal and a bug.
-func mustValidateObject(t *testing.T, object map[string]interface{}, required, optional []string) {
+func mustValidateObject(t testing.TB, object map[string]interface{}, required, optional []string) {
 	for _, requiredAttribute := range required {
 		if _, ok := object[requiredAttribute]; !ok {
 			t.Fatalf("required attribute %s not in object", requiredAttribute)
@@ -350,7 +457,7 @@ func mustValidateObject(t *testing.T, object map[string]interface{}, required, o
 
 // mustValidateCatalog ensures the catalog has the correct attributes.
 // This should be done with schema validation, provided it rejects rogue attributes.
-func mustValidateCatalog(t *testing.T) {
+func mustValidateCatalog(t testing.TB) {
 	var object interface{}
 
 	if err := Get("/v2/catalog", http.StatusOK, &object); err != nil {
@@ -393,6 +500,8 @@ func mustValidateCatalog(t *testing.T) {
 			"metadata",
 			"dashboard_client",
 			"plan_updatable",
+			"instances_retrievable",
+			"bindings_retrievable",
 		}
 
 		mustValidateObject(t, service, required, optional)
@@ -481,3 +590,22 @@ func mustValidateCatalog(t *testing.T) {
 		}
 	}
 }
+
+// PlanRolloutSource selects service plans for default plan rollouts, tests seed it to
+// make selection deterministic.
+var PlanRolloutSource = rand.NewSource(0) // nolint:gosec
+
+// SetOptions modifies the service broker options with a callback, returning a
+// function that restores the original options.
+func SetOptions(modify func(*config.Options)) func() {
+	original := config.GetOptions()
+
+	options := original
+	modify(&options)
+
+	config.SetOptions(&options)
+
+	return func() {
+		config.SetOptions(&original)
+	}
+}
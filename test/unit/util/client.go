@@ -15,26 +15,37 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/couchbase/service-broker/generated/clientset/servicebroker"
 	servicebrokerfake "github.com/couchbase/service-broker/generated/clientset/servicebroker/fake"
 	v1 "github.com/couchbase/service-broker/pkg/apis/servicebroker/v1alpha1"
 	"github.com/couchbase/service-broker/pkg/client"
 
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	dynamicclient "k8s.io/client-go/dynamic"
 	dynamicclientfake "k8s.io/client-go/dynamic/fake"
 	kubernetesclient "k8s.io/client-go/kubernetes"
 	kubernetesclientfake "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/restmapper"
+	clienttesting "k8s.io/client-go/testing"
 )
 
 var (
+	// errSimulated is raised when an error is deliberately injected.
+	errSimulated = errors.New("simulated error")
+
 	// resources is a list of API resources that the broker knows about.
 	// The broker will use the discovery client to map from a dynamic object's
 	// api version and kind, into a group, version and resource for use with
@@ -47,6 +58,15 @@ var (
 			GroupVersion: "v1",
 			APIResources: []metav1.APIResource{
 				{Name: "pods", Namespaced: true, Group: "", Version: "v1", Kind: "Pod"},
+				{Name: "services", Namespaced: true, Group: "", Version: "v1", Kind: "Service"},
+				{Name: "secrets", Namespaced: true, Group: "", Version: "v1", Kind: "Secret"},
+				{Name: "namespaces", Namespaced: false, Group: "", Version: "v1", Kind: "Namespace"},
+			},
+		},
+		{
+			GroupVersion: "batch/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "jobs", Namespaced: true, Group: "batch", Version: "v1", Kind: "Job"},
 			},
 		},
 	}
@@ -143,7 +163,7 @@ func ResetClients(clients client.Clients) error {
 
 // ResetDynamicClient deletes any objects created by template rendering.
 // This simulates garbage collection when a registry item is deleted.
-func MustResetDynamicClient(t *testing.T, clients client.Clients) {
+func MustResetDynamicClient(t testing.TB, clients client.Clients) {
 	c, ok := clients.(*clientsImpl)
 	if !ok {
 		t.Fatal("wrong client type")
@@ -154,6 +174,258 @@ func MustResetDynamicClient(t *testing.T, clients client.Clients) {
 	c.dynamic = dynamic
 }
 
+// MustFailDynamicCreate causes creation of the named resource via the dynamic
+// client to be forbidden.  This simulates Kubernetes errors, such as exceeded
+// quotas, during provisioning.
+func MustFailDynamicCreate(t testing.TB, clients client.Clients, resource, name, message string) {
+	c, ok := clients.(*clientsImpl)
+	if !ok {
+		t.Fatal("wrong client type")
+	}
+
+	dynamic, ok := c.dynamic.(*dynamicclientfake.FakeDynamicClient)
+	if !ok {
+		t.Fatal("wrong dynamic client type")
+	}
+
+	reactor := func(action clienttesting.Action) (bool, runtime.Object, error) {
+		createAction, ok := action.(clienttesting.CreateAction)
+		if !ok {
+			return false, nil, nil
+		}
+
+		object, err := meta.Accessor(createAction.GetObject())
+		if err != nil || object.GetName() != name {
+			return false, nil, nil
+		}
+
+		return true, nil, k8serrors.NewForbidden(schema.GroupResource{Resource: resource}, name, fmt.Errorf("%w: %s", errSimulated, message))
+	}
+
+	dynamic.PrependReactor("create", resource, reactor)
+}
+
+// MustDelayDynamicCreate causes creation of the named resource via the dynamic
+// client to be delayed before it completes.  This simulates a hung API server
+// during provisioning.  Note the fake client is serialized, so all other dynamic
+// client calls are delayed too.
+func MustDelayDynamicCreate(t testing.TB, clients client.Clients, resource, name string, delay time.Duration) {
+	c, ok := clients.(*clientsImpl)
+	if !ok {
+		t.Fatal("wrong client type")
+	}
+
+	dynamic, ok := c.dynamic.(*dynamicclientfake.FakeDynamicClient)
+	if !ok {
+		t.Fatal("wrong dynamic client type")
+	}
+
+	reactor := func(action clienttesting.Action) (bool, runtime.Object, error) {
+		createAction, ok := action.(clienttesting.CreateAction)
+		if !ok {
+			return false, nil, nil
+		}
+
+		object, err := meta.Accessor(createAction.GetObject())
+		if err != nil || object.GetName() != name {
+			return false, nil, nil
+		}
+
+		time.Sleep(delay)
+
+		return false, nil, nil
+	}
+
+	dynamic.PrependReactor("create", resource, reactor)
+}
+
+// MustFailDynamicDelete causes deletion of the named resource via the dynamic
+// client to fail.  This simulates Kubernetes errors during deprovisioning.
+func MustFailDynamicDelete(t testing.TB, clients client.Clients, resource, name string) {
+	c, ok := clients.(*clientsImpl)
+	if !ok {
+		t.Fatal("wrong client type")
+	}
+
+	dynamic, ok := c.dynamic.(*dynamicclientfake.FakeDynamicClient)
+	if !ok {
+		t.Fatal("wrong dynamic client type")
+	}
+
+	reactor := func(action clienttesting.Action) (bool, runtime.Object, error) {
+		deleteAction, ok := action.(clienttesting.DeleteAction)
+		if !ok || deleteAction.GetName() != name {
+			return false, nil, nil
+		}
+
+		return true, nil, fmt.Errorf("%w: deletion of %s %s failed", errSimulated, resource, name)
+	}
+
+	dynamic.PrependReactor("delete", resource, reactor)
+}
+
+// MustFailDynamicDeleteOnce causes the first deletion of the named resource via the
+// dynamic client to fail.  This simulates transient Kubernetes errors.
+func MustFailDynamicDeleteOnce(t testing.TB, clients client.Clients, resource, name string) {
+	c, ok := clients.(*clientsImpl)
+	if !ok {
+		t.Fatal("wrong client type")
+	}
+
+	dynamic, ok := c.dynamic.(*dynamicclientfake.FakeDynamicClient)
+	if !ok {
+		t.Fatal("wrong dynamic client type")
+	}
+
+	var failed int32
+
+	reactor := func(action clienttesting.Action) (bool, runtime.Object, error) {
+		deleteAction, ok := action.(clienttesting.DeleteAction)
+		if !ok || deleteAction.GetName() != name {
+			return false, nil, nil
+		}
+
+		if !atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			return false, nil, nil
+		}
+
+		return true, nil, fmt.Errorf("%w: deletion of %s %s failed", errSimulated, resource, name)
+	}
+
+	dynamic.PrependReactor("delete", resource, reactor)
+}
+
+// MustFailSecretCreate causes creation of secrets to fail.  This simulates a
+// registry that is no longer writable.
+func MustFailSecretCreate(t testing.TB, clients client.Clients) {
+	c, ok := clients.(*clientsImpl)
+	if !ok {
+		t.Fatal("wrong client type")
+	}
+
+	kubernetes, ok := c.kubernetes.(*kubernetesclientfake.Clientset)
+	if !ok {
+		t.Fatal("wrong kubernetes client type")
+	}
+
+	reactor := func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("%w: creation of secret failed", errSimulated)
+	}
+
+	kubernetes.PrependReactor("create", "secrets", reactor)
+}
+
+// MustConflictSecretUpdate causes the first update of the named secret to fail with
+// a conflict, after the secret has been modified as if by another writer that set the
+// given key.  This simulates concurrent modification of a registry.
+func MustConflictSecretUpdate(t testing.TB, clients client.Clients, name, key string) {
+	c, ok := clients.(*clientsImpl)
+	if !ok {
+		t.Fatal("wrong client type")
+	}
+
+	kubernetes, ok := c.kubernetes.(*kubernetesclientfake.Clientset)
+	if !ok {
+		t.Fatal("wrong kubernetes client type")
+	}
+
+	tracker := kubernetes.Tracker()
+
+	var conflicted bool
+
+	reactor := func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updateAction, ok := action.(clienttesting.UpdateAction)
+		if !ok || conflicted {
+			return false, nil, nil
+		}
+
+		secret, ok := updateAction.GetObject().(*corev1.Secret)
+		if !ok || secret.Name != name {
+			return false, nil, nil
+		}
+
+		conflicted = true
+
+		object, err := tracker.Get(updateAction.GetResource(), secret.Namespace, name)
+		if err != nil {
+			return true, nil, err
+		}
+
+		current, ok := object.(*corev1.Secret)
+		if !ok {
+			return true, nil, fmt.Errorf("%w: unexpected object type", errSimulated)
+		}
+
+		if current.Data == nil {
+			current.Data = map[string][]byte{}
+		}
+
+		current.Data[key] = []byte(`"concurrent"`)
+
+		if err := tracker.Update(updateAction.GetResource(), current, secret.Namespace); err != nil {
+			return true, nil, err
+		}
+
+		return true, nil, k8serrors.NewConflict(schema.GroupResource{Resource: "secrets"}, name, fmt.Errorf("%w: object has been modified", errSimulated))
+	}
+
+	kubernetes.PrependReactor("update", "secrets", reactor)
+}
+
+// MustDelayDynamicDelete causes deletion of the named resource via the dynamic client
+// to mark it as terminating, and only remove it after a delay.  This simulates
+// resources with finalizers e.g. namespaces.
+func MustDelayDynamicDelete(t testing.TB, clients client.Clients, resource, name string, delay time.Duration) {
+	c, ok := clients.(*clientsImpl)
+	if !ok {
+		t.Fatal("wrong client type")
+	}
+
+	dynamic, ok := c.dynamic.(*dynamicclientfake.FakeDynamicClient)
+	if !ok {
+		t.Fatal("wrong dynamic client type")
+	}
+
+	tracker := dynamic.Tracker()
+
+	reactor := func(action clienttesting.Action) (bool, runtime.Object, error) {
+		deleteAction, ok := action.(clienttesting.DeleteAction)
+		if !ok || deleteAction.GetName() != name {
+			return false, nil, nil
+		}
+
+		gvr := deleteAction.GetResource()
+		namespace := deleteAction.GetNamespace()
+
+		object, err := tracker.Get(gvr, namespace, name)
+		if err != nil {
+			return true, nil, err
+		}
+
+		accessor, err := meta.Accessor(object)
+		if err != nil {
+			return true, nil, err
+		}
+
+		now := metav1.Now()
+		accessor.SetDeletionTimestamp(&now)
+
+		if err := tracker.Update(gvr, object, namespace); err != nil {
+			return true, nil, err
+		}
+
+		go func() {
+			time.Sleep(delay)
+
+			_ = tracker.Delete(gvr, namespace, name)
+		}()
+
+		return true, nil, nil
+	}
+
+	dynamic.PrependReactor("delete", resource, reactor)
+}
+
 // Kubernetes returns a typed client for Kubernetes resources.
 func (c *clientsImpl) Kubernetes() kubernetesclient.Interface {
 	return c.kubernetes
@@ -174,3 +446,23 @@ func (c *clientsImpl) Dynamic() dynamicclient.Interface {
 func (c *clientsImpl) RESTMapper() meta.RESTMapper {
 	return c.mapper
 }
+
+// MustCreateNamespace creates a namespace for service instances to be provisioned in.
+func MustCreateNamespace(t testing.TB, clients client.Clients, name string) {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+	}
+
+	if _, err := clients.Kubernetes().CoreV1().Namespaces().Create(context.TODO(), namespace, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// MustHaveNamespace checks that a namespace exists.
+func MustHaveNamespace(t testing.TB, clients client.Clients, name string) {
+	if _, err := clients.Kubernetes().CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
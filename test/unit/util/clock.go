@@ -0,0 +1,134 @@
+// Copyright 2020-2021 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file  except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the  License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/util"
+)
+
+// errNotWaiting is raised when nothing is waiting on a fake clock.
+var errNotWaiting = errors.New("nothing waiting on fake clock")
+
+// fakeClockWaiter is a channel waiting for the fake clock to reach a deadline.
+type fakeClockWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// FakeClock is a clock that only advances when told to, allowing timeouts to be
+// triggered deterministically.
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+// NewFakeClock returns a new fake clock starting at the current system time.
+func NewFakeClock() *FakeClock {
+	return &FakeClock{
+		now: time.Now(),
+	}
+}
+
+// Now returns the fake clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// After returns a channel that receives the fake time once the clock has been
+// advanced by at least the duration.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, fakeClockWaiter{deadline: c.now.Add(d), c: ch})
+
+	return ch
+}
+
+// Advance moves the fake clock forward, waking any waiters whose deadlines
+// have been reached.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+
+	waiters := c.waiters[:0]
+
+	for _, waiter := range c.waiters {
+		if waiter.deadline.After(c.now) {
+			waiters = append(waiters, waiter)
+			continue
+		}
+
+		waiter.c <- c.now
+	}
+
+	c.waiters = waiters
+}
+
+// Waiters returns the number of channels waiting for the fake clock to advance.
+func (c *FakeClock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.waiters)
+}
+
+// AdvanceWhenWaiting advances the fake clock once something is waiting on it.
+func (c *FakeClock) AdvanceWhenWaiting(d time.Duration) error {
+	callback := func() error {
+		if c.Waiters() == 0 {
+			return errNotWaiting
+		}
+
+		return nil
+	}
+
+	if err := WaitFor(callback, time.Minute); err != nil {
+		return err
+	}
+
+	c.Advance(d)
+
+	return nil
+}
+
+// UseFakeClock replaces the service broker's clock with a fake one, returning
+// it and a function to restore the system clock.
+func UseFakeClock() (*FakeClock, func()) {
+	clock := NewFakeClock()
+
+	util.SetDefaultClock(clock)
+
+	return clock, func() {
+		util.SetDefaultClock(util.SystemClock)
+	}
+}
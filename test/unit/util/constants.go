@@ -93,6 +93,32 @@ vFKYb6v/2ENK34iu3AHVow==
 	// Token is the default OAuth bearer token.
 	Token = "HeMan"
 
+	// TokenPrincipal is the principal authenticated by the default token.
+	TokenPrincipal = "she-ra"
+
+	// ReadOnlyPrincipal is a principal that is only authorized to read resources.
+	ReadOnlyPrincipal = "read-only"
+
+	// ReadOnlyToken is the OAuth bearer token that authenticates the read only principal.
+	ReadOnlyToken = "ManAtArms"
+
+	// ResponseCompressionThreshold is the response body size at which responses
+	// are compressed.
+	ResponseCompressionThreshold = 256
+
 	// Namespace is the default namespace, that isn't default.
 	Namespace = "Skeletor"
+
+	// SourceNamespace is a namespace, other than the default, that templates
+	// are allowed to read from.
+	SourceNamespace = "Hordak"
+
+	// IllegalSourceNamespace is a namespace templates are not allowed to read from.
+	IllegalSourceNamespace = "EvilLyn"
+
+	// QueryParameter is a request query parameter that templates are allowed to read.
+	QueryParameter = "orko"
+
+	// IllegalQueryParameter is a request query parameter templates are not allowed to read.
+	IllegalQueryParameter = "beastman"
 )
@@ -15,12 +15,83 @@
 package util
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"testing"
+	"time"
+
+	"github.com/couchbase/service-broker/pkg/util"
 )
 
 // Assert asserts a condition holds, causing test failure if it doesn't.
-func Assert(t *testing.T, condition bool) {
+func Assert(t testing.TB, condition bool) {
 	if !condition {
 		t.Fatalf("assertion failed")
 	}
 }
+
+// MustGenerateServerCertificatePEM generates a self-signed server certificate for
+// localhost that is valid for the requested lifetime, returning the PEM encoded
+// certificate and private key.
+func MustGenerateServerCertificatePEM(t testing.TB, lifetime time.Duration) ([]byte, []byte) {
+	key, err := util.GenerateKey(util.KeyTypeEllipticP256, util.KeyEncodingPKCS8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := util.GenerateCertificate(key, "localhost", lifetime, util.Server, []string{"DNS:localhost"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// MustGenerateClientCertificate generates a CA and a client certificate signed by it,
+// returning the CA certificate pool and the client key/certificate.
+func MustGenerateClientCertificate(t testing.TB, cn string) (*x509.CertPool, tls.Certificate) {
+	caKey, err := util.GenerateKey(util.KeyTypeEllipticP256, util.KeyEncodingPKCS8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCert, err := util.GenerateCertificate(caKey, "client-ca", time.Hour, util.CA, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := util.GenerateKey(util.KeyTypeEllipticP256, util.KeyEncodingPKCS8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := util.GenerateCertificate(key, cn, time.Hour, util.Client, nil, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		t.Fatal("failed to import CA certificate")
+	}
+
+	certificate, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pool, certificate
+}
+
+// MustGenerateServerCertificate generates a self-signed server certificate for
+// localhost that is valid for the requested lifetime.
+func MustGenerateServerCertificate(t testing.TB, lifetime time.Duration) tls.Certificate {
+	cert, key := MustGenerateServerCertificatePEM(t, lifetime)
+
+	certificate, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate
+}
@@ -63,12 +63,31 @@ func ServerRunning() error {
 	return nil
 }
 
+// InsecureServerRunning returns a wait function that checks a plain HTTP server is
+// running at the given address.
+func InsecureServerRunning(address string) util.WaitFunc {
+	return func() error {
+		response, err := http.Get("http://" + address + "/readyz")
+		if err != nil {
+			return err
+		}
+
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status code %v", response.StatusCode)
+		}
+
+		return nil
+	}
+}
+
 // WaitFor waits until a condition is nil.
 func WaitFor(f util.WaitFunc, timeout time.Duration) error {
 	return util.WaitFor(f, timeout)
 }
 
 // MustWaitFor waits until a condition is nil.
-func MustWaitFor(t *testing.T, f util.WaitFunc, timeout time.Duration) {
+func MustWaitFor(t testing.TB, f util.WaitFunc, timeout time.Duration) {
 	util.MustWaitFor(t, f, timeout)
 }